@@ -9,34 +9,55 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"strings"
-	"time"
+	"sync"
 
 	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
-	gvnvirtualnetwork "github.com/containers/gvisor-tap-vsock/pkg/virtualnetwork"
+	"github.com/ktock/container2wasm/internal/netstack"
 	"golang.org/x/net/websocket"
 )
 
-const (
-	gatewayIP = "192.168.127.1"
-	vmIP      = "192.168.127.3"
-	vmMAC     = "02:00:00:00:00:01"
-)
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ports" {
+		if err := runPorts(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	var portFlags sliceFlags
-	flag.Var(&portFlags, "p", "map port between host and guest (host:guest). -mac must be set correctly.")
+	flag.Var(&portFlags, "p", "map port between host and the first VM ([ip:]host:guest[/proto]; proto is tcp (default) or udp; IPv6 address must be enclosed by brackets). -mac must be set correctly.")
+	var vmFlags sliceFlags
+	flag.Var(&vmFlags, "vm", "VM connected to the network (NAME[=MAC]). The VM can be resolved as NAME or NAME."+vmDomain+" from the VMs. MAC defaults to -mac for the first VM.")
+	var dnsRecordFlags sliceFlags
+	flag.Var(&dnsRecordFlags, "dns-record", "static DNS record (name=ip) served by the gateway. name without domain is added to the first -dns-search domain.")
+	var dnsSearchFlags sliceFlags
+	flag.Var(&dnsSearchFlags, "dns-search", "DNS search domain provided to the container via DHCP")
+	var envFlags sliceFlags
+	flag.Var(&envFlags, "env", "environment variable (KEY=VALUE) passed to the runtime (valid only with invoke flag)")
+	var mapDirFlags sliceFlags
+	flag.Var(&mapDirFlags, "mapdir", "directory mapping (GUEST::HOST) passed to the runtime (valid only with invoke flag)")
+	var wasiAddrFlags sliceFlags
+	flag.Var(&wasiAddrFlags, "wasi-addr", "IP address used to communicate between wasi and network stack (valid only with invoke flag). Specify for each invoked WASM image in order. A free port on localhost is used by default.")
+	var rules []netstack.Rule
+	flag.Var(&netstack.RuleFlag{Rules: &rules, Allow: true}, "allow", "allow connections from the VMs to TARGET[:PORT] (TARGET is CIDR, IP, hostname, *.DOMAIN or *). Rules are evaluated in the specified order with -deny and the first match is applied. If any -allow is specified, connections not matching any rule are denied.")
+	flag.Var(&netstack.RuleFlag{Rules: &rules, Allow: false}, "deny", "deny connections from the VMs to TARGET[:PORT] (same format as -allow)")
 	var (
 		debug         = flag.Bool("debug", false, "enable debug print")
 		listenWS      = flag.Bool("listen-ws", false, "listen on a websocket port specified as argument")
 		enableTLS     = flag.Bool("enable-tls", false, "enable TLS for the websocket connection")
 		wsCert        = flag.String("ws-cert", "", "TLS cert for ws connection")
 		wsKey         = flag.String("ws-key", "", "TLS key for ws connection")
-		invoke        = flag.Bool("invoke", false, "invoke the container with NW support")
-		mac           = flag.String("mac", vmMAC, "mac address assigned to the container")
-		wasiAddr      = flag.String("wasi-addr", "127.0.0.1:1234", "IP address used to communicate between wasi and network stack (valid only with invoke flag)") // TODO: automatically use empty random port or unix socket
-		wasmtimeCli13 = flag.Bool("wasmtime-cli-13", false, "Use old wasmtime CLI (<= 13)")
+		invoke        = flag.Bool("invoke", false, "invoke the container with NW support. Multiple WASM images separated by \""+invokeSep+"\" are connected to the network as the VMs specified by -vm in order.")
+		mac           = flag.String("mac", netstack.VMMAC, "mac address assigned to the container (the first VM)")
+		runtimeName   = flag.String("runtime", "wasmtime", "runtime used with invoke flag (one of "+strings.Join(runtimeNames(), ", ")+"). wazero is embedded to c2w-net.")
+		wasmtimeCli13 = flag.Bool("wasmtime-cli-13", false, "Use old wasmtime CLI (<= 13). Same as -runtime=wasmtime-13.")
+		noHostAccess  = flag.Bool("no-host-access", false, "disallow the VMs to connect to the host (including "+netstack.HostVirtualIP+" and the host's addresses)")
+		connRate      = flag.Float64("conn-rate", 0, "max number of new connections per second per VM (0 means unlimited)")
+		egressRate    = flag.Int("egress-rate", 0, "max bytes per second sent by each VM (0 means unlimited)")
+		apiSocket     = flag.String("api-socket", "", "unix socket to serve the API for managing port forwards and getting statistics (used by \"c2w-net ports\")")
+		pcapFile      = flag.String("pcap", "", "file to record all ethernet frames exchanged with the VMs in pcapng format")
+		auditLog      = flag.String("audit-log", "", "file to record blocked connections as JSON lines (\"-\" means stderr)")
 	)
 	flag.Parse()
 	args := flag.Args()
@@ -44,83 +65,180 @@ func main() {
 		panic("specify args")
 	}
 	socketAddr := args[0]
+	if *wasmtimeCli13 {
+		*runtimeName = "wasmtime-13"
+	}
+	rt, ok := wasiRuntimes[*runtimeName]
+	if *invoke && !ok && unsupportedRuntimes[*runtimeName] {
+		panic(fmt.Sprintf("runtime %q can't pass the listening socket to the guest so it can't be used with --invoke (use one of %s); run the image with it without networking", *runtimeName, strings.Join(runtimeNames(), ", ")))
+	} else if *invoke && !ok {
+		panic(fmt.Sprintf("unknown runtime %q (must be one of %s)", *runtimeName, strings.Join(runtimeNames(), ", ")))
+	}
+	vms, err := parseVMs(vmFlags, *mac)
+	if err != nil {
+		panic(err)
+	}
+	var invocations [][]string
+	if *invoke {
+		if invocations, err = splitInvocations(args); err != nil {
+			panic(err)
+		}
+		if len(invocations) > len(vms) {
+			panic(fmt.Sprintf("%d WASM images are invoked but %d VMs are specified; specify -vm for each image", len(invocations), len(vms)))
+		}
+		if len(wasiAddrFlags) > len(invocations) {
+			panic(fmt.Sprintf("%d -wasi-addr are specified for %d WASM images", len(wasiAddrFlags), len(invocations)))
+		}
+		for len(wasiAddrFlags) < len(invocations) {
+			wasiAddrFlags = append(wasiAddrFlags, "127.0.0.1:0")
+		}
+	}
+	leases := make(map[string]string)
+	for _, vm := range vms {
+		leases[vm.ip] = vm.mac
+	}
 	forwards := make(map[string]string)
 	for _, p := range portFlags {
-		parts := strings.Split(p, ":")
-		switch len(parts) {
-		case 3:
-			// IP:PORT1:PORT2
-			forwards[strings.Join(parts[0:2], ":")] = strings.Join([]string{vmIP, parts[2]}, ":")
-		case 2:
-			// PORT1:PORT2
-			forwards["0.0.0.0:"+parts[0]] = vmIP + ":" + parts[1]
+		f, err := netstack.ParsePortForward(p)
+		if err != nil {
+			panic(err)
 		}
+		forwards[f.Local()] = net.JoinHostPort(vms[0].ip, f.GuestPort)
 	}
 	if *debug {
 		log.SetOutput(os.Stderr)
 	} else {
 		log.SetOutput(io.Discard)
 	}
+	log.Printf("VMs: %+v\n", vms)
 	log.Printf("port mapping: %+v\n", forwards)
-	config := &gvntypes.Configuration{
-		Debug:             *debug,
-		MTU:               1500,
-		Subnet:            "192.168.127.0/24",
-		GatewayIP:         gatewayIP,
-		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
-		DHCPStaticLeases: map[string]string{
-			vmIP: *mac,
-		},
-		Forwards: forwards,
-		NAT: map[string]string{
-			"192.168.127.254": "127.0.0.1",
-		},
-		GatewayVirtualIPs: []string{"192.168.127.254"},
-		Protocol:          gvntypes.QemuProtocol,
-	}
-	vn, err := gvnvirtualnetwork.New(config)
+	dnsSearchFlags = append(dnsSearchFlags, vmDomain)
+	zones, err := parseDNSRecords(append(vmDNSRecords(vms), dnsRecordFlags...), dnsSearchFlags)
 	if err != nil {
 		panic(err)
 	}
-	if *invoke {
-		go func() {
-			fmt.Fprintf(os.Stderr, "waiting for NW initialization\n")
-			var conn net.Conn
-			for i := 0; i < 10; i++ {
-				time.Sleep(1 * time.Second)
-				log.Printf("connecting to NW...\n")
-				conn, err = net.Dial("tcp", *wasiAddr)
-				if err == nil {
-					break
-				}
-				log.Printf("failed connecting to NW: %v\n", err)
+	var audit io.Writer
+	if *auditLog == "-" {
+		audit = os.Stderr
+	} else if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		audit = f
+	}
+	pol, err := newPolicy(policyConfig{
+		rules:        rules,
+		noHostAccess: *noHostAccess,
+		connRate:     *connRate,
+		egressRate:   *egressRate,
+		audit:        audit,
+	}, []string{netstack.Subnet, netstack.Subnet6})
+	if err != nil {
+		panic(err)
+	}
+	var pcap *netstack.PcapngWriter
+	if *pcapFile != "" {
+		f, err := os.Create(*pcapFile)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		if pcap, err = netstack.NewPcapngWriter(f); err != nil {
+			panic(err)
+		}
+	}
+	// wrapConn applies the packet capture and the network policy to the connection of a VM.
+	wrapConn := func(conn net.Conn, name string) net.Conn {
+		if pcap != nil {
+			if c, err := pcap.Capture(conn, name); err != nil {
+				log.Printf("failed to capture %q: %v\n", name, err)
+			} else {
+				conn = c
 			}
-			if conn == nil {
-				log.Fatalf("failed to connect to vm: lasterr=%d", err)
+		}
+		if pol != nil {
+			conn = pol.wrap(conn)
+		}
+		return conn
+	}
+	netOpts := []netstack.Option{
+		netstack.WithDebug(*debug),
+		netstack.WithDHCPStaticLeases(leases),
+		netstack.WithDNS(zones, dnsSearchFlags),
+		netstack.WithForwards(forwards),
+	}
+	if !*noHostAccess {
+		netOpts = append(netOpts, netstack.WithHostAccess())
+	}
+	vn, err := netstack.New(netOpts...)
+	if err != nil {
+		panic(err)
+	}
+	if *apiSocket != "" {
+		closeAPI, err := serveAPI(vn, *apiSocket)
+		if err != nil {
+			panic(err)
+		}
+		defer closeAPI()
+	}
+	if *invoke {
+		// The first image runs in the foreground and c2w-net exits with it. The others are stopped then.
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		var first invokeConfig
+		for i, inv := range invocations {
+			vm := vms[i]
+			c := invokeConfig{
+				wasmFile:   inv[0],
+				listenAddr: wasiAddrFlags[i],
+				envs:       envFlags,
+				mapDirs:    mapDirFlags,
+				listening: func(addr string) {
+					go func() {
+						log.Printf("connecting to NW of %q at %s\n", vm.name, addr)
+						conn, err := net.Dial("tcp", addr)
+						if err != nil {
+							log.Fatalf("failed to connect to vm %q: %v", vm.name, err)
+						}
+						// We register our VM network as a qemu "-netdev socket".
+						if err := vn.AcceptQemu(ctx, wrapConn(conn, vm.name)); err != nil {
+							log.Printf("failed AcceptQemu: %v\n", err)
+						}
+					}()
+				},
 			}
-			// We register our VM network as a qemu "-netdev socket".
-			if err := vn.AcceptQemu(context.TODO(), conn); err != nil {
-				log.Printf("failed AcceptQemu: %v\n", err)
+			c.args = withListenFD(withMAC(inv[1:], vm.mac), rt.listenFD(c))
+			if i == 0 {
+				c.stdin = os.Stdin
+				first = c
+				continue
 			}
-		}()
-		var cmd *exec.Cmd
-		if *wasmtimeCli13 {
-			cmd = exec.Command("wasmtime", append([]string{"run", "--tcplisten=" + *wasiAddr, "--env='LISTEN_FDS=1'", "--"}, args...)...)
-		} else {
-			cmd = exec.Command("wasmtime", append([]string{"run", "-S", "preview2=n", "-S", "tcplisten=" + *wasiAddr, "--env='LISTEN_FDS=1'", "--"}, args...)...)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := rt.run(ctx, c); err != nil && ctx.Err() == nil {
+					fmt.Fprintf(os.Stderr, "failed to run %q (VM %q) on %s: %v\n", c.wasmFile, vm.name, *runtimeName, err)
+				}
+			}()
 		}
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			panic(err)
+		err := rt.run(ctx, first)
+		cancel()
+		wg.Wait()
+		if err != nil {
+			if code, ok := exitCode(err); ok {
+				os.Exit(code)
+			}
+			fmt.Fprintf(os.Stderr, "failed to run %q on %s: %v\n", first.wasmFile, *runtimeName, err)
+			os.Exit(1)
 		}
 		return
 	}
 	if *listenWS {
 		http.Handle("/", websocket.Handler(func(ws *websocket.Conn) {
 			ws.PayloadType = websocket.BinaryFrame
-			if err := vn.AcceptQemu(context.TODO(), ws); err != nil {
+			if err := vn.AcceptQemu(context.TODO(), wrapConn(ws, ws.Request().RemoteAddr)); err != nil {
 				log.Printf("forwarding finished: %v\n", err)
 			}
 		}))
@@ -135,16 +253,60 @@ func main() {
 		}
 		return
 	}
-	conn, err := net.Dial("tcp", socketAddr)
-	if err != nil {
-		panic(err)
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(args))
+	for _, socketAddr := range args {
+		conn, err := net.Dial("tcp", socketAddr)
+		if err != nil {
+			panic(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// We register our VM network as a qemu "-netdev socket".
+			if err := vn.AcceptQemu(context.TODO(), wrapConn(conn, socketAddr)); err != nil {
+				errCh <- fmt.Errorf("connection to %q: %w", socketAddr, err)
+			}
+		}()
 	}
-	// We register our VM network as a qemu "-netdev socket".
-	if err := vn.AcceptQemu(context.TODO(), conn); err != nil {
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
 		panic(err)
 	}
 }
 
+// parseDNSRecords parses DNS records formatted as "name=ip" into zones.
+// The first label of the name is used as the record name and the rest is used as the zone.
+func parseDNSRecords(records, search []string) ([]gvntypes.Zone, error) {
+	var zones []gvntypes.Zone
+	zoneIdx := make(map[string]int)
+	for _, r := range records {
+		name, addr, ok := strings.Cut(r, "=")
+		ip := net.ParseIP(addr)
+		if !ok || name == "" || ip == nil {
+			return nil, fmt.Errorf("invalid DNS record %q: must be name=ip", r)
+		}
+		name = strings.TrimSuffix(name, ".")
+		label, zone, ok := strings.Cut(name, ".")
+		if !ok {
+			if len(search) == 0 {
+				return nil, fmt.Errorf("DNS record %q must have a domain or -dns-search must be specified", r)
+			}
+			zone = strings.TrimSuffix(search[0], ".")
+		}
+		zone += "."
+		i, ok := zoneIdx[zone]
+		if !ok {
+			i = len(zones)
+			zoneIdx[zone] = i
+			zones = append(zones, gvntypes.Zone{Name: zone})
+		}
+		zones[i].Records = append(zones[i].Records, gvntypes.Record{Name: label, IP: ip})
+	}
+	return zones, nil
+}
+
 type sliceFlags []string
 
 func (f *sliceFlags) String() string {
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktock/container2wasm/internal/netstack"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// flowTimeout is the duration after which an idle UDP/ICMP flow is considered as a new one.
+	flowTimeout = 60 * time.Second
+	// maxFlows is the max number of flows remembered per VM.
+	maxFlows = 4096
+	// maxDNSNames is the max number of addresses whose DNS names are remembered per VM.
+	maxDNSNames = 65536
+)
+
+// policy is the network policy applied to the packets sent by the VMs.
+// Rules are evaluated in order and the first matching rule is applied.
+// If no rule matches, the packet is denied if any allow rule is specified.
+// Otherwise, it is allowed.
+type policy struct {
+	rules        []netstack.Rule
+	defaultAllow bool
+
+	noHostAccess bool
+	hostIPs      []net.IP
+
+	connRate   float64 // new connections per second
+	egressRate int     // bytes per second
+
+	subnets  []*net.IPNet
+	gateways []net.IP
+
+	auditMu sync.Mutex
+	audit   io.Writer
+}
+
+type policyConfig struct {
+	rules        []netstack.Rule
+	noHostAccess bool
+	connRate     float64
+	egressRate   int
+	audit        io.Writer
+}
+
+// newPolicy returns the policy applied to the network. It returns nil if no policy is configured.
+func newPolicy(c policyConfig, subnets []string) (*policy, error) {
+	if len(c.rules) == 0 && !c.noHostAccess && c.connRate <= 0 && c.egressRate <= 0 {
+		return nil, nil
+	}
+	p := &policy{
+		rules:        c.rules,
+		defaultAllow: true,
+		noHostAccess: c.noHostAccess,
+		connRate:     c.connRate,
+		egressRate:   c.egressRate,
+		gateways:     []net.IP{net.ParseIP(netstack.GatewayIP), net.ParseIP(netstack.GatewayIP6)},
+		audit:        c.audit,
+	}
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+		p.subnets = append(p.subnets, ipnet)
+	}
+	for _, r := range c.rules {
+		if r.Allowed() {
+			p.defaultAllow = false
+			break
+		}
+	}
+	if c.noHostAccess {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the host's addresses: %w", err)
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				p.hostIPs = append(p.hostIPs, ipnet.IP)
+			}
+		}
+		p.hostIPs = append(p.hostIPs, net.ParseIP(netstack.HostVirtualIP), net.ParseIP(netstack.HostVirtualIP6))
+	}
+	return p, nil
+}
+
+// check returns whether the packet to the destination is allowed and the reason.
+func (p *policy) check(dst net.IP, port uint16, names []string) (bool, string) {
+	if p.noHostAccess && p.isHost(dst) {
+		return false, "host access is disabled"
+	}
+	if r, ok := netstack.MatchRule(p.rules, dst.String(), strconv.Itoa(int(port)), names...); ok {
+		if r.Allowed() {
+			return true, fmt.Sprintf("allowed by %q", r)
+		}
+		return false, fmt.Sprintf("denied by %q", r)
+	}
+	if p.defaultAllow {
+		return true, "allowed by default"
+	}
+	return false, "no allow rule matched"
+}
+
+func (p *policy) isHost(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, h := range p.hostIPs {
+		if h.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal returns true if the packet to ip doesn't leave the network (e.g. DHCP, DNS, neighbor
+// discovery and traffic between VMs).
+func (p *policy) isLocal(ip net.IP) bool {
+	if ip.Equal(net.IPv4bcast) || (ip.To4() == nil && (ip.IsLinkLocalUnicast() || ip.IsMulticast())) {
+		return true
+	}
+	if p.isGateway(ip) {
+		return true
+	}
+	if ip.Equal(net.ParseIP(netstack.HostVirtualIP)) || ip.Equal(net.ParseIP(netstack.HostVirtualIP6)) {
+		return false
+	}
+	for _, s := range p.subnets {
+		if s.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *policy) isGateway(ip net.IP) bool {
+	for _, g := range p.gateways {
+		if ip.Equal(g) {
+			return true
+		}
+	}
+	return false
+}
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	VM     string    `json:"vm"`
+	Proto  string    `json:"proto"`
+	Src    string    `json:"src"`
+	Dst    string    `json:"dst"`
+	Host   []string  `json:"host,omitempty"`
+	Reason string    `json:"reason"`
+}
+
+func (p *policy) logBlocked(e auditEntry) {
+	log.Printf("blocked: %+v\n", e)
+	if p.audit == nil {
+		return
+	}
+	d, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("failed to marshal audit log: %v\n", err)
+		return
+	}
+	p.auditMu.Lock()
+	defer p.auditMu.Unlock()
+	if _, err := p.audit.Write(append(d, '\n')); err != nil {
+		log.Printf("failed to write audit log: %v\n", err)
+	}
+}
+
+// wrap returns the connection of a VM that applies the policy to the frames sent by the VM.
+// conn must use the QEMU protocol (4 bytes length header followed by an ethernet frame).
+func (p *policy) wrap(conn net.Conn) net.Conn {
+	c := &policyConn{
+		Conn:      conn,
+		p:         p,
+		br:        bufio.NewReader(conn),
+		flows:     make(map[flowKey]time.Time),
+		fragments: make(map[fragmentKey]time.Time),
+		dnsNames:  make(map[tcpip.Address][]string),
+	}
+	c.tx.OnFrame = c.snoopDNS
+	if p.connRate > 0 {
+		c.connLimiter = rate.NewLimiter(rate.Limit(p.connRate), max(int(p.connRate), 1))
+	}
+	if p.egressRate > 0 {
+		// burst must allow the largest frame
+		c.egressLimiter = rate.NewLimiter(rate.Limit(p.egressRate), max(p.egressRate, 65536))
+	}
+	return c
+}
+
+type flowKey struct {
+	proto   uint8
+	dst     tcpip.Address
+	srcPort uint16
+	dstPort uint16
+}
+
+type policyConn struct {
+	net.Conn
+	p *policy
+
+	br   *bufio.Reader
+	rbuf []byte
+
+	wMu sync.Mutex
+	tx  netstack.FrameSplitter
+
+	flows         map[flowKey]time.Time
+	fragments     map[fragmentKey]time.Time
+	connLimiter   *rate.Limiter
+	egressLimiter *rate.Limiter
+
+	dnsNamesMu sync.Mutex
+	dnsNames   map[tcpip.Address][]string
+}
+
+// Read returns the frames sent by the VM, dropping ones denied by the policy.
+func (c *policyConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > netstack.MaxFrameSize {
+			return 0, fmt.Errorf("frame size %d exceeds the limit %d", size, netstack.MaxFrameSize)
+		}
+		frame := make([]byte, 4+size)
+		copy(frame, hdr[:])
+		if _, err := io.ReadFull(c.br, frame[4:]); err != nil {
+			return 0, err
+		}
+		if c.egressLimiter != nil {
+			if err := c.egressLimiter.WaitN(context.Background(), min(len(frame), c.egressLimiter.Burst())); err != nil {
+				return 0, err
+			}
+		}
+		if c.allowFrame(frame[4:]) {
+			c.rbuf = frame
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write sends the frames to the VM. DNS responses are inspected for applying hostname rules.
+func (c *policyConn) Write(b []byte) (int, error) {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	c.tx.Write(b)
+	return c.Conn.Write(b)
+}
+
+// allowFrame returns true if the frame sent by the VM is allowed.
+func (c *policyConn) allowFrame(frame []byte) bool {
+	if len(frame) < header.EthernetMinimumSize {
+		return true
+	}
+	eth := header.Ethernet(frame)
+	if t := eth.Type(); t != header.IPv4ProtocolNumber && t != header.IPv6ProtocolNumber {
+		return true // ARP, etc. The network stack doesn't route others.
+	}
+	pkt, ok := parsePacket(eth)
+	if !ok {
+		return true // dropped by the stack
+	}
+	dst := net.IP(pkt.dst.AsSlice())
+	if c.p.isLocal(dst) {
+		return true
+	}
+	key := flowKey{proto: pkt.proto, dst: pkt.dst}
+	var tcp header.TCP
+	isNew := false
+	switch tcpip.TransportProtocolNumber(pkt.proto) {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		if len(pkt.transport) < 4 {
+			// The ports of non-first fragments and of fragments too short for them aren't known.
+			return c.fragmentAllowed(pkt)
+		}
+		// Both TCP and UDP headers start with the ports.
+		key.srcPort = binary.BigEndian.Uint16(pkt.transport[0:2])
+		key.dstPort = binary.BigEndian.Uint16(pkt.transport[2:4])
+		if tcpip.TransportProtocolNumber(pkt.proto) == header.TCPProtocolNumber && len(pkt.transport) >= header.TCPMinimumSize {
+			tcp = header.TCP(pkt.transport)
+			isNew = tcp.Flags() == header.TCPFlagSyn
+		}
+	default:
+		if pkt.transport == nil {
+			return c.fragmentAllowed(pkt)
+		}
+	}
+	if tcp == nil {
+		isNew = c.touchFlow(key)
+	}
+	names := c.lookupNames(pkt.dst)
+	allowed, reason := c.p.check(dst, key.dstPort, names)
+	if allowed && isNew && c.connLimiter != nil && !c.connLimiter.Allow() {
+		allowed, reason = false, "connection rate limit exceeded"
+	}
+	if allowed {
+		if pkt.fragmented {
+			c.allowFragments(pkt)
+		}
+		return true
+	}
+	if isNew {
+		c.p.logBlocked(auditEntry{
+			Time:   time.Now(),
+			VM:     eth.SourceAddress().String(),
+			Proto:  protoName(pkt.proto),
+			Src:    net.JoinHostPort(pkt.src.String(), strconv.Itoa(int(key.srcPort))),
+			Dst:    net.JoinHostPort(dst.String(), strconv.Itoa(int(key.dstPort))),
+			Host:   names,
+			Reason: reason,
+		})
+	}
+	if tcp != nil && tcp.Flags()&header.TCPFlagRst == 0 {
+		// Reset the connection instead of letting the VM wait for the timeout.
+		if err := c.writeRST(eth, pkt, tcp); err != nil {
+			log.Printf("failed to reset connection: %v\n", err)
+		}
+	}
+	return false
+}
+
+// packet is an IPv4 or IPv6 packet.
+type packet struct {
+	src, dst tcpip.Address
+	proto    uint8
+	// transport is the transport header and the payload. It's nil unless the packet is the first fragment.
+	transport []byte
+
+	// fragmented is true if the packet is a fragment. fragmentID is the identification of the fragments.
+	fragmented bool
+	fragmentID uint32
+}
+
+type fragmentKey struct {
+	proto    uint8
+	src, dst tcpip.Address
+	id       uint32
+}
+
+// allowFragments allows the following fragments of the allowed first fragment.
+func (c *policyConn) allowFragments(pkt packet) {
+	now := time.Now()
+	c.fragments[fragmentKey{pkt.proto, pkt.src, pkt.dst, pkt.fragmentID}] = now
+	if len(c.fragments) > maxFlows {
+		for k, t := range c.fragments {
+			if now.Sub(t) > flowTimeout {
+				delete(c.fragments, k)
+			}
+		}
+	}
+}
+
+// fragmentAllowed returns true if the packet whose ports aren't known is a fragment of an allowed packet.
+// The fragments received before the first fragment are dropped.
+func (c *policyConn) fragmentAllowed(pkt packet) bool {
+	if !pkt.fragmented {
+		return false // malformed
+	}
+	t, ok := c.fragments[fragmentKey{pkt.proto, pkt.src, pkt.dst, pkt.fragmentID}]
+	return ok && time.Since(t) <= flowTimeout
+}
+
+// parsePacket parses the IP packet in the ethernet frame. IPv6 extension headers are skipped.
+// It returns false if the packet is malformed.
+func parsePacket(eth header.Ethernet) (pkt packet, _ bool) {
+	b := []byte(eth[header.EthernetMinimumSize:])
+	if eth.Type() == header.IPv4ProtocolNumber {
+		ip := header.IPv4(b)
+		if !ip.IsValid(len(ip)) {
+			return pkt, false
+		}
+		pkt.src, pkt.dst, pkt.proto = ip.SourceAddress(), ip.DestinationAddress(), ip.Protocol()
+		if ip.FragmentOffset() == 0 {
+			pkt.transport = ip.Payload()
+		}
+		pkt.fragmented = ip.More() || ip.FragmentOffset() != 0
+		pkt.fragmentID = uint32(ip.ID())
+		return pkt, true
+	}
+	ip := header.IPv6(b)
+	if !ip.IsValid(len(ip)) {
+		return pkt, false
+	}
+	pkt.src, pkt.dst = ip.SourceAddress(), ip.DestinationAddress()
+	next, payload := ip.NextHeader(), ip.Payload()
+	for {
+		switch header.IPv6ExtensionHeaderIdentifier(next) {
+		case header.IPv6HopByHopOptionsExtHdrIdentifier, header.IPv6RoutingExtHdrIdentifier, header.IPv6DestinationOptionsExtHdrIdentifier:
+			if len(payload) < 2 || len(payload) < (int(payload[1])+1)*8 {
+				return pkt, false
+			}
+			next, payload = payload[0], payload[(int(payload[1])+1)*8:]
+			continue
+		case header.IPv6FragmentExtHdrIdentifier:
+			if len(payload) < header.IPv6FragmentExtHdrLength {
+				return pkt, false
+			}
+			frag := header.IPv6FragmentExtHdr([6]byte(payload[2:header.IPv6FragmentExtHdrLength]))
+			pkt.fragmented, pkt.fragmentID = true, frag.ID()
+			next, payload = payload[0], payload[header.IPv6FragmentExtHdrLength:]
+			if frag.FragmentOffset() != 0 {
+				payload = nil
+			}
+			continue
+		}
+		break
+	}
+	pkt.proto, pkt.transport = next, payload
+	return pkt, true
+}
+
+// touchFlow records the UDP/ICMP flow and returns true if it's a new one.
+func (c *policyConn) touchFlow(key flowKey) bool {
+	now := time.Now()
+	last, ok := c.flows[key]
+	c.flows[key] = now
+	if len(c.flows) > maxFlows {
+		for k, t := range c.flows {
+			if now.Sub(t) > flowTimeout {
+				delete(c.flows, k)
+			}
+		}
+	}
+	return !ok || now.Sub(last) > flowTimeout
+}
+
+// writeRST sends TCP RST to the VM in response to the TCP segment of the packet.
+func (c *policyConn) writeRST(eth header.Ethernet, pkt packet, tcp header.TCP) error {
+	segLen := uint32(len(tcp.Payload()))
+	if tcp.Flags()&header.TCPFlagSyn != 0 {
+		segLen++
+	}
+	if tcp.Flags()&header.TCPFlagFin != 0 {
+		segLen++
+	}
+	var seq uint32
+	flags := header.TCPFlagRst
+	if tcp.Flags()&header.TCPFlagAck != 0 {
+		seq = tcp.AckNumber()
+	} else {
+		flags |= header.TCPFlagAck
+	}
+	ipSize := header.IPv4MinimumSize
+	if eth.Type() == header.IPv6ProtocolNumber {
+		ipSize = header.IPv6MinimumSize
+	}
+	frame := make([]byte, 4+header.EthernetMinimumSize+ipSize+header.TCPMinimumSize)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	header.Ethernet(frame[4:]).Encode(&header.EthernetFields{
+		SrcAddr: eth.DestinationAddress(),
+		DstAddr: eth.SourceAddress(),
+		Type:    eth.Type(),
+	})
+	b := frame[4+header.EthernetMinimumSize:]
+	if eth.Type() == header.IPv6ProtocolNumber {
+		header.IPv6(b).Encode(&header.IPv6Fields{
+			PayloadLength:     header.TCPMinimumSize,
+			TransportProtocol: header.TCPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           pkt.dst,
+			DstAddr:           pkt.src,
+		})
+	} else {
+		rip := header.IPv4(b)
+		rip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(header.IPv4MinimumSize + header.TCPMinimumSize),
+			TTL:         64,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     pkt.dst,
+			DstAddr:     pkt.src,
+		})
+		rip.SetChecksum(^rip.CalculateChecksum())
+	}
+	rtcp := header.TCP(b[ipSize:])
+	rtcp.Encode(&header.TCPFields{
+		SrcPort:    tcp.DestinationPort(),
+		DstPort:    tcp.SourcePort(),
+		SeqNum:     seq,
+		AckNum:     tcp.SequenceNumber() + segLen,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, pkt.dst, pkt.src, uint16(header.TCPMinimumSize))
+	rtcp.SetChecksum(^rtcp.CalculateChecksum(xsum))
+
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	if c.tx.Pending() {
+		return fmt.Errorf("a frame is being written to the VM")
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// snoopDNS records the names of the addresses in the DNS response sent to the VM.
+// Only the responses from the DNS server of the gateway are trusted; the other VMs can send any response.
+func (c *policyConn) snoopDNS(frame []byte) {
+	if len(frame) < header.EthernetMinimumSize {
+		return
+	}
+	eth := header.Ethernet(frame)
+	if t := eth.Type(); t != header.IPv4ProtocolNumber && t != header.IPv6ProtocolNumber {
+		return
+	}
+	pkt, ok := parsePacket(eth)
+	if !ok || tcpip.TransportProtocolNumber(pkt.proto) != header.UDPProtocolNumber || len(pkt.transport) < header.UDPMinimumSize {
+		return
+	}
+	if !c.p.isGateway(net.IP(pkt.src.AsSlice())) {
+		return
+	}
+	udp := header.UDP(pkt.transport)
+	if udp.SourcePort() != 53 {
+		return
+	}
+	var msg dns.Msg
+	if err := msg.Unpack(udp.Payload()); err != nil {
+		return
+	}
+	var names []string
+	addName := func(n string) {
+		n = strings.ToLower(strings.TrimSuffix(n, "."))
+		for _, e := range names {
+			if e == n {
+				return
+			}
+		}
+		names = append(names, n)
+	}
+	for _, q := range msg.Question {
+		addName(q.Name)
+	}
+	var addrs []tcpip.Address
+	for _, rr := range msg.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			addName(v.Hdr.Name)
+			addName(v.Target)
+		case *dns.A:
+			addName(v.Hdr.Name)
+			if ip4 := v.A.To4(); ip4 != nil {
+				addrs = append(addrs, tcpip.AddrFrom4Slice(ip4))
+			}
+		case *dns.AAAA:
+			addName(v.Hdr.Name)
+			if ip6 := v.AAAA.To16(); ip6 != nil && v.AAAA.To4() == nil {
+				addrs = append(addrs, tcpip.AddrFrom16Slice(ip6))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	c.dnsNamesMu.Lock()
+	defer c.dnsNamesMu.Unlock()
+	if len(c.dnsNames) > maxDNSNames {
+		c.dnsNames = make(map[tcpip.Address][]string)
+	}
+	for _, a := range addrs {
+		c.dnsNames[a] = names
+	}
+}
+
+func (c *policyConn) lookupNames(addr tcpip.Address) []string {
+	c.dnsNamesMu.Lock()
+	defer c.dnsNamesMu.Unlock()
+	return c.dnsNames[addr]
+}
+
+func protoName(p uint8) string {
+	switch tcpip.TransportProtocolNumber(p) {
+	case header.TCPProtocolNumber:
+		return "tcp"
+	case header.UDPProtocolNumber:
+		return "udp"
+	case header.ICMPv4ProtocolNumber:
+		return "icmp"
+	case header.ICMPv6ProtocolNumber:
+		return "icmpv6"
+	}
+	return strconv.Itoa(int(p))
+}
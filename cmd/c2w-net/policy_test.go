@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/ktock/container2wasm/internal/netstack"
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var (
+	testVMMAC      = tcpip.LinkAddress("\x5a\x94\xef\xe4\x0c\xee")
+	testGatewayMAC = tcpip.LinkAddress("\x5a\x94\xef\xe4\x0c\xdd")
+)
+
+const (
+	testVMIP  = "192.168.127.3"
+	testVMIP6 = "fdc2:127::3"
+)
+
+func testAddr(ip string) tcpip.Address {
+	if ip4 := net.ParseIP(ip).To4(); ip4 != nil {
+		return tcpip.AddrFrom4Slice(ip4)
+	}
+	return tcpip.AddrFrom16Slice(net.ParseIP(ip).To16())
+}
+
+func ethernetFrame(typ tcpip.NetworkProtocolNumber, src, dst tcpip.LinkAddress, payload []byte) []byte {
+	b := make([]byte, header.EthernetMinimumSize+len(payload))
+	header.Ethernet(b).Encode(&header.EthernetFields{SrcAddr: src, DstAddr: dst, Type: typ})
+	copy(b[header.EthernetMinimumSize:], payload)
+	return b
+}
+
+// ipv4Frame returns the frame of the IPv4 packet. off is the fragment offset in bytes.
+func ipv4Frame(src, dst string, proto tcpip.TransportProtocolNumber, id uint16, more bool, off uint16, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+len(payload))
+	var flags uint8
+	if more {
+		flags = header.IPv4FlagMoreFragments
+	}
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength:    uint16(len(b)),
+		ID:             id,
+		Flags:          flags,
+		FragmentOffset: off,
+		TTL:            64,
+		Protocol:       uint8(proto),
+		SrcAddr:        testAddr(src),
+		DstAddr:        testAddr(dst),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(b[header.IPv4MinimumSize:], payload)
+	return ethernetFrame(header.IPv4ProtocolNumber, testVMMAC, testGatewayMAC, b)
+}
+
+// ipv6Frame returns the frame of the IPv6 packet. next is the first header following the IPv6 header.
+func ipv6Frame(src, dst string, next uint8, payload []byte) []byte {
+	b := make([]byte, header.IPv6MinimumSize+len(payload))
+	header.IPv6(b).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(payload)),
+		TransportProtocol: tcpip.TransportProtocolNumber(next),
+		HopLimit:          64,
+		SrcAddr:           testAddr(src),
+		DstAddr:           testAddr(dst),
+	})
+	copy(b[header.IPv6MinimumSize:], payload)
+	return ethernetFrame(header.IPv6ProtocolNumber, testVMMAC, testGatewayMAC, b)
+}
+
+// ipv6Options returns the IPv6 options extension header (hop-by-hop or destination options) padded to 8 bytes.
+func ipv6Options(next uint8, payload []byte) []byte {
+	return append([]byte{next, 0, 1, 4, 0, 0, 0, 0}, payload...) // PadN option
+}
+
+// ipv6Fragment returns the IPv6 fragment extension header. off is the fragment offset in bytes.
+func ipv6Fragment(next uint8, id uint32, more bool, off uint16, payload []byte) []byte {
+	b := make([]byte, header.IPv6FragmentExtHdrLength)
+	b[0] = next
+	v := off &^ 7
+	if more {
+		v |= 1
+	}
+	binary.BigEndian.PutUint16(b[2:], v)
+	binary.BigEndian.PutUint32(b[4:], id)
+	return append(b, payload...)
+}
+
+func tcpSegment(srcPort, dstPort uint16, flags header.TCPFlags) []byte {
+	b := make([]byte, header.TCPMinimumSize)
+	header.TCP(b).Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+		SeqNum:     1,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	return b
+}
+
+func udpDatagram(srcPort, dstPort uint16, payload []byte) []byte {
+	b := make([]byte, header.UDPMinimumSize+len(payload))
+	header.UDP(b).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(len(b)),
+	})
+	copy(b[header.UDPMinimumSize:], payload)
+	return b
+}
+
+// dnsResponse returns the frame of the DNS response resolving name to ip sent from src to the VM.
+func dnsResponse(t *testing.T, src, name, ip string) []byte {
+	var msg dns.Msg
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.Response = true
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	payload, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := ipv4Frame(src, testVMIP, header.UDPProtocolNumber, 1, false, 0, udpDatagram(53, 40000, payload))
+	eth := header.Ethernet(frame)
+	eth.Encode(&header.EthernetFields{SrcAddr: testGatewayMAC, DstAddr: testVMMAC, Type: header.IPv4ProtocolNumber})
+	return frame
+}
+
+// discardConn discards the frames sent to the VM.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestPolicyAllowFrame(t *testing.T) {
+	syn := tcpSegment(40000, 443, header.TCPFlagSyn)
+	synDenied := tcpSegment(40000, 80, header.TCPFlagSyn)
+	type step struct {
+		// toVM is the frame sent to the VM before checking frame (e.g. DNS response).
+		toVM  []byte
+		frame []byte
+		want  bool
+	}
+	for _, tt := range []struct {
+		name  string
+		rules []string
+		steps func(t *testing.T) []step
+	}{
+		{
+			name:  "tcp and udp ports",
+			rules: []string{"*:443"},
+			steps: func(t *testing.T) []step {
+				return []step{
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 1, false, 0, syn), want: true},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 2, false, 0, synDenied), want: false},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.UDPProtocolNumber, 3, false, 0, udpDatagram(40000, 443, []byte("hello"))), want: true},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.UDPProtocolNumber, 4, false, 0, udpDatagram(40000, 80, []byte("hello"))), want: false},
+					{frame: ipv4Frame(testVMIP, netstack.GatewayIP, header.TCPProtocolNumber, 5, false, 0, synDenied), want: true}, // local
+				}
+			},
+		},
+		{
+			name:  "ipv4 fragments",
+			rules: []string{"*:443"},
+			steps: func(t *testing.T) []step {
+				return []step{
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 1, true, 0, syn), want: true},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 1, false, 24, []byte("payload")), want: true},
+					// The first fragment of id 2 isn't allowed.
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 2, true, 0, synDenied), want: false},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 2, false, 24, []byte("payload")), want: false},
+					// The first fragment of id 3 isn't seen.
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 3, false, 24, []byte("payload")), want: false},
+					// The fragment of the other destination isn't allowed by the first fragment of id 1.
+					{frame: ipv4Frame(testVMIP, "1.2.3.5", header.TCPProtocolNumber, 1, false, 24, []byte("payload")), want: false},
+				}
+			},
+		},
+		{
+			name:  "ipv4 fragments too short for ports",
+			rules: []string{"*:443"},
+			steps: func(t *testing.T) []step {
+				return []step{
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 1, true, 0, syn[:2]), want: false},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.UDPProtocolNumber, 2, true, 0, []byte{0x9c}), want: false},
+					// The ports are read from the first 4 bytes even if the TCP header is incomplete.
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 3, true, 0, syn[:8]), want: true},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 3, false, 8, syn[8:]), want: true},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 4, true, 0, synDenied[:8]), want: false},
+					{frame: ipv4Frame(testVMIP, "1.2.3.4", header.TCPProtocolNumber, 4, false, 8, synDenied[8:]), want: false},
+				}
+			},
+		},
+		{
+			name:  "ipv6 extension headers",
+			rules: []string{"*:443"},
+			steps: func(t *testing.T) []step {
+				hbh, dstOpts := uint8(header.IPv6HopByHopOptionsExtHdrIdentifier), uint8(header.IPv6DestinationOptionsExtHdrIdentifier)
+				tcp := uint8(header.TCPProtocolNumber)
+				return []step{
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", tcp, syn), want: true},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", tcp, synDenied), want: false},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", hbh, ipv6Options(dstOpts, ipv6Options(tcp, syn))), want: true},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", hbh, ipv6Options(dstOpts, ipv6Options(tcp, synDenied))), want: false},
+					// truncated extension header
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", hbh, []byte{tcp}), want: true}, // dropped by the stack
+				}
+			},
+		},
+		{
+			name:  "ipv6 fragments",
+			rules: []string{"*:443"},
+			steps: func(t *testing.T) []step {
+				frag, hbh := uint8(header.IPv6FragmentExtHdrIdentifier), uint8(header.IPv6HopByHopOptionsExtHdrIdentifier)
+				tcp := uint8(header.TCPProtocolNumber)
+				return []step{
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", hbh, ipv6Options(frag, ipv6Fragment(tcp, 7, true, 0, syn))), want: true},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", frag, ipv6Fragment(tcp, 7, false, 24, []byte("payload"))), want: true},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", frag, ipv6Fragment(tcp, 8, true, 0, synDenied)), want: false},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", frag, ipv6Fragment(tcp, 8, false, 24, []byte("payload"))), want: false},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", frag, ipv6Fragment(tcp, 9, false, 24, []byte("payload"))), want: false},
+					{frame: ipv6Frame(testVMIP6, "2001:db8::1", frag, ipv6Fragment(tcp, 10, true, 0, syn[:3])), want: false},
+				}
+			},
+		},
+		{
+			name:  "snooped dns names",
+			rules: []string{"example.com:443"},
+			steps: func(t *testing.T) []step {
+				return []step{
+					{frame: ipv4Frame(testVMIP, "93.184.216.34", header.TCPProtocolNumber, 1, false, 0, syn), want: false},
+					// The response from the other VM isn't trusted.
+					{toVM: dnsResponse(t, "192.168.127.5", "example.com", "93.184.216.34")},
+					{frame: ipv4Frame(testVMIP, "93.184.216.34", header.TCPProtocolNumber, 2, false, 0, syn), want: false},
+					{toVM: dnsResponse(t, netstack.GatewayIP, "example.com", "93.184.216.34")},
+					{frame: ipv4Frame(testVMIP, "93.184.216.34", header.TCPProtocolNumber, 3, false, 0, syn), want: true},
+					{frame: ipv4Frame(testVMIP, "93.184.216.34", header.TCPProtocolNumber, 4, false, 0, synDenied), want: false},
+					{frame: ipv4Frame(testVMIP, "93.184.216.35", header.TCPProtocolNumber, 5, false, 0, syn), want: false},
+				}
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []netstack.Rule
+			for _, s := range tt.rules {
+				r, err := netstack.ParseRule(s, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rules = append(rules, r)
+			}
+			p, err := newPolicy(policyConfig{rules: rules}, []string{netstack.Subnet, netstack.Subnet6})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := p.wrap(discardConn{}).(*policyConn)
+			for i, s := range tt.steps(t) {
+				if s.toVM != nil {
+					frame := binary.BigEndian.AppendUint32(nil, uint32(len(s.toVM)))
+					if _, err := c.Write(append(frame, s.toVM...)); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				if got := c.allowFrame(s.frame); got != s.want {
+					t.Errorf("step %d: allowed = %v; want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	gvnclient "github.com/containers/gvisor-tap-vsock/pkg/client"
+	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/ktock/container2wasm/internal/netstack"
+)
+
+// apiBase is the base URL of the control API served on the unix socket.
+const apiBase = "http://c2w-net"
+
+// serveAPI serves the control API of the network on the unix socket.
+// The API is gvisor-tap-vsock's services API:
+//
+//   - GET /services/forwarder/all: list port forwards
+//   - POST /services/forwarder/expose: add a port forward ({"local":..., "remote":..., "protocol":"tcp"|"udp"})
+//   - POST /services/forwarder/unexpose: remove a port forward ({"local":..., "protocol":"tcp"|"udp"})
+//   - GET /stats: statistics of the network stack
+func serveAPI(vn *netstack.Network, socketPath string) (func() error, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on API socket %q: %w", socketPath, err)
+	}
+	go http.Serve(l, vn.ServicesMux())
+	return l.Close, nil
+}
+
+// newHTTPClient returns the HTTP client connecting to the API socket.
+func newHTTPClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+const portsUsage = `Usage: c2w-net ports [options] COMMAND [ARG...]
+
+Manage port forwards of a running c2w-net through the API socket (-api-socket of c2w-net).
+
+Commands:
+  ls                            list port forwards
+  add [ip:]host:guest[/proto]   add a port forward to the guest (proto is tcp (default) or udp)
+  rm [ip:]host[/proto]          remove a port forward
+  stats                         print statistics of the network stack
+
+Options:
+`
+
+// runPorts runs "c2w-net ports" subcommand.
+func runPorts(args []string) error {
+	fs := flag.NewFlagSet("ports", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), portsUsage)
+		fs.PrintDefaults()
+	}
+	var (
+		apiSocket = fs.String("api-socket", "", "unix socket of the c2w-net API")
+		guestIP   = fs.String("guest-ip", netstack.VMIP, "IP address of the VM that the port is forwarded to (used by add)")
+	)
+	fs.Parse(args)
+	if *apiSocket == "" {
+		return fmt.Errorf("specify -api-socket")
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return fmt.Errorf("specify command")
+	}
+	c := gvnclient.New(newHTTPClient(*apiSocket), apiBase)
+	switch cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "ls":
+		ports, err := c.List()
+		if err != nil {
+			return fmt.Errorf("failed to list port forwards: %w", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 4, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PROTO\tLOCAL\tREMOTE")
+		for _, p := range ports {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Protocol, p.Local, p.Remote)
+		}
+		return tw.Flush()
+	case "add":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("specify a port mapping")
+		}
+		f, err := netstack.ParsePortForward(cmdArgs[0])
+		if err != nil {
+			return err
+		}
+		return c.Expose(&gvntypes.ExposeRequest{
+			Protocol: f.Proto,
+			Local:    f.HostAddr,
+			Remote:   net.JoinHostPort(*guestIP, f.GuestPort),
+		})
+	case "rm":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("specify a local address")
+		}
+		proto, hostAddr, err := netstack.ParseHostAddr(cmdArgs[0])
+		if err != nil {
+			return err
+		}
+		return c.Unexpose(&gvntypes.UnexposeRequest{
+			Protocol: proto,
+			Local:    hostAddr,
+		})
+	case "stats":
+		return printStats(*apiSocket, os.Stdout)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// printStats prints statistics of the network stack (e.g. bytes sent/received and the number of TCP connections).
+func printStats(socketPath string, w io.Writer) error {
+	res, err := newHTTPClient(socketPath).Get(apiBase + "/stats")
+	if err != nil {
+		return fmt.Errorf("failed to get statistics: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get statistics: unexpected status: %d", res.StatusCode)
+	}
+	var stats map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/ktock/container2wasm/internal/wazerorun"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// defaultListenFD is the fd of the listening socket that the WASM image uses by default.
+const defaultListenFD = 3
+
+// invokeSep separates the WASM images invoked on the network.
+const invokeSep = "---"
+
+// invokeConfig is the configuration of the WASM image invoked with networking.
+type invokeConfig struct {
+	wasmFile   string
+	args       []string
+	listenAddr string   // address of the listening socket passed to the guest (IP:PORT; a free port is used if PORT is 0)
+	envs       []string // KEY=VALUE
+	mapDirs    []string // GUEST::HOST
+	stdin      io.Reader
+
+	// listening is called with the address of the listening socket after it's created and before
+	// the guest starts. The network stack connects to the address.
+	listening func(addr string)
+}
+
+// wasiRuntime runs a WASM image with the listening socket connected to the network stack.
+type wasiRuntime interface {
+	// listenFD returns the fd of the listening socket in the guest.
+	listenFD(c invokeConfig) int
+
+	// run runs the WASM image until it exits or ctx is canceled.
+	run(ctx context.Context, c invokeConfig) error
+}
+
+// wasiRuntimes are the runtimes supported by the invoke flag. The runtime must be able to pass the
+// listening socket to the guest (see unsupportedRuntimes).
+var wasiRuntimes = map[string]wasiRuntime{
+	"wasmtime": &commandRuntime{
+		cmd:        "wasmtime",
+		prefix:     []string{"run"},
+		fileSep:    true,
+		listenArgs: []string{"-S", "preview2=n", "-S", "listenfd=y", "--env=LISTEN_FDS=1"},
+		envArgs:    func(env string) []string { return []string{"--env=" + env} },
+		mapDirArgs: func(guest, host string) []string {
+			return []string{"--dir=" + host + "::" + guest}
+		},
+	},
+	// wasmtime <= 13
+	"wasmtime-13": &commandRuntime{
+		cmd:        "wasmtime",
+		prefix:     []string{"run"},
+		fileSep:    true,
+		listenArgs: []string{"--listenfd", "--env=LISTEN_FDS=1"},
+		envArgs:    func(env string) []string { return []string{"--env=" + env} },
+		mapDirArgs: func(guest, host string) []string {
+			return []string{"--mapdir=" + guest + "::" + host}
+		},
+	},
+	"wazero": wazeroRuntime{},
+}
+
+// unsupportedRuntimes are the runtimes that can't be used by the invoke flag.
+// The guest accepts the connection from the network stack on the listening socket passed by the runtime
+// because WASI preview1 has no API to connect out. These runtimes can't pass the socket and connecting out
+// from the guest needs the socket API of each runtime to be supported by the emulator in the image.
+var unsupportedRuntimes = map[string]bool{
+	"wasmer":   true,
+	"wasmedge": true,
+	"iwasm":    true,
+}
+
+func runtimeNames() []string {
+	var names []string
+	for n := range wasiRuntimes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandRuntime runs a WASM image using the command of the runtime.
+// The command line is "cmd prefix... flags... [--] wasmFile args...".
+type commandRuntime struct {
+	cmd    string
+	prefix []string
+
+	// fileSep adds "--" before the WASM file.
+	fileSep bool
+
+	// listenArgs are the flags to pass the listening socket inherited from c2w-net (LISTEN_FDS) to the guest.
+	listenArgs []string
+	envArgs    func(env string) []string
+	mapDirArgs func(guest, host string) []string
+}
+
+func (r *commandRuntime) listenFD(c invokeConfig) int {
+	// wasmtime passes listening sockets before preopened directories.
+	return defaultListenFD
+}
+
+func (r *commandRuntime) run(ctx context.Context, c invokeConfig) error {
+	// The listening socket is created by c2w-net and inherited by the runtime as fd 3 so that
+	// the network stack never connects to a socket of another process.
+	l, err := net.Listen("tcp", c.listenAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	args := append([]string{}, r.prefix...)
+	args = append(args, r.listenArgs...)
+	for _, e := range c.envs {
+		args = append(args, r.envArgs(e)...)
+	}
+	for _, m := range c.mapDirs {
+		mount, err := wazerorun.ParseMapDir(m)
+		if err != nil {
+			return err
+		}
+		args = append(args, r.mapDirArgs(mount.Guest, mount.Host)...)
+	}
+	if r.fileSep {
+		args = append(args, "--")
+	}
+	args = append(args, c.wasmFile)
+	args = append(args, c.args...)
+	cmd := exec.CommandContext(ctx, r.cmd, args...)
+	cmd.Stdin = c.stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if c.listening != nil {
+		c.listening(l.Addr().String())
+	}
+	return cmd.Wait()
+}
+
+// wazeroRuntime runs a WASM image on the wazero runtime embedded to c2w-net.
+type wazeroRuntime struct{}
+
+func (wazeroRuntime) config(c invokeConfig) (wazerorun.Config, error) {
+	rc := wazerorun.Config{
+		Args:       c.args,
+		Envs:       c.envs,
+		ListenAddr: c.listenAddr,
+		Listening:  c.listening,
+		Stdin:      c.stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+	}
+	for _, m := range c.mapDirs {
+		mount, err := wazerorun.ParseMapDir(m)
+		if err != nil {
+			return rc, err
+		}
+		rc.Mounts = append(rc.Mounts, mount)
+	}
+	return rc, nil
+}
+
+func (r wazeroRuntime) listenFD(c invokeConfig) int {
+	return wazerorun.DefaultListenFD + len(c.mapDirs)
+}
+
+func (r wazeroRuntime) run(ctx context.Context, c invokeConfig) error {
+	rc, err := r.config(c)
+	if err != nil {
+		return err
+	}
+	return wazerorun.Run(ctx, c.wasmFile, rc)
+}
+
+// exitCode returns the exit code of the guest if err is caused by the exit of the guest.
+func exitCode(err error) (int, bool) {
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode(), true
+	}
+	var se *sys.ExitError
+	if errors.As(err, &se) {
+		return int(se.ExitCode()), true
+	}
+	return 0, false
+}
+
+// splitInvocations splits the args of the invoke flag into the WASM images and their args
+// separated by invokeSep.
+func splitInvocations(args []string) (res [][]string, _ error) {
+	var cur []string
+	for _, a := range append(args, invokeSep) {
+		if a != invokeSep {
+			cur = append(cur, a)
+			continue
+		}
+		if len(cur) == 0 {
+			return nil, fmt.Errorf("WASM image must be specified before and after %q", invokeSep)
+		}
+		res = append(res, cur)
+		cur = nil
+	}
+	return res, nil
+}
+
+// withMAC adds "--mac" flag to the options of the WASM image after "--net" flag unless it's specified.
+func withMAC(args []string, mac string) []string {
+	netIdx := -1
+	for i, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			break // COMMAND
+		}
+		if a == "--mac" || strings.HasPrefix(a, "--mac=") {
+			return args
+		}
+		if a == "--net=socket" || strings.HasPrefix(a, "--net=socket=") {
+			netIdx = i
+		}
+	}
+	if netIdx < 0 {
+		return args
+	}
+	res := append([]string{}, args[:netIdx+1]...)
+	res = append(res, "--mac="+mac)
+	return append(res, args[netIdx+1:]...)
+}
+
+// withListenFD configures the "--net=socket" flag of the WASM image to use the listening socket at fd.
+func withListenFD(args []string, fd int) []string {
+	if fd == defaultListenFD {
+		return args
+	}
+	res := append([]string{}, args...)
+	for i, a := range res {
+		if a == "--net=socket" {
+			res[i] = fmt.Sprintf("--net=socket=listenfd=%d", fd)
+		}
+	}
+	return res
+}
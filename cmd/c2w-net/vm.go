@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ktock/container2wasm/internal/netstack"
+)
+
+const (
+	// vmDomain is the domain of the DNS names of the VMs on the network.
+	vmDomain = "c2w.internal"
+
+	// maxVMs is the max number of VMs on the network.
+	// VMs are assigned 192.168.127.3 - 192.168.127.202. The IPv6 address of a VM is
+	// derived from its MAC address (see netstack.VMIP6).
+	maxVMs = 200
+)
+
+// vmConfig is a VM connected to the network.
+type vmConfig struct {
+	name string
+	mac  string
+	ip   string
+	ip6  string
+}
+
+// parseVMs parses VMs formatted as "NAME[=MAC]".
+// IPv4 addresses are assigned from netstack.VMIP in order and IPv6 addresses are
+// configured by the VMs using SLAAC (netstack.VMIP6). MAC addresses are assigned
+// in order if omitted, starting from defaultMAC for the first VM.
+// If no VM is specified, a VM named "vm" with defaultMAC is returned.
+func parseVMs(vms []string, defaultMAC string) ([]vmConfig, error) {
+	if len(vms) == 0 {
+		vms = []string{"vm"}
+	}
+	if len(vms) > maxVMs {
+		return nil, fmt.Errorf("too many VMs (max: %d)", maxVMs)
+	}
+	baseIP := net.ParseIP(netstack.VMIP).To4()
+	names := make(map[string]struct{})
+	macs := make(map[string]struct{})
+	var res []vmConfig
+	for i, v := range vms {
+		name, mac, ok := strings.Cut(v, "=")
+		if name == "" || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("invalid VM name %q", name)
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicated VM name %q", name)
+		}
+		names[name] = struct{}{}
+		if !ok {
+			if i == 0 {
+				mac = defaultMAC
+			} else {
+				mac = fmt.Sprintf("02:00:00:00:%02x:%02x", (i+1)>>8, (i+1)&0xff)
+			}
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address of VM %q: %w", name, err)
+		}
+		mac = hw.String()
+		if _, ok := macs[mac]; ok {
+			return nil, fmt.Errorf("duplicated MAC address %q", mac)
+		}
+		macs[mac] = struct{}{}
+		ip := net.IPv4(baseIP[0], baseIP[1], baseIP[2], baseIP[3]+byte(i))
+		ip6, err := netstack.VMIP6(mac)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, vmConfig{name: name, mac: mac, ip: ip.String(), ip6: ip6})
+	}
+	return res, nil
+}
+
+// vmDNSRecords returns the DNS records ("name=ip") that resolve the names of the VMs
+// to their IPv4 and IPv6 addresses.
+func vmDNSRecords(vms []vmConfig) (records []string) {
+	for _, vm := range vms {
+		records = append(records,
+			fmt.Sprintf("%s.%s=%s", vm.name, vmDomain, vm.ip),
+			fmt.Sprintf("%s.%s=%s", vm.name, vmDomain, vm.ip6))
+	}
+	return records
+}
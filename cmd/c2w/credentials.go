@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubServer is the key of Docker Hub in docker config.json and the credential helpers.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// dockerConfig is the part of docker config.json used for the credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerCredentials returns the credentials of the registry host configured for docker
+// ($DOCKER_CONFIG/config.json or ~/.docker/config.json). The credential helpers are supported as well.
+// The returned username is empty if the secret is an identity token. It's passed to docker.WithAuthCreds.
+func dockerCredentials(host string) (string, string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil // no config
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("failed to parse docker config: %w", err)
+	}
+	server := host
+	if host == "docker.io" || host == "index.docker.io" || host == "registry-1.docker.io" {
+		server = dockerHubServer
+	}
+	if helper, ok := config.CredHelpers[server]; ok {
+		return helperCredentials(helper, server)
+	}
+	for key, a := range config.Auths {
+		if credentialsHost(key) != server {
+			continue
+		}
+		if a.IdentityToken != "" {
+			return "", a.IdentityToken, nil
+		}
+		if a.Auth == "" {
+			return a.Username, a.Password, nil
+		}
+		b, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth of %q: %w", key, err)
+		}
+		username, password, ok := strings.Cut(string(b), ":")
+		if !ok {
+			return "", "", fmt.Errorf("invalid auth of %q: no separator", key)
+		}
+		return username, password, nil
+	}
+	if config.CredsStore != "" {
+		return helperCredentials(config.CredsStore, server)
+	}
+	return "", "", nil
+}
+
+// credentialsHost returns the host of the key of "auths" in docker config.json. The key can be a URL
+// (e.g. "https://registry.example.com/v1/").
+func credentialsHost(key string) string {
+	if key == dockerHubServer {
+		return key
+	}
+	if _, rest, ok := strings.Cut(key, "://"); ok {
+		key = rest
+	}
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
+
+// helperCredentials gets the credentials of the server from the credential helper (docker-credential-<helper>).
+func helperCredentials(helper, server string) (string, string, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(string(out), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("failed to get credentials of %q from %q: %w: %s", server, helper, err, stderr.String())
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return "", "", fmt.Errorf("invalid credentials of %q from %q: %w", server, helper, err)
+	}
+	if creds.Username == "<token>" {
+		return "", creds.Secret, nil // identity token
+	}
+	return creds.Username, creds.Secret, nil
+}
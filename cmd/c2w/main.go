@@ -2,18 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/platforms"
 	vendor "github.com/ktock/container2wasm"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
 	"github.com/ktock/container2wasm/version"
 	"github.com/urfave/cli"
 )
@@ -83,7 +87,36 @@ func main() {
 			Name:  "pack",
 			Usage: "Overwrite directory to pack with the emulator (valid only for aarch64 QEMU on emscripten)",
 		},
+		cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "DNS server used by the container (can be specified multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "DNS search domain used by the container (can be specified multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "Add a host-to-IP mapping (host:ip) to /etc/hosts of the container (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "trust-ca",
+			Usage: "PEM file of CA certificates added to the trust store of the container (e.g. the CA of the proxy specified by c2w-net-proxy's --ca-cert)",
+		},
+		cli.StringFlag{
+			Name:  "image-policy",
+			Usage: "JSON file of the policy of the signatures (cosign, Notation) and the provenance required for converting the image. The image is verified in the registry and converted by the verified digest",
+		},
+		cli.BoolFlag{
+			Name:  "boot-trace",
+			Usage: "Record boot timeline in the output image (can be inspected by \"trace\" command)",
+		},
 	}, flags...)
+	app.Commands = []cli.Command{traceCommand, runCommand}
+	if imageNameSeparated(app.Commands, os.Args[1:]) {
+		// "c2w [options] -- IMAGE [OUTPUT]" converts the image even if it's named after a sub command (e.g. "trace")
+		app.Commands = nil
+	}
 	app.Action = rootAction
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
@@ -91,6 +124,27 @@ func main() {
 	}
 }
 
+// imageNameSeparated returns true if args have "--" before any sub command name.
+func imageNameSeparated(commands []cli.Command, args []string) bool {
+	for _, a := range args {
+		if a == "--" {
+			return true
+		}
+		for _, c := range commands {
+			if c.HasName(a) {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// subcommandTargetError is the error of the file that doesn't exist but specified to the sub command.
+// The user may want to convert the image named after the sub command.
+func subcommandTargetError(command, p string, err error) error {
+	return fmt.Errorf("%w (use \"c2w [options] -- %s %s\" to convert the image named %q)", err, command, p, command)
+}
+
 func rootAction(clicontext *cli.Context) error {
 	if clicontext.Bool("show-dockerfile") {
 		fmt.Printf("%s", vendor.Dockerfile)
@@ -157,8 +211,27 @@ func rootAction(clicontext *cli.Context) error {
 	if a := clicontext.String("pack"); a != "" && legacy {
 		return fmt.Errorf("\"pack\" unsupported on docker build as of now; install docker buildx instead")
 	}
+	if _, err := trustCABuildArgs(clicontext); err != nil {
+		return err
+	}
+	var policy *imagepolicy.Policy
+	if p := clicontext.String("image-policy"); p != "" {
+		if !needsImg {
+			return fmt.Errorf("\"image-policy\" unsupported with \"external-bundle\" and \"pack\"; specify it to imagemounter instead")
+		}
+		policy, err = imagepolicy.LoadPolicyFile(p)
+		if err != nil {
+			return err
+		}
+	}
 
 	srcImgName := arg1
+	if policy != nil {
+		srcImgName, err = verifySourceImg(context.TODO(), srcImgName, clicontext.String("target-arch"), policy)
+		if err != nil {
+			return err
+		}
+	}
 	tmpdir, err := os.MkdirTemp("", "container2wasm")
 	if err != nil {
 		return err
@@ -239,6 +312,15 @@ func build(builderPath string, srcImgPath string, destDir, destFile string, clic
 	if clicontext.Bool("external-bundle") {
 		buildxArgs = append(buildxArgs, "--build-arg", "EXTERNAL_BUNDLE=true")
 	}
+	if clicontext.Bool("boot-trace") {
+		buildxArgs = append(buildxArgs, "--build-arg", "INIT_TRACE=true")
+	}
+	buildxArgs = append(buildxArgs, dnsBuildArgs(clicontext)...)
+	caArgs, err := trustCABuildArgs(clicontext)
+	if err != nil {
+		return err
+	}
+	buildxArgs = append(buildxArgs, caArgs...)
 	for _, a := range clicontext.StringSlice("build-arg") {
 		buildxArgs = append(buildxArgs, "--build-arg", a)
 	}
@@ -303,6 +385,15 @@ func buildWithLegacyBuilder(builderPath string, srcImgPath, destDir, destFile st
 	if clicontext.Bool("external-bundle") {
 		buildArgs = append(buildArgs, "--build-arg", "EXTERNAL_BUNDLE=true")
 	}
+	if clicontext.Bool("boot-trace") {
+		buildArgs = append(buildArgs, "--build-arg", "INIT_TRACE=true")
+	}
+	buildArgs = append(buildArgs, dnsBuildArgs(clicontext)...)
+	caArgs, err := trustCABuildArgs(clicontext)
+	if err != nil {
+		return err
+	}
+	buildArgs = append(buildArgs, caArgs...)
 	for _, a := range clicontext.StringSlice("build-arg") {
 		buildArgs = append(buildArgs, "--build-arg", a)
 	}
@@ -316,6 +407,42 @@ func buildWithLegacyBuilder(builderPath string, srcImgPath, destDir, destFile st
 	return cmd.Run()
 }
 
+func dnsBuildArgs(clicontext *cli.Context) (args []string) {
+	for _, f := range []struct {
+		flag string
+		arg  string
+	}{
+		{"dns", "DNS"},
+		{"dns-search", "DNS_SEARCH"},
+		{"add-host", "ADD_HOST"},
+	} {
+		if v := clicontext.StringSlice(f.flag); len(v) > 0 {
+			args = append(args, "--build-arg", fmt.Sprintf("%s=%s", f.arg, strings.Join(v, ",")))
+		}
+	}
+	return args
+}
+
+// trustCABuildArgs returns the build args to add the certificates specified by "trust-ca" flag to the container.
+// The certificates are passed to the build as base64-encoded PEM.
+func trustCABuildArgs(clicontext *cli.Context) ([]string, error) {
+	p := clicontext.String("trust-ca")
+	if p == "" {
+		return nil, nil
+	}
+	if clicontext.Bool("external-bundle") {
+		return nil, fmt.Errorf("\"trust-ca\" unsupported with \"external-bundle\"")
+	}
+	d, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted CA: %w", err)
+	}
+	if b, _ := pem.Decode(d); b == nil {
+		return nil, fmt.Errorf("no PEM data found in %q", p)
+	}
+	return []string{"--build-arg", fmt.Sprintf("TRUST_CA=%s", base64.StdEncoding.EncodeToString(d))}, nil
+}
+
 func prepareSourceImg(builderPath, imgName, tmpdir, targetarch string) error {
 	log.Printf("saving %q to %q\n", imgName, tmpdir)
 	// TODO: check architecture
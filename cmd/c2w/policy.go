@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/containerd/containerd/images"
+	ctdreference "github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// verifySourceImg verifies the image in the registry is allowed by the policy and returns the reference
+// pinned to the verified digest. The image is pulled by the returned reference so that the converted
+// image is the verified one even if the tag is updated or a different image has the name locally.
+func verifySourceImg(ctx context.Context, imgName, targetarch string, policy *imagepolicy.Policy) (string, error) {
+	named, err := reference.ParseDockerRef(imgName)
+	if err != nil {
+		return "", err
+	}
+	refspec, err := ctdreference.Parse(named.String())
+	if err != nil {
+		return "", err
+	}
+	authorizer := docker.NewDockerAuthorizer(docker.WithAuthCreds(dockerCredentials))
+	hosts := docker.ConfigureDefaultRegistries(docker.WithAuthorizer(authorizer), docker.WithPlainHTTP(docker.MatchLocalhost))
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: hosts})
+	_, desc, err := resolver.Resolve(ctx, refspec.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q: %w", refspec.String(), err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return "", err
+	}
+	store := &imagepolicy.RegistryStore{
+		Locator:  refspec.Locator,
+		Resolver: resolver,
+		Fetcher:  fetcher,
+		Hosts: func() ([]imagepolicy.RegistryHost, error) {
+			registryHosts, err := hosts(refspec.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			var res []imagepolicy.RegistryHost
+			for _, host := range registryHosts {
+				res = append(res, imagepolicy.RegistryHost{
+					Client:     host.Client,
+					Authorizer: host.Authorizer,
+					Scheme:     host.Scheme,
+					Host:       host.Host,
+					Path:       host.Path,
+					Header:     host.Header,
+				})
+			}
+			return res, nil
+		},
+	}
+	digests := []digest.Digest{desc.Digest}
+	if targetarch != "" {
+		p, err := platforms.Parse(targetarch)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse arch %q", targetarch)
+		}
+		manifestDigest, err := platformManifestDigest(ctx, store, desc, platforms.Only(p))
+		if err != nil {
+			return "", err
+		}
+		if manifestDigest != desc.Digest {
+			digests = append(digests, manifestDigest)
+		}
+	}
+	res, err := imagepolicy.Verify(ctx, store, policy, digests...)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify %q: %w", imgName, err)
+	}
+	log.Printf("image %v is verified by %s (provenance builder: %q)\n", res.Digest, res.Signer, res.ProvenanceBuilderID)
+	return reference.FamiliarName(named) + "@" + desc.Digest.String(), nil
+}
+
+// platformManifestDigest returns the digest of the manifest for the platform. desc is a manifest or an index.
+// The indexes are verified by their digests.
+func platformManifestDigest(ctx context.Context, s imagepolicy.Store, desc ocispec.Descriptor, platform platforms.MatchComparer) (digest.Digest, error) {
+	if desc.MediaType != images.MediaTypeDockerSchema2ManifestList && desc.MediaType != ocispec.MediaTypeImageIndex {
+		return desc.Digest, nil
+	}
+	b, err := imagepolicy.FetchVerified(ctx, s, desc)
+	if err != nil {
+		return "", err
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return "", err
+	}
+	for _, m := range idx.Manifests {
+		if m.Platform != nil && platform.Match(*m.Platform) {
+			return platformManifestDigest(ctx, s, m, platform)
+		}
+	}
+	return "", fmt.Errorf("manifest not found in %v for the target architecture", desc.Digest)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/ktock/container2wasm/internal/netstack"
+	"github.com/ktock/container2wasm/internal/wazerorun"
+	"github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero/sys"
+	"github.com/urfave/cli"
+	"golang.org/x/term"
+)
+
+var runCommand = cli.Command{
+	Name:      "run",
+	Usage:     "Run a WASM image on the embedded wazero runtime with networking",
+	ArgsUsage: "wasm-file [wasm options] [COMMAND] [ARG...]",
+	Description: "Networking is enabled by default using the network stack embedded to c2w (same as c2w-net). " +
+		"The exit code of the container is propagated.",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "mapdir",
+			Usage: "Directory mapping (GUEST::HOST)",
+		},
+		cli.StringSliceFlag{
+			Name:  "dir",
+			Usage: "Directory mapping (HOST[::GUEST]) (same as wasmtime's --dir flag)",
+		},
+		cli.StringSliceFlag{
+			Name:  "env",
+			Usage: "Environment variable (KEY=VALUE)",
+		},
+		cli.BoolTFlag{
+			Name:  "net",
+			Usage: "Enable networking (use --net=false to disable)",
+		},
+		cli.StringSliceFlag{
+			Name:  "publish, p",
+			Usage: "Map port between host and the container ([ip:]host:guest[/proto]; proto is tcp (default) or udp; IPv6 address must be enclosed by brackets)",
+		},
+		cli.StringFlag{
+			Name:  "mac",
+			Usage: "MAC address assigned to the container",
+			Value: netstack.VMMAC,
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Enable debug print of the network stack",
+		},
+	},
+	SkipArgReorder: true,
+	Action:         runAction,
+}
+
+func runAction(clicontext *cli.Context) error {
+	wasmPath := clicontext.Args().First()
+	if wasmPath == "" {
+		return fmt.Errorf("specify wasm image")
+	}
+	if _, err := os.Stat(wasmPath); err != nil {
+		return subcommandTargetError("run", wasmPath, err)
+	}
+	c := wazerorun.Config{
+		Args:   clicontext.Args().Tail(),
+		Envs:   clicontext.StringSlice("env"),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	for _, m := range clicontext.StringSlice("mapdir") {
+		mount, err := wazerorun.ParseMapDir(m)
+		if err != nil {
+			return err
+		}
+		c.Mounts = append(c.Mounts, mount)
+	}
+	for _, m := range clicontext.StringSlice("dir") {
+		host, guest, ok := strings.Cut(m, "::")
+		if !ok {
+			guest = host
+		}
+		if guest == "" || host == "" {
+			return fmt.Errorf("invalid directory mapping %q: must be HOST[::GUEST]", m)
+		}
+		c.Mounts = append(c.Mounts, wazerorun.Mount{Host: host, Guest: guest})
+	}
+
+	if clicontext.Bool("net") {
+		vn, err := startNetwork(clicontext)
+		if err != nil {
+			return err
+		}
+		// wazero listens on a free port and the network stack connects to it before the guest starts.
+		c.ListenAddr = "127.0.0.1:0"
+		c.Listening = func(addr string) { go connectNetwork(vn, addr) }
+		c.Args = withNetSocket(c.Args, c.ListenFD())
+	}
+
+	restore, err := makeStdinRaw()
+	if err != nil {
+		return err
+	}
+	err = wazerorun.Run(context.Background(), wasmPath, c)
+	restore()
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code != 0 {
+			return cli.NewExitError("", int(code))
+		}
+		return nil
+	}
+	return err
+}
+
+// startNetwork starts the network stack.
+func startNetwork(clicontext *cli.Context) (*netstack.Network, error) {
+	if clicontext.Bool("debug") {
+		log.SetOutput(os.Stderr)
+	} else {
+		log.SetOutput(io.Discard)
+		logrus.SetLevel(logrus.FatalLevel)
+	}
+	mac, err := net.ParseMAC(clicontext.String("mac"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address: %w", err)
+	}
+	forwards := make(map[string]string)
+	for _, p := range clicontext.StringSlice("publish") {
+		f, err := netstack.ParsePortForward(p)
+		if err != nil {
+			return nil, err
+		}
+		forwards[f.Local()] = net.JoinHostPort(netstack.VMIP, f.GuestPort)
+	}
+	return netstack.New(
+		netstack.WithDebug(clicontext.Bool("debug")),
+		netstack.WithDHCPStaticLeases(map[string]string{
+			netstack.VMIP: mac.String(),
+		}),
+		netstack.WithForwards(forwards),
+		netstack.WithHostAccess(),
+	)
+}
+
+// connectNetwork connects the network stack to the listening socket of the guest at wasiAddr.
+func connectNetwork(vn *netstack.Network, wasiAddr string) {
+	conn, err := net.Dial("tcp", wasiAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to the container: %v\n", err)
+		return
+	}
+	// We register our VM network as a qemu "-netdev socket".
+	if err := vn.AcceptQemu(context.TODO(), conn); err != nil {
+		log.Printf("failed AcceptQemu: %v\n", err)
+	}
+}
+
+// withNetSocket configures the WASM image to use the listening socket at fd for networking.
+// "--net=socket" is added if networking isn't configured by args.
+func withNetSocket(args []string, fd int) []string {
+	netFlag := fmt.Sprintf("--net=socket=listenfd=%d", fd)
+	res := append([]string{}, args...)
+	for i, a := range res {
+		if a == "--" || !strings.HasPrefix(a, "-") {
+			break
+		}
+		if a == "--net=socket" {
+			res[i] = netFlag
+			return res
+		} else if strings.HasPrefix(a, "--net") {
+			return res
+		}
+	}
+	return append([]string{netFlag}, res...)
+}
+
+// makeStdinRaw puts stdin into raw mode if it's a terminal.
+// The container's terminal handles echo and line editing.
+// The returned function restores the mode. The mode is also restored on termination signals.
+func makeStdinRaw() (restore func(), _ error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}, nil
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make stdin raw: %w", err)
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGHUP)
+	doneCh := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigCh:
+			term.Restore(fd, state)
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		case <-doneCh:
+		}
+	}()
+	return func() {
+		signal.Stop(sigCh)
+		close(doneCh)
+		term.Restore(fd, state)
+	}, nil
+}
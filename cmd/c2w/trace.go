@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	inittype "github.com/ktock/container2wasm/cmd/init/types"
+	"github.com/urfave/cli"
+)
+
+var traceCommand = cli.Command{
+	Name:      "trace",
+	Usage:     "Run a WASM image built with \"--boot-trace\" and show the summary of its boot timeline",
+	ArgsUsage: "wasm-file|timeline-file [wasm options] [COMMAND] [ARG...]",
+	Description: "If a file other than *.wasm is specified, the timeline is read from that file. " +
+		"It can be either the timeline JSON or the console output of the image.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "runtime",
+			Usage: "WASI runtime command used for running the image",
+			Value: "wasmtime",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the timeline in JSON instead of the summary",
+		},
+	},
+	SkipArgReorder: true,
+	Action:         traceAction,
+}
+
+func traceAction(clicontext *cli.Context) error {
+	target := clicontext.Args().First()
+	if target == "" {
+		return fmt.Errorf("specify wasm image or timeline file")
+	}
+	if _, err := os.Stat(target); err != nil {
+		return subcommandTargetError("trace", target, err)
+	}
+	var tl *inittype.Timeline
+	var err error
+	if strings.HasSuffix(target, ".wasm") {
+		tl, err = traceRun(clicontext.String("runtime"), target, clicontext.Args().Tail())
+	} else {
+		tl, err = traceRead(target)
+	}
+	if err != nil {
+		return err
+	}
+	if clicontext.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(tl)
+	}
+	return printTimeline(os.Stdout, tl)
+}
+
+// traceRun runs the image and extracts the timeline from its console output.
+// The timeline is printed to stderr by init but the console of the image can be either of stdout and stderr
+// of the runtime. Other outputs are passed through.
+func traceRun(runtime, wasmPath string, args []string) (*inittype.Timeline, error) {
+	cmd := exec.Command(runtime, append([]string{wasmPath}, args...)...)
+	cmd.Stdin = os.Stdin
+	outR, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	errR, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run %q: %w", runtime, err)
+	}
+	type result struct {
+		tl  *inittype.Timeline
+		err error
+	}
+	errCh := make(chan result, 1)
+	go func() {
+		tl, err := scanTimeline(errR, os.Stderr)
+		errCh <- result{tl, err}
+	}()
+	tl, scanErr := scanTimeline(outR, os.Stdout)
+	// pipes must be read before Wait
+	if res := <-errCh; tl == nil && (res.tl != nil || !errors.Is(res.err, errTimelineNotFound)) {
+		tl, scanErr = res.tl, res.err
+	}
+	if err := cmd.Wait(); err != nil && tl == nil {
+		return nil, fmt.Errorf("failed to run image: %w", err)
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	return tl, nil
+}
+
+// traceRead reads the timeline from a file containing either the timeline JSON
+// or the console output of the image.
+func traceRead(p string) (*inittype.Timeline, error) {
+	d, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var tl inittype.Timeline
+	if err := json.Unmarshal(d, &tl); err == nil {
+		return &tl, nil
+	}
+	return scanTimeline(bytes.NewReader(d), io.Discard)
+}
+
+var errTimelineNotFound = errors.New("timeline not found; the image must be built with \"--boot-trace\"")
+
+// scanTimeline extracts the timeline from the console output read from r. Other outputs are written to
+// passthrough. r is read until EOF even if the timeline is malformed so that the writer isn't blocked.
+func scanTimeline(r io.Reader, passthrough io.Writer) (*inittype.Timeline, error) {
+	var tl *inittype.Timeline
+	var parseErr error
+	br := bufio.NewReader(r)
+	for {
+		l, err := br.ReadString('\n')
+		if i := strings.Index(l, inittype.TimelineMarker); i >= 0 {
+			if i > 0 {
+				fmt.Fprint(passthrough, l[:i])
+			}
+			tl = new(inittype.Timeline)
+			if err := json.Unmarshal([]byte(strings.TrimSpace(l[i+len(inittype.TimelineMarker):])), tl); err != nil {
+				tl, parseErr = nil, fmt.Errorf("failed to parse timeline: %w", err)
+			}
+		} else {
+			fmt.Fprint(passthrough, l)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if tl == nil && parseErr != nil {
+		return nil, parseErr
+	} else if tl == nil {
+		return nil, errTimelineNotFound
+	}
+	return tl, nil
+}
+
+func printTimeline(w io.Writer, tl *inittype.Timeline) error {
+	phases := append([]inittype.Phase{}, tl.Phases...)
+	sort.SliceStable(phases, func(i, j int) bool {
+		return phases[i].Start < phases[j].Start
+	})
+	var total time.Duration
+	for _, p := range phases {
+		if p.End > total {
+			total = p.End
+		}
+	}
+	tw := tabwriter.NewWriter(w, 4, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tSTART\tDURATION\t%")
+	for _, p := range phases {
+		d := p.End - p.Start
+		var ratio float64
+		if total > 0 {
+			ratio = float64(d) / float64(total) * 100
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%.1f\n", p.Name, p.Start.Round(time.Millisecond), d.Round(time.Millisecond), ratio)
+	}
+	fmt.Fprintf(tw, "total\t\t%v\t\n", total.Round(time.Millisecond))
+	return tw.Flush()
+}
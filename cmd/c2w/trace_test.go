@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	inittype "github.com/ktock/container2wasm/cmd/init/types"
+)
+
+func TestScanTimeline(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		input           string
+		want            *inittype.Timeline
+		wantPassthrough string
+		wantErr         bool
+	}{
+		{
+			name:            "timeline",
+			input:           "booting\nconsole " + inittype.TimelineMarker + `{"phases":[{"name":"kernel","start":0,"end":1000}]}` + "\nhello\n",
+			want:            &inittype.Timeline{Phases: []inittype.Phase{{Name: "kernel", Start: 0, End: 1000}}},
+			wantPassthrough: "booting\nconsole hello\n",
+		},
+		{
+			name:            "malformed timeline",
+			input:           "booting\n" + inittype.TimelineMarker + "{\nhello\nworld",
+			wantPassthrough: "booting\nhello\nworld",
+			wantErr:         true,
+		},
+		{
+			name:            "no timeline",
+			input:           "hello\n",
+			wantPassthrough: "hello\n",
+			wantErr:         true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var passthrough bytes.Buffer
+			got, err := scanTimeline(strings.NewReader(tt.input), &passthrough)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("unexpected error %v (want error: %v)", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("unexpected timeline %+v; want %+v", got, tt.want)
+			}
+			if passthrough.String() != tt.wantPassthrough {
+				t.Fatalf("unexpected passthrough %q; want %q", passthrough.String(), tt.wantPassthrough)
+			}
+		})
+	}
+}
+
+func TestScanTimelineDrain(t *testing.T) {
+	// The writer (e.g. the runtime writing to the pipe) must not be blocked by the malformed timeline.
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(pw, inittype.TimelineMarker+"{\n")
+		if err == nil {
+			_, err = pw.Write(bytes.Repeat([]byte("output\n"), 10000))
+		}
+		pw.Close()
+		written <- err
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := scanTimeline(pr, io.Discard)
+		done <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("writer is blocked")
+	}
+	if err := <-done; err == nil || errors.Is(err, errTimelineNotFound) {
+		t.Fatalf("unexpected error %v; want parse error", err)
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/archive/compression"
@@ -19,6 +21,7 @@ import (
 	ctdoci "github.com/containerd/containerd/oci"
 	"github.com/containerd/platforms"
 	inittype "github.com/ktock/container2wasm/cmd/init/types"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
 	"github.com/moby/sys/user"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
@@ -41,8 +44,32 @@ func main() {
 		noVmtouch         = flag.Bool("no-vmtouch", false, "do not perform vmtouch")
 		externalBundle    = flag.Bool("external-bundle", false, "provide bundle externally during runtime")
 		noBinfmt          = flag.Bool("no-binfmt", false, "do not install binfmt")
+		trace             = flag.Bool("trace", false, "record boot timeline and print it on the console")
+		dnsServers        = flag.String("dns", "", "comma-separated list of DNS servers")
+		dnsSearch         = flag.String("dns-search", "", "comma-separated list of DNS search domains")
+		addHosts          = flag.String("add-host", "", "comma-separated list of host-to-IP mappings (host:ip) added to /etc/hosts")
+		trustCAFlag       = flag.String("trust-ca", "", "base64-encoded PEM certificates added to the trust store of the container")
+		imagePolicyFlag   = flag.String("image-policy", "", "base64-encoded JSON of the policy of the signatures (cosign, Notation) and the provenance required for unpacking the image")
 	)
 	flag.Parse()
+	dnsCfg, err := parseDNSConfig(*dnsServers, *dnsSearch, *addHosts)
+	if err != nil {
+		panic(err)
+	}
+	trustCA, err := decodeTrustedCA(*trustCAFlag)
+	if err != nil {
+		panic(err)
+	}
+	if *externalBundle && trustCA != nil {
+		panic("trust-ca is unsupported with external-bundle")
+	}
+	policy, err := decodeImagePolicy(*imagePolicyFlag)
+	if err != nil {
+		panic(err)
+	}
+	if *externalBundle && policy != nil {
+		panic("image-policy is unsupported with external-bundle")
+	}
 	args := flag.Args()
 	imgDir := args[0]
 	platform := args[1]
@@ -53,7 +80,7 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		cfg, err := unpack(context.TODO(), imgDir, &p, rootfs)
+		cfg, err := unpack(context.TODO(), imgDir, &p, rootfs, policy)
 		if err != nil {
 			panic(err)
 		}
@@ -64,11 +91,11 @@ func main() {
 		if err := os.WriteFile("image.json", cfgD, 0600); err != nil {
 			panic(err)
 		}
-		if err := createSpec(bytes.NewReader(cfgD), rootfs, *debug, *debugInit, *imageConfigPath, *runtimeConfigPath, *imageRootfsPath, *noVmtouch, *noBinfmt); err != nil {
+		if err := createSpec(bytes.NewReader(cfgD), rootfs, *debug, *debugInit, *imageConfigPath, *runtimeConfigPath, *imageRootfsPath, *noVmtouch, *noBinfmt, *trace, dnsCfg, trustCA); err != nil {
 			panic(err)
 		}
 	} else {
-		bootConfig, err := generateBootConfig(*debug, *debugInit, *imageConfigPath, *runtimeConfigPath, *imageRootfsPath, *noVmtouch, "", true)
+		bootConfig, err := generateBootConfig(*debug, *debugInit, *imageConfigPath, *runtimeConfigPath, *imageRootfsPath, *noVmtouch, "", true, *trace, dnsCfg)
 		if err != nil {
 			panic(err)
 		}
@@ -82,13 +109,18 @@ func main() {
 	}
 }
 
-func unpack(ctx context.Context, imgDir string, platform *ocispec.Platform, rootfs string) (io.Reader, error) {
+// unpack unpacks the image in imgDir to rootfs. If policy is specified, only the images allowed by the
+// policy are unpacked.
+func unpack(ctx context.Context, imgDir string, platform *ocispec.Platform, rootfs string, policy *imagepolicy.Policy) (io.Reader, error) {
 	fmt.Println("Trying to unpack image as an OCI image")
 	if rootfs == "" {
 		return nil, fmt.Errorf("specify rootfs")
 	}
 	idxR, err := os.Open(filepath.Join(imgDir, "index.json"))
 	if err != nil {
+		if policy != nil {
+			return nil, fmt.Errorf("image policy requires an OCI layout: %w", err)
+		}
 		fmt.Println("Failed to unpack the image as an OCI image:", err)
 		return unpackDocker(ctx, imgDir, platform, rootfs)
 	}
@@ -100,7 +132,14 @@ func unpack(ctx context.Context, imgDir string, platform *ocispec.Platform, root
 	if platform != nil {
 		platformMC = platforms.Only(*platform)
 	}
-	return unpackOCI(ctx, imgDir, platformMC, rootfs, idx.Manifests)
+	descs := idx.Manifests
+	if policy != nil {
+		descs, err = verifyImages(ctx, imgDir, platformMC, policy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unpackOCI(ctx, imgDir, platformMC, rootfs, descs)
 }
 
 func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchComparer, rootfs string, descs []ocispec.Descriptor) (io.Reader, error) {
@@ -111,7 +150,7 @@ func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchCom
 			if desc.Platform != nil && platformMC != nil && !platformMC.Match(*desc.Platform) {
 				continue
 			}
-			mfstD, err := os.ReadFile(filepath.Join(imgDir, "/blobs/sha256", desc.Digest.Encoded()))
+			mfstD, err := readBlob(imgDir, desc)
 			if err != nil {
 				return nil, err
 			}
@@ -123,7 +162,7 @@ func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchCom
 				fmt.Printf("%v is not a container manifest. skipping...", desc.Digest.String())
 				continue
 			}
-			configD, err := os.ReadFile(filepath.Join(imgDir, "/blobs/sha256", manifest.Config.Digest.Encoded()))
+			configD, err := readBlob(imgDir, manifest.Config)
 			if err != nil {
 				return nil, err
 			}
@@ -136,15 +175,18 @@ func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchCom
 			}
 			for _, layerDesc := range manifest.Layers {
 				if err := func() error {
-					layerR, err := os.Open(filepath.Join(imgDir, "/blobs/sha256", layerDesc.Digest.Encoded()))
+					layerF, err := os.Open(filepath.Join(imgDir, "/blobs/sha256", layerDesc.Digest.Encoded()))
 					if err != nil {
 						return err
 					}
-					defer layerR.Close()
+					defer layerF.Close()
+					verifier := layerDesc.Digest.Verifier()
+					layerR := io.TeeReader(layerF, verifier)
 					r, err := compression.DecompressStream(layerR)
 					if err != nil {
 						return err
 					}
+					defer r.Close()
 					var opts []archive.ApplyOpt
 					if os.Getenv("_NO_SAME_OWNER") == "1" {
 						opts = append(opts, archive.WithNoSameOwner())
@@ -152,6 +194,16 @@ func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchCom
 					if _, err := archive.Apply(ctx, rootfs, r, opts...); err != nil {
 						return err
 					}
+					// read the rest not read by the tar reader (e.g. the padding) for verifying the whole layer
+					if _, err := io.Copy(io.Discard, r); err != nil {
+						return err
+					}
+					if _, err := io.Copy(io.Discard, layerR); err != nil {
+						return err
+					}
+					if !verifier.Verified() {
+						return fmt.Errorf("unexpected digest of layer %v", layerDesc.Digest)
+					}
 					return nil
 				}(); err != nil {
 					return nil, err
@@ -159,7 +211,7 @@ func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchCom
 			}
 			return bytes.NewReader(configD), nil
 		case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
-			idxD, err := os.ReadFile(filepath.Join(imgDir, "/blobs/sha256", desc.Digest.Encoded()))
+			idxD, err := readBlob(imgDir, desc)
 			if err != nil {
 				return nil, err
 			}
@@ -172,28 +224,7 @@ func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchCom
 			return nil, fmt.Errorf("unsupported mediatype %v", desc.MediaType)
 		}
 	}
-	if len(children) > 0 {
-		var childrenDescs []ocispec.Descriptor
-		for _, d := range children {
-			if d.Platform != nil && platformMC != nil && !platformMC.Match(*d.Platform) {
-				continue
-			}
-			childrenDescs = append(childrenDescs, d)
-		}
-		sort.SliceStable(childrenDescs, func(i, j int) bool {
-			if childrenDescs[i].Platform == nil {
-				return false
-			}
-			if childrenDescs[j].Platform == nil {
-				return true
-			}
-			if platformMC != nil {
-				return platformMC.Less(*childrenDescs[i].Platform, *childrenDescs[j].Platform)
-			}
-			return true
-		})
-		children = childrenDescs
-	}
+	children = platformManifests(children, platformMC)
 	if len(children) > 0 {
 		fmt.Printf("nested manifest: processing %v\n", children)
 		return unpackOCI(ctx, imgDir, platformMC, rootfs, children)
@@ -201,6 +232,46 @@ func unpackOCI(ctx context.Context, imgDir string, platformMC platforms.MatchCom
 	return nil, fmt.Errorf("target config not found")
 }
 
+// platformManifests returns the manifests in an index for the platform. They are sorted in the order of
+// preference. The manifests without the platform are placed last.
+func platformManifests(descs []ocispec.Descriptor, platformMC platforms.MatchComparer) []ocispec.Descriptor {
+	var res []ocispec.Descriptor
+	for _, d := range descs {
+		if d.Platform != nil && platformMC != nil && !platformMC.Match(*d.Platform) {
+			continue
+		}
+		res = append(res, d)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Platform == nil {
+			return false
+		}
+		if res[j].Platform == nil {
+			return true
+		}
+		if platformMC != nil {
+			return platformMC.Less(*res[i].Platform, *res[j].Platform)
+		}
+		return true
+	})
+	return res
+}
+
+// readBlob reads the blob in the OCI layout and verifies its digest.
+func readBlob(imgDir string, desc ocispec.Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(imgDir, "/blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return nil, err
+	}
+	if got := desc.Digest.Algorithm().FromBytes(b); got != desc.Digest {
+		return nil, fmt.Errorf("unexpected digest %v of %v", got, desc.Digest)
+	}
+	return b, nil
+}
+
 func isContainerManifest(manifest ocispec.Manifest) bool {
 	if !images.IsConfigType(manifest.Config.MediaType) {
 		return false
@@ -275,7 +346,7 @@ func unpackDocker(ctx context.Context, imgDir string, platform *ocispec.Platform
 	return nil, fmt.Errorf("target config not found")
 }
 
-func createSpec(r io.Reader, rootfs string, debug bool, debugInit bool, imageConfigPath, runtimeConfigPath, imageRootfsPath string, noVmtouch bool, noBinfmt bool) error {
+func createSpec(r io.Reader, rootfs string, debug bool, debugInit bool, imageConfigPath, runtimeConfigPath, imageRootfsPath string, noVmtouch bool, noBinfmt bool, trace bool, dnsCfg dnsConfig, trustCA []byte) error {
 	if rootfs == "" {
 		return fmt.Errorf("rootfs path must be specified")
 	}
@@ -283,7 +354,11 @@ func createSpec(r io.Reader, rootfs string, debug bool, debugInit bool, imageCon
 	if err := json.NewDecoder(r).Decode(&config); err != nil {
 		return err
 	}
-	s, err := generateSpec(config, rootfs)
+	caEnv, err := installTrustedCA(rootfs, trustCA)
+	if err != nil {
+		return fmt.Errorf("failed to install trusted CA: %w", err)
+	}
+	s, err := generateSpec(config, rootfs, caEnv)
 	if err != nil {
 		return err
 	}
@@ -293,7 +368,7 @@ func createSpec(r io.Reader, rootfs string, debug bool, debugInit bool, imageCon
 			binfmtArch = arch
 		}
 	}
-	bootConfig, err := generateBootConfig(debug, debugInit, imageConfigPath, runtimeConfigPath, imageRootfsPath, noVmtouch, binfmtArch, false)
+	bootConfig, err := generateBootConfig(debug, debugInit, imageConfigPath, runtimeConfigPath, imageRootfsPath, noVmtouch, binfmtArch, false, trace, dnsCfg)
 	if err != nil {
 		return err
 	}
@@ -314,7 +389,9 @@ func createSpec(r io.Reader, rootfs string, debug bool, debugInit bool, imageCon
 	return nil
 }
 
-func generateSpec(config ocispec.Image, rootfs string) (_ *specs.Spec, err error) {
+// generateSpec generates the runtime spec of the container. env is the default environment variables
+// overwritten by the image config.
+func generateSpec(config ocispec.Image, rootfs string, env []string) (_ *specs.Spec, err error) {
 	ic := config.Config
 	ctdCtx := ctdnamespaces.WithNamespace(context.TODO(), "default")
 	p := "linux/riscv64"
@@ -325,6 +402,7 @@ func generateSpec(config ocispec.Image, rootfs string) (_ *specs.Spec, err error
 		ctdoci.WithHostNamespace(specs.NetworkNamespace),
 		ctdoci.WithoutRunMount,
 		ctdoci.WithDefaultPathEnv,
+		ctdoci.WithEnv(env),
 		ctdoci.WithEnv(ic.Env),
 		ctdoci.WithTTY,           // TODO: make it configurable
 		ctdoci.WithNewPrivileges, // TODO: make it configurable
@@ -381,7 +459,7 @@ func generateSpec(config ocispec.Image, rootfs string) (_ *specs.Spec, err error
 	return s, nil
 }
 
-func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPath, imageRootfsPath string, noVmtouch bool, binfmtArch string, externalBundle bool) (*inittype.BootConfig, error) {
+func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPath, imageRootfsPath string, noVmtouch bool, binfmtArch string, externalBundle bool, trace bool, dnsCfg dnsConfig) (*inittype.BootConfig, error) {
 	runcArgs := []string{"run", "-b", runtimeBundlePath, "foo"}
 	if debug {
 		runcArgs = append([]string{"--debug"}, runcArgs...)
@@ -395,6 +473,9 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 	bootConfig := &inittype.BootConfig{
 		Debug:     debug,
 		DebugInit: debugInit,
+		Trace:     trace,
+		DNS:       dnsCfg.servers,
+		DNSSearch: dnsCfg.search,
 		Cmd: [][]string{
 			append([]string{"/sbin/runc"}, runcArgs...),
 		},
@@ -408,6 +489,7 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 		},
 		Mounts: []inittype.MountInfo{
 			{
+				ID:     "proc",
 				FSType: "proc",
 				Src:    "proc",
 				Dst:    "/proc",
@@ -449,7 +531,7 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 				},
 			},
 			{
-				// make etc writable (e.g. by udhcpc)
+				// make etc writable (e.g. for network configuration)
 				FSType: "tmpfs",
 				Src:    "tmpfs",
 				Dst:    "/etc",
@@ -457,12 +539,12 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 					{
 						Path:     "/etc/hosts",
 						Mode:     0644,
-						Contents: "127.0.0.1	localhost\n",
+						Contents: dnsCfg.hostsContents(),
 					},
 					{
 						Path:     "/etc/resolv.conf",
 						Mode:     0644,
-						Contents: "",
+						Contents: dnsCfg.resolvConfContents(),
 					},
 				},
 			},
@@ -480,6 +562,7 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 		},
 	}
 	rootfsMount := inittype.MountInfo{
+		ID:     "rootfs",
 		FSType: "overlay",
 		Src:    "overlay",
 		Data:   fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", imageRootfsPath, "/run/rootfs-upper", "/run/rootfs-work"),
@@ -512,12 +595,12 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 			{
 				Path:     "/run/rootfs/etc/hosts",
 				Mode:     0644,
-				Contents: "127.0.0.1	localhost\n",
+				Contents: dnsCfg.hostsContents(),
 			},
 			{
 				Path:     "/run/rootfs/etc/resolv.conf",
 				Mode:     0644,
-				Contents: "",
+				Contents: dnsCfg.resolvConfContents(),
 			},
 		},
 	}
@@ -529,7 +612,7 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 	if binfmtArch != "" {
 		procfsPos, found := 0, false
 		for i, m := range bootConfig.Mounts {
-			if m.FSType == "proc" {
+			if m.ID == "proc" {
 				procfsPos, found = i, true
 				break
 			}
@@ -540,13 +623,68 @@ func generateBootConfig(debug, debugInit bool, imageConfigPath, runtimeConfigPat
 		var newMountInfo []inittype.MountInfo
 		newMountInfo = append(newMountInfo, bootConfig.Mounts[:procfsPos+1]...)
 		newMountInfo = append(newMountInfo, inittype.MountInfo{
+			ID:     "binfmt_misc",
 			FSType: "binfmt_misc",
 			Src:    "binfmt_misc",
-			Dst:    "/proc/sys/fs/binfmt_misc",
+			Dst:    "/proc/sys/fs/binfmt_misc", // waits for procfs as the parent mount
 			Cmd:    []string{"binfmt", "--install", binfmtArch},
+			Async:  true, // installing the emulator can run in parallel with the following mounts
 		})
 		newMountInfo = append(newMountInfo, bootConfig.Mounts[procfsPos+1:]...)
 		bootConfig.Mounts = newMountInfo
 	}
 	return bootConfig, nil
 }
+
+// dnsConfig is the name resolution configuration baked into the image.
+type dnsConfig struct {
+	servers []string
+	search  []string
+	hosts   [][2]string // pairs of host name and IP
+}
+
+func parseDNSConfig(servers, search, hosts string) (c dnsConfig, _ error) {
+	for _, s := range splitList(servers) {
+		if net.ParseIP(s) == nil {
+			return c, fmt.Errorf("invalid DNS server address %q", s)
+		}
+		c.servers = append(c.servers, s)
+	}
+	c.search = splitList(search)
+	for _, h := range splitList(hosts) {
+		// IPv6 address contains ":" so split at the first one
+		name, ip, ok := strings.Cut(h, ":")
+		if !ok || name == "" || net.ParseIP(ip) == nil {
+			return c, fmt.Errorf("invalid host mapping %q: must be host:ip", h)
+		}
+		c.hosts = append(c.hosts, [2]string{name, ip})
+	}
+	return c, nil
+}
+
+func (c dnsConfig) hostsContents() string {
+	contents := "127.0.0.1	localhost\n"
+	for _, h := range c.hosts {
+		contents += fmt.Sprintf("%s	%s\n", h[1], h[0])
+	}
+	return contents
+}
+
+func (c dnsConfig) resolvConfContents() (contents string) {
+	if len(c.search) > 0 {
+		contents += fmt.Sprintf("search %s\n", strings.Join(c.search, " "))
+	}
+	for _, s := range c.servers {
+		contents += fmt.Sprintf("nameserver %s\n", s)
+	}
+	return contents
+}
+
+func splitList(s string) (l []string) {
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
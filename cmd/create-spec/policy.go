@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/platforms"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// decodeImagePolicy decodes the base64-encoded JSON of the image policy.
+func decodeImagePolicy(s string) (*imagepolicy.Policy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	d, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image policy: %w", err)
+	}
+	return imagepolicy.ParsePolicy(d)
+}
+
+// verifyImages returns the manifests of the images in index.json of the OCI layout allowed by the policy.
+// An image is allowed if the manifest or the index in index.json, or the manifest for the platform in the index
+// is signed. Only the signed manifest is returned if the index itself isn't signed.
+// The signatures need to be stored in the layout as well (e.g. "cosign save", "oras copy --recursive").
+func verifyImages(ctx context.Context, imgDir string, platformMC platforms.MatchComparer, policy *imagepolicy.Policy) ([]ocispec.Descriptor, error) {
+	s := &imagepolicy.LayoutStore{Open: func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(imgDir, name))
+	}}
+	descs, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	var verified []ocispec.Descriptor
+	var errs []error
+	for _, desc := range descs {
+		manifests := []ocispec.Descriptor{desc}
+		if desc.MediaType == images.MediaTypeDockerSchema2ManifestList || desc.MediaType == ocispec.MediaTypeImageIndex {
+			idxD, err := imagepolicy.FetchVerified(ctx, s, desc)
+			if err != nil {
+				return nil, err
+			}
+			var idx ocispec.Index
+			if err := json.Unmarshal(idxD, &idx); err != nil {
+				return nil, err
+			}
+			manifests = platformManifests(idx.Manifests, platformMC)
+		}
+		digests := []digest.Digest{desc.Digest}
+		for _, m := range manifests {
+			digests = append(digests, m.Digest)
+		}
+		res, err := imagepolicy.Verify(ctx, s, policy, digests...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("image %v is verified by %s (provenance builder: %q)\n", res.Digest, res.Signer, res.ProvenanceBuilderID)
+		if res.Digest != desc.Digest {
+			// the manifests in the index except the signed one aren't trusted
+			for _, m := range manifests {
+				if m.Digest == res.Digest {
+					manifests = []ocispec.Descriptor{m}
+					break
+				}
+			}
+		}
+		verified = append(verified, manifests...)
+	}
+	if len(verified) == 0 {
+		return nil, fmt.Errorf("no image in the OCI layout is allowed by the policy: %w", errors.Join(errs...))
+	}
+	return verified, nil
+}
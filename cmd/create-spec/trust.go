@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/continuity/fs"
+)
+
+// trustedCAName is the name of the file of the trusted CA certificates placed in the trust store.
+const trustedCAName = "c2w-trusted-ca.crt"
+
+// trustStore is the layout of the CA certificates in a distribution.
+type trustStore struct {
+	// bundle is the file containing all trusted certificates (read by most of TLS libraries).
+	bundle string
+	// anchorDir is the directory of the certificates that are added to bundle by the distribution's tool
+	// (e.g. update-ca-certificates, update-ca-trust).
+	anchorDir string
+	// release is the file that identifies the distribution.
+	release string
+}
+
+var trustStores = []trustStore{
+	{
+		bundle:    "/etc/ssl/certs/ca-certificates.crt",
+		anchorDir: "/usr/local/share/ca-certificates",
+		release:   "/etc/debian_version",
+	},
+	{
+		bundle:    "/etc/ssl/certs/ca-certificates.crt",
+		anchorDir: "/usr/local/share/ca-certificates",
+		release:   "/etc/alpine-release",
+	},
+	{
+		bundle:    "/etc/pki/tls/certs/ca-bundle.crt",
+		anchorDir: "/etc/pki/ca-trust/source/anchors",
+		release:   "/etc/redhat-release",
+	},
+}
+
+// decodeTrustedCA decodes base64-encoded PEM certificates.
+// Only the certificates are returned; other PEM blocks (e.g. private keys) are dropped.
+func decodeTrustedCA(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	d, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode trusted CA: %w", err)
+	}
+	var certs bytes.Buffer
+	rest := d
+	for {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(b.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to parse trusted CA: %w", err)
+		}
+		if err := pem.Encode(&certs, &pem.Block{Type: b.Type, Bytes: b.Bytes}); err != nil {
+			return nil, err
+		}
+	}
+	if certs.Len() == 0 {
+		return nil, fmt.Errorf("no certificate found in trusted CA")
+	}
+	return certs.Bytes(), nil
+}
+
+// installTrustedCA adds the PEM certificates to the trust store of rootfs.
+// The bundle of the store is created if it doesn't exist.
+// This returns the environment variables pointing to the trusted certificates.
+// This is no-op if ca is empty.
+func installTrustedCA(rootfs string, ca []byte) (env []string, _ error) {
+	if len(ca) == 0 {
+		return nil, nil
+	}
+	if !bytes.HasSuffix(ca, []byte("\n")) {
+		ca = append(ca, '\n')
+	}
+	s := detectTrustStore(rootfs)
+	bundle, err := fs.RootPath(rootfs, s.bundle)
+	if err != nil {
+		return nil, err
+	}
+	if err := appendFile(bundle, ca); err != nil {
+		return nil, err
+	}
+	anchor := filepath.Join(s.anchorDir, trustedCAName)
+	anchorPath, err := fs.RootPath(rootfs, anchor)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(anchorPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(anchorPath, ca, 0644); err != nil {
+		return nil, err
+	}
+	return []string{
+		"SSL_CERT_FILE=" + s.bundle,
+		"REQUESTS_CA_BUNDLE=" + s.bundle,
+		"NODE_EXTRA_CA_CERTS=" + anchor, // node.js uses its own CAs in addition to this
+	}, nil
+}
+
+// detectTrustStore returns the trust store layout of the distribution of rootfs.
+func detectTrustStore(rootfs string) trustStore {
+	for _, s := range trustStores {
+		if exists(rootfs, s.release) {
+			return s
+		}
+	}
+	for _, s := range trustStores {
+		if exists(rootfs, s.bundle) {
+			return s
+		}
+	}
+	return trustStores[0] // unknown distribution
+}
+
+func exists(rootfs, p string) bool {
+	hp, err := fs.RootPath(rootfs, p)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(hp)
+	return err == nil
+}
+
+func appendFile(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if cur, err := os.ReadFile(p); err == nil && len(cur) > 0 && !bytes.HasSuffix(cur, []byte("\n")) {
+		data = append([]byte("\n"), data...)
+	}
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA returns a self-signed CA certificate and its private key in PEM.
+func testCA(t *testing.T) (cert, key []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestDecodeTrustedCA(t *testing.T) {
+	cert, key := testCA(t)
+	cert2, _ := testCA(t)
+	for _, tt := range []struct {
+		name    string
+		input   string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+		},
+		{
+			name:  "certificates",
+			input: base64.StdEncoding.EncodeToString(append(append([]byte{}, cert...), cert2...)),
+			want:  append(append([]byte{}, cert...), cert2...),
+		},
+		{
+			name:  "private key is dropped",
+			input: base64.StdEncoding.EncodeToString(append(append([]byte("comment\n"), key...), cert...)),
+			want:  cert,
+		},
+		{
+			name:    "no certificate",
+			input:   base64.StdEncoding.EncodeToString(key),
+			wantErr: true,
+		},
+		{
+			name:    "invalid certificate",
+			input:   base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")})),
+			wantErr: true,
+		},
+		{
+			name:    "invalid base64",
+			input:   "!",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeTrustedCA(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("must be an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("unexpected certificates %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeRootfsFile(t *testing.T, rootfs, p, data string) {
+	hp := filepath.Join(rootfs, p)
+	if err := os.MkdirAll(filepath.Dir(hp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hp, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectTrustStore(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		files []string
+		want  trustStore
+	}{
+		{
+			name:  "debian",
+			files: []string{"/etc/debian_version"},
+			want:  trustStores[0],
+		},
+		{
+			name:  "alpine",
+			files: []string{"/etc/alpine-release"},
+			want:  trustStores[1],
+		},
+		{
+			name:  "rhel",
+			files: []string{"/etc/redhat-release"},
+			want:  trustStores[2],
+		},
+		{
+			name:  "unknown distribution with a bundle",
+			files: []string{"/etc/pki/tls/certs/ca-bundle.crt"},
+			want:  trustStores[2],
+		},
+		{
+			name: "unknown distribution",
+			want: trustStores[0],
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			for _, f := range tt.files {
+				writeRootfsFile(t, rootfs, f, "")
+			}
+			if got := detectTrustStore(rootfs); got != tt.want {
+				t.Fatalf("unexpected trust store %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallTrustedCA(t *testing.T) {
+	cert, _ := testCA(t)
+	for _, tt := range []struct {
+		name    string
+		release string
+		bundle  string // existing contents of the bundle
+		wantEnv []string
+		want    string // contents of the bundle after installing
+	}{
+		{
+			name:    "debian",
+			release: "/etc/debian_version",
+			bundle:  "existing\n",
+			wantEnv: []string{
+				"SSL_CERT_FILE=/etc/ssl/certs/ca-certificates.crt",
+				"REQUESTS_CA_BUNDLE=/etc/ssl/certs/ca-certificates.crt",
+				"NODE_EXTRA_CA_CERTS=/usr/local/share/ca-certificates/" + trustedCAName,
+			},
+			want: "existing\n" + string(cert),
+		},
+		{
+			name:    "rhel bundle without trailing newline",
+			release: "/etc/redhat-release",
+			bundle:  "existing",
+			wantEnv: []string{
+				"SSL_CERT_FILE=/etc/pki/tls/certs/ca-bundle.crt",
+				"REQUESTS_CA_BUNDLE=/etc/pki/tls/certs/ca-bundle.crt",
+				"NODE_EXTRA_CA_CERTS=/etc/pki/ca-trust/source/anchors/" + trustedCAName,
+			},
+			want: "existing\n" + string(cert),
+		},
+		{
+			name:    "no bundle",
+			release: "/etc/alpine-release",
+			wantEnv: []string{
+				"SSL_CERT_FILE=/etc/ssl/certs/ca-certificates.crt",
+				"REQUESTS_CA_BUNDLE=/etc/ssl/certs/ca-certificates.crt",
+				"NODE_EXTRA_CA_CERTS=/usr/local/share/ca-certificates/" + trustedCAName,
+			},
+			want: string(cert),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			writeRootfsFile(t, rootfs, tt.release, "")
+			bundle := strings.TrimPrefix(tt.wantEnv[0], "SSL_CERT_FILE=")
+			if tt.bundle != "" {
+				writeRootfsFile(t, rootfs, bundle, tt.bundle)
+			}
+			env, err := installTrustedCA(rootfs, bytes.TrimSuffix(cert, []byte("\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Fatalf("unexpected env %q; want %q", env, tt.wantEnv)
+			}
+			got, err := os.ReadFile(filepath.Join(rootfs, bundle))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("unexpected bundle %q; want %q", got, tt.want)
+			}
+			anchor, err := os.ReadFile(filepath.Join(rootfs, strings.TrimPrefix(tt.wantEnv[2], "NODE_EXTRA_CA_CERTS=")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(anchor, cert) {
+				t.Fatalf("unexpected anchor %q; want %q", anchor, cert)
+			}
+		})
+	}
+	env, err := installTrustedCA(t.TempDir(), nil)
+	if err != nil || env != nil {
+		t.Fatalf("empty CA must be no-op: %q, %v", env, err)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -37,6 +39,7 @@ func main() {
 }
 
 func doInit() error {
+	tl := newTimeline()
 	os.Setenv("PATH", "/bin:/sbin:/usr/bin:/usr/sbin:/usr/local/bin")
 	os.Setenv("HOME", "/root")
 	os.Setenv("TERM", "vt100")
@@ -49,6 +52,9 @@ func doInit() error {
 	if err := json.Unmarshal(cfgD, &cfg); err != nil {
 		return fmt.Errorf("cannot parse boot config: %w", err)
 	}
+	if !cfg.Trace {
+		tl = nil
+	}
 	scmd := exec.Command("stty", "-echo")
 	scmd.Stdin = os.Stdin
 	if err := scmd.Run(); err != nil {
@@ -73,9 +79,14 @@ func doInit() error {
 		}
 	}
 
-	if err := mountAll(cfg.Mounts); err != nil {
+	endMounts := tl.begin("mounts")
+	if err := mountAll(cfg.Mounts, tl); err != nil {
 		return err
 	}
+	endMounts()
+	if err := tl.loadKernelUptime(); err != nil {
+		log.Printf("failed to get kernel uptime: %v\n", err)
+	}
 
 	if os.Getenv("NO_RUNTIME_CONFIG") != "1" && os.Getenv("QEMU_MODE") != "1" {
 		// WASI-related filesystems
@@ -103,12 +114,14 @@ func doInit() error {
 	}
 	for _, cmd := range cfg.CmdPreRun {
 		log.Printf("executing(pre-run): %+v\n", cmd)
+		endPreRun := tl.begin("pre-run:" + cmd[0])
 		c := exec.Command(cmd[0], cmd[1:]...)
 		c.Stdout = log.Writer()
 		c.Stderr = log.Writer()
 		if err := c.Run(); err != nil {
 			return fmt.Errorf("failed to pre-run %v: %w", cmd, err)
 		}
+		endPreRun()
 	}
 
 	if cfg.Debug {
@@ -121,6 +134,7 @@ func doInit() error {
 	if os.Getenv("NO_RUNTIME_CONFIG") != "1" && os.Getenv("QEMU_MODE") != "1" {
 		// Wizer snapshot can be created by the host here
 		//////////////////////////////////////////////////////////////////////
+		endSnapshotWait := tl.begin("snapshot-wait")
 		fmt.Printf("==========") // special string not printed
 		var b [2]byte
 		var bPos int
@@ -139,6 +153,7 @@ func doInit() error {
 			}
 			bPos = 0
 		}
+		endSnapshotWait()
 		///////////////////////////////////////////////////////////////////////
 
 		infoD, err := os.ReadFile(filepath.Join("/mnt", packFSTag, "info"))
@@ -146,7 +161,10 @@ func doInit() error {
 			return err
 		}
 		log.Printf("INFO:\n%s\n", string(infoD))
-		info = parseInfo(infoD)
+		info, err = parseInfo(infoD)
+		if err != nil {
+			return err
+		}
 		//log.Printf("Running: %+v\n", s.Process.Args)
 	}
 
@@ -157,6 +175,7 @@ func doInit() error {
 		}
 		// QEMU snapshot can be created here
 		//////////////////////////////////////////////////////////////////////
+		endSnapshotWait := tl.begin("snapshot-wait")
 		fmt.Printf("==========") // special string not printed
 		for {
 			time.Sleep(time.Second) // expect a snapshot is taken
@@ -173,6 +192,7 @@ func doInit() error {
 				return fmt.Errorf("failed unmounting(pack) %q: %w", packFSTag, err)
 			}
 		}
+		endSnapshotWait()
 		///////////////////////////////////////////////////////////////////////
 
 		// WASI-related filesystems
@@ -193,30 +213,33 @@ func doInit() error {
 			return err
 		}
 		log.Printf("INFO:\n%s\n", string(infoD))
-		info = parseInfo(infoD)
+		info, err = parseInfo(infoD)
+		if err != nil {
+			return err
+		}
 	}
 
+	if !info.time.IsZero() {
+		tv := syscall.NsecToTimeval(info.time.UnixNano())
+		if err := syscall.Settimeofday(&tv); err != nil {
+			return fmt.Errorf("failed setting date to %v: %w", info.time, err)
+		}
+	}
 	if info.withNet {
-		if info.mac != "" {
-			if o, err := exec.Command("ip", "link", "set", "dev", "eth0", "down").CombinedOutput(); err != nil {
-				return fmt.Errorf("failed eth0 down: %v: %w", string(o), err)
+		endNet := tl.begin("net")
+		for _, d := range cfg.DNS {
+			if ip := net.ParseIP(d); ip != nil {
+				info.net.dns = append(info.net.dns, ip)
 			}
-			if o, err := exec.Command("ip", "link", "set", "dev", "eth0", "address", info.mac).CombinedOutput(); err != nil {
-				return fmt.Errorf("failed change mac address of eth0: %v: %w", string(o), err)
-			}
-		}
-		if o, err := exec.Command("ip", "link", "set", "dev", "eth0", "up").CombinedOutput(); err != nil {
-			return fmt.Errorf("failed eth0 up: %v: %w", string(o), err)
 		}
-		if o, err := exec.Command("udhcpc", "-i", "eth0").CombinedOutput(); err != nil {
-			return fmt.Errorf("failed udhcpc: %w", err)
-		} else if cfg.Debug {
-			o2, _ := exec.Command("ip", "a").CombinedOutput()
-			log.Printf("finished udhcpc: %s\n %s\n", string(o), string(o2))
+		info.net.search = append(info.net.search, cfg.DNSSearch...)
+		if err := setupNetwork(info.net); err != nil {
+			return fmt.Errorf("failed to configure network: %w", err)
 		}
+		endNet()
 	}
-	if o, err := exec.Command("ip", "link", "set", "dev", "lo", "up").CombinedOutput(); err != nil {
-		return fmt.Errorf("failed lo up: %v: %w", string(o), err)
+	if err := setupLoopback(); err != nil {
+		return err
 	}
 
 	if externalBundle {
@@ -236,6 +259,7 @@ func doInit() error {
 		bundle9pPath := "/run/9pbundle"
 		bundle9pSpecPath := filepath.Join(bundle9pPath, "config", "config.json")
 		bundle9pImageConfigPath := filepath.Join(bundle9pPath, "config", "imageconfig.json")
+		bundle9pManifestDigestPath := filepath.Join(bundle9pPath, "config", "manifest-digest")
 
 		if err := os.MkdirAll(bundle9pPath, os.FileMode(0755)); err != nil {
 			return fmt.Errorf("failed to create %q: %w", bundle9pPath, err)
@@ -273,11 +297,18 @@ func doInit() error {
 			return err
 		}
 		f.Close()
+		if d, err := os.ReadFile(bundle9pManifestDigestPath); err == nil {
+			log.Printf("image digest: %s\n", string(d))
+		} else {
+			log.Printf("failed to read image digest: %v\n", err) // older imagemounter doesn't provide the digest
+		}
 	}
 
-	if err := mountAll(cfg.PostMounts); err != nil {
+	endPostMounts := tl.begin("post-mounts")
+	if err := mountAll(cfg.PostMounts, tl); err != nil {
 		return err
 	}
+	endPostMounts()
 
 	s = patchSpec(s, info, imageConfig)
 	log.Printf("Running: %+v\n", s.Process.Args)
@@ -304,11 +335,17 @@ func doInit() error {
 		c.Stdout = os.Stdout
 		c.Stderr = os.Stderr
 		// TODO: signal?
-		if err := c.Run(); err != nil {
+		endRun := tl.begin("run:" + cmd[0])
+		err := c.Run()
+		endRun()
+		if err != nil {
 			lastErr = fmt.Errorf("failed to run %v: %w", cmd, err)
 			break
 		}
 	}
+	if err := tl.emit(); err != nil {
+		log.Printf("failed to emit timeline: %v\n", err)
+	}
 
 	if err := exec.Command("poweroff", "-f").Run(); err != nil {
 		return fmt.Errorf("failed running poweroff")
@@ -368,39 +405,154 @@ func mount(m inittype.MountInfo) error {
 	return nil
 }
 
-func mountAll(mounts []inittype.MountInfo) error {
+// mountAll performs the mounts according to their dependencies.
+// Non-async mounts are performed in the order of the slice. Async mounts
+// start as soon as the preceding non-async mount and their dependencies
+// (either listed in DependsOn or implied by a parent mount destination)
+// complete.
+func mountAll(mounts []inittype.MountInfo, tl *timeline) error {
 	if len(mounts) == 0 {
 		return nil
 	}
-	var wg sync.WaitGroup
-	for _, m := range mounts {
-		if m.Async {
-			m := m
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				if err := mount(m); err != nil {
-					if m.Optional {
-						log.Printf("failed optional mount %+v: %v", m, err)
-					} else {
-						panic(err)
-					}
+	deps, err := mountDeps(mounts)
+	if err != nil {
+		return err
+	}
+	type result struct {
+		done   chan struct{}
+		failed bool
+		err    error
+	}
+	results := make([]*result, len(mounts))
+	for i := range results {
+		results[i] = &result{done: make(chan struct{})}
+	}
+	for i, m := range mounts {
+		go func() {
+			r := results[i]
+			defer close(r.done)
+			for _, d := range deps[i] {
+				<-results[d].done
+				if results[d].failed {
+					log.Printf("skipping mount %s: dependency %s failed", mountName(m), mountName(mounts[d]))
+					r.failed = true
+					return
 				}
-			}()
-		} else {
+			}
+			start := time.Now()
+			endMount := tl.begin("mount:" + m.Dst)
+			defer endMount()
 			if err := mount(m); err != nil {
 				if m.Optional {
 					log.Printf("failed optional mount %+v: %v", m, err)
-				} else {
-					return err
+					return
 				}
+				r.failed, r.err = true, err
+				return
+			}
+			log.Printf("mounted %s in %v", mountName(m), time.Since(start))
+		}()
+	}
+	var errs []error
+	for _, r := range results {
+		<-r.done
+		if r.err != nil {
+			errs = append(errs, r.err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// appendDep adds the dependency d unless it's already listed.
+func appendDep(deps []int, d int) []int {
+	if slices.Contains(deps, d) {
+		return deps
+	}
+	return append(deps, d)
+}
+
+// mountDeps returns the indexes of the mounts that each mount depends on. Each index is listed once.
+func mountDeps(mounts []inittype.MountInfo) ([][]int, error) {
+	ids := make(map[string]int)
+	for i, m := range mounts {
+		if m.ID == "" {
+			continue
+		}
+		if _, ok := ids[m.ID]; ok {
+			return nil, fmt.Errorf("duplicated mount ID %q", m.ID)
+		}
+		ids[m.ID] = i
+	}
+	deps := make([][]int, len(mounts))
+	lastSync := -1
+	for i, m := range mounts {
+		if lastSync >= 0 {
+			deps[i] = append(deps[i], lastSync)
+		}
+		for _, id := range m.DependsOn {
+			d, ok := ids[id]
+			if !ok {
+				return nil, fmt.Errorf("mount %s depends on unknown mount %q", mountName(m), id)
+			}
+			if d == i {
+				return nil, fmt.Errorf("mount %s depends on itself", mountName(m))
+			}
+			deps[i] = appendDep(deps[i], d)
+		}
+		for j := i - 1; j >= 0; j-- {
+			if isUnder(m.Dst, mounts[j].Dst) {
+				deps[i] = appendDep(deps[i], j) // nearest parent mount
+				break
 			}
 		}
+		if !m.Async {
+			lastSync = i
+		}
+	}
+
+	// detect cycles of explicit dependencies
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(mounts))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("dependency cycle detected at mount %s", mountName(mounts[i]))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, d := range deps[i] {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
 	}
+	for i := range mounts {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
 
-	wg.Wait()
+// isUnder returns true if path p is the same as or placed under dir.
+func isUnder(p, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(p))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
 
-	return nil
+func mountName(m inittype.MountInfo) string {
+	if m.ID != "" {
+		return fmt.Sprintf("%q", m.ID)
+	}
+	return fmt.Sprintf("%q", m.Dst)
 }
 
 var (
@@ -415,11 +567,12 @@ type runtimeFlags struct {
 	args       []string
 
 	withNet bool
-	mac     string
+	net     netConfig
 	bundle  string
+	time    time.Time
 }
 
-func parseInfo(infoD []byte) (info runtimeFlags) {
+func parseInfo(infoD []byte) (info runtimeFlags, _ error) {
 	var options []string
 	lmchs := delimLines.FindAllIndex(infoD, -1)
 	prev := 0
@@ -470,13 +623,19 @@ func parseInfo(infoD []byte) (info runtimeFlags) {
 		case "env":
 			info.env = append(info.env, o)
 		case "n":
-			info.withNet = true // TODO: check mode (e.g. dhcp, ...)
-			info.mac = o
+			c, err := parseNetConfig(o)
+			if err != nil {
+				return info, err
+			}
+			info.withNet = true
+			info.net = c
 		case "t":
 			if o != "" {
-				if err := exec.Command("date", "+%s", "-s", "@"+o).Run(); err != nil {
-					log.Printf("failed setting date: %v", err) // TODO: return error
+				sec, err := strconv.ParseInt(o, 10, 64)
+				if err != nil {
+					return info, fmt.Errorf("invalid time %q (must be seconds since epoch): %w", o, err)
 				}
+				info.time = time.Unix(sec, 0)
 			}
 		case "b":
 			info.bundle = o
@@ -484,7 +643,7 @@ func parseInfo(infoD []byte) (info runtimeFlags) {
 			log.Printf("unsupported prefix: %q", inst)
 		}
 	}
-	return
+	return info, nil
 }
 
 func patchSpec(s runtimespec.Spec, info runtimeFlags, imageConfig imagespec.Image) runtimespec.Spec {
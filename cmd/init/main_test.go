@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	inittype "github.com/ktock/container2wasm/cmd/init/types"
+)
+
+func TestMountDeps(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		mounts []inittype.MountInfo
+		want   [][]int
+	}{
+		{
+			name: "sync mounts are ordered",
+			mounts: []inittype.MountInfo{
+				{Dst: "/proc"},
+				{Dst: "/run"},
+				{Dst: "/tmp"},
+			},
+			want: [][]int{nil, {0}, {1}},
+		},
+		{
+			name: "async mount waits for the preceding sync mount and its dependencies",
+			mounts: []inittype.MountInfo{
+				{ID: "proc", Dst: "/proc"},
+				{Dst: "/run"},
+				{ID: "binfmt_misc", DependsOn: []string{"proc"}, Dst: "/proc/sys/fs/binfmt_misc", Async: true},
+				{Dst: "/tmp"},
+			},
+			want: [][]int{nil, {0}, {1, 0}, {1}},
+		},
+		{
+			name: "nested mount depends on the nearest parent mount",
+			mounts: []inittype.MountInfo{
+				{Dst: "/run", Async: true},
+				{Dst: "/run/bundle", Async: true},
+				{Dst: "/run/bundle/rootfs", Async: true},
+				{Dst: "/runx", Async: true},
+			},
+			want: [][]int{nil, {0}, {1}, nil},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mountDeps(tt.mounts)
+			if err != nil {
+				t.Fatalf("failed to resolve dependencies: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected dependencies %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMountDepsError(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		mounts []inittype.MountInfo
+		want   string
+	}{
+		{
+			name: "missing dependency",
+			mounts: []inittype.MountInfo{
+				{ID: "a", Dst: "/a"},
+				{ID: "b", DependsOn: []string{"c"}, Dst: "/b", Async: true},
+			},
+			want: `depends on unknown mount "c"`,
+		},
+		{
+			name: "self dependency",
+			mounts: []inittype.MountInfo{
+				{ID: "a", DependsOn: []string{"a"}, Dst: "/a", Async: true},
+			},
+			want: "depends on itself",
+		},
+		{
+			name: "duplicated ID",
+			mounts: []inittype.MountInfo{
+				{ID: "a", Dst: "/a"},
+				{ID: "a", Dst: "/b"},
+			},
+			want: `duplicated mount ID "a"`,
+		},
+		{
+			name: "cycle of async mounts",
+			mounts: []inittype.MountInfo{
+				{ID: "a", DependsOn: []string{"c"}, Dst: "/a", Async: true},
+				{ID: "b", DependsOn: []string{"a"}, Dst: "/b", Async: true},
+				{ID: "c", DependsOn: []string{"b"}, Dst: "/c", Async: true},
+			},
+			want: "dependency cycle detected",
+		},
+		{
+			name: "sync mount depending on a later mount",
+			mounts: []inittype.MountInfo{
+				{ID: "a", DependsOn: []string{"b"}, Dst: "/a"},
+				{ID: "b", Dst: "/b"},
+			},
+			want: "dependency cycle detected",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mountDeps(tt.mounts)
+			if err == nil {
+				t.Fatalf("dependencies must be an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("unexpected error %q; want %q", err, tt.want)
+			}
+		})
+	}
+}
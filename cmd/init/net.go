@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// netIface is the network interface of the VM connected to the host's network stack.
+	netIface = "eth0"
+
+	// dhcpTimeout is the timeout of the first DHCP attempt. nclient4 doubles it on each of the following
+	// attempts (2s, 4s, 8s, 16s).
+	dhcpTimeout = 2 * time.Second
+	// dhcpRetry is the number of DHCP attempts (nclient4.WithRetry counts the attempts, not the retries).
+	dhcpRetry = 4
+
+	// slaacTimeout is the max duration to wait for the kernel to configure IPv6 address using router
+	// advertisements (router solicitation delay and duplicate address detection take about 2s).
+	slaacTimeout = 5 * time.Second
+)
+
+// netConfig is the configuration of the network interface.
+// IPv4 address is configured using DHCP if addrs doesn't contain IPv4 address.
+// IPv6 addresses can also be configured by the kernel using router advertisements.
+type netConfig struct {
+	mac      net.HardwareAddr
+	addrs    []*net.IPNet
+	gateways []net.IP
+	dns      []net.IP
+	search   []string
+	hosts    []hostEntry
+}
+
+type hostEntry struct {
+	name string
+	ip   net.IP
+}
+
+// parseNetConfig parses the value of "n:" runtime flag.
+// The format is "[MAC] [ip=ADDR/PREFIX]... [gw=ADDR]... [dns=ADDR]... [search=DOMAIN]... [host=NAME:ADDR]...".
+// Both of IPv4 and IPv6 addresses are allowed.
+func parseNetConfig(o string) (c netConfig, _ error) {
+	for _, f := range strings.Fields(o) {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			mac, err := net.ParseMAC(f)
+			if err != nil {
+				return c, fmt.Errorf("invalid MAC address %q in network config: %w", f, err)
+			}
+			c.mac = mac
+			continue
+		}
+		switch k {
+		case "ip":
+			ip, ipnet, err := net.ParseCIDR(v)
+			if err != nil {
+				return c, fmt.Errorf("invalid address %q in network config (must be ADDR/PREFIX e.g. 192.168.127.3/24 or fd00::3/64): %w", v, err)
+			}
+			ipnet.IP = ip
+			c.addrs = append(c.addrs, ipnet)
+		case "gw":
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return c, fmt.Errorf("invalid gateway address %q in network config", v)
+			}
+			c.gateways = append(c.gateways, ip)
+		case "dns":
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return c, fmt.Errorf("invalid DNS server address %q in network config", v)
+			}
+			c.dns = append(c.dns, ip)
+		case "search":
+			c.search = append(c.search, v)
+		case "host":
+			// IPv6 address contains ":" so split at the first one
+			name, addr, _ := strings.Cut(v, ":")
+			ip := net.ParseIP(addr)
+			if name == "" || ip == nil {
+				return c, fmt.Errorf("invalid host mapping %q in network config (must be NAME:ADDR)", v)
+			}
+			c.hosts = append(c.hosts, hostEntry{name, ip})
+		default:
+			return c, fmt.Errorf("unknown network config %q (must be one of ip, gw, dns, search or host)", k)
+		}
+	}
+	for _, gw := range c.gateways {
+		if gw.To4() == nil && !hasIP(addrIPs(c.addrs), false) {
+			return c, fmt.Errorf("IPv6 gateway %v is specified without IPv6 addresses; specify ip=ADDR/PREFIX as well", gw)
+		}
+	}
+	return c, nil
+}
+
+// setupLoopback brings up the loopback interface.
+func setupLoopback() error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("cannot find loopback interface: %w", err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("failed to bring up loopback interface: %w", err)
+	}
+	return nil
+}
+
+// setupNetwork configures the network interface connected to the host's network stack.
+func setupNetwork(c netConfig) error {
+	link, err := netlink.LinkByName(netIface)
+	if err != nil {
+		return fmt.Errorf("cannot find network interface %q; make sure the emulator is started with networking enabled (e.g. --net flag): %w", netIface, err)
+	}
+	if c.mac != nil {
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to bring down %q: %w", netIface, err)
+		}
+		if err := netlink.LinkSetHardwareAddr(link, c.mac); err != nil {
+			return fmt.Errorf("failed to set MAC address %v to %q: %w", c.mac, netIface, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %q: %w", netIface, err)
+	}
+	if !hasIP(addrIPs(c.addrs), true) {
+		lc, err := dhcp(netIface)
+		if err != nil {
+			return err
+		}
+		c.addrs = append(lc.addrs, c.addrs...)
+		if !hasIP(c.gateways, true) {
+			c.gateways = append(lc.gateways, c.gateways...)
+		}
+		c.dns = append(c.dns, lc.dns...)
+		c.search = append(c.search, lc.search...)
+	}
+	for _, a := range c.addrs {
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: a}); err != nil {
+			return fmt.Errorf("failed to assign address %v to %q: %w", a, netIface, err)
+		}
+		log.Printf("assigned %v to %q\n", a, netIface)
+	}
+	for _, gw := range c.gateways {
+		if err := netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: gw}); err != nil {
+			return fmt.Errorf("failed to add default route via %v; make sure the gateway is reachable from the assigned addresses: %w", gw, err)
+		}
+		log.Printf("added default route via %v\n", gw)
+	}
+	if !hasIP(addrIPs(c.addrs), false) {
+		waitSLAAC(link)
+	}
+	if len(c.dns) > 0 || len(c.search) > 0 {
+		if err := writeResolvConf("/etc/resolv.conf", c.dns, c.search); err != nil {
+			return err
+		}
+	}
+	if len(c.hosts) > 0 {
+		if err := appendHosts("/etc/hosts", c.hosts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitSLAAC waits for the kernel to configure the global IPv6 address of the link using the router
+// advertisements. The network works without IPv6 if it isn't configured until slaacTimeout.
+func waitSLAAC(link netlink.Link) {
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil || len(addrs) == 0 {
+			// The kernel doesn't support IPv6 (no link-local address is configured).
+			return
+		}
+		for _, a := range addrs {
+			if a.Scope == syscall.RT_SCOPE_UNIVERSE && a.Flags&syscall.IFA_F_TENTATIVE == 0 {
+				log.Printf("IPv6 address %v is configured on %q\n", a.IPNet, netIface)
+				return
+			}
+		}
+		if time.Since(start) > slaacTimeout {
+			log.Printf("no IPv6 router advertisement on %q; IPv6 is unavailable\n", netIface)
+			return
+		}
+	}
+}
+
+// dhcp acquires the configuration of the interface using DHCP.
+func dhcp(iface string) (c netConfig, _ error) {
+	client, err := nclient4.New(iface, nclient4.WithTimeout(dhcpTimeout), nclient4.WithRetry(dhcpRetry))
+	if err != nil {
+		return c, fmt.Errorf("failed to create DHCP client on %q: %w", iface, err)
+	}
+	defer client.Close()
+	lease, err := client.Request(context.Background())
+	if errors.Is(err, nclient4.ErrNoResponse) {
+		return c, fmt.Errorf("no DHCP response on %q after %d attempts; make sure the network stack (e.g. c2w-net) is running and connected to the emulator: %w", iface, dhcpRetry, err)
+	} else if err != nil {
+		return c, fmt.Errorf("DHCP on %q failed: %w", iface, err)
+	}
+	ack := lease.ACK
+	mask := ack.SubnetMask()
+	if mask == nil {
+		mask = ack.YourIPAddr.DefaultMask()
+	}
+	c.addrs = []*net.IPNet{{IP: ack.YourIPAddr, Mask: mask}}
+	if r := ack.Router(); len(r) > 0 {
+		c.gateways = []net.IP{r[0]}
+	}
+	c.dns = ack.DNS()
+	if l := ack.DomainSearch(); l != nil {
+		c.search = l.Labels
+	} else if d := ack.DomainName(); d != "" {
+		c.search = []string{d}
+	}
+	log.Printf("DHCP lease acquired: %s\n", ack.Summary())
+	return c, nil
+}
+
+func appendHosts(p string, hosts []hostEntry) error {
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", p, err)
+	}
+	defer f.Close()
+	for _, h := range hosts {
+		if _, err := fmt.Fprintf(f, "%s\t%s\n", h.ip, h.name); err != nil {
+			return fmt.Errorf("failed to write to %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func writeResolvConf(p string, dns []net.IP, search []string) error {
+	var b strings.Builder
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	for _, d := range dns {
+		fmt.Fprintf(&b, "nameserver %s\n", d)
+	}
+	if err := os.WriteFile(p, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %q: %w", p, err)
+	}
+	return nil
+}
+
+// hasIP returns true if ips contain an IPv4 (v4 == true) or IPv6 (v4 == false) address.
+func hasIP(ips []net.IP, v4 bool) bool {
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIPs(addrs []*net.IPNet) (ips []net.IP) {
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips
+}
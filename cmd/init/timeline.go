@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	inittype "github.com/ktock/container2wasm/cmd/init/types"
+)
+
+// timeline records boot phases. A nil timeline records nothing.
+type timeline struct {
+	mu     sync.Mutex
+	origin time.Time     // start of init; used as the monotonic clock
+	base   time.Duration // uptime of the kernel when init started
+	phases []inittype.Phase
+}
+
+func newTimeline() *timeline {
+	return &timeline{origin: time.Now()}
+}
+
+// begin starts a phase and returns the function to end it.
+func (t *timeline) begin(name string) (end func()) {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Since(t.origin)
+	return func() {
+		end := time.Since(t.origin)
+		t.mu.Lock()
+		t.phases = append(t.phases, inittype.Phase{Name: name, Start: start, End: end})
+		t.mu.Unlock()
+	}
+}
+
+// loadKernelUptime records the time spent before init started, using /proc/uptime.
+// procfs must be mounted.
+func (t *timeline) loadKernelUptime() error {
+	if t == nil {
+		return nil
+	}
+	d, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return err
+	}
+	f := strings.Fields(string(d))
+	if len(f) == 0 {
+		return fmt.Errorf("unexpected /proc/uptime %q", string(d))
+	}
+	uptime, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.base = time.Duration(uptime*float64(time.Second)) - time.Since(t.origin)
+	if t.base < 0 {
+		t.base = 0
+	}
+	t.mu.Unlock()
+	return nil
+}
+
+// emit prints the timeline to stderr (the console) as a single line prefixed by inittype.TimelineMarker
+// so that it isn't mixed into the stdout of the container.
+func (t *timeline) emit() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	tl := inittype.Timeline{
+		Phases: []inittype.Phase{{Name: "kernel", End: t.base}},
+	}
+	for _, p := range t.phases {
+		tl.Phases = append(tl.Phases, inittype.Phase{Name: p.Name, Start: t.base + p.Start, End: t.base + p.End})
+	}
+	t.mu.Unlock()
+	d, err := json.Marshal(tl)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(os.Stderr, "\n%s%s\n", inittype.TimelineMarker, string(d))
+	return err
+}
@@ -1,5 +1,11 @@
 package init
 
+import "time"
+
+// TimelineMarker prefixes the line on the console that carries the boot timeline
+// emitted by init in JSON.
+const TimelineMarker = "c2w-timeline:"
+
 type BootConfig struct {
 	Mounts     []MountInfo   `json:"mounts"`
 	CmdPreRun  [][]string    `json:"cmd_pre_run,omitempty"`
@@ -8,6 +14,12 @@ type BootConfig struct {
 	DebugInit  bool          `json:"debug_init,omitempty"`
 	Container  ContainerInfo `json:"container"`
 	PostMounts []MountInfo   `json:"post_mounts"`
+	Trace      bool          `json:"trace,omitempty"`
+
+	// DNS is the list of DNS servers prior to the ones provided by DHCP.
+	DNS []string `json:"dns,omitempty"`
+	// DNSSearch is the list of DNS search domains.
+	DNSSearch []string `json:"dns_search,omitempty"`
 }
 
 type ContainerInfo struct {
@@ -19,6 +31,13 @@ type ContainerInfo struct {
 }
 
 type MountInfo struct {
+	// ID identifies this mount so that other mounts can depend on it.
+	ID string `json:"id,omitempty"`
+	// DependsOn lists IDs of mounts that must complete before this mount.
+	// Mounts nested under the destination of an earlier mount implicitly
+	// depend on it.
+	DependsOn []string `json:"depends_on,omitempty"`
+
 	FSType   string     `json:"fstype,omitempty"`
 	Src      string     `json:"src"`
 	Dst      string     `json:"dst"`
@@ -43,3 +62,15 @@ type FileInfo struct {
 	Mode     uint32 `json:"mode"`
 	Contents string `json:"contents,omitempty"`
 }
+
+// Timeline is the boot timeline recorded by init.
+type Timeline struct {
+	Phases []Phase `json:"phases"`
+}
+
+// Phase is a boot phase. Start and End are monotonic durations since the kernel boot.
+type Phase struct {
+	Name  string        `json:"name"`
+	Start time.Duration `json:"start"`
+	End   time.Duration `json:"end"`
+}
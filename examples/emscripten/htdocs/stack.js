@@ -364,6 +364,100 @@ function connect(name, shared, toNet, certbuf) {
             return false;
         }
     }
+    var httpEvents = []; // IDs of the requests that have a response or body to read
+    function notifyHTTPEvent(id) {
+        if (!httpEvents.includes(id)) {
+            httpEvents.push(id);
+        }
+        if (timeoutHandler) {
+            // complete the pending "recv-is-readable" request
+            clearTimeout(timeoutHandler);
+            timeoutHandler = null;
+            Atomics.store(toNetNotify, 0, 2); // http events are available
+            Atomics.notify(toNetNotify, 0);
+        }
+    }
+    function respHeaderList(resp) {
+        var list = [];
+        var encoded = resp.headers.has("content-encoding");
+        for (const [key, value] of resp.headers) {
+            if (encoded && ((key == "content-encoding") || (key == "content-length"))) {
+                continue; // the body is decoded by the browser
+            }
+            list.push([key, value]);
+        }
+        return list;
+    }
+    function readRespBody(id) {
+        var connObj = httpConnections[id];
+        if ((connObj == undefined) || connObj.reading || connObj.done) {
+            return;
+        }
+        if (connObj.respBodybuf.byteLength >= maxRespBodybufSize) {
+            return; // resumed by http_readbody
+        }
+        connObj.reading = true;
+        connObj.bodyReader.read().then(({done, value}) => {
+            connObj.reading = false;
+            if (done) {
+                connObj.done = true;
+            } else {
+                connObj.respBodybuf = appendData(connObj.respBodybuf, value);
+            }
+            notifyHTTPEvent(id);
+            readRespBody(id);
+        }).catch((error) => {
+            connObj.reading = false;
+            connObj.done = true;
+            console.log("failed to fetch body: " + error);
+            notifyHTTPEvent(id);
+        });
+    }
+    function startFetch(id) {
+        var connObj = httpConnections[id];
+        connObj.requestSent = true;
+        fetch(connObj.address, connObj.request).then((resp) => {
+            var headerList = respHeaderList(resp);
+            connObj.response = new TextEncoder().encode(JSON.stringify({
+                bodyUsed: resp.bodyUsed,
+                headers: Object.fromEntries(headerList),
+                headerList: headerList,
+                redirected: resp.redirected,
+                status: resp.status,
+                statusText: resp.statusText,
+                type: resp.type,
+                url: resp.url
+            }));
+            connObj.done = false;
+            connObj.respBodybuf = new Uint8Array(0);
+            if (resp.body == null) {
+                connObj.done = true;
+            } else {
+                connObj.bodyReader = resp.body.getReader();
+                readRespBody(id);
+            }
+            notifyHTTPEvent(id);
+        }).catch((error) => {
+            if (connObj.reqBodyController && !connObj.response && (connObj.reqBodybuf != null)) {
+                // Streaming request body can fail (e.g. on HTTP/1.1). Retry with the buffered body.
+                connObj.reqBodyController = null;
+                connObj.request.duplex = undefined;
+                connObj.requestSent = false;
+                if (connObj.reqBodyEOF) {
+                    connObj.request.body = connObj.reqBodybuf;
+                    startFetch(id);
+                }
+                return;
+            }
+            connObj.response = new TextEncoder().encode(JSON.stringify({
+                status: 503,
+                statusText: "Service Unavailable",
+            }))
+            connObj.respBodybuf = new Uint8Array(0);
+            connObj.done = true;
+            notifyHTTPEvent(id);
+        });
+    }
     return function(msg){
         const req_ = msg.data;
         if (typeof req_ == "object" && req_.type) {
@@ -379,6 +473,10 @@ function connect(name, shared, toNet, certbuf) {
                         streamStatus[0] = 1; // ready for reading
                         Atomics.store(toNetNotify, 0, 1);
                         Atomics.notify(toNetNotify, 0);
+                    } else if (httpEvents.length > 0) {
+                        streamStatus[0] = 0;
+                        Atomics.store(toNetNotify, 0, 2); // http events are available
+                        Atomics.notify(toNetNotify, 0);
                     } else {
                         if ((req_.timeout != undefined) && (req_.timeout > 0)) {
                             if (timeoutHandler) {
@@ -415,6 +513,17 @@ function connect(name, shared, toNet, certbuf) {
                 case "notify-send-from-net":
                     sockRecvWS(req_.len);
                     break;
+                case "http_events":
+                    var n = Math.min(httpEvents.length, Math.floor(Math.min(req_.len, streamData.byteLength) / 4));
+                    var ids = new DataView(new ArrayBuffer(n * 4));
+                    for (var i = 0; i < n; i++) {
+                        ids.setUint32(i * 4, httpEvents[i], true);
+                    }
+                    httpEvents = httpEvents.slice(n);
+                    streamData.set(new Uint8Array(ids.buffer), 0);
+                    streamLen[0] = n * 4;
+                    streamStatus[0] = 0;
+                    break;
                 case "http_send":
                     var reqObj = JSON.parse(new TextDecoder().decode(req_.req));
                     reqObj.mode = "cors";
@@ -422,6 +531,11 @@ function connect(name, shared, toNet, certbuf) {
                     if (reqObj.headers && reqObj.headers["User-Agent"] != "") {
                         delete reqObj.headers["User-Agent"]; // Browser will add its own value.
                     }
+                    if (reqObj.headerList) {
+                        // headerList preserves multiple values of a field so prefer it to headers.
+                        reqObj.headers = reqObj.headerList.filter(([key, value]) => key.toLowerCase() != "user-agent");
+                        delete reqObj.headerList;
+                    }
                     var reqID = getID();
                     if (reqID < 0) {
                         console.log(name + ":" + "failed to get id");
@@ -440,95 +554,56 @@ function connect(name, shared, toNet, certbuf) {
                         respBodybuf: null,
                     };
                     httpConnections[reqID] = connObj;
+                    if (supportsRequestStreams && (reqObj.method != "HEAD") && (reqObj.method != "GET")) {
+                        // Stream the request body. The body is also buffered (up to maxRetryReqBodySize)
+                        // to retry without streaming if the server doesn't support it.
+                        reqObj.body = new ReadableStream({
+                            start(controller) {
+                                connObj.reqBodyController = controller;
+                            }
+                        });
+                        reqObj.duplex = "half";
+                        startFetch(reqID);
+                    }
                     streamStatus[0] = reqID;
                     break;
                 case "http_writebody":
-                    var s;
                     if (httpConnections[req_.id] == undefined) {
-                        s = newUint8Array(0);
-                    } else {
-                        s = httpConnections[req_.id].reqBodybuf;
+                        console.log(name + ":" + "request is not available");
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    var connObj = httpConnections[req_.id];
+                    if (connObj.reqBodyController) {
+                        try {
+                            if (req_.body.byteLength > 0) {
+                                connObj.reqBodyController.enqueue(new Uint8Array(req_.body));
+                            }
+                            if (req_.isEOF) {
+                                connObj.reqBodyController.close();
+                            }
+                        } catch (error) {
+                            console.log("failed to stream request body: " + error); // the request has been finished
+                        }
+                    }
+                    if (connObj.reqBodybuf != null) {
+                        connObj.reqBodybuf = appendData(connObj.reqBodybuf, req_.body);
+                        if (connObj.reqBodyController && (connObj.reqBodybuf.byteLength > maxRetryReqBodySize)) {
+                            connObj.reqBodybuf = null; // too large to retry
+                        }
                     }
-                    httpConnections[req_.id].reqBodybuf = appendData(s, req_.body)
-                    httpConnections[req_.id].reqBodyEOF = req_.isEOF;
+                    connObj.reqBodyEOF = req_.isEOF;
                     streamStatus[0] = 0;
-                    if (req_.isEOF && !httpConnections[req_.id].requestSent) {
-                        httpConnections[req_.id].requestSent = true;
-                        var connObj = httpConnections[req_.id];
+                    if (req_.isEOF && !connObj.requestSent) {
+                        if (connObj.reqBodybuf == null) {
+                            console.log(name + ":" + "request body is too large to retry");
+                            streamStatus[0] = -1;
+                            break;
+                        }
                         if ((connObj.request.method != "HEAD") && (connObj.request.method != "GET")) {
                             connObj.request.body = connObj.reqBodybuf;
                         }
-                        fetch(connObj.address, connObj.request).then((resp) => {
-                            connObj.done = false;
-                            connObj.respBodybuf = new Uint8Array(0);
-                            if (resp.ok) {
-                                resp.arrayBuffer().then((data) => {
-                                    var headers = {};
-                                    for (const key of resp.headers.keys()) {
-                                        if (data.byteLength > 0) {
-                                            if (key == "content-encoding") {
-                                                continue;
-                                            }
-                                            if (key == "content-length") {
-                                                headers[key] = data.byteLength.toString();
-                                                continue;
-                                            }
-                                        }
-                                        headers[key] = resp.headers.get(key);
-                                    }
-                                    connObj.response = new TextEncoder().encode(JSON.stringify({
-                                        bodyUsed: resp.bodyUsed,
-                                        headers: headers,
-                                        redirected: resp.redirected,
-                                        status: resp.status,
-                                        statusText: resp.statusText,
-                                        type: resp.type,
-                                        url: resp.url
-                                    }));
-                                    connObj.respBodybuf = new Uint8Array(data);
-                                    connObj.done = true;
-                                }).catch((error) => {
-                                    var headers = {};
-                                    for (const key of resp.headers.keys()) {
-                                        headers[key] = resp.headers.get(key);
-                                    }
-                                    connObj.response = new TextEncoder().encode(JSON.stringify({
-                                        bodyUsed: resp.bodyUsed,
-                                        headers: headers,
-                                        redirected: resp.redirected,
-                                        status: resp.status,
-                                        statusText: resp.statusText,
-                                        type: resp.type,
-                                        url: resp.url
-                                    }));
-                                    connObj.respBodybuf = new Uint8Array(0);
-                                    connObj.done = true;
-                                    console.log("failed to fetch body: " + error);
-                                });
-                            } else {
-                                var headers = {};
-                                for (const key of resp.headers.keys()) {
-                                    headers[key] = resp.headers.get(key);
-                                }
-                                connObj.response = new TextEncoder().encode(JSON.stringify({
-                                    bodyUsed: resp.bodyUsed,
-                                    headers: headers,
-                                    redirected: resp.redirected,
-                                    status: resp.status,
-                                    statusText: resp.statusText,
-                                    type: resp.type,
-                                    url: resp.url
-                                }));
-                                connObj.done = true;
-                            }
-                        }).catch((error) => {
-                            connObj.response = new TextEncoder().encode(JSON.stringify({
-                                status: 503,
-                                statusText: "Service Unavailable",
-                            }))
-                            connObj.respBodybuf = new Uint8Array(0);
-                            connObj.done = true;
-                        });
+                        startFetch(req_.id);
                     }
                     break;
                 case "http_isreadable":
@@ -562,6 +637,8 @@ function connect(name, shared, toNet, certbuf) {
                     if ((httpConnections[req_.id].done) && (httpConnections[req_.id].respBodybuf.byteLength == 0)) {
                         streamStatus[0] = 1;
                         delete httpConnections[req_.id]; // connection done
+                    } else {
+                        readRespBody(req_.id);
                     }
                     break;
                 case "send_cert":
@@ -581,6 +658,27 @@ function connect(name, shared, toNet, certbuf) {
     }
 }
 
+// maxRespBodybufSize is the size of the response body buffered before the stack reads it.
+const maxRespBodybufSize = 16 * 1024 * 1024;
+
+// maxRetryReqBodySize is the max size of the streamed request body buffered for retrying without streaming.
+const maxRetryReqBodySize = 16 * 1024 * 1024;
+
+// supportsRequestStreams is true if the browser supports streaming request bodies.
+// https://developer.chrome.com/docs/capabilities/web-apis/fetch-streaming-requests
+const supportsRequestStreams = (() => {
+    let duplexAccessed = false;
+    const hasContentType = new Request(location.origin, {
+        body: new ReadableStream(),
+        method: 'POST',
+        get duplex() {
+            duplexAccessed = true;
+            return 'half';
+        },
+    }).headers.has('Content-Type');
+    return duplexAccessed && !hasContentType;
+})();
+
 var decompressID = 0;
 var decompressors = {};
 
@@ -12,14 +12,16 @@ onmessage = (msg) => {
         undefined, // 3: receive certificates
         undefined, // 4: socket listenfd
         undefined, // 5: accepted socket fd (multi-connection is unsupported)
-        // 6...: used by wasi shim
+        undefined, // 6: notification of http events
+        // 7...: used by wasi shim
     ];
     var certfd = 3;
     var listenfd = 4;
-    var args = ['arg0', '--certfd='+certfd, '--net-listenfd='+listenfd, '--debug'];
+    var httpeventfd = 6;
+    var args = ['arg0', '--certfd='+certfd, '--net-listenfd='+listenfd, '--http-eventfd='+httpeventfd, '--debug'];
     var env = [];
     var wasi = new WASI(args, env, fds);
-    wasiHack(wasi, certfd, 5);
+    wasiHack(wasi, certfd, 5, httpeventfd);
     wasiHackSocket(wasi, listenfd, 5);
     fetch(getImagename(), { credentials: 'same-origin' }).then((resp) => {
         resp['arrayBuffer']().then((wasm) => {
@@ -37,7 +39,10 @@ onmessage = (msg) => {
 const ERRNO_INVAL = 28;
 const ERRNO_AGAIN= 6;
 
-function wasiHack(wasi, certfd, connfd) {
+// version of the host ABI implemented by envHack (see docs/host-abi.md in container2wasm repo)
+const ABI_VERSION = 1;
+
+function wasiHack(wasi, certfd, connfd, httpeventfd) {
     var certbuf = new Uint8Array(0);
     var _fd_close = wasi.wasiImport.fd_close;
     wasi.wasiImport.fd_close = (fd) => {
@@ -52,8 +57,43 @@ function wasiHack(wasi, certfd, connfd) {
         if (fd == certfd) {
             return 0;
         }
+        if (fd == httpeventfd) {
+            let buffer = new DataView(wasi.inst.exports.memory.buffer);
+            // https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#-fdstat-struct
+            buffer.setUint8(fdstat_ptr, 2); // filetype = 2 (character_device)
+            buffer.setUint16(fdstat_ptr + 2, 4, true); // fdflags = 4 (nonblock)
+            return 0;
+        }
         return _fd_fdstat_get.apply(wasi.wasiImport, [fd, fdstat_ptr]);
     }
+    var _fd_read = wasi.wasiImport.fd_read;
+    wasi.wasiImport.fd_read = (fd, iovs_ptr, iovs_len, nread_ptr) => {
+        if (fd == httpeventfd) {
+            var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            var buffer8 = new Uint8Array(wasi.inst.exports.memory.buffer);
+            var iovecs = Iovec.read_bytes_array(buffer, iovs_ptr, iovs_len);
+            var nread = 0;
+            for (i = 0; i < iovecs.length; i++) {
+                var iovec = iovecs[i];
+                if (iovec.buf_len < 4) {
+                    continue;
+                }
+                var data = httpRecvEvents(iovec.buf_len);
+                if (data == errStatus) {
+                    return ERRNO_INVAL;
+                }
+                buffer8.set(data, iovec.buf);
+                nread = data.length;
+                break;
+            }
+            if (nread == 0) {
+                return ERRNO_AGAIN;
+            }
+            buffer.setUint32(nread_ptr, nread, true);
+            return 0;
+        }
+        return _fd_read.apply(wasi.wasiImport, [fd, iovs_ptr, iovs_len, nread_ptr]);
+    }
     wasi.wasiImport.fd_fdstat_set_flags = (fd, fdflags) => {
         // TODO
         return 0;
@@ -91,17 +131,22 @@ function wasiHack(wasi, certfd, connfd) {
         let in_ = Subscription.read_bytes_array(buffer, in_ptr, nsubscriptions);
         let isReadPollStdin = false;
         let isReadPollConn = false;
+        let isReadPollHTTPEvent = false;
         let isClockPoll = false;
         let pollSubStdin;
         let pollSubConn;
+        let pollSubHTTPEvent;
         let clockSub;
         let timeout = Number.MAX_VALUE;
         for (let sub of in_) {
             if (sub.u.tag.variant == "fd_read") {
-                if ((sub.u.data.fd != 0) && (sub.u.data.fd != connfd)) {
-                    return ERRNO_INVAL; // only fd=0 and connfd is supported as of now (FIXME)
+                if ((sub.u.data.fd != 0) && (sub.u.data.fd != connfd) && (sub.u.data.fd != httpeventfd)) {
+                    return ERRNO_INVAL; // only fd=0, connfd and httpeventfd are supported as of now (FIXME)
                 }
-                if (sub.u.data.fd == 0) {
+                if (sub.u.data.fd == httpeventfd) {
+                    isReadPollHTTPEvent = true;
+                    pollSubHTTPEvent = sub;
+                } else if (sub.u.data.fd == 0) {
                     isReadPollStdin = true;
                     pollSubStdin = sub;
                 } else {
@@ -119,8 +164,16 @@ function wasiHack(wasi, certfd, connfd) {
             }
         }
         let events = [];
-        if (isReadPollStdin || isReadPollConn || isClockPoll) {
+        if (isReadPollStdin || isReadPollConn || isReadPollHTTPEvent || isClockPoll) {
             var sockreadable = sockWaitForReadable(timeout / 1000000000);
+            if (isReadPollHTTPEvent && (sockreadable != errStatus) && (streamData[1] == 1)) {
+                // http events are available (set by "recv-is-readable")
+                let event = new Event();
+                event.userdata = pollSubHTTPEvent.userdata;
+                event.error = 0;
+                event.type = new EventType("fd_read");
+                events.push(event);
+            }
             if (isReadPollConn) {
                 if (sockreadable == errStatus) {
                     return ERRNO_INVAL;
@@ -147,8 +200,23 @@ function wasiHack(wasi, certfd, connfd) {
     }
 }
 
+function httpRecvEvents(len){
+    streamCtrl[0] = 0;
+    postMessage({type: "http_events", len: len});
+    Atomics.wait(streamCtrl, 0, 0);
+    if (streamStatus[0] < 0) {
+        errStatus.val = streamStatus[0]
+        return errStatus;
+    }
+    let ddlen = streamLen[0];
+    return streamData.slice(0, ddlen);
+}
+
 function envHack(wasi){
     return {
+        abi_version: function(){
+            return ABI_VERSION;
+        },
         http_send: function(addressP, addresslen, reqP, reqlen, idP){
             var buffer = new DataView(wasi.inst.exports.memory.buffer);
             var address = new Uint8Array(wasi.inst.exports.memory.buffer, addressP, addresslen);
@@ -54,6 +54,97 @@ function connect(name, shared, conn, certbuf) {
         }
         return curID;
     }
+    var httpEvents = []; // IDs of the requests that have a response or body to read
+    var notifyReadable = null; // completes the pending "recv-is-readable" request
+    function notifyHTTPEvent(id) {
+        if (!httpEvents.includes(id)) {
+            httpEvents.push(id);
+        }
+        if (notifyReadable) {
+            notifyReadable();
+        }
+    }
+    function readRespBody(id) {
+        var connObj = httpConnections[id];
+        if ((connObj == undefined) || connObj.reading || connObj.done) {
+            return;
+        }
+        if (connObj.respBodybuf.byteLength >= maxRespBodybufSize) {
+            return; // resumed by http_readbody
+        }
+        connObj.reading = true;
+        connObj.bodyReader.read().then(({done, value}) => {
+            connObj.reading = false;
+            if (done) {
+                connObj.done = true;
+            } else {
+                connObj.respBodybuf = appendData(connObj.respBodybuf, value);
+            }
+            notifyHTTPEvent(id);
+            readRespBody(id);
+        }).catch((error) => {
+            connObj.reading = false;
+            connObj.done = true;
+            console.log("failed to fetch body: " + error);
+            notifyHTTPEvent(id);
+        });
+    }
+    function respHeaderList(resp) {
+        var list = [];
+        var encoded = resp.headers.has("content-encoding");
+        for (const [key, value] of resp.headers) {
+            if (encoded && ((key == "content-encoding") || (key == "content-length"))) {
+                continue; // the body is decoded by the browser
+            }
+            list.push([key, value]);
+        }
+        return list;
+    }
+    function startFetch(id) {
+        var connObj = httpConnections[id];
+        connObj.requestSent = true;
+        fetch(connObj.address, connObj.request).then((resp) => {
+            var headerList = respHeaderList(resp);
+            connObj.response = new TextEncoder().encode(JSON.stringify({
+                bodyUsed: resp.bodyUsed,
+                headers: Object.fromEntries(headerList),
+                headerList: headerList,
+                redirected: resp.redirected,
+                status: resp.status,
+                statusText: resp.statusText,
+                type: resp.type,
+                url: resp.url
+            })),
+            connObj.done = false;
+            connObj.respBodybuf = new Uint8Array(0);
+            if (resp.body == null) {
+                connObj.done = true;
+            } else {
+                connObj.bodyReader = resp.body.getReader();
+                readRespBody(id);
+            }
+            notifyHTTPEvent(id);
+        }).catch((error) => {
+            if (connObj.reqBodyController && !connObj.response && (connObj.reqBodybuf != null)) {
+                // Streaming request body can fail (e.g. on HTTP/1.1). Retry with the buffered body.
+                connObj.reqBodyController = null;
+                connObj.request.duplex = undefined;
+                connObj.requestSent = false;
+                if (connObj.reqBodyEOF) {
+                    connObj.request.body = connObj.reqBodybuf;
+                    startFetch(id);
+                }
+                return;
+            }
+            connObj.response = new TextEncoder().encode(JSON.stringify({
+                status: 503,
+                statusText: "Service Unavailable",
+            }))
+            connObj.respBodybuf = new Uint8Array(0);
+            connObj.done = true;
+            notifyHTTPEvent(id);
+        });
+    }
     function serveData(data, len) {
         var length = len;
         if (length > streamData.byteLength)
@@ -95,34 +186,50 @@ function connect(name, shared, conn, certbuf) {
                 break;
             case "recv-is-readable":
                 var recvbufP = recvbuf.buf;
+                streamData[1] = (httpEvents.length > 0) ? 1 : 0; // http events are available
                 if (recvbufP.byteLength > 0) {
                     streamData[0] = 1; // ready for reading
                 } else {
-                    if ((req_.timeout != undefined) && (req_.timeout > 0)) {
+                    if ((req_.timeout != undefined) && (req_.timeout > 0) && (httpEvents.length == 0)) {
                         if (this.timeoutHandler) {
                             clearTimeout(this.timeoutHandler);
                             this.timeoutHandler = null;
                         }
-                        this.timeoutHandler = setTimeout(() => {
+                        var complete = () => {
                             if (this.timeoutHandler) {
                                 clearTimeout(this.timeoutHandler);
                                 this.timeoutHandler = null;
                             }
+                            notifyReadable = null;
                             if (recvbuf.buf.byteLength > 0) {
                                 streamData[0] = 1; // ready for reading
                             } else {
                                 streamData[0] = 0; // timeout
                             }
+                            streamData[1] = (httpEvents.length > 0) ? 1 : 0;
                             streamStatus[0] = 0;
                             Atomics.store(streamCtrl, 0, 1);
                             Atomics.notify(streamCtrl, 0);
-                        }, req_.timeout * 1000);
+                        };
+                        this.timeoutHandler = setTimeout(complete, req_.timeout * 1000);
+                        notifyReadable = complete; // http events complete the request immediately
                         return;
                     }
                     streamData[0] = 0; // timeout
                 }
                 streamStatus[0] = 0;
                 break;
+            case "http_events":
+                var n = Math.min(httpEvents.length, Math.floor(Math.min(req_.len, streamData.byteLength) / 4));
+                var ids = new DataView(new ArrayBuffer(n * 4));
+                for (var i = 0; i < n; i++) {
+                    ids.setUint32(i * 4, httpEvents[i], true);
+                }
+                httpEvents = httpEvents.slice(n);
+                streamData.set(new Uint8Array(ids.buffer), 0);
+                streamLen[0] = n * 4;
+                streamStatus[0] = 0;
+                break;
             case "http_send":
                 var reqObj = JSON.parse(new TextDecoder().decode(req_.req));
                 reqObj.mode = "cors";
@@ -130,6 +237,11 @@ function connect(name, shared, conn, certbuf) {
                 if (reqObj.headers && reqObj.headers["User-Agent"] != "") {
                     delete reqObj.headers["User-Agent"]; // Browser will add its own value.
                 }
+                if (reqObj.headerList) {
+                    // headerList preserves multiple values of a field so prefer it to headers.
+                    reqObj.headers = reqObj.headerList.filter(([key, value]) => key.toLowerCase() != "user-agent");
+                    delete reqObj.headerList;
+                }
                 var reqID = getID();
                 if (reqID < 0) {
                     console.log(name + ":" + "failed to get id");
@@ -144,50 +256,51 @@ function connect(name, shared, conn, certbuf) {
                     reqBodyEOF: false,
                 };
                 httpConnections[reqID] = connObj;
+                if (supportsRequestStreams && (reqObj.method != "HEAD") && (reqObj.method != "GET")) {
+                    // Stream the request body. The body is also buffered (up to maxRetryReqBodySize)
+                    // to retry without streaming if the server doesn't support it.
+                    reqObj.body = new ReadableStream({
+                        start(controller) {
+                            connObj.reqBodyController = controller;
+                        }
+                    });
+                    reqObj.duplex = "half";
+                    startFetch(reqID);
+                }
                 streamStatus[0] = reqID;
                 break;
             case "http_writebody":
-                httpConnections[req_.id].reqBodybuf = appendData(httpConnections[req_.id].reqBodybuf, req_.body)
-                httpConnections[req_.id].reqBodyEOF = req_.isEOF;
+                var connObj = httpConnections[req_.id];
+                if (connObj.reqBodyController) {
+                    try {
+                        if (req_.body.byteLength > 0) {
+                            connObj.reqBodyController.enqueue(new Uint8Array(req_.body));
+                        }
+                        if (req_.isEOF) {
+                            connObj.reqBodyController.close();
+                        }
+                    } catch (error) {
+                        console.log("failed to stream request body: " + error); // the request has been finished
+                    }
+                }
+                if (connObj.reqBodybuf != null) {
+                    connObj.reqBodybuf = appendData(connObj.reqBodybuf, req_.body);
+                    if (connObj.reqBodyController && (connObj.reqBodybuf.byteLength > maxRetryReqBodySize)) {
+                        connObj.reqBodybuf = null; // too large to retry
+                    }
+                }
+                connObj.reqBodyEOF = req_.isEOF;
                 streamStatus[0] = 0;
-                if (req_.isEOF && !httpConnections[req_.id].requestSent) {
-                    httpConnections[req_.id].requestSent = true;
-                    var connObj = httpConnections[req_.id];
+                if (req_.isEOF && !connObj.requestSent) {
+                    if (connObj.reqBodybuf == null) {
+                        console.log(name + ":" + "request body is too large to retry");
+                        streamStatus[0] = -1;
+                        break;
+                    }
                     if ((connObj.request.method != "HEAD") && (connObj.request.method != "GET")) {
                         connObj.request.body = connObj.reqBodybuf;
                     }
-                    fetch(connObj.address, connObj.request).then((resp) => {
-                        connObj.response = new TextEncoder().encode(JSON.stringify({
-                            bodyUsed: resp.bodyUsed,
-                            headers: resp.headers,
-                            redirected: resp.redirected,
-                            status: resp.status,
-                            statusText: resp.statusText,
-                            type: resp.type,
-                            url: resp.url
-                        })),
-                        connObj.done = false;
-                        connObj.respBodybuf = new Uint8Array(0);
-                        if (resp.ok) {
-                            resp.arrayBuffer().then((data) => {
-                                connObj.respBodybuf = new Uint8Array(data);
-                                connObj.done = true;
-                            }).catch((error) => {
-                                connObj.respBodybuf = new Uint8Array(0);
-                                connObj.done = true;
-                                console.log("failed to fetch body: " + error);
-                            });
-                        } else {
-                            connObj.done = true;
-                        }
-                    }).catch((error) => {
-                        connObj.response = new TextEncoder().encode(JSON.stringify({
-                            status: 503,
-                            statusText: "Service Unavailable",
-                        }))
-                        connObj.respBodybuf = new Uint8Array(0);
-                        connObj.done = true;
-                    });
+                    startFetch(req_.id);
                 }
                 break;
             case "http_isreadable":
@@ -221,6 +334,8 @@ function connect(name, shared, conn, certbuf) {
                 if ((httpConnections[req_.id].done) && (httpConnections[req_.id].respBodybuf.byteLength == 0)) {
                     streamStatus[0] = 1;
                     delete httpConnections[req_.id]; // connection done
+                } else {
+                    readRespBody(req_.id);
                 }
                 break;
             case "send_cert":
@@ -251,6 +366,27 @@ function connect(name, shared, conn, certbuf) {
     }
 }
 
+// maxRespBodybufSize is the size of the response body buffered before the stack reads it.
+const maxRespBodybufSize = 16 * 1024 * 1024;
+
+// maxRetryReqBodySize is the max size of the streamed request body buffered for retrying without streaming.
+const maxRetryReqBodySize = 16 * 1024 * 1024;
+
+// supportsRequestStreams is true if the browser supports streaming request bodies.
+// https://developer.chrome.com/docs/capabilities/web-apis/fetch-streaming-requests
+const supportsRequestStreams = (() => {
+    let duplexAccessed = false;
+    const hasContentType = new Request(location.origin, {
+        body: new ReadableStream(),
+        method: 'POST',
+        get duplex() {
+            duplexAccessed = true;
+            return 'half';
+        },
+    }).headers.has('Content-Type');
+    return duplexAccessed && !hasContentType;
+})();
+
 function appendData(data1, data2) {
     buf2 = new Uint8Array(data1.byteLength + data2.byteLength);
     buf2.set(new Uint8Array(data1), 0);
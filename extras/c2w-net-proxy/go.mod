@@ -1,17 +1,18 @@
-module c2w-net-proxy
+module github.com/ktock/container2wasm/extras/c2w-net-proxy
 
 go 1.23.0
 
 toolchain go1.23.2
 
 require (
-	github.com/containers/gvisor-tap-vsock v0.8.5
+	github.com/ktock/container2wasm/internal/netstack v0.0.0-00010101000000-000000000000
 	github.com/sirupsen/logrus v1.9.3
 )
 
 require (
 	github.com/Microsoft/go-winio v0.6.2 // indirect
 	github.com/apparentlymart/go-cidr v1.1.0 // indirect
+	github.com/containers/gvisor-tap-vsock v0.8.5 // indirect
 	github.com/google/btree v1.1.2 // indirect
 	github.com/google/gopacket v1.1.19 // indirect
 	github.com/insomniacslk/dhcp v0.0.0-20240710054256-ddd8a41251c9 // indirect
@@ -38,3 +39,6 @@ replace github.com/u-root/uio => github.com/ktock/u-root-uio v0.0.0-202309111429
 
 // FIXME: Temporary use a forked repostory which removed an unused package for reducing dependencies (see #454).
 replace github.com/containers/gvisor-tap-vsock => github.com/ktock/gvisor-tap-vsock v0.0.0-20250428083527-5f02d9ba79d4
+
+// Shares the network stack with the other components of this repo.
+replace github.com/ktock/container2wasm/internal/netstack => ../../internal/netstack
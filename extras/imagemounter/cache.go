@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+	"github.com/ktock/container2wasm/extras/imagemounter/hostcache"
+	"github.com/ktock/container2wasm/extras/imagemounter/layercache"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerCache caches the contents of the layers.
+// Entries are keyed by the digests of the layers so they are shared among images.
+type layerCache struct {
+	esgzcache.BlobCache
+
+	// persistent is true if the entries can be available to the later runs of imagemounter.
+	persistent bool
+
+	// budget limits the total size of the layers made by streamTarLayer (unlimited if nil).
+	budget *layercache.Budget
+
+	spillOnce sync.Once
+	spill     esgzcache.BlobCache
+	spillErr  error
+}
+
+// newLayerCache returns the cache of the layers.
+// If dir is specified, the layers are cached in the directory (e.g. a directory preopened by the WASI runtime).
+// If host is true, the layers are cached in the storage provided by the host (e.g. Cache API of the browser).
+// Otherwise, the layers are cached in memory up to memorySize bytes (unlimited if 0).
+func newLayerCache(dir string, host bool, memorySize int64) (*layerCache, error) {
+	switch {
+	case dir != "" && host:
+		return nil, fmt.Errorf("directory cache and host cache can't be used together")
+	case dir != "":
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		c, err := esgzcache.NewDirectoryCache(abs, esgzcache.DirectoryCacheConfig{})
+		if err != nil {
+			return nil, err
+		}
+		return &layerCache{BlobCache: c, persistent: true}, nil
+	case host:
+		return &layerCache{BlobCache: hostcache.Cache{}, persistent: true}, nil
+	default:
+		// The chunks of the streamed layers evicted from the memory are restored by reading the layer
+		// from the beginning so the layers exceeding the memory are too slow to read.
+		c := &layerCache{BlobCache: layercache.NewMemoryCache(memorySize)}
+		if memorySize > 0 {
+			c.budget = layercache.NewBudget(memorySize)
+		}
+		return c, nil
+	}
+}
+
+// spillCache returns the cache in a temporary directory for the streamed layers exceeding the budget.
+// It fails if the temporary directory isn't available (e.g. not preopened by the WASI runtime).
+func (c *layerCache) spillCache() (esgzcache.BlobCache, error) {
+	c.spillOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "imagemounter-")
+		if err != nil {
+			c.spillErr = err
+			return
+		}
+		log.Printf("layers exceeding the memory cache are stored in %s\n", dir)
+		c.spill, c.spillErr = esgzcache.NewDirectoryCache(dir, esgzcache.DirectoryCacheConfig{})
+	})
+	return c.spill, c.spillErr
+}
+
+// forLayer returns the cache for the layer. name distinguishes the users of the cache in the layer.
+// The returned cache doesn't close the underlying cache.
+func (c *layerCache) forLayer(dgst digest.Digest, name string) esgzcache.BlobCache {
+	return layercache.WithPrefix(c.BlobCache, dgst.Encoded()+"-"+name+"-")
+}
+
+// tarLayerReader returns getReader that serves the layers from the cache.
+// If the cache is persistent, the layers returned by getReader are stored to the cache so that the
+// later runs don't need to fetch them. The cached layers are reused only if they match the digest of the
+// layer (diffID if decompressed).
+func (c *layerCache) tarLayerReader(getReader func(imagespec.Descriptor, bool) (io.ReaderAt, error)) func(imagespec.Descriptor, digest.Digest, bool) (io.ReaderAt, error) {
+	return func(desc imagespec.Descriptor, diffID digest.Digest, withDecompression bool) (io.ReaderAt, error) {
+		key := desc.Digest.Encoded() + "-tar"
+		dgst := desc.Digest
+		if withDecompression {
+			key += "-decompressed"
+			dgst = diffID
+		}
+		// The cache isn't polluted by the large data. The reader is used until imagemounter exits.
+		if r, err := c.Get(key, esgzcache.Direct()); err == nil {
+			err := verifyReaderAt(r, dgst)
+			if err == nil {
+				log.Printf("using cached layer %v\n", desc.Digest)
+				return r, nil
+			}
+			log.Printf("ignoring cached layer %v: %v\n", desc.Digest, err)
+			r.Close()
+		}
+		r, err := getReader(desc, withDecompression)
+		if err != nil || !c.persistent {
+			return r, err
+		}
+		if sr, ok := r.(interface{ Size() int64 }); ok {
+			if err := c.store(key, io.NewSectionReader(r, 0, sr.Size())); err != nil {
+				log.Printf("failed to cache layer %v: %v\n", desc.Digest, err)
+			}
+		}
+		return r, nil
+	}
+}
+
+// verifyReaderAt checks the contents of r with dgst.
+func verifyReaderAt(r io.ReaderAt, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	v := dgst.Verifier()
+	if _, err := io.Copy(v, io.NewSectionReader(r, 0, math.MaxInt64)); err != nil {
+		return err
+	}
+	if !v.Verified() {
+		return fmt.Errorf("unexpected digest; want %v", dgst)
+	}
+	return nil
+}
+
+// streamTarLayer makes the layer from the stream of the blob returned by open. The files are indexed while the
+// decompressed tar is stored to the cache in chunks so the whole layer doesn't need to be on memory. Evicted
+// chunks are read again from the stream. The blob is verified with the digest of the layer and the tar is
+// verified with diffID. If the layers don't fit in the budget, the layer is stored in a temporary directory.
+func (c *layerCache) streamTarLayer(q *qidSet, desc imagespec.Descriptor, diffID digest.Digest, format layerFormat, open func() (io.ReadCloser, error)) (*NodeLayer, error) {
+	key := desc.Digest.Encoded() + "-tar"
+	if format != formatTar {
+		key += "-decompressed"
+	}
+	openTar := func() (io.ReadCloser, error) {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+		zr, err := layercache.VerifyBlob(r, desc.Digest, func(r io.ReadCloser) (io.ReadCloser, error) {
+			return decompressLayer(r, format)
+		})
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return zr, nil
+	}
+	l, complete := layercache.Open(c.BlobCache, key, diffID, layercache.DefaultChunkSize, openTar)
+	if complete {
+		log.Printf("using cached layer %v\n", desc.Digest)
+		return newTarNode(q, l)
+	}
+	n, err := storeTarLayer(q, l, c.budget)
+	if !errors.Is(err, layercache.ErrBudgetExceeded) {
+		return n, err
+	}
+	spill, serr := c.spillCache()
+	if serr != nil {
+		return nil, fmt.Errorf("layers are larger than the memory cache and no temporary directory is available (%v); increase -cache-memory-size or use -cache-dir or -cache-host: %w", serr, err)
+	}
+	log.Printf("layer %v exceeds the memory cache; storing it in the temporary directory\n", desc.Digest)
+	l, _ = layercache.Open(spill, key, diffID, layercache.DefaultChunkSize, openTar)
+	return storeTarLayer(q, l, nil)
+}
+
+// storeTarLayer stores the layer while indexing the files.
+func storeTarLayer(q *qidSet, l *layercache.Layer, budget *layercache.Budget) (n *NodeLayer, _ error) {
+	if err := l.Store(budget, func(r io.Reader) (err error) {
+		cr := &countingReader{r: r}
+		n, err = indexTar(q, cr, cr.pos, l)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (c *layerCache) store(key string, r io.Reader) error {
+	w, err := c.Add(key, esgzcache.Direct())
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/ktock/container2wasm/extras/imagemounter/registryauth"
+)
+
+// credentials_* functions are available since version 4 of the host ABI.
+
+//go:wasmimport env credentials_get
+func credentials_get(hostP uint32, hostlen uint32, idP uint32) uint32
+
+//go:wasmimport env credentials_isreadable
+func credentials_isreadable(id uint32, isOKP uint32, foundP uint32, sizeP uint32) uint32
+
+//go:wasmimport env credentials_read
+func credentials_read(id uint32, respP uint32, bufsize uint32, respsizeP uint32) uint32
+
+//go:wasmimport env credentials_release
+func credentials_release(id uint32) uint32
+
+// hostCredentials returns the credentials of the registry host provided by the host (e.g. the page on browser).
+func hostCredentials(host string) (*registryauth.Credentials, error) {
+	if host == "" {
+		return nil, nil
+	}
+	var id uint32
+	res := credentials_get(
+		uint32(uintptr(unsafe.Pointer(&[]byte(host)[0]))),
+		uint32(len(host)),
+		uint32(uintptr(unsafe.Pointer(&id))),
+	)
+	if res != 0 {
+		return nil, fmt.Errorf("failed to get credentials of %q", host)
+	}
+	defer credentials_release(id)
+	var isOK, found, size uint32
+	for {
+		res := credentials_isreadable(id,
+			uint32(uintptr(unsafe.Pointer(&isOK))),
+			uint32(uintptr(unsafe.Pointer(&found))),
+			uint32(uintptr(unsafe.Pointer(&size))))
+		if res != 0 {
+			return nil, fmt.Errorf("credentials of %q are not readable", host)
+		}
+		if isOK == 1 {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	if found != 1 || size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	var respsize uint32
+	res = credentials_read(id,
+		uint32(uintptr(unsafe.Pointer(&buf[0]))),
+		size,
+		uint32(uintptr(unsafe.Pointer(&respsize))))
+	if res != 0 {
+		return nil, fmt.Errorf("failed to read credentials of %q", host)
+	}
+	var c registryauth.Credentials
+	if err := json.Unmarshal(buf[:respsize], &c); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials of %q: %w", host, err)
+	}
+	return &c, nil
+}
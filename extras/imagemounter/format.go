@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/klauspost/compress/zstd"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerFormat is the format of the layer.
+type layerFormat int
+
+const (
+	formatTar         layerFormat = iota // uncompressed tar
+	formatGzip                           // gzip-compressed tar
+	formatZstd                           // zstd-compressed tar
+	formatUnknown                        // tar possibly compressed. The compression is detected from the contents.
+	formatEStargz                        // eStargz (lazily pulled)
+	formatZstdChunked                    // zstd:chunked (lazily pulled)
+)
+
+func (f layerFormat) String() string {
+	switch f {
+	case formatTar:
+		return "tar"
+	case formatGzip:
+		return "gzip"
+	case formatZstd:
+		return "zstd"
+	case formatEStargz:
+		return "estargz"
+	case formatZstdChunked:
+		return "zstd:chunked"
+	}
+	return "unknown"
+}
+
+// lazy returns true if the layer can be lazily pulled.
+func (f layerFormat) lazy() bool {
+	return f == formatEStargz || f == formatZstdChunked
+}
+
+// whole returns the format used for fetching the whole layer.
+func (f layerFormat) whole() layerFormat {
+	switch f {
+	case formatEStargz:
+		return formatGzip
+	case formatZstdChunked:
+		return formatZstd
+	}
+	return f
+}
+
+// detectLayerFormat detects the format of the layer from the media type and the annotations.
+func detectLayerFormat(desc imagespec.Descriptor) (layerFormat, error) {
+	compression, err := images.DiffCompression(context.TODO(), desc.MediaType)
+	if err != nil {
+		return 0, err
+	}
+	switch compression {
+	case "":
+		return formatTar, nil
+	case "gzip":
+		if _, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+			return formatEStargz, nil
+		}
+		return formatGzip, nil
+	case "zstd":
+		if _, ok := desc.Annotations[zstdchunked.ManifestChecksumAnnotation]; ok {
+			return formatZstdChunked, nil
+		}
+		return formatZstd, nil
+	case "unknown":
+		return formatUnknown, nil
+	}
+	return 0, fmt.Errorf("unsupported compression %q of layer %v", compression, desc.Digest)
+}
+
+// tocDigestAnnotation returns the annotation containing the digest of the TOC of the lazily pulled layer.
+func tocDigestAnnotation(format layerFormat) string {
+	if format == formatZstdChunked {
+		return zstdchunked.ManifestChecksumAnnotation
+	}
+	return estargz.TOCJSONDigestAnnotation
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressLayer returns the reader of the tar in the layer. Closing the returned reader closes r.
+func decompressLayer(r io.ReadCloser, format layerFormat) (io.ReadCloser, error) {
+	if format == formatUnknown {
+		br := bufio.NewReader(r)
+		magic, _ := br.Peek(4)
+		switch {
+		case bytes.HasPrefix(magic, gzipMagic):
+			format = formatGzip
+		case bytes.HasPrefix(magic, zstdMagic):
+			format = formatZstd
+		default:
+			format = formatTar
+		}
+		r = &readerWithCloser{br, r.Close}
+	}
+	switch format.whole() {
+	case formatGzip:
+		zr, err := newWasmDecompressor(r)
+		if err != nil {
+			return nil, err
+		}
+		return &readerWithCloser{zr, r.Close}, nil
+	case formatZstd:
+		// Decompressed in the guest because the host only supports gzip.
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return &readerWithCloser{zr, func() error {
+			zr.Close()
+			return r.Close()
+		}}, nil
+	}
+	return r, nil
+}
@@ -1,4 +1,4 @@
-module imagemounter
+module github.com/ktock/container2wasm/extras/imagemounter
 
 go 1.25.0
 
@@ -7,13 +7,19 @@ require (
 	github.com/containerd/platforms v0.2.1
 	github.com/containerd/stargz-snapshotter v0.15.1
 	github.com/containerd/stargz-snapshotter/estargz v0.15.1
-	github.com/containers/gvisor-tap-vsock v0.8.5
+	github.com/google/flatbuffers v25.2.10+incompatible
 	github.com/hugelgupf/p9 v0.0.0-00010101000000-000000000000
+	github.com/klauspost/compress v1.17.7
+	github.com/ktock/container2wasm/internal/imagepolicy v0.0.0-00010101000000-000000000000
+	github.com/ktock/container2wasm/internal/netstack v0.0.0-00010101000000-000000000000
+	github.com/ktock/container2wasm/internal/wasmhost v0.0.0-00010101000000-000000000000
 	github.com/moby/sys/user v0.3.0
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.1.1
 	github.com/opencontainers/runtime-spec v1.2.1
+	github.com/pelletier/go-toml v1.9.5
 	github.com/sirupsen/logrus v1.9.3
+	github.com/tetratelabs/wazero v1.11.0
 	golang.org/x/sync v0.20.0
 )
 
@@ -26,6 +32,7 @@ require (
 	github.com/containerd/log v0.1.0 // indirect
 	github.com/containerd/ttrpc v1.2.2 // indirect
 	github.com/containerd/typeurl/v2 v2.1.1 // indirect
+	github.com/containers/gvisor-tap-vsock v0.8.5 // indirect
 	github.com/go-logr/logr v1.2.4 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
@@ -38,7 +45,6 @@ require (
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/hashicorp/go-retryablehttp v0.7.4 // indirect
 	github.com/insomniacslk/dhcp v0.0.0-20240710054256-ddd8a41251c9 // indirect
-	github.com/klauspost/compress v1.17.7 // indirect
 	github.com/miekg/dns v1.1.63 // indirect
 	github.com/moby/locker v1.0.1 // indirect
 	github.com/moby/sys/mountinfo v0.7.1 // indirect
@@ -52,7 +58,7 @@ require (
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/mod v0.24.0 // indirect
 	golang.org/x/net v0.37.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 	golang.org/x/tools v0.28.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
@@ -79,3 +85,12 @@ replace github.com/containerd/stargz-snapshotter/estargz => github.com/ktock/sta
 
 // FIXME: Temporary use a forked repostory which removed an unused package for reducing dependencies (see #454).
 replace github.com/containers/gvisor-tap-vsock => github.com/ktock/gvisor-tap-vsock v0.0.0-20250428083527-5f02d9ba79d4
+
+// Shares the network stack with the other components of this repo.
+replace github.com/ktock/container2wasm/internal/netstack => ../../internal/netstack
+
+// Shares the verification of the images with c2w.
+replace github.com/ktock/container2wasm/internal/imagepolicy => ../../internal/imagepolicy
+
+// Runs the tests on the host functions of this repo.
+replace github.com/ktock/container2wasm/internal/wasmhost => ../../internal/wasmhost
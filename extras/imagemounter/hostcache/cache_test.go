@@ -0,0 +1,62 @@
+package hostcache_test
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ktock/container2wasm/internal/wasmhost"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// TestCache adds and reads the entries on the wazero host. The entries stored in the cache directory
+// must be available to the later host.
+func TestCache(t *testing.T) {
+	guest := filepath.Join(t.TempDir(), "guest.wasm")
+	cmd := exec.Command("go", "build", "-o", guest, "./testdata/guest")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the guest: %v: %s", err, out)
+	}
+	wasm, err := os.ReadFile(guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("memory", func(t *testing.T) {
+		runGuest(t, wasm, wasmhost.NewHost(), "store")
+	})
+	t.Run("dir", func(t *testing.T) {
+		dir := t.TempDir()
+		runGuest(t, wasm, wasmhost.NewHost(wasmhost.WithCacheDir(dir)), "store")
+		runGuest(t, wasm, wasmhost.NewHost(wasmhost.WithCacheDir(dir)), "load")
+	})
+}
+
+func runGuest(t *testing.T, wasm []byte, h *wasmhost.Host, mode string) {
+	t.Helper()
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	if _, err := h.Instantiate(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	conf := wazero.NewModuleConfig().WithSysWalltime().WithSysNanotime().WithSysNanosleep().WithRandSource(crand.Reader).WithStdout(&out).WithStderr(&out).WithArgs("arg0", "-mode", mode)
+	_, err := r.InstantiateWithConfig(ctx, wasm, conf)
+	t.Log(out.String())
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		t.Fatalf("guest (%s) failed: %v", mode, err)
+	}
+}
@@ -0,0 +1,184 @@
+package hostcache
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+)
+
+// cache_* functions are available since version 3 of the host ABI.
+
+//go:wasmimport env cache_get
+func cache_get(keyP uint32, keylen uint32, idP uint32) uint32
+
+//go:wasmimport env cache_isreadable
+func cache_isreadable(id uint32, isOKP uint32, foundP uint32, sizeP uint32) uint32
+
+//go:wasmimport env cache_readat
+func cache_readat(id uint32, respP uint32, offset uint64, len uint32, respsizeP uint32) uint32
+
+//go:wasmimport env cache_release
+func cache_release(id uint32) uint32
+
+//go:wasmimport env cache_add
+func cache_add(keyP uint32, keylen uint32, idP uint32) uint32
+
+//go:wasmimport env cache_write
+func cache_write(id uint32, bufP uint32, buflen uint32) uint32
+
+//go:wasmimport env cache_commit
+func cache_commit(id uint32, commit uint32) uint32
+
+// Cache is esgzcache.BlobCache provided by the host.
+type Cache struct{}
+
+func (Cache) Get(key string, opts ...esgzcache.Option) (esgzcache.Reader, error) {
+	var id uint32
+	res := cache_get(
+		uint32(uintptr(unsafe.Pointer(&[]byte(key)[0]))),
+		uint32(len(key)),
+		uint32(uintptr(unsafe.Pointer(&id))),
+	)
+	if res != 0 {
+		return nil, fmt.Errorf("failed to get cache %q", key)
+	}
+	var isOK, found uint32
+	var size uint64
+	for {
+		res := cache_isreadable(id,
+			uint32(uintptr(unsafe.Pointer(&isOK))),
+			uint32(uintptr(unsafe.Pointer(&found))),
+			uint32(uintptr(unsafe.Pointer(&size))))
+		if res != 0 {
+			cache_release(id)
+			return nil, fmt.Errorf("cache %q is not readable", key)
+		}
+		if isOK == 1 {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	if found != 1 {
+		cache_release(id)
+		return nil, fmt.Errorf("missed cache: %q", key)
+	}
+	var once sync.Once
+	return &reader{&readerAt{id, int64(size)}, func() error {
+		once.Do(func() {
+			cache_release(id)
+		})
+		return nil
+	}}, nil
+}
+
+func (Cache) Add(key string, opts ...esgzcache.Option) (esgzcache.Writer, error) {
+	var id uint32
+	res := cache_add(
+		uint32(uintptr(unsafe.Pointer(&[]byte(key)[0]))),
+		uint32(len(key)),
+		uint32(uintptr(unsafe.Pointer(&id))),
+	)
+	if res != 0 {
+		return nil, fmt.Errorf("failed to add cache %q", key)
+	}
+	var done bool
+	finish := func(commit uint32) error {
+		if done {
+			return nil
+		}
+		done = true
+		if res := cache_commit(id, commit); res != 0 {
+			return fmt.Errorf("failed to commit cache %q", key)
+		}
+		return nil
+	}
+	return &writer{
+		Writer: writerFunc(func(p []byte) (int, error) {
+			if len(p) == 0 {
+				return 0, nil
+			}
+			res := cache_write(id,
+				uint32(uintptr(unsafe.Pointer(&p[0]))),
+				uint32(len(p)),
+			)
+			if res != 0 {
+				return 0, fmt.Errorf("failed to write cache %q", key)
+			}
+			return len(p), nil
+		}),
+		commitFunc: func() error { return finish(1) },
+		abortFunc:  func() error { return finish(0) },
+		closeFunc:  func() error { return finish(0) }, // aborts the entry not committed
+	}, nil
+}
+
+func (Cache) Close() error {
+	return nil
+}
+
+type reader struct {
+	io.ReaderAt
+	closeFunc func() error
+}
+
+func (r *reader) Close() error {
+	return r.closeFunc()
+}
+
+type writer struct {
+	io.Writer
+	commitFunc func() error
+	abortFunc  func() error
+	closeFunc  func() error
+}
+
+func (w *writer) Commit() error {
+	return w.commitFunc()
+}
+
+func (w *writer) Abort() error {
+	return w.abortFunc()
+}
+
+func (w *writer) Close() error {
+	return w.closeFunc()
+}
+
+type readerAt struct {
+	id   uint32
+	size int64
+}
+
+func (r *readerAt) ReadAt(p []byte, offset int64) (int, error) {
+	var n int
+	// the host can return less bytes than requested
+	for n < len(p) && offset+int64(n) < r.size {
+		var respsize uint32
+		res := cache_readat(
+			r.id,
+			uint32(uintptr(unsafe.Pointer(&p[n]))),
+			uint64(offset+int64(n)),
+			uint32(len(p)-n),
+			uint32(uintptr(unsafe.Pointer(&respsize))),
+		)
+		if res != 0 {
+			return n, fmt.Errorf("failed to read cache")
+		}
+		if respsize == 0 {
+			break
+		}
+		n += int(respsize)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,3 @@
+// Package hostcache provides the cache stored by the host using the cache_* functions of the host ABI
+// (docs/host-abi.md). It's available only on WASI.
+package hostcache
@@ -0,0 +1,103 @@
+// Command guest adds and reads the entries of hostcache. It's run by the test of hostcache on the wazero
+// host. "-mode=store" adds the entries and "-mode=load" reads the entries stored by the previous run.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ktock/container2wasm/extras/imagemounter/hostcache"
+)
+
+var data = bytes.Repeat([]byte("0123456789"), 1000)
+
+func main() {
+	mode := flag.String("mode", "store", "store or load")
+	flag.Parse()
+	var err error
+	switch *mode {
+	case "store":
+		err = store()
+	case "load":
+		err = load()
+	default:
+		err = fmt.Errorf("unknown mode %q", *mode)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func store() error {
+	c := hostcache.Cache{}
+	if _, err := c.Get("committed"); err == nil {
+		return fmt.Errorf("entry must not exist before it's added")
+	}
+	w, err := c.Add("committed")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil { // closing the committed entry is harmless
+		return err
+	}
+	w, err = c.Add("aborted")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Abort(); err != nil {
+		return err
+	}
+	w, err = c.Add("closed")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil { // aborts the entry not committed
+		return err
+	}
+	return load()
+}
+
+func load() error {
+	c := hostcache.Cache{}
+	for _, key := range []string{"aborted", "closed"} {
+		if _, err := c.Get(key); err == nil {
+			return fmt.Errorf("entry %q must not be committed", key)
+		}
+	}
+	r, err := c.Get("committed")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	got, err := io.ReadAll(io.NewSectionReader(r, 0, int64(len(data))))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("unexpected contents (read %d bytes; want %d)", len(got), len(data))
+	}
+	b := make([]byte, 20)
+	if n, err := r.ReadAt(b, int64(len(data)-10)); n != 10 || err != io.EOF || !bytes.Equal(b[:n], data[len(data)-10:]) {
+		return fmt.Errorf("unexpected read %q (%v) at the end of the entry", b[:n], err)
+	}
+	if n, err := r.ReadAt(b, int64(len(data))); n != 0 || err != io.EOF {
+		return fmt.Errorf("read %d bytes (%v) beyond the entry", n, err)
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+// Package hostlayer reads the layers fetched by the host using the layer_* functions of the host ABI
+// (docs/host-abi.md). It's available only on WASI.
+package hostlayer
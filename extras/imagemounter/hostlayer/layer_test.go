@@ -0,0 +1,62 @@
+package hostlayer_test
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ktock/container2wasm/internal/wasmhost"
+	"github.com/ktock/container2wasm/internal/wasmhost/conformance"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// TestOpenLarge reads the layer larger than 4GiB on the wazero host.
+// The layer is stored as a sparse file so this doesn't consume the disk space much.
+func TestOpenLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the large layer test in short mode")
+	}
+	guest := filepath.Join(t.TempDir(), "guest.wasm")
+	cmd := exec.Command("go", "build", "-o", guest, "./testdata/guest")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the guest: %v: %s", err, out)
+	}
+	wasm, err := os.ReadFile(guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, conformance.LargeBlob())
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	if _, err := wasmhost.NewHost(wasmhost.WithLayerDir(t.TempDir())).Instantiate(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	conf := wazero.NewModuleConfig().WithSysWalltime().WithSysNanotime().WithSysNanosleep().WithRandSource(crand.Reader).WithStdout(&out).WithStderr(&out).WithArgs("arg0", "-addr", srv.URL+"/blobs/sha256/"+conformance.LargeBlobDigest)
+	_, err = r.InstantiateWithConfig(ctx, wasm, conf)
+	t.Log(out.String())
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		t.Fatalf("guest failed: %v", err)
+	}
+}
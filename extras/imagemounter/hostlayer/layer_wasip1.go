@@ -0,0 +1,81 @@
+package hostlayer
+
+import (
+	"fmt"
+	"io"
+	"time"
+	"unsafe"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+//go:wasmimport env layer_request
+func layer_request(addressP uint32, addresslen uint32, digestP uint32, digestlen uint32, withDecompression uint32, idP uint32) uint32
+
+// layer_isreadable64 and layer_readat64 are available since version 2 of the host ABI.
+
+//go:wasmimport env layer_isreadable64
+func layer_isreadable64(id uint32, isOKP uint32, sizeP uint32) uint32
+
+//go:wasmimport env layer_readat64
+func layer_readat64(id uint32, respP uint32, offset uint64, len uint32, respsizeP uint32) uint32
+
+// Open makes the host fetch the blob at address and returns the reader of it.
+// The host verifies the blob with dgst and decompresses it with gzip if withDecompression is true.
+// This waits until the host makes the blob available.
+func Open(address string, dgst digest.Digest, withDecompression bool) (*io.SectionReader, error) {
+	encoded := dgst.Encoded()
+	var id uint32
+	var withDecompressionN uint32 = 0
+	if withDecompression {
+		withDecompressionN = 1
+	}
+	res := layer_request(
+		uint32(uintptr(unsafe.Pointer(&[]byte(address)[0]))),
+		uint32(len(address)),
+		uint32(uintptr(unsafe.Pointer(&[]byte(encoded)[0]))),
+		uint32(len(encoded)),
+		uint32(withDecompressionN),
+		uint32(uintptr(unsafe.Pointer(&id))),
+	)
+	if res != 0 {
+		return nil, fmt.Errorf("failed to send layer request")
+	}
+	var isOK uint32 = 0
+	var size uint64
+	for {
+		res := layer_isreadable64(id,
+			uint32(uintptr(unsafe.Pointer(&isOK))),
+			uint32(uintptr(unsafe.Pointer(&size))))
+		if res != 0 {
+			return nil, fmt.Errorf("layer is not readable")
+		}
+		if isOK == 1 {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	return io.NewSectionReader(&reader{id}, 0, int64(size)), nil
+}
+
+type reader struct {
+	id uint32
+}
+
+func (r *reader) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var respsize uint32
+	res := layer_readat64(
+		r.id,
+		uint32(uintptr(unsafe.Pointer(&p[0]))),
+		uint64(offset),
+		uint32(len(p)),
+		uint32(uintptr(unsafe.Pointer(&respsize))),
+	)
+	if res != 0 {
+		return 0, fmt.Errorf("failed to receive layer response")
+	}
+	return int(respsize), nil
+}
@@ -0,0 +1,55 @@
+// Command guest reads the large blob served by the conformance fixtures using hostlayer and checks its
+// contents around and beyond 4GiB. It's run by the test of hostlayer on the wazero host.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ktock/container2wasm/extras/imagemounter/hostlayer"
+	"github.com/ktock/container2wasm/internal/wasmhost/conformance"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func main() {
+	addr := flag.String("addr", "", "URL of the large blob")
+	flag.Parse()
+	if err := check(*addr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func check(addr string) error {
+	r, err := hostlayer.Open(addr, digest.NewDigestFromEncoded(digest.SHA256, conformance.LargeBlobDigest), false)
+	if err != nil {
+		return err
+	}
+	if r.Size() != conformance.LargeBlobSize {
+		return fmt.Errorf("unexpected size %d (want %d)", r.Size(), int64(conformance.LargeBlobSize))
+	}
+	want := conformance.LargeBlob()
+	var offsets []int64
+	for _, m := range conformance.LargeBlobMarkers() {
+		offsets = append(offsets, max(m-10, 0), m+conformance.LargeBlobMarkerSize/2)
+	}
+	offsets = append(offsets, 1<<32, r.Size()-10)
+	for _, off := range offsets {
+		got, wantB := make([]byte, 200), make([]byte, 200)
+		n, err := r.ReadAt(got, off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read at %d: %w", off, err)
+		}
+		wantN, _ := want.ReadAt(wantB, off)
+		if n != wantN || !bytes.Equal(got[:n], wantB[:wantN]) {
+			return fmt.Errorf("unexpected data at %d (read %d bytes; want %d)", off, n, wantN)
+		}
+	}
+	if n, err := r.ReadAt(make([]byte, 10), r.Size()); n != 0 || err != io.EOF {
+		return fmt.Errorf("read %d bytes (%v) at the end of the blob", n, err)
+	}
+	return nil
+}
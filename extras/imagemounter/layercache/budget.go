@@ -0,0 +1,45 @@
+package layercache
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrBudgetExceeded is returned by Layer.Store if the contents don't fit in the budget.
+var ErrBudgetExceeded = errors.New("layers exceed the budget")
+
+// Budget limits the total size of the contents of the layers sharing it. Layers stored in a cache that
+// evicts chunks should share a budget no larger than the cache so that restoring evicted chunks (reading
+// the contents from the beginning) doesn't happen on every read.
+type Budget struct {
+	mu     sync.Mutex
+	remain int64
+}
+
+// NewBudget returns Budget of size bytes.
+func NewBudget(size int64) *Budget {
+	return &Budget{remain: size}
+}
+
+// Remain returns the bytes not used by the layers.
+func (b *Budget) Remain() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remain
+}
+
+func (b *Budget) take(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.remain {
+		return false
+	}
+	b.remain -= n
+	return true
+}
+
+func (b *Budget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remain += n
+}
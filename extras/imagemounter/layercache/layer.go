@@ -0,0 +1,329 @@
+package layercache
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultChunkSize is the default size of the chunks of Layer.
+const DefaultChunkSize = 1024 * 1024
+
+// readAheadChunks is the number of the chunks following the requested one stored on refilling.
+const readAheadChunks = 3
+
+// Layer is the contents of a layer (e.g. decompressed tar) stored in a cache in chunks so that the
+// whole contents don't need to be kept in memory.
+// If chunks are evicted from the cache, they are restored by reading the contents again from the beginning.
+// The contents are verified with their digest and the restored chunks are verified with the digests of the
+// chunks recorded while storing.
+type Layer struct {
+	cache     esgzcache.BlobCache
+	key       string
+	dgst      digest.Digest
+	chunkSize int64
+	open      func() (io.ReadCloser, error)
+
+	size         int64 // -1 until stored
+	chunkDigests []digest.Digest
+
+	refillMu sync.Mutex
+}
+
+// Open returns the layer stored in cache with key. open returns the contents from the beginning and dgst is
+// their digest (e.g. the diffID of the layer).
+// If the layer hasn't been stored to cache yet, complete is false and Store needs to be called before reading.
+// The layer stored in cache is reused only if its chunks match dgst so a corrupted cache (e.g. a directory
+// reused among runs) is stored again.
+func Open(cache esgzcache.BlobCache, key string, dgst digest.Digest, chunkSize int64, open func() (io.ReadCloser, error)) (l *Layer, complete bool) {
+	l = &Layer{
+		cache:     cache,
+		key:       key,
+		dgst:      dgst,
+		chunkSize: chunkSize,
+		open:      open,
+		size:      -1,
+	}
+	if r, err := cache.Get(l.sizeKey(), esgzcache.Direct()); err == nil {
+		defer r.Close()
+		b := make([]byte, 20)
+		n, err := r.ReadAt(b, 0)
+		if err == nil || err == io.EOF {
+			if size, err := strconv.ParseInt(string(b[:n]), 10, 64); err == nil {
+				l.size = size
+			}
+		}
+	}
+	if l.size >= 0 {
+		if err := l.verify(); err != nil {
+			l.size = -1
+		}
+	}
+	return l, l.size >= 0
+}
+
+// verify checks the stored chunks with the digest of the contents and records the digests of the chunks.
+func (l *Layer) verify() error {
+	if err := l.dgst.Validate(); err != nil {
+		return err
+	}
+	v := l.dgst.Verifier()
+	var digests []digest.Digest
+	buf := make([]byte, l.chunkSize)
+	for idx := int64(0); idx*l.chunkSize < l.size; idx++ {
+		b := buf[:l.chunkLen(idx)]
+		r, err := l.cache.Get(l.chunkKey(idx), esgzcache.Direct())
+		if err != nil {
+			return err
+		}
+		n, err := r.ReadAt(b, 0)
+		r.Close()
+		if n != len(b) {
+			return fmt.Errorf("failed to read chunk %d of %q: %w", idx, l.key, err)
+		}
+		v.Write(b)
+		digests = append(digests, digest.FromBytes(b))
+	}
+	if !v.Verified() {
+		return fmt.Errorf("unexpected digest of layer %q; want %v", l.key, l.dgst)
+	}
+	l.chunkDigests = digests
+	return nil
+}
+
+// VerifyBlob returns the contents of the blob r decompressed by decompress. The returned reader fails
+// at the end of the contents if the blob doesn't match dgst. The rest of the blob following the contents
+// (e.g. the trailer of the compression) is read for the verification.
+func VerifyBlob(r io.ReadCloser, dgst digest.Digest, decompress func(io.ReadCloser) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	v := dgst.Verifier()
+	blob := io.TeeReader(r, v)
+	zr, err := decompress(&readCloser{blob, r.Close})
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedReader{zr, blob, v, dgst}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.closeFunc()
+}
+
+// verifiedReader returns an error instead of io.EOF if the blob doesn't match the digest.
+type verifiedReader struct {
+	io.ReadCloser
+	blob io.Reader
+	v    digest.Verifier
+	dgst digest.Digest
+}
+
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, r.blob); err != nil {
+			return n, err
+		}
+		if !r.v.Verified() {
+			return n, fmt.Errorf("unexpected digest of blob; want %v", r.dgst)
+		}
+	}
+	return n, err
+}
+
+func (l *Layer) chunkKey(idx int64) string {
+	return fmt.Sprintf("%s-%d", l.key, idx)
+}
+
+// sizeKey is the entry storing the size. It's added after all chunks so its existence means the layer is complete.
+func (l *Layer) sizeKey() string {
+	return l.key + "-size"
+}
+
+// Store reads the contents and stores them to the cache.
+// The contents are passed to index (e.g. for building an index of the files) while being stored.
+// The contents not read by index are stored after it returns.
+// Store fails if the contents don't match the digest so the result of index must not be used in that case.
+// The layer isn't complete until the contents are verified.
+// If budget isn't nil, the contents are charged to it and Store fails with ErrBudgetExceeded if they don't
+// fit. The charge is kept only if the layer is stored.
+func (l *Layer) Store(budget *Budget, index func(r io.Reader) error) (retErr error) {
+	if err := l.dgst.Validate(); err != nil {
+		return fmt.Errorf("invalid digest of layer %q: %w", l.key, err)
+	}
+	rc, err := l.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	v := l.dgst.Verifier()
+	r := io.TeeReader(rc, v)
+	w := &chunkWriter{l: l, buf: make([]byte, 0, l.chunkSize), budget: budget}
+	defer func() {
+		if retErr != nil && budget != nil {
+			budget.release(w.size)
+		}
+	}()
+	if err := index(io.TeeReader(r, w)); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if !v.Verified() {
+		return fmt.Errorf("unexpected digest of layer %q; want %v", l.key, l.dgst)
+	}
+	l.size = w.size
+	l.chunkDigests = w.digests
+	return l.add(l.sizeKey(), []byte(strconv.FormatInt(w.size, 10)))
+}
+
+// Size returns the size of the contents. It's available after the layer is stored.
+func (l *Layer) Size() int64 {
+	return l.size
+}
+
+func (l *Layer) ReadAt(p []byte, off int64) (int, error) {
+	if l.size < 0 {
+		return 0, fmt.Errorf("layer %q is not stored", l.key)
+	}
+	var n int
+	for n < len(p) && off+int64(n) < l.size {
+		cur := off + int64(n)
+		m, err := l.readChunk(cur/l.chunkSize, p[n:], cur%l.chunkSize)
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunkLen returns the length of the chunk.
+func (l *Layer) chunkLen(idx int64) int64 {
+	return min(l.chunkSize, l.size-idx*l.chunkSize)
+}
+
+func (l *Layer) readChunk(idx int64, p []byte, off int64) (int, error) {
+	want := min(int64(len(p)), l.chunkLen(idx)-off)
+	if r, err := l.cache.Get(l.chunkKey(idx), esgzcache.Direct()); err == nil {
+		defer r.Close()
+		n, err := r.ReadAt(p[:want], off)
+		if int64(n) == want {
+			return n, nil
+		}
+		return 0, fmt.Errorf("failed to read chunk %d of %q: %w", idx, l.key, err)
+	}
+	chunk, err := l.refill(idx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore chunk %d of %q: %w", idx, l.key, err)
+	}
+	return copy(p[:want], chunk[off:]), nil
+}
+
+// refill reads the contents from the beginning and stores the chunk and the following readAheadChunks chunks.
+// The chunks are verified with the digests recorded while storing. It returns the contents of the chunk. Reading a chunk near the end of the contents costs as much as reading
+// the whole contents so the cache that evicts chunks should be large enough to hold the layer.
+func (l *Layer) refill(idx int64) ([]byte, error) {
+	l.refillMu.Lock()
+	defer l.refillMu.Unlock()
+	rc, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if _, err := io.CopyN(io.Discard, rc, idx*l.chunkSize); err != nil {
+		return nil, err
+	}
+	var chunk []byte
+	for i := idx; i <= idx+readAheadChunks && i*l.chunkSize < l.size; i++ {
+		b := make([]byte, l.chunkLen(i))
+		if _, err := io.ReadFull(rc, b); err != nil {
+			return nil, err
+		}
+		if i >= int64(len(l.chunkDigests)) || digest.FromBytes(b) != l.chunkDigests[i] {
+			return nil, fmt.Errorf("unexpected digest of chunk %d of %q", i, l.key)
+		}
+		if err := l.add(l.chunkKey(i), b); err != nil {
+			return nil, err
+		}
+		if i == idx {
+			chunk = b
+		}
+	}
+	return chunk, nil
+}
+
+func (l *Layer) add(key string, b []byte) error {
+	w, err := l.cache.Add(key, esgzcache.Direct())
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := w.Write(b); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// chunkWriter stores the written data to the cache in chunks.
+type chunkWriter struct {
+	l       *Layer
+	buf     []byte
+	idx     int64
+	size    int64 // also the charge to the budget
+	digests []digest.Digest
+	budget  *Budget
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := min(len(p), cap(w.buf)-len(w.buf))
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *chunkWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if w.budget != nil && !w.budget.take(int64(len(w.buf))) {
+		return fmt.Errorf("layer %q: %w", w.l.key, ErrBudgetExceeded)
+	}
+	if err := w.l.add(w.l.chunkKey(w.idx), w.buf); err != nil {
+		if w.budget != nil {
+			w.budget.release(int64(len(w.buf)))
+		}
+		return err
+	}
+	w.digests = append(w.digests, digest.FromBytes(w.buf))
+	w.size += int64(len(w.buf))
+	w.idx++
+	w.buf = make([]byte, 0, w.l.chunkSize) // the cache can keep the previous one
+	return nil
+}
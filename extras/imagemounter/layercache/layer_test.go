@@ -0,0 +1,352 @@
+package layercache
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	testFileSize  = 4 * 1024 * 1024
+	testFileNum   = 16 // 64MiB in total
+	testChunkSize = 256 * 1024
+	testCacheSize = 8 * 1024 * 1024
+)
+
+// testFileData returns the contents of the idx-th file in the test tar. The contents are
+// derived from the offset so they can be checked without keeping the whole tar.
+func testFileData(idx int, off int64, p []byte) {
+	for i := range p {
+		o := off + int64(i)
+		p[i] = byte(o*31 + o/251 + int64(idx))
+	}
+}
+
+// testTar streams the tar containing testFileNum files without keeping it on memory.
+func testTar() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		buf := make([]byte, 64*1024)
+		for i := 0; i < testFileNum; i++ {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     fmt.Sprintf("file%d", i),
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     testFileSize,
+			}); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			for off := int64(0); off < testFileSize; off += int64(len(buf)) {
+				testFileData(i, off, buf)
+				if _, err := tw.Write(buf); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr
+}
+
+var testTarDigest = sync.OnceValue(func() digest.Digest {
+	r := testTar()
+	defer r.Close()
+	dgst, err := digest.FromReader(r)
+	if err != nil {
+		panic(err)
+	}
+	return dgst
+})
+
+// tamperedReader flips the byte at off.
+type tamperedReader struct {
+	r   io.ReadCloser
+	off int64
+	pos int64
+}
+
+func (r *tamperedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.off >= r.pos && r.off < r.pos+int64(n) {
+		p[r.off-r.pos] ^= 0xff
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *tamperedReader) Close() error {
+	return r.r.Close()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type testEntry struct {
+	name string
+	idx  int
+	off  int64
+}
+
+// storeTestLayer stores the test tar to cache and returns the offsets of the files recorded in the streaming pass.
+func storeTestLayer(t *testing.T, cache esgzcache.BlobCache, opens *atomic.Int64) (*Layer, []testEntry) {
+	l, complete := Open(cache, "test", testTarDigest(), testChunkSize, func() (io.ReadCloser, error) {
+		opens.Add(1)
+		return testTar(), nil
+	})
+	if complete {
+		t.Fatalf("layer must not be complete before stored")
+	}
+	var entries []testEntry
+	if err := l.Store(nil, func(r io.Reader) error {
+		cr := &countingReader{r: r}
+		tr := tar.NewReader(cr)
+		for i := 0; ; i++ {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			entries = append(entries, testEntry{h.Name, i, cr.n})
+		}
+	}); err != nil {
+		t.Fatalf("failed to store layer: %v", err)
+	}
+	if len(entries) != testFileNum {
+		t.Fatalf("unexpected number of entries %d; want %d", len(entries), testFileNum)
+	}
+	return l, entries
+}
+
+func checkTestFiles(t *testing.T, l *Layer, entries []testEntry, rnd *rand.Rand, n int) {
+	want := make([]byte, 64*1024)
+	got := make([]byte, len(want))
+	for i := 0; i < n; i++ {
+		e := entries[rnd.Intn(len(entries))]
+		off := rnd.Int63n(testFileSize - int64(len(want)))
+		size := 1 + rnd.Intn(len(want))
+		testFileData(e.idx, off, want[:size])
+		if _, err := io.NewSectionReader(l, e.off, testFileSize).ReadAt(got[:size], off); err != nil {
+			t.Fatalf("failed to read %q at %d: %v", e.name, off, err)
+		}
+		if !bytes.Equal(got[:size], want[:size]) {
+			t.Fatalf("unexpected contents of %q at %d", e.name, off)
+		}
+	}
+}
+
+func TestLayerBoundedMemory(t *testing.T) {
+	var maxHeap uint64
+	measure := func() {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		maxHeap = max(maxHeap, ms.HeapAlloc)
+	}
+	measure()
+	baseHeap := maxHeap
+
+	c := NewMemoryCache(testCacheSize)
+	var opens atomic.Int64
+	l, entries := storeTestLayer(t, c, &opens)
+	measure()
+	if got, want := l.Size(), int64(testFileNum*(testFileSize+512)); got < want {
+		t.Fatalf("unexpected size %d; want >= %d", got, want)
+	}
+	if c.Size() > testCacheSize {
+		t.Fatalf("cache size %d exceeds the limit %d", c.Size(), testCacheSize)
+	}
+
+	// Most chunks are evicted so they need to be fetched again.
+	checkTestFiles(t, l, entries, rand.New(rand.NewSource(1)), 50)
+	measure()
+	if c.Size() > testCacheSize {
+		t.Fatalf("cache size %d exceeds the limit %d", c.Size(), testCacheSize)
+	}
+	if opens.Load() <= 1 {
+		t.Fatalf("evicted chunks must be fetched again")
+	}
+
+	// The whole layer (64MiB) must not be kept in memory.
+	limit := uint64(testCacheSize + 8*testChunkSize + 4*1024*1024)
+	if grown := maxHeap - baseHeap; grown > limit {
+		t.Fatalf("heap grew by %d bytes; want <= %d", grown, limit)
+	}
+}
+
+func TestLayerComplete(t *testing.T) {
+	c := NewMemoryCache(0)
+	var opens atomic.Int64
+	l, entries := storeTestLayer(t, c, &opens)
+	checkTestFiles(t, l, entries, rand.New(rand.NewSource(2)), 20)
+	if n := opens.Load(); n != 1 {
+		t.Fatalf("layer must be fetched once if the cache is large enough; fetched %d times", n)
+	}
+
+	l2, complete := Open(c, "test", testTarDigest(), testChunkSize, func() (io.ReadCloser, error) {
+		t.Fatalf("stored layer must not be fetched")
+		return nil, nil
+	})
+	if !complete {
+		t.Fatalf("stored layer must be complete")
+	}
+	if l2.Size() != l.Size() {
+		t.Fatalf("unexpected size %d; want %d", l2.Size(), l.Size())
+	}
+	checkTestFiles(t, l2, entries, rand.New(rand.NewSource(3)), 20)
+}
+
+func TestLayerReadAtEOF(t *testing.T) {
+	c := NewMemoryCache(0)
+	var opens atomic.Int64
+	l, _ := storeTestLayer(t, c, &opens)
+	p := make([]byte, 100)
+	n, err := l.ReadAt(p, l.Size()-10)
+	if n != 10 || err != io.EOF {
+		t.Fatalf("unexpected result of reading the end: %d, %v; want 10, EOF", n, err)
+	}
+}
+
+func TestLayerTampered(t *testing.T) {
+	c := NewMemoryCache(0)
+	l, _ := Open(c, "test", testTarDigest(), testChunkSize, func() (io.ReadCloser, error) {
+		return &tamperedReader{r: testTar(), off: testFileNum * testFileSize / 2}, nil
+	})
+	if err := l.Store(nil, func(r io.Reader) error {
+		_, err := io.Copy(io.Discard, tar.NewReader(r))
+		return err
+	}); err == nil {
+		t.Fatalf("tampered layer must not be stored")
+	}
+	if _, complete := Open(c, "test", testTarDigest(), testChunkSize, nil); complete {
+		t.Fatalf("tampered layer must not be complete")
+	}
+}
+
+func TestLayerRefillTampered(t *testing.T) {
+	c := NewMemoryCache(testCacheSize)
+	var tampered atomic.Bool
+	l, _ := Open(c, "test", testTarDigest(), testChunkSize, func() (io.ReadCloser, error) {
+		if tampered.Load() {
+			return &tamperedReader{r: testTar(), off: 0}, nil
+		}
+		return testTar(), nil
+	})
+	if err := l.Store(nil, func(r io.Reader) error { return nil }); err != nil {
+		t.Fatalf("failed to store layer: %v", err)
+	}
+	tampered.Store(true)
+	// The first chunk is evicted so it's read again from the tampered contents.
+	if _, err := l.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Fatalf("tampered chunk must not be served")
+	}
+}
+
+func TestLayerCorruptedCache(t *testing.T) {
+	c, err := esgzcache.NewDirectoryCache(t.TempDir(), esgzcache.DirectoryCacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var opens atomic.Int64
+	l, entries := storeTestLayer(t, c, &opens)
+	if _, complete := Open(c, "test", testTarDigest(), testChunkSize, nil); !complete {
+		t.Fatalf("stored layer must be complete")
+	}
+
+	// Overwrite a chunk in the cache (e.g. a cache directory modified after the previous run).
+	w, err := c.Add(l.chunkKey(3), esgzcache.Direct())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, testChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	l2, complete := Open(c, "test", testTarDigest(), testChunkSize, func() (io.ReadCloser, error) {
+		opens.Add(1)
+		return testTar(), nil
+	})
+	if complete {
+		t.Fatalf("corrupted layer must not be reused")
+	}
+	if err := l2.Store(nil, func(r io.Reader) error { return nil }); err != nil {
+		t.Fatalf("failed to store layer again: %v", err)
+	}
+	checkTestFiles(t, l2, entries, rand.New(rand.NewSource(4)), 20)
+}
+
+func TestLayerBudget(t *testing.T) {
+	const layerSize = 10 * testChunkSize
+	newLayer := func(c esgzcache.BlobCache, key string, seed int64) *Layer {
+		b := make([]byte, layerSize)
+		rand.New(rand.NewSource(seed)).Read(b)
+		l, _ := Open(c, key, digest.FromBytes(b), testChunkSize, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		})
+		return l
+	}
+	store := func(l *Layer, b *Budget) error {
+		return l.Store(b, func(r io.Reader) error { return nil })
+	}
+
+	// Each layer fits in the budget but the two layers don't.
+	budget := NewBudget(layerSize * 3 / 2)
+	c := NewMemoryCache(0)
+	if err := store(newLayer(c, "layer1", 1), budget); err != nil {
+		t.Fatalf("failed to store the first layer: %v", err)
+	}
+	if got, want := budget.Remain(), int64(layerSize/2); got != want {
+		t.Fatalf("unexpected remaining budget %d; want %d", got, want)
+	}
+	l2 := newLayer(c, "layer2", 2)
+	if err := store(l2, budget); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("unexpected error %v; want %v", err, ErrBudgetExceeded)
+	}
+	if got, want := budget.Remain(), int64(layerSize/2); got != want {
+		t.Fatalf("the failed layer must not be charged; remaining budget %d, want %d", got, want)
+	}
+	if _, complete := Open(c, "layer2", l2.dgst, testChunkSize, nil); complete {
+		t.Fatalf("layer exceeding the budget must not be complete")
+	}
+
+	// The layer exceeding the budget can be stored in another cache (e.g. a temporary directory).
+	dc, err := esgzcache.NewDirectoryCache(t.TempDir(), esgzcache.DirectoryCacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	if err := store(newLayer(dc, "layer2", 2), nil); err != nil {
+		t.Fatalf("failed to store the second layer without budget: %v", err)
+	}
+
+	// A layer larger than the whole budget is refused as well.
+	if err := store(newLayer(NewMemoryCache(0), "layer3", 3), NewBudget(layerSize-1)); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("unexpected error %v; want %v", err, ErrBudgetExceeded)
+	}
+}
@@ -0,0 +1,137 @@
+// Package layercache provides the caches of the layers used by imagemounter.
+package layercache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+)
+
+// MemoryCache is esgzcache.BlobCache on memory. When the total size of the entries exceeds the limit,
+// the least recently used entries are evicted. Entries being read aren't evicted until they're closed.
+type MemoryCache struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key  string
+	data []byte
+	refs int
+}
+
+// NewMemoryCache returns MemoryCache that keeps at most maxSize bytes (unlimited if 0).
+func NewMemoryCache(maxSize int64) *MemoryCache {
+	return &MemoryCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Size returns the total size of the entries.
+func (c *MemoryCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *MemoryCache) Get(key string, opts ...esgzcache.Option) (esgzcache.Reader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("missed cache: %q", key)
+	}
+	c.lru.MoveToFront(e)
+	ent := e.Value.(*memoryCacheEntry)
+	ent.refs++
+	var once sync.Once
+	return &reader{bytes.NewReader(ent.data), func() error {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			ent.refs--
+			c.evict()
+		})
+		return nil
+	}}, nil
+}
+
+func (c *MemoryCache) Add(key string, opts ...esgzcache.Option) (esgzcache.Writer, error) {
+	b := new(bytes.Buffer)
+	return &writer{
+		Writer: b,
+		commitFunc: func() error {
+			c.add(key, b.Bytes())
+			return nil
+		},
+	}, nil
+}
+
+func (c *MemoryCache) add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if c.maxSize > 0 && int64(len(data)) > c.maxSize {
+		return // never fits
+	}
+	c.entries[key] = c.lru.PushFront(&memoryCacheEntry{key: key, data: data})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+func (c *MemoryCache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	for e := c.lru.Back(); e != nil && c.size > c.maxSize; {
+		prev := e.Prev()
+		if ent := e.Value.(*memoryCacheEntry); ent.refs == 0 {
+			c.lru.Remove(e)
+			delete(c.entries, ent.key)
+			c.size -= int64(len(ent.data))
+		}
+		e = prev
+	}
+}
+
+func (c *MemoryCache) Close() error {
+	return nil
+}
+
+type reader struct {
+	io.ReaderAt
+	closeFunc func() error
+}
+
+func (r *reader) Close() error {
+	return r.closeFunc()
+}
+
+type writer struct {
+	io.Writer
+	commitFunc func() error
+}
+
+func (w *writer) Commit() error {
+	return w.commitFunc()
+}
+
+func (w *writer) Abort() error {
+	return nil
+}
+
+func (w *writer) Close() error {
+	return nil
+}
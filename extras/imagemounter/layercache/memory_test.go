@@ -0,0 +1,151 @@
+package layercache
+
+import (
+	"io"
+	"testing"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+)
+
+func addEntry(t *testing.T, c esgzcache.BlobCache, key string, data string) {
+	t.Helper()
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readEntry(t *testing.T, c esgzcache.BlobCache, key string) (string, error) {
+	t.Helper()
+	r, err := c.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), nil
+}
+
+func TestMemoryCacheEvict(t *testing.T) {
+	c := NewMemoryCache(10)
+	addEntry(t, c, "a", "aaaa")
+	r, err := c.Get("a")
+	if err != nil {
+		t.Fatalf("failed to get a: %v", err)
+	}
+	addEntry(t, c, "b", "bbbb")
+	addEntry(t, c, "c", "cccc") // "a" is being read so "b" is evicted
+	if _, err := c.Get("b"); err == nil {
+		t.Fatalf("b must be evicted")
+	}
+	if c.Size() != 8 {
+		t.Fatalf("unexpected size %d; want 8", c.Size())
+	}
+	b := make([]byte, 4)
+	if _, err := r.ReadAt(b, 0); err != nil || string(b) != "aaaa" {
+		t.Fatalf("unexpected contents %q (%v) of the entry being read", b, err)
+	}
+	r.Close()
+	r.Close()
+	// Closing twice must not unpin the entry again.
+	r.Close()
+	addEntry(t, c, "d", "dddd") // "a" is the least recently used
+	if _, err := c.Get("a"); err == nil {
+		t.Fatalf("a must be evicted")
+	}
+	addEntry(t, c, "e", "too large entry")
+	if _, err := c.Get("e"); err == nil {
+		t.Fatalf("entry larger than the limit must not be added")
+	}
+}
+
+func TestMemoryCacheLRU(t *testing.T) {
+	c := NewMemoryCache(12)
+	for _, k := range []string{"a", "b", "c"} {
+		addEntry(t, c, k, k+k+k+k)
+	}
+	if _, err := readEntry(t, c, "a"); err != nil { // "b" becomes the least recently used
+		t.Fatalf("failed to get a: %v", err)
+	}
+	addEntry(t, c, "d", "dddd")
+	for k, evicted := range map[string]bool{"a": false, "b": true, "c": false, "d": false} {
+		got, err := readEntry(t, c, k)
+		if evicted {
+			if err == nil {
+				t.Errorf("%s must be evicted", k)
+			}
+			continue
+		}
+		if err != nil || got != k+k+k+k {
+			t.Errorf("unexpected contents %q (%v) of %s", got, err, k)
+		}
+	}
+}
+
+func TestMemoryCachePinned(t *testing.T) {
+	c := NewMemoryCache(8)
+	addEntry(t, c, "a", "aaaa")
+	addEntry(t, c, "b", "bbbb")
+	ra, err := c.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb, err := c.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entries being read can't be evicted so the new entry is evicted instead.
+	addEntry(t, c, "c", "cccc")
+	if _, err := c.Get("c"); err == nil {
+		t.Fatalf("c must be evicted while a and b are being read")
+	}
+	if c.Size() != 8 {
+		t.Fatalf("unexpected size %d; want 8", c.Size())
+	}
+	// The closed entry can be evicted.
+	ra.Close()
+	addEntry(t, c, "c", "cccc")
+	if _, err := c.Get("a"); err == nil {
+		t.Fatalf("a must be evicted after it's closed")
+	}
+	rb.Close()
+	for _, k := range []string{"b", "c"} {
+		if _, err := readEntry(t, c, k); err != nil {
+			t.Errorf("failed to get %s: %v", k, err)
+		}
+	}
+}
+
+func TestMemoryCacheUnlimited(t *testing.T) {
+	c := NewMemoryCache(0)
+	for _, k := range []string{"a", "b", "c"} {
+		addEntry(t, c, k, k+k+k+k)
+	}
+	addEntry(t, c, "a", "xxxx") // the existing entry is kept
+	if got, err := readEntry(t, c, "a"); err != nil || got != "aaaa" {
+		t.Fatalf("unexpected contents %q (%v) of a", got, err)
+	}
+	if c.Size() != 12 {
+		t.Fatalf("unexpected size %d; want 12", c.Size())
+	}
+	w, err := c.Add("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("dddd"))
+	w.Abort()
+	w.Close()
+	if _, err := c.Get("d"); err == nil {
+		t.Fatalf("aborted entry must not be added")
+	}
+}
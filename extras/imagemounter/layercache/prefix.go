@@ -0,0 +1,28 @@
+package layercache
+
+import (
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+)
+
+// WithPrefix returns the cache that adds the prefix to the keys of c so that the users of c don't
+// conflict. Closing the returned cache doesn't close c because c is shared among the users.
+func WithPrefix(c esgzcache.BlobCache, prefix string) esgzcache.BlobCache {
+	return &prefixedCache{c, prefix}
+}
+
+type prefixedCache struct {
+	c      esgzcache.BlobCache
+	prefix string
+}
+
+func (c *prefixedCache) Add(key string, opts ...esgzcache.Option) (esgzcache.Writer, error) {
+	return c.c.Add(c.prefix+key, opts...)
+}
+
+func (c *prefixedCache) Get(key string, opts ...esgzcache.Option) (esgzcache.Reader, error) {
+	return c.c.Get(c.prefix+key, opts...)
+}
+
+func (c *prefixedCache) Close() error {
+	return nil // the underlying cache is shared
+}
@@ -0,0 +1,51 @@
+package layercache
+
+import (
+	"testing"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+)
+
+// closeCountingCache counts the calls of Close.
+type closeCountingCache struct {
+	esgzcache.BlobCache
+	closed int
+}
+
+func (c *closeCountingCache) Close() error {
+	c.closed++
+	return c.BlobCache.Close()
+}
+
+func TestWithPrefix(t *testing.T) {
+	c := &closeCountingCache{BlobCache: NewMemoryCache(0)}
+	l1, l2 := WithPrefix(c, "layer1-"), WithPrefix(c, "layer2-")
+	addEntry(t, l1, "blob", "1111")
+	addEntry(t, l2, "blob", "2222")
+	for _, tt := range []struct {
+		c    esgzcache.BlobCache
+		key  string
+		want string
+	}{
+		{l1, "blob", "1111"},
+		{l2, "blob", "2222"},
+		{c, "layer1-blob", "1111"},
+		{c, "layer2-blob", "2222"},
+	} {
+		if got, err := readEntry(t, tt.c, tt.key); err != nil || got != tt.want {
+			t.Errorf("unexpected contents %q (%v) of %q; want %q", got, err, tt.key, tt.want)
+		}
+	}
+	if _, err := l1.Get("layer2-blob"); err == nil {
+		t.Errorf("the entry of the other prefix must not be visible")
+	}
+	if err := l1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.closed != 0 {
+		t.Fatalf("the underlying cache must not be closed")
+	}
+	if got, err := readEntry(t, l2, "blob"); err != nil || got != "2222" {
+		t.Fatalf("unexpected contents %q (%v) after closing the other prefix", got, err)
+	}
+}
@@ -0,0 +1,240 @@
+package layercache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry serves the blobs of the repository "test". Manifests are served by the tags as well.
+type testRegistry struct {
+	blobs map[digest.Digest][]byte
+	types map[digest.Digest]string
+	tags  map[string]digest.Digest
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		blobs: make(map[digest.Digest][]byte),
+		types: make(map[digest.Digest]string),
+		tags:  make(map[string]digest.Digest),
+	}
+}
+
+func (r *testRegistry) add(mediaType string, b []byte) imagespec.Descriptor {
+	dgst := digest.FromBytes(b)
+	r.blobs[dgst] = b
+	r.types[dgst] = mediaType
+	return imagespec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(b))}
+}
+
+func (r *testRegistry) addJSON(t *testing.T, mediaType string, v interface{}) imagespec.Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.add(mediaType, b)
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var dgst digest.Digest
+	if ref, ok := strings.CutPrefix(req.URL.Path, "/v2/test/manifests/"); ok {
+		if dgst, ok = r.tags[ref]; !ok {
+			dgst = digest.Digest(ref)
+		}
+	} else if ref, ok := strings.CutPrefix(req.URL.Path, "/v2/test/blobs/"); ok {
+		dgst = digest.Digest(ref)
+	}
+	b, ok := r.blobs[dgst]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", r.types[dgst])
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	if req.Method == http.MethodGet {
+		w.Write(b)
+	}
+}
+
+// signCosign adds the cosign signature of dgst signed by key.
+func (r *testRegistry) signCosign(t *testing.T, key *ecdsa.PrivateKey, dgst digest.Digest) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example.com/test"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, dgst))
+	h := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := r.add("application/vnd.dev.cosign.simplesigning.v1+json", payload)
+	l.Annotations = map[string]string{"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(sig)}
+	m := r.addJSON(t, imagespec.MediaTypeImageManifest, imagespec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imagespec.MediaTypeImageManifest,
+		Config:    r.add(imagespec.MediaTypeImageConfig, []byte(`{}`)),
+		Layers:    []imagespec.Descriptor{l},
+	})
+	r.tags[dgst.Algorithm().String()+"-"+dgst.Encoded()+".sig"] = m.Digest
+}
+
+func gunzip(r io.ReadCloser) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false) // the data following the gzip stream is ignored
+	return &readCloser{zr, r.Close}, nil
+}
+
+func TestLayerTamperedRegistry(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := imagepolicy.ParsePolicy([]byte(fmt.Sprintf(`{"cosignPublicKeys":[%q]}`, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	data := bytes.Repeat([]byte("hello"), 100000)
+	if err := tw.WriteHeader(&tar.Header{Name: "hello", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var blob bytes.Buffer
+	zw := gzip.NewWriter(&blob)
+	if _, err := zw.Write(tarBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID := digest.FromBytes(tarBuf.Bytes())
+
+	reg := newTestRegistry()
+	layer := reg.add(imagespec.MediaTypeImageLayerGzip, blob.Bytes())
+	manifest := reg.addJSON(t, imagespec.MediaTypeImageManifest, imagespec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imagespec.MediaTypeImageManifest,
+		Config: reg.addJSON(t, imagespec.MediaTypeImageConfig, imagespec.Image{
+			RootFS: imagespec.RootFS{Type: "layers", DiffIDs: []digest.Digest{diffID}},
+		}),
+		Layers: []imagespec.Descriptor{layer},
+	})
+	reg.tags["latest"] = manifest.Digest
+	reg.signCosign(t, key, manifest.Digest)
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts)),
+	})
+	ref := host + "/test"
+	fetcher, err := resolver.Fetcher(ctx, ref+":latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &imagepolicy.RegistryStore{
+		Locator:  ref,
+		Resolver: resolver,
+		Fetcher:  fetcher,
+		Hosts: func() ([]imagepolicy.RegistryHost, error) {
+			return []imagepolicy.RegistryHost{{Scheme: "http", Host: host, Path: "/v2"}}, nil
+		},
+	}
+	desc, err := store.Resolve(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imagepolicy.Verify(ctx, store, policy, desc.Digest); err != nil {
+		t.Fatalf("failed to verify the manifest: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		blob   []byte
+		wantOK bool
+	}{
+		{
+			name:   "original",
+			blob:   blob.Bytes(),
+			wantOK: true,
+		},
+		{
+			name: "modified",
+			blob: func() []byte {
+				b := bytes.Clone(blob.Bytes())
+				b[len(b)/2] ^= 0xff
+				return b
+			}(),
+		},
+		{
+			// The tar matches diffID but the blob doesn't match the digest in the manifest.
+			name: "appended",
+			blob: append(bytes.Clone(blob.Bytes()), "appended"...),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reg.blobs[layer.Digest] = tt.blob
+			c := NewMemoryCache(0)
+			open := func() (io.ReadCloser, error) {
+				r, err := fetcher.Fetch(ctx, layer)
+				if err != nil {
+					return nil, err
+				}
+				return VerifyBlob(r, layer.Digest, gunzip)
+			}
+			l, _ := Open(c, "test", diffID, DefaultChunkSize, open)
+			err := l.Store(nil, func(r io.Reader) error {
+				_, err := io.Copy(io.Discard, tar.NewReader(r))
+				return err
+			})
+			if tt.wantOK {
+				if err != nil {
+					t.Fatalf("failed to store layer: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("tampered blob must not be stored")
+			}
+			if _, complete := Open(c, "test", diffID, DefaultChunkSize, open); complete {
+				t.Fatalf("tampered blob must not be complete")
+			}
+		})
+	}
+}
@@ -2,31 +2,19 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
 	"context"
-	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
-	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math/big"
 	"mime"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -34,6 +22,7 @@ import (
 	"unsafe"
 
 	ctdcontainers "github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/images"
 	ctdnamespaces "github.com/containerd/containerd/namespaces"
 	ctdoci "github.com/containerd/containerd/oci"
 	"github.com/containerd/containerd/reference"
@@ -42,6 +31,7 @@ import (
 	"github.com/containerd/platforms"
 	esgzcache "github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	esgzconfig "github.com/containerd/stargz-snapshotter/fs/config"
 	esgzreader "github.com/containerd/stargz-snapshotter/fs/reader"
 	esgzremote "github.com/containerd/stargz-snapshotter/fs/remote"
@@ -49,12 +39,16 @@ import (
 	esgzmetadata "github.com/containerd/stargz-snapshotter/metadata"
 	esgzmetadatamemory "github.com/containerd/stargz-snapshotter/metadata/memory"
 	esgztask "github.com/containerd/stargz-snapshotter/task"
-	esgzcontainerdutil "github.com/containerd/stargz-snapshotter/util/containerdutil"
-	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
-	gvnvirtualnetwork "github.com/containers/gvisor-tap-vsock/pkg/virtualnetwork"
 	p9staticfs "github.com/hugelgupf/p9/fsimpl/staticfs"
 	"github.com/hugelgupf/p9/fsimpl/templatefs"
 	"github.com/hugelgupf/p9/p9"
+	"github.com/ktock/container2wasm/extras/imagemounter/hostlayer"
+	"github.com/ktock/container2wasm/extras/imagemounter/layercache"
+	"github.com/ktock/container2wasm/extras/imagemounter/ocilayout"
+	"github.com/ktock/container2wasm/extras/imagemounter/registryauth"
+	"github.com/ktock/container2wasm/extras/imagemounter/registryhosts"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
+	"github.com/ktock/container2wasm/internal/netstack"
 	"github.com/moby/sys/user"
 	digest "github.com/opencontainers/go-digest"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -63,360 +57,9 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-var proxyKey crypto.PrivateKey
-var proxyCert *x509.Certificate
-
-const proxyIP = "192.168.127.253"
-
+// p9IP is the address that serves the image via 9p.
 const p9IP = "192.168.127.252"
 
-func handleTunneling(w http.ResponseWriter, r *http.Request) {
-	serverURL := r.URL
-	cert, err := generateCert(serverURL.Hostname())
-	if err != nil {
-		log.Printf("failed to generate cert: %v\n", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
-	}
-	client_conn, _, err := hijacker.Hijack()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-	go func() {
-		defer client_conn.Close()
-		l := newListener(&stringAddr{"tcp", proxyIP + ":80"}, client_conn)
-		server := &http.Server{
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.URL.Scheme == "" {
-					r.URL.Scheme = "https"
-				}
-				if r.URL.Host == "" {
-					r.URL.Host = serverURL.Host
-				}
-				handleHTTP(w, r)
-			}),
-			// Disable HTTP/2 (FIXME)
-			// https://pkg.go.dev/net/http#hdr-HTTP_2
-			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		}
-		server.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{*cert},
-		}
-		log.Printf("serving server for %s...\n", serverURL.Host)
-		server.ServeTLS(l, "", "")
-	}()
-}
-
-func generateCert(host string) (*tls.Certificate, error) {
-	ser, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 60))
-	if err != nil {
-		return nil, err
-	}
-	cert := &x509.Certificate{
-		SerialNumber: ser,
-		Subject: pkix.Name{
-			CommonName: host,
-		},
-		NotAfter:    time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		DNSNames:    []string{host},
-	}
-	if ip := net.ParseIP(host); ip != nil {
-		cert.IPAddresses = append(cert.IPAddresses, ip)
-	}
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	certD, err := x509.CreateCertificate(rand.Reader, cert, proxyCert, key.Public(), proxyKey)
-	if err != nil {
-		return nil, err
-	}
-	return &tls.Certificate{
-		Certificate: [][]byte{certD},
-		PrivateKey:  key,
-	}, nil
-}
-
-type listener struct {
-	ch      net.Conn
-	addr    net.Addr
-	closeCh chan struct{}
-}
-
-func newListener(addr net.Addr, ch net.Conn) *listener {
-	return &listener{
-		ch:      ch,
-		addr:    addr,
-		closeCh: make(chan struct{}),
-	}
-}
-
-func (l *listener) Accept() (net.Conn, error) {
-	if l.ch == nil {
-		<-l.closeCh
-		return nil, fmt.Errorf("closed")
-	}
-	c := l.ch
-	l.ch = nil
-	return c, nil
-}
-
-func (l *listener) Close() error { close(l.closeCh); return nil }
-
-func (l *listener) Addr() net.Addr { return l.addr }
-
-type stringAddr struct {
-	network string
-	address string
-}
-
-func (a *stringAddr) Network() string { return a.network }
-func (a *stringAddr) String() string  { return a.address }
-
-type FetchParameters struct {
-	Method  string            `json:"method,omitempty"`
-	Headers map[string]string `json:"headers,omitempty"`
-}
-
-type FetchResponse struct {
-	Headers    map[string]string `json:"headers,omitempty"`
-	Status     int               `json:"status,omitempty"`
-	StatusText string            `json:"statusText,omitempty"`
-}
-
-func encodeHeader(h http.Header) map[string]string {
-	res := make(map[string]string)
-	for k, vs := range h {
-		res[k] = strings.Join(vs, ", ")
-	}
-	return res
-}
-
-func decodeHeader(h map[string]string) http.Header {
-	res := make(http.Header)
-	for k, v := range h {
-		res.Add(k, v)
-	}
-	return res
-}
-
-func httpRequestToFetchParameters(req *http.Request) *FetchParameters {
-	return &FetchParameters{
-		Method:  req.Method,
-		Headers: encodeHeader(req.Header),
-	}
-}
-
-func contentLengthFromHeaders(h http.Header) int64 {
-	i, _ := strconv.Atoi(h.Get("Content-Length"))
-	return int64(i)
-}
-
-func fetchResponseToHTTPResponse(req *http.Request, resp *FetchResponse) *http.Response {
-	h := decodeHeader(resp.Headers)
-	return &http.Response{
-		Request:       req,
-		Status:        resp.StatusText,
-		StatusCode:    resp.Status,
-		Header:        h,
-		ContentLength: contentLengthFromHeaders(h), // required by containerd resolver
-	}
-}
-
-//go:wasmimport env http_send
-func http_send(addressP uint32, addresslen uint32, reqP, reqlen uint32, idP uint32) uint32
-
-//go:wasmimport env http_writebody
-func http_writebody(id uint32, chunkP, len uint32, nwrittenP uint32, isEOF uint32) uint32
-
-//go:wasmimport env http_isreadable
-func http_isreadable(id uint32, isOKP uint32) uint32
-
-//go:wasmimport env http_recv
-func http_recv(id uint32, respP uint32, bufsize uint32, respsizeP uint32, isEOFP uint32) uint32
-
-//go:wasmimport env http_readbody
-func http_readbody(id uint32, bodyP uint32, bufsize uint32, bodysizeP uint32, isEOFP uint32) uint32
-
-func doHttpRoundTrip(req *http.Request) (*http.Response, error) {
-	defer func() {
-		if req.Body != nil {
-			req.Body.Close()
-		}
-	}()
-
-	address := req.URL.String()
-	if address == "" {
-		return nil, fmt.Errorf("specify destination address")
-	}
-
-	fetchReqD, err := json.Marshal(httpRequestToFetchParameters(req))
-	if err != nil {
-		return nil, err
-	}
-	if len(fetchReqD) == 0 {
-		return nil, fmt.Errorf("empty request")
-	}
-
-	var id uint32
-	res := http_send(
-		uint32(uintptr(unsafe.Pointer(&[]byte(address)[0]))),
-		uint32(len(address)),
-		uint32(uintptr(unsafe.Pointer(&[]byte(fetchReqD)[0]))),
-		uint32(len(fetchReqD)),
-		uint32(uintptr(unsafe.Pointer(&id))),
-	)
-	if res != 0 {
-		return nil, fmt.Errorf("failed to send request")
-	}
-
-	var buf []byte = make([]byte, 1048576)
-	var isEOF uint32
-	var nwritten uint32 = 0
-	idx := 0
-	chunksize := 0
-	bodyR := io.Reader(req.Body)
-	if bodyR == nil {
-		bodyR = bytes.NewReader(make([]byte, 0))
-	}
-	for {
-		if idx >= chunksize {
-			// chunk is fully written. full another one.
-			chunksize, err = bodyR.Read(buf)
-			if err != nil && err != io.EOF {
-				return nil, err
-			}
-			if err == io.EOF {
-				isEOF = 1
-			}
-			idx = 0
-		}
-		res := http_writebody(
-			id,
-			uint32(uintptr(unsafe.Pointer(&[]byte(buf[idx:])[0]))),
-			uint32(chunksize),
-			uint32(uintptr(unsafe.Pointer(&nwritten))),
-			isEOF,
-		)
-		if res != 0 {
-			return nil, fmt.Errorf("failed to write request body")
-		}
-		idx += int(nwritten)
-		if idx < chunksize {
-			// not fully written. retry for the remaining.
-			continue
-		}
-		if isEOF == 1 {
-			break
-		}
-	}
-
-	var isOK uint32 = 0
-	for {
-		res := http_isreadable(id, uint32(uintptr(unsafe.Pointer(&isOK))))
-		if res != 0 {
-			return nil, fmt.Errorf("response body is not readable")
-		}
-		if isOK == 1 {
-			break
-		}
-		time.Sleep(5 * time.Millisecond)
-	}
-
-	var respsize uint32
-	var respFull []byte
-	isEOF = 0
-	for {
-		res := http_recv(
-			id,
-			uint32(uintptr(unsafe.Pointer(&[]byte(buf)[0]))),
-			uint32(len(buf)),
-			uint32(uintptr(unsafe.Pointer(&respsize))),
-			uint32(uintptr(unsafe.Pointer(&isEOF))),
-		)
-		if res != 0 {
-			return nil, fmt.Errorf("failed to receive response")
-		}
-		respFull = append(respFull, buf[:int(respsize)]...)
-		if isEOF == 1 {
-			break
-		}
-	}
-	var resp FetchResponse
-	if err := json.Unmarshal(respFull, &resp); err != nil {
-		return nil, err
-	}
-	respFull = nil
-
-	isEOF = 0
-	pr, pw := io.Pipe()
-	go func() {
-		var bodysize uint32
-		for {
-			res := http_readbody(
-				id,
-				uint32(uintptr(unsafe.Pointer(&[]byte(buf)[0]))),
-				uint32(len(buf)),
-				uint32(uintptr(unsafe.Pointer(&bodysize))),
-				uint32(uintptr(unsafe.Pointer(&isEOF))),
-			)
-			if res != 0 {
-				pw.CloseWithError(fmt.Errorf("failed to read response body"))
-				return
-			}
-			if bodysize > 0 {
-				if _, err := pw.Write(buf[:int(bodysize)]); err != nil {
-					pw.CloseWithError(err)
-					return
-				}
-			}
-			if isEOF == 1 {
-				break
-			}
-		}
-		buf = nil
-		pw.Close()
-	}()
-	r := fetchResponseToHTTPResponse(req, &resp)
-	r.Body = pr
-	return r, nil
-}
-
-func handleHTTP(w http.ResponseWriter, req *http.Request) {
-	resp, err := doHttpRoundTrip(req)
-	if err != nil {
-		log.Printf("failed to proxy request: %v\n", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-	defer resp.Body.Close()
-	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}
-
-func copyHeader(dst, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
-		}
-	}
-}
-
-const (
-	gatewayIP = "192.168.127.1"
-	vmIP      = "192.168.127.3"
-)
-
 func main() {
 	var listenFd int
 	flag.IntVar(&listenFd, "net-listenfd", 0, "fd to listen for the connection")
@@ -424,12 +67,46 @@ func main() {
 	flag.IntVar(&certFd, "certfd", 0, "fd to output cert")
 	var certFile string
 	flag.StringVar(&certFile, "certfile", "", "file to output cert")
+	var caCertFile string
+	flag.StringVar(&caCertFile, "ca-cert", "", "PEM file of the CA certificate used for signing the certificates of the destinations (a CA is generated if not specified)")
+	var caKeyFile string
+	flag.StringVar(&caKeyFile, "ca-key", "", "PEM file of the private key of -ca-cert")
+	var leafCertValidity time.Duration
+	flag.DurationVar(&leafCertValidity, "leaf-cert-validity", netstack.DefaultLeafCertValidity, "validity period of the certificates generated for the destinations")
 	var debug bool
 	flag.BoolVar(&debug, "debug", false, "debug log")
+	var httpEventFd int
+	flag.IntVar(&httpEventFd, "http-eventfd", 0, "fd to receive the IDs of the fetch requests that became readable (the host is polled if not specified)")
+	var rules []netstack.Rule
+	flag.Var(&netstack.RuleFlag{Rules: &rules, Allow: true}, "allow", "allow requests from the container to TARGET[:PORT] (TARGET is CIDR, IP, hostname, *.DOMAIN or *). Rules are evaluated in the specified order with -deny and the first match is applied. If any -allow is specified, requests not matching any rule are denied.")
+	flag.Var(&netstack.RuleFlag{Rules: &rules, Allow: false}, "deny", "deny requests from the container to TARGET[:PORT] (same format as -allow)")
+	var requestRate float64
+	flag.Float64Var(&requestRate, "request-rate", 0, "max number of requests per second from the container (0 means unlimited)")
+	var auditLogFile string
+	flag.StringVar(&auditLogFile, "audit-log", "", "file to record blocked requests as JSON lines (\"-\" means stderr)")
+	var pcapFile string
+	flag.StringVar(&pcapFile, "pcap", "", "file to record all ethernet frames exchanged with the container in pcapng format")
+	var pcapRing int
+	flag.IntVar(&pcapRing, "pcap-ring", 0, "number of recent ethernet frames kept in memory and served in pcapng format at http://"+netstack.GatewayIP+netstack.DebugPcapPath+" (0 disables)")
 	var arch string
 	flag.StringVar(&arch, "arch", "amd64", "target image architecture")
 	var imageAddr string
-	flag.StringVar(&imageAddr, "image-addr", "", "base address of image structured as OCI Image Layout")
+	flag.StringVar(&imageAddr, "image-addr", "", "image reference in the registry (can be pinned as NAME@sha256:DIGEST) or base address of image structured as OCI Image Layout (the image in the layout can be chosen as ADDR:TAG or ADDR@sha256:DIGEST)")
+	var imageDigestFd int
+	flag.IntVar(&imageDigestFd, "image-digest-fd", 0, "fd to output the digest resolved from -image-addr")
+	var cacheDir string
+	flag.StringVar(&cacheDir, "cache-dir", "", "directory to cache the layers persistently (e.g. a directory preopened by the WASI runtime)")
+	var cacheHost bool
+	flag.BoolVar(&cacheHost, "cache-host", false, "cache the layers persistently in the storage provided by the host (e.g. Cache API of the browser)")
+	var cacheMemorySize int64
+	flag.Int64Var(&cacheMemorySize, "cache-memory-size", 512*1024*1024, "max bytes of the layers cached in memory if neither -cache-dir nor -cache-host is specified (0 means unlimited). Streamed layers exceeding it are stored in the temporary directory")
+	var registryAuth registryauth.Flag
+	flag.Var(&registryAuth, "registry-auth", "credentials of the registry as HOST=USERNAME:PASSWORD (can be specified multiple times)")
+	var registryAuthHost bool
+	flag.BoolVar(&registryAuthHost, "registry-auth-host", false, "ask the host for the credentials of the registries not specified by -registry-auth and "+dockerAuthConfigEnv)
+	var imagePolicyFile string
+	flag.StringVar(&imagePolicyFile, "image-policy", "", "JSON file of the policy of the signatures (cosign, Notation) and the provenance required for serving the image. Unsigned images are refused")
+	flag.StringVar(&registryHostsDir, "registry-hosts-dir", "", "directory containing hosts.toml of the registries laid out as containerd's hosts directory (e.g. a directory preopened by the WASI runtime) for configuring mirrors, plain HTTP registries, CA certificates, etc.")
 	flag.Parse()
 
 	if debug {
@@ -440,46 +117,89 @@ func main() {
 		logrus.SetLevel(logrus.FatalLevel)
 	}
 
+	if err := netstack.CheckHostABI(hostABIVersion); err != nil {
+		panic(err)
+	}
+	if httpEventFd != 0 {
+		fetchTransport.Events = netstack.OpenEventFD(httpEventFd)
+	}
+
 	var (
 		imageServer *p9.Server
 		waitImageServerInit func()
 		err error
 	)
 	if imageAddr != "" {
-		imageServer, waitImageServerInit, err = NewImageServer(context.TODO(), imageAddr, imagespec.Platform{
+		creds := []registryauth.Func{registryAuth.Lookup}
+		if c := os.Getenv(dockerAuthConfigEnv); c != "" {
+			f, err := registryauth.FromDockerConfig([]byte(c))
+			if err != nil {
+				panic(fmt.Errorf("invalid %s: %w", dockerAuthConfigEnv, err))
+			}
+			creds = append(creds, f)
+		}
+		if registryAuthHost {
+			creds = append(creds, hostCredentials)
+		}
+		registryCredentials = registryauth.Chain(creds...)
+		if imagePolicyFile != "" {
+			imagePolicy, err = imagepolicy.LoadPolicyFile(imagePolicyFile)
+			if err != nil {
+				panic(err)
+			}
+		}
+		var cache *layerCache
+		cache, err = newLayerCache(cacheDir, cacheHost, cacheMemorySize)
+		if err != nil {
+			panic(err)
+		}
+		var imageDigest digest.Digest
+		imageServer, imageDigest, waitImageServerInit, err = NewImageServer(context.TODO(), imageAddr, imagespec.Platform{
 			Architecture: arch,
 			OS:           "linux",
-		})
+		}, cache)
 		if err != nil {
 			panic(err)
 		}
+		if imageDigestFd != 0 {
+			f := os.NewFile(uintptr(imageDigestFd), "")
+			if _, err := f.WriteString(imageDigest.String()); err != nil {
+				panic(err)
+			}
+			if err := f.Close(); err != nil {
+				panic(err)
+			}
+		}
 	}
 
-	ser, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 60))
-	if err != nil {
-		panic(err)
+	var auditLog io.Writer
+	if auditLogFile == "-" {
+		auditLog = os.Stderr
+	} else if auditLogFile != "" {
+		f, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		auditLog = f
 	}
-	cert := &x509.Certificate{
-		SerialNumber: ser,
-		Subject: pkix.Name{
-			CommonName:         proxyIP,
-			OrganizationalUnit: []string{"proxy"},
-			Organization:       []string{"proxy"},
-			Country:            []string{"US"},
-		},
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		DNSNames:              []string{proxyIP},
-		IPAddresses:           []net.IP{net.ParseIP(proxyIP)},
-		IsCA:                  true,
-		BasicConstraintsValid: true,
-	}
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		panic(err)
+	proxyOpts := []netstack.ProxyOption{
+		netstack.WithLeafCertValidity(leafCertValidity),
+		netstack.WithPolicy(netstack.NewPolicy(rules, requestRate, auditLog)),
+	}
+	if caCertFile != "" || caKeyFile != "" {
+		caCert, caKey, err := netstack.LoadCA(caCertFile, caKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		proxyOpts = append(proxyOpts, netstack.WithCA(caCert, caKey))
+	}
+	var captureRing *netstack.FrameRing
+	if pcapRing > 0 {
+		captureRing = netstack.NewFrameRing(pcapRing)
+		proxyOpts = append(proxyOpts, netstack.WithFrameRing(captureRing))
 	}
-	certD, err := x509.CreateCertificate(rand.Reader, cert, cert, key.Public(), key)
+	proxy, err := netstack.NewProxy(fetchTransport, proxyOpts...)
 	if err != nil {
 		panic(err)
 	}
@@ -492,92 +212,75 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-	} else {
+	} else if caCertFile == "" {
 		panic("specify cert destination")
 	}
-	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: certD}); err != nil {
-		panic(err)
-	}
-	if err := f.Close(); err != nil {
-		panic(err)
-	}
-	tlsCert := &tls.Certificate{
-		Certificate: [][]byte{certD},
-		PrivateKey:  key,
-	}
-	proxyCert, err = x509.ParseCertificate(tlsCert.Certificate[0])
-	if err != nil {
-		panic(err)
+	if f != nil {
+		if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: proxy.CACert().Raw}); err != nil {
+			panic(err)
+		}
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
 	}
-	proxyKey = key
 
-	config := &gvntypes.Configuration{
-		Debug:             debug,
-		MTU:               1500,
-		Subnet:            "192.168.127.0/24",
-		GatewayIP:         gatewayIP,
-		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
-		GatewayVirtualIPs: []string{proxyIP, p9IP},
-		Protocol:          gvntypes.QemuProtocol,
-	}
-	vn, err := gvnvirtualnetwork.New(config)
+	vn, err := netstack.New(
+		netstack.WithDebug(debug),
+		netstack.WithVirtualIPs(netstack.ProxyIP, p9IP),
+	)
 	if err != nil {
 		panic(err)
 	}
-
-	server := &http.Server{
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == http.MethodConnect {
-				handleTunneling(w, r)
-			} else {
-				handleHTTP(w, r)
+	go func() {
+		log.Fatal(proxy.Serve(vn))
+	}()
+	if imageAddr != "" {
+		go func() {
+			l, err := vn.Listen("tcp", p9IP+":80")
+			if err != nil {
+				panic(err)
+			}
+			if waitImageServerInit != nil {
+				waitImageServerInit()
 			}
-		}),
-		// Disable HTTP/2 (FIXME)
-		// https://pkg.go.dev/net/http#hdr-HTTP_2
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+			log.Fatal(imageServer.Serve(l))
+		}()
 	}
-
-	go func() {
-		s := server
-		s.Addr = "0.0.0.0:80"
-		l, err := vn.Listen("tcp", proxyIP+":80")
+	var onFrame []func(netstack.Frame)
+	if pcapFile != "" {
+		f, err := os.Create(pcapFile)
 		if err != nil {
 			panic(err)
 		}
-		log.Println("serving proxy with http")
-		log.Fatal(server.Serve(l))
-	}()
-	go func() {
-		s := server
-		s.Addr = "0.0.0.0:443"
-		l, err := vn.Listen("tcp", proxyIP+":443")
+		defer f.Close()
+		p, err := netstack.NewPcapngWriter(f)
 		if err != nil {
 			panic(err)
 		}
-		s.TLSConfig = &tls.Config{
-			Certificates: make([]tls.Certificate, 1),
+		ifID, err := p.AddInterface("vm")
+		if err != nil {
+			panic(err)
 		}
-		s.TLSConfig.Certificates[0] = *tlsCert
-		log.Println("serving proxy with https")
-		log.Fatal(server.ServeTLS(l, "", ""))
-	}()
-	if imageAddr != "" {
-		go func() {
-			l, err := vn.Listen("tcp", p9IP+":80")
-			if err != nil {
-				panic(err)
+		onFrame = append(onFrame, func(fr netstack.Frame) {
+			if err := p.WriteFrame(ifID, fr); err != nil {
+				log.Printf("failed to write captured frame: %v\n", err)
 			}
+		})
+	}
+	if captureRing != nil {
+		onFrame = append(onFrame, captureRing.Add)
+		go func() {
+			l, err := vn.Listen("tcp", netstack.GatewayIP+":80")
 			if err != nil {
 				panic(err)
 			}
-			if waitImageServerInit != nil {
-				waitImageServerInit()
-			}
-			log.Fatal(imageServer.Serve(l))
+			mux := http.NewServeMux()
+			mux.Handle(netstack.DebugPcapPath, captureRing)
+			log.Println("serving captured frames on " + netstack.GatewayIP + netstack.DebugPcapPath)
+			log.Fatal(http.Serve(l, mux))
 		}()
 	}
-	ql, err := findListener(listenFd)
+	ql, err := netstack.FindListener(listenFd)
 	if err != nil {
 		panic(err)
 	}
@@ -588,71 +291,58 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if len(onFrame) > 0 {
+		qconn = netstack.CaptureConn(qconn, func(f netstack.Frame) {
+			for _, fn := range onFrame {
+				fn(f)
+			}
+		})
+	}
 	if err := vn.AcceptQemu(context.TODO(), qconn); err != nil {
 		panic(err)
 	}
 }
 
-func findListener(listenFd int) (net.Listener, error) {
-	if listenFd == 0 {
-		for preopenFd := 3; ; preopenFd++ {
-			var stat syscall.Stat_t
-			if err := syscall.Fstat(preopenFd, &stat); err != nil {
-				var se syscall.Errno
-				if errors.As(err, &se) && se == syscall.EBADF {
-					err = nil
-				}
-				log.Printf("findListner failed (fd=%d): %v\n", preopenFd, err)
-				return nil, err
-			} else if stat.Filetype == syscall.FILETYPE_SOCKET_STREAM {
-				listenFd = preopenFd
-				break
-			}
-		}
-	}
-	syscall.SetNonblock(listenFd, true)
-	f := os.NewFile(uintptr(listenFd), "")
-	defer f.Close()
-	log.Printf("using socket at fd=%d\n", listenFd)
-	return net.FileListener(f)
-}
-
-func NewImageServer(ctx context.Context, imageAddr string, platform imagespec.Platform) (*p9.Server, func(), error) {
-	config, rootNode, configD, waitInit, err := fsFromImage(ctx, imageAddr, platform, true)
+// NewImageServer returns the 9p server of the image. It also returns the digest resolved from imageAddr, which
+// is served as "config/manifest-digest" as well.
+func NewImageServer(ctx context.Context, imageAddr string, platform imagespec.Platform, cache *layerCache) (*p9.Server, digest.Digest, func(), error) {
+	img, rootNode, waitInit, err := fsFromImage(ctx, imageAddr, platform, cache)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to fetch image %q: %w", imageAddr, err)
+		return nil, "", nil, fmt.Errorf("failed to fetch image %q: %w", imageAddr, err)
 	}
-	s, err := generateSpec(*config, rootNode)
+	log.Printf("Resolved image %q to %v (manifest for the platform: %v)\n", imageAddr, img.target.Digest, img.manifestDesc.Digest)
+	s, err := generateSpec(img.config, rootNode)
 	if err != nil {
-		return nil, nil, err
+		return nil, "", nil, err
 	}
 	specD, err := json.Marshal(s)
 	if err != nil {
-		return nil, nil, err
+		return nil, "", nil, err
 	}
 	initNodes := make(map[string]p9.File)
 	initNodes["rootfs"] = rootNode
 	for name, o := range map[string][]p9staticfs.Option{
 		"config": {
 			p9staticfs.WithFile("config.json", string(specD)),
-			p9staticfs.WithFile("imageconfig.json", string(configD)),
+			p9staticfs.WithFile("imageconfig.json", string(img.configData)),
+			p9staticfs.WithFile("manifest-digest", img.target.Digest.String()),
 		},
 	} {
 		a, err := p9staticfs.New(o...)
 		if err != nil {
-			return nil, nil, err
+			return nil, "", nil, err
 		}
 		n, err := a.Attach()
 		if err != nil {
-			return nil, nil, err
+			return nil, "", nil, err
 		}
 		initNodes[name] = n
 	}
 	a, err := NewRouteNode(initNodes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create route node: %w", err)
+		return nil, "", nil, fmt.Errorf("failed to create route node: %w", err)
 	}
-	return p9.NewServer(a), waitInit, nil
+	return p9.NewServer(a), img.target.Digest, waitInit, nil
 }
 
 const (
@@ -717,112 +407,124 @@ func generateSpec(config imagespec.Image, rootNode p9.File) (_ *runtimespec.Spec
 	return s, nil
 }
 
-func fsFromImage(ctx context.Context, addr string, platform imagespec.Platform, insecure bool) (*imagespec.Image, *Node, []byte, func(), error) {
+func fsFromImage(ctx context.Context, addr string, platform imagespec.Platform, cache *layerCache) (*resolvedImage, *Node, func(), error) {
 	var layers []NodeLayer
-	var config imagespec.Image
-	var configData []byte
+	var img *resolvedImage
 	var waitInit func()
 	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
 		log.Printf("Pulling from HTTP server %q\n", addr)
-		manifest, image, configD, err := fetchManifestAndConfigOCILayout(ctx, addr, platform)
+		var tag string
+		var dgst digest.Digest
+		var err error
+		addr, tag, dgst, err = ocilayout.ParseAddr(addr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		img, err = fetchManifestAndConfigOCILayout(ctx, addr, tag, dgst, platform)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
-		config = image
-		configData = configD
-		layers, waitInit, err = fetchLayers(ctx, manifest, EStargzLayerConfig{
+		index, err := findSOCIIndexOCILayout(addr, img.manifest)
+		if err != nil {
+			log.Printf("failed to get SOCI index: %v\n", err)
+		}
+		layers, waitInit, err = fetchLayers(ctx, img.manifest, img.config.RootFS.DiffIDs, EStargzLayerConfig{
 			NoBackgroundFetch: true,
 			PrefetchTimeout:   5 * time.Second,
 			// NoPrefetch:        true,
+			Cache: cache,
 		}, nil, map[string]esgzremote.Handler{
 			"url-reader": &layerOCILayoutURLHandler{addr},
-		}, reference.Spec{}, newLayerOCILayoutExternalReaderAt(addr))
+		}, reference.Spec{}, index, tarLayerFromReader(cache, cache.tarLayerReader(newLayerOCILayoutExternalReaderAt(addr))))
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
 	} else {
 		log.Printf("Pulling from registry %q\n", addr)
 		refspec, err := reference.Parse(addr)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
+		}
+		var fetcher remotes.Fetcher
+		img, fetcher, err = fetchManifestAndConfigRegistry(ctx, refspec, platform)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		manifest, image, configD, fetcher, err := fetchManifestAndConfigRegistry(ctx, refspec, platform)
+		index, err := findSOCIIndexRegistry(ctx, refspec, fetcher, img.manifestDesc, img.manifest)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			log.Printf("failed to get SOCI index: %v\n", err)
 		}
-		config = image
-		configData = configD
-		layers, waitInit, err = fetchLayers(ctx, manifest, EStargzLayerConfig{
+		layers, waitInit, err = fetchLayers(ctx, img.manifest, img.config.RootFS.DiffIDs, EStargzLayerConfig{
 			NoBackgroundFetch: true,
 			PrefetchTimeout:   5 * time.Second,
 			// NoPrefetch:        true,
-		}, wasmRegistryHosts, nil, refspec, func(desc imagespec.Descriptor, withDecompression bool) (io.ReaderAt, error) {
-			r, err := fetcher.Fetch(ctx, desc)
-			if err != nil {
-				return nil, err
-			}
-			defer r.Close()
-			if withDecompression {
-				raw := r
-				zr, err := newWasmDecompressor(raw)
-				if err != nil {
-					return nil, err
-				}
-				r = &readerWithCloser{zr, func() error {
-					return raw.Close()
-				}}
-			}
-
-			var rs [][]byte
-			var curoff int
-			var chunkSize = 10 * 1024 * 1024
-			b := make([]byte, chunkSize)
-			for {
-				n, err := r.Read(b[curoff:])
-				curoff += n
-				if err != nil {
-					if err == io.EOF {
-						rs = append(rs, b[:curoff])
-						break
-					}
-					return nil, err
-				}
-				if curoff == len(b) {
-					rs = append(rs, b)
-					curoff = 0
-					b = make([]byte, chunkSize)
-				}
-			}
-			r.Close()
-			var totalLen int
-			for _, s := range rs {
-				totalLen += len(s)
-			}
-			data := make([]byte, totalLen)
-			var i int
-			for _, s := range rs {
-				i += copy(data[i:], s)
-			}
-			return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+			Cache: cache,
+		}, wasmRegistryHosts, nil, refspec, index, func(q *qidSet, desc imagespec.Descriptor, diffID digest.Digest, format layerFormat) (*NodeLayer, error) {
+			return cache.streamTarLayer(q, desc, diffID, format, func() (io.ReadCloser, error) {
+				return fetcher.Fetch(ctx, desc)
+			})
 		})
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	imgFS := &applier{}
 
 	for _, l := range layers {
 		if err := imgFS.ApplyNodes(l); err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	imgFS.addDots()
-	return &config, imgFS.n, configData, waitInit, nil
+	return img, imgFS.n, waitInit, nil
 }
 
-var defaultClient = &http.Client{Transport: wasmRoundTripper{}}
+// fetchTransport performs the requests of the image server and the proxy via the host.
+var fetchTransport = &netstack.FetchTransport{
+	Host:         netstack.WasmHost,
+	PollInterval: 5 * time.Millisecond,
+	ChunkSize:    1024 * 1024,
+}
+
+var defaultClient = &http.Client{Transport: fetchTransport}
+
+// dockerAuthConfigEnv is the environment variable containing docker config.json that has the credentials of the registries.
+const dockerAuthConfigEnv = "DOCKER_AUTH_CONFIG"
+
+// registryCredentials are the credentials of the registries. Requests are anonymous if nil.
+var registryCredentials registryauth.Func
+
+// registryHostsDir is the directory containing hosts.toml of the registries.
+var registryHostsDir string
+
+var (
+	registryHostsMu sync.Mutex
+
+	// registryHosts caches the endpoints of the registries keyed by the registry host.
+	// Their clients and authorizers are shared among the requests so that the tokens are reused.
+	registryHosts = make(map[string][]docker.RegistryHost)
+
+	// registryAuthorizers are the authorizers of the endpoints keyed by their TLS configuration.
+	// The authorizers fetch the tokens using the same configuration.
+	registryAuthorizers = make(map[string]docker.Authorizer)
+)
+
+// resolvedImage is the image resolved from the image address.
+type resolvedImage struct {
+	// target is the manifest or the index resolved from the address. The image can be pinned by its digest.
+	target imagespec.Descriptor
 
-func fetchManifestAndConfigRegistry(ctx context.Context, refspec reference.Spec, platform platforms.Platform) (imagespec.Manifest, imagespec.Image, []byte, remotes.Fetcher, error) {
+	// manifestDesc is the manifest for the platform. It's target if target is a manifest.
+	manifestDesc imagespec.Descriptor
+
+	manifest   imagespec.Manifest
+	config     imagespec.Image
+	configData []byte
+}
+
+// fetchManifestAndConfigRegistry fetches the image from the registry. The reference can be pinned by the
+// digest (e.g. "<name>@sha256:<hex>", "<name>:<tag>@sha256:<hex>").
+func fetchManifestAndConfigRegistry(ctx context.Context, refspec reference.Spec, platform platforms.Platform) (*resolvedImage, remotes.Fetcher, error) {
 	resolver := docker.NewResolver(docker.ResolverOptions{
 		Hosts: func(host string) ([]docker.RegistryHost, error) {
 			if host != refspec.Hostname() {
@@ -831,139 +533,258 @@ func fetchManifestAndConfigRegistry(ctx context.Context, refspec reference.Spec,
 			return wasmRegistryHosts(refspec)
 		},
 	})
-	_, img, err := resolver.Resolve(ctx, refspec.String())
+	_, target, err := resolver.Resolve(ctx, refspec.String())
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, nil, err
+		return nil, nil, err
+	}
+	if dgst := refspec.Digest(); dgst != "" && target.Digest != dgst {
+		return nil, nil, fmt.Errorf("unexpected digest %v of %q", target.Digest, refspec.String())
 	}
 	fetcher, err := resolver.Fetcher(ctx, refspec.String())
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, nil, err
+		return nil, nil, err
 	}
-	manifest, err := esgzcontainerdutil.FetchManifestPlatform(ctx, fetcher, img, platform)
+	manifestDesc, err := resolvePlatformManifest(ctx, fetcher, target, platform)
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, nil, err
+		return nil, nil, err
 	}
-	r, err := fetcher.Fetch(ctx, manifest.Config)
-	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, nil, err
+	if err := verifyImage(ctx, &imagepolicy.RegistryStore{
+		Locator:  refspec.Locator,
+		Resolver: resolver,
+		Fetcher:  fetcher,
+		Hosts:    func() ([]imagepolicy.RegistryHost, error) { return policyRegistryHosts(refspec) },
+	}, target.Digest, manifestDesc.Digest); err != nil {
+		return nil, nil, err
 	}
-	defer r.Close()
-	configD, err := io.ReadAll(r)
+	img, err := fetchManifestAndConfig(ctx, fetcher, target, manifestDesc)
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, nil, err
-	}
-	var config imagespec.Image
-	if err := json.NewDecoder(bytes.NewReader(configD)).Decode(&config); err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, nil, err
+		return nil, nil, err
 	}
-	return manifest, config, configD, fetcher, err
+	return img, fetcher, nil
 }
 
-func fetchManifestAndConfigOCILayout(ctx context.Context, addr string, platform platforms.Platform) (imagespec.Manifest, imagespec.Image, []byte, error) {
-	c := defaultClient
-
-	// Fetch index
-	resp, err := c.Get(addr + "/index.json")
+// resolvePlatformManifest returns the descriptor of the manifest for the platform. desc is a manifest or an index.
+// The indexes are verified by their digests.
+func resolvePlatformManifest(ctx context.Context, fetcher remotes.Fetcher, desc imagespec.Descriptor, platform platforms.Platform) (imagespec.Descriptor, error) {
+	if desc.MediaType != images.MediaTypeDockerSchema2ManifestList && desc.MediaType != imagespec.MediaTypeImageIndex {
+		return desc, nil
+	}
+	b, err := fetchVerified(func(desc imagespec.Descriptor) (io.ReadCloser, error) {
+		return fetcher.Fetch(ctx, desc)
+	}, desc)
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, err
+		return imagespec.Descriptor{}, err
 	}
 	var index imagespec.Index
-	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, err
+	if err := json.Unmarshal(b, &index); err != nil {
+		return imagespec.Descriptor{}, err
 	}
-	io.ReadAll(resp.Body)
-	resp.Body.Close()
-
-	var target digest.Digest
-	found := false
 	for _, m := range index.Manifests {
-		p := platform
+		p := platforms.DefaultSpec()
 		if m.Platform != nil {
 			p = *m.Platform
 		}
 		if platforms.NewMatcher(platform).Match(p) {
-			target, found = m.Digest, true
-			break
+			return resolvePlatformManifest(ctx, fetcher, m, platform)
 		}
 	}
-	if !found {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, fmt.Errorf("manifest not found for platform %v", platform)
-	}
+	return imagespec.Descriptor{}, fmt.Errorf("manifest not found for platform %v", platform)
+}
 
-	// Fetch manifest
-	resp, err = c.Get(addr + "/blobs/sha256/" + target.Encoded())
+// fetchManifestAndConfig fetches the manifest and the config of the image. They are verified by their digests
+// so that the image pinned by the digest is served as is.
+func fetchManifestAndConfig(ctx context.Context, fetcher remotes.Fetcher, target, manifestDesc imagespec.Descriptor) (*resolvedImage, error) {
+	fetch := func(desc imagespec.Descriptor) (io.ReadCloser, error) {
+		return fetcher.Fetch(ctx, desc)
+	}
+	manifestD, err := fetchVerified(fetch, manifestDesc)
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, err
+		return nil, err
 	}
 	var manifest imagespec.Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, err
+	if err := json.Unmarshal(manifestD, &manifest); err != nil {
+		return nil, err
 	}
-	io.ReadAll(resp.Body)
-	resp.Body.Close()
-
-	// Fetch config
-	resp, err = c.Get(addr + "/blobs/sha256/" + manifest.Config.Digest.Encoded())
+	configD, err := fetchVerified(fetch, manifest.Config)
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, err
+		return nil, err
 	}
 	var config imagespec.Image
-	configD, err := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(configD, &config); err != nil {
+		return nil, err
+	}
+	return &resolvedImage{
+		target:       target,
+		manifestDesc: manifestDesc,
+		manifest:     manifest,
+		config:       config,
+		configData:   configD,
+	}, nil
+}
+
+// fetchManifestAndConfigOCILayout fetches the image from the OCI layout served at addr. The image is chosen by
+// the digest or by the tag ("org.opencontainers.image.ref.name" annotation) in index.json. The first image
+// for the platform is chosen if neither is specified.
+func fetchManifestAndConfigOCILayout(ctx context.Context, addr, tag string, dgst digest.Digest, platform platforms.Platform) (*resolvedImage, error) {
+	c := defaultClient
+
+	// Fetch index
+	resp, err := c.Get(addr + "/index.json")
 	if err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, err
+		return nil, err
 	}
-	if err := json.NewDecoder(bytes.NewReader(configD)).Decode(&config); err != nil {
-		return imagespec.Manifest{}, imagespec.Image{}, nil, err
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch index.json: %v", resp.Status)
 	}
+	var index imagespec.Index
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	io.ReadAll(resp.Body)
 	resp.Body.Close()
 
-	return manifest, config, configD, nil
+	store := ociLayoutStore(addr)
+	target, found := ocilayout.SelectManifest(index, tag, dgst, platform)
+	if !found && dgst != "" && tag == "" {
+		// the digest can be of a manifest that isn't in index.json (e.g. the manifest for a platform in an index)
+		target, err = ociLayoutDescriptor(ctx, store, dgst)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	if !found {
+		switch {
+		case tag != "":
+			return nil, fmt.Errorf("image tagged %q not found in the OCI layout", tag)
+		case dgst != "":
+			return nil, fmt.Errorf("image %v not found in the OCI layout", dgst)
+		}
+		return nil, fmt.Errorf("manifest not found for platform %v", platform)
+	}
+	manifestDesc, err := resolvePlatformManifest(ctx, store, target, platform)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyImage(ctx, store, target.Digest, manifestDesc.Digest); err != nil {
+		return nil, err
+	}
+	return fetchManifestAndConfig(ctx, store, target, manifestDesc)
 }
 
-func fetchLayers(ctx context.Context, manifest imagespec.Manifest, config EStargzLayerConfig, hosts esgzsource.RegistryHosts, handlers map[string]esgzremote.Handler, refspec reference.Spec, unlazyReader func(imagespec.Descriptor, bool) (io.ReaderAt, error)) (layers []NodeLayer, waitInit func(), err error) {
-	layers, waitInit, err = getEStargzLayers(ctx, manifest, config, hosts, handlers, refspec)
-	if err == nil {
-		return layers, waitInit, nil
+// ociLayoutDescriptor returns the descriptor of the manifest or the index in the OCI layout.
+func ociLayoutDescriptor(ctx context.Context, store remotes.Fetcher, dgst digest.Digest) (imagespec.Descriptor, error) {
+	b, err := fetchVerified(func(desc imagespec.Descriptor) (io.ReadCloser, error) {
+		return store.Fetch(ctx, desc)
+	}, imagespec.Descriptor{Digest: dgst})
+	if err != nil {
+		return imagespec.Descriptor{}, fmt.Errorf("image %v not found in the OCI layout: %w", dgst, err)
 	}
-
-	log.Printf("falling back to gzip mode (previous error: %v)\n", err)
-	layers, err = getTarLayers(ctx, manifest, true, unlazyReader)
-	if err == nil {
-		return layers, nil, nil
+	var m struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
 	}
-
-	log.Printf("falling back to tar mode (previous error: %v)\n", err)
-	layers, err = getTarLayers(ctx, manifest, false, unlazyReader)
-	if err == nil {
-		return layers, nil, nil
+	if err := json.Unmarshal(b, &m); err != nil {
+		return imagespec.Descriptor{}, fmt.Errorf("%v isn't a manifest: %w", dgst, err)
 	}
-
-	return nil, nil, fmt.Errorf("failed to fetch layers (last error: %v)", err)
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = imagespec.MediaTypeImageManifest
+		if m.Manifests != nil {
+			mediaType = imagespec.MediaTypeImageIndex
+		}
+	}
+	return imagespec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(b))}, nil
 }
 
-func getTarLayers(ctx context.Context, manifest imagespec.Manifest, withDecompression bool, getReader func(imagespec.Descriptor, bool) (io.ReaderAt, error)) ([]NodeLayer, error) {
+// fetchLayers makes the nodes of the layers. The way to fetch each layer is chosen by its format.
+// eStargz and zstd:chunked layers are lazily pulled. gzip layers indexed by the SOCI index are also lazily pulled.
+// Other layers are fetched as a whole by newTarLayer. diffIDs are the digests of the tars of the layers in the config.
+func fetchLayers(ctx context.Context, manifest imagespec.Manifest, diffIDs []digest.Digest, config EStargzLayerConfig, hosts esgzsource.RegistryHosts, handlers map[string]esgzremote.Handler, refspec reference.Spec, index *sociIndex, newTarLayer func(*qidSet, imagespec.Descriptor, digest.Digest, layerFormat) (*NodeLayer, error)) ([]NodeLayer, func(), error) {
+	if len(diffIDs) != len(manifest.Layers) {
+		return nil, nil, fmt.Errorf("the config has %d diffIDs but the manifest has %d layers", len(diffIDs), len(manifest.Layers))
+	}
 	layers := make([]NodeLayer, len(manifest.Layers))
-	q := new(qidSet)
+	maxConcurrency := config.MaxConcurrency
+	if maxConcurrency == 0 {
+		maxConcurrency = int64(2)
+	}
+	cache := config.Cache
+	if cache == nil {
+		cache = &layerCache{BlobCache: layercache.NewMemoryCache(0)}
+	}
+	// Lazily pulled layers use the index of the layer as the upper 32 bits of QIDs.
+	// QIDs of other layers start after them.
+	q := &qidSet{curQID: uint64(len(manifest.Layers)) << 32}
+	esgzresolver := esgzremote.NewResolver(esgzconfig.BlobConfig{}, handlers)
+	tm := esgztask.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
+	prefetcheg, _ := errgroup.WithContext(context.TODO())
 	eg, _ := errgroup.WithContext(ctx)
 	for i, l := range manifest.Layers {
 		i, l := i, l
 		eg.Go(func() error {
-			r, err := getReader(l, withDecompression)
+			format, err := detectLayerFormat(l)
 			if err != nil {
 				return err
 			}
-			n, err := newTarNode(q, r)
+			var n *NodeLayer
+			withSOCI := format == formatGzip && index.has(l.Digest)
+			switch {
+			case format.lazy():
+				n, err = newEStargzLayer(ctx, i, l, format, config, esgzresolver, hosts, refspec, cache, tm, prefetcheg)
+			case withSOCI:
+				n, err = newSOCILayer(ctx, q, l, index, esgzresolver, hosts, refspec, cache)
+			default:
+				n, err = newTarLayer(q, l, diffIDs[i], format)
+			}
+			if err != nil && (format.lazy() || withSOCI) {
+				log.Printf("failed to lazily pull layer %v; fetching whole layer (error: %v)\n", l.Digest, err)
+				n, err = newTarLayer(q, l, diffIDs[i], format.whole())
+			}
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to fetch layer %v (%v): %w", l.Digest, format, err)
 			}
 			layers[i] = *n
 			return nil
 		})
 	}
 	if err := eg.Wait(); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return layers, func() {
+		prefetcheg.Wait()
+	}, nil
+}
+
+// tarLayerFromReader returns newTarLayer that makes the layer from the ReaderAt returned by getReader.
+// getReader decompresses gzip if withDecompression is true. Layers in other compressions are decompressed
+// while streaming the compressed layer returned by getReader.
+func tarLayerFromReader(cache *layerCache, getReader func(imagespec.Descriptor, digest.Digest, bool) (io.ReaderAt, error)) func(*qidSet, imagespec.Descriptor, digest.Digest, layerFormat) (*NodeLayer, error) {
+	return func(q *qidSet, desc imagespec.Descriptor, diffID digest.Digest, format layerFormat) (*NodeLayer, error) {
+		if format == formatTar || format == formatGzip {
+			r, err := getReader(desc, diffID, format == formatGzip)
+			if err != nil {
+				return nil, err
+			}
+			return newTarNode(q, r)
+		}
+		return cache.streamTarLayer(q, desc, diffID, format, func() (io.ReadCloser, error) {
+			r, err := getReader(desc, diffID, false)
+			if err != nil {
+				return nil, err
+			}
+			var size int64 = -1
+			if sr, ok := r.(interface{ Size() int64 }); ok {
+				size = sr.Size()
+			}
+			if size < 0 {
+				return nil, fmt.Errorf("unknown size of layer %v", desc.Digest)
+			}
+			return io.NopCloser(io.NewSectionReader(r, 0, size)), nil
+		})
 	}
-	return layers, nil
 }
 
 func newTarNode(q *qidSet, trRaw io.ReaderAt) (*NodeLayer, error) {
@@ -971,7 +792,25 @@ func newTarNode(q *qidSet, trRaw io.ReaderAt) (*NodeLayer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to make position watcher: %w", err)
 	}
-	tr := tar.NewReader(pw)
+	return indexTar(q, pw, pw.CurrentPos, trRaw)
+}
+
+// indexTar makes the nodes of the tar read from r. pos returns the current position in r.
+// The contents of the files are read from trRaw so r can be a stream (e.g. the first read of the layer).
+func indexTar(q *qidSet, r io.Reader, pos func() int64, trRaw io.ReaderAt) (*NodeLayer, error) {
+	tr := tar.NewReader(r)
+	return newNodeLayer(q, func() (*tar.Header, int64, error) {
+		h, err := tr.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		return h, pos(), nil
+	}, trRaw)
+}
+
+// newNodeLayer makes the nodes of the layer. next returns the next entry in the layer and the offset of
+// its contents in trRaw. next returns io.EOF at the end of the layer.
+func newNodeLayer(q *qidSet, next func() (*tar.Header, int64, error), trRaw io.ReaderAt) (*NodeLayer, error) {
 
 	// Walk functions for nodes
 	getormake := func(n *Node, base string) (c *Node, err error) {
@@ -1019,7 +858,7 @@ func newTarNode(q *qidSet, trRaw io.ReaderAt) (*NodeLayer, error) {
 	// Walk through all nodes.
 	for {
 		// Fetch and parse next header.
-		h, err := tr.Next()
+		h, off, err := next()
 		if err != nil {
 			if err != io.EOF {
 				return nil, fmt.Errorf("failed to parse tar file: %w", err)
@@ -1081,7 +920,7 @@ func newTarNode(q *qidSet, trRaw io.ReaderAt) (*NodeLayer, error) {
 				qid:  qid,
 				attr: attr,
 				link: h.Linkname,
-				r:    io.NewSectionReader(trRaw, pw.CurrentPos(), h.Size),
+				r:    io.NewSectionReader(trRaw, off, h.Size),
 			}
 		}
 
@@ -1097,126 +936,128 @@ type EStargzLayerConfig struct {
 	PrefetchTimeout    time.Duration
 	NoPrefetch         bool
 	NoBackgroundFetch  bool
+	Cache              *layerCache // layers are cached in memory if nil
 }
 
-func wasmRegistryHosts(ref reference.Spec) (hosts []docker.RegistryHost, _ error) {
+// wasmRegistryHosts returns the endpoints of the registry of ref configured by -registry-hosts-dir.
+func wasmRegistryHosts(ref reference.Spec) ([]docker.RegistryHost, error) {
 	host := ref.Hostname()
-	client := defaultClient
-	config := docker.RegistryHost{
-		Client:       client,
-		Host:         host,
-		Scheme:       "https",
-		Path:         "/v2",
-		Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
-		Authorizer:   docker.NewDockerAuthorizer(docker.WithAuthClient(client)),
-	}
-	if localhost, _ := docker.MatchLocalhost(config.Host); localhost {
-		config.Scheme = "http"
-	}
-	if config.Host == "docker.io" {
-		config.Host = "registry-1.docker.io"
-	}
-	hosts = append(hosts, config)
-	return
+	registryHostsMu.Lock()
+	defer registryHostsMu.Unlock()
+	if hosts, ok := registryHosts[host]; ok {
+		return hosts, nil
+	}
+	configs, err := registryhosts.Hosts(registryHostsDir, host)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []docker.RegistryHost
+	for _, c := range configs {
+		client := defaultClient
+		var tlsConfig *netstack.FetchTLSConfig
+		if len(c.CACerts) > 0 || c.SkipVerify {
+			tlsConfig = &netstack.FetchTLSConfig{InsecureSkipVerify: c.SkipVerify}
+			for _, cert := range c.CACerts {
+				tlsConfig.CACerts = append(tlsConfig.CACerts, string(cert))
+			}
+			tr := *fetchTransport
+			tr.TLS = tlsConfig
+			client = &http.Client{Transport: &tr}
+		}
+		key, err := json.Marshal(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		authorizer, ok := registryAuthorizers[string(key)]
+		if !ok {
+			authorizer = registryauth.NewAuthorizer(client, registryCredentials)
+			registryAuthorizers[string(key)] = authorizer
+		}
+		hosts = append(hosts, docker.RegistryHost{
+			Client:       client,
+			Authorizer:   authorizer,
+			Host:         c.Host,
+			Scheme:       c.Scheme,
+			Path:         c.Path,
+			Capabilities: c.Capabilities,
+			Header:       c.Header,
+		})
+	}
+	registryHosts[host] = hosts
+	return hosts, nil
 }
 
-func getEStargzLayers(ctx context.Context, manifest imagespec.Manifest, config EStargzLayerConfig, hosts esgzsource.RegistryHosts, handlers map[string]esgzremote.Handler, refspec reference.Spec) ([]NodeLayer, func(), error) {
-	layers := make([]NodeLayer, len(manifest.Layers))
-	checkChunkDigests := config.DisableChunkVerify
-	maxConcurrency := config.MaxConcurrency
-	if maxConcurrency == 0 {
-		maxConcurrency = int64(2)
-	}
+// newEStargzLayer makes the node of the i-th layer lazily pulled. The format is eStargz or zstd:chunked.
+func newEStargzLayer(ctx context.Context, i int, l imagespec.Descriptor, format layerFormat, config EStargzLayerConfig, esgzresolver *esgzremote.Resolver, hosts esgzsource.RegistryHosts, refspec reference.Spec, cache *layerCache, tm *esgztask.BackgroundTaskManager, prefetcheg *errgroup.Group) (*NodeLayer, error) {
+	checkChunkDigests := !config.DisableChunkVerify
 	prefetchTimeout := config.PrefetchTimeout
 	if prefetchTimeout == 0 {
 		prefetchTimeout = time.Second * 10
 	}
 	noPrefetch := config.NoPrefetch
 	noBackgroundFetch := config.NoBackgroundFetch
-	blobCache := esgzcache.NewMemoryCache()
-	readerCache := esgzcache.NewMemoryCache()
-	esgzresolver := esgzremote.NewResolver(esgzconfig.BlobConfig{}, handlers)
-	tm := esgztask.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
-	prefetcheg, _ := errgroup.WithContext(context.TODO())
-	eg, _ := errgroup.WithContext(ctx)
-	for i, l := range manifest.Layers {
-		i, l := i, l
-		eg.Go(func() error {
-			b, err := esgzresolver.Resolve(ctx, hosts, refspec, l, blobCache) // TODO: use directory cache
-			if err != nil {
-				return err
-			}
-			mr, err := esgzmetadatamemory.NewReader(
-				io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
-					tm.DoPrioritizedTask()
-					defer tm.DonePrioritizedTask()
-					return b.ReadAt(p, offset)
-				}), 0, b.Size()),
-				esgzmetadata.WithDecompressors(newGzipDecompressor()),
-			)
-			if err != nil {
-				return err
-			}
-			vr, err := esgzreader.NewReader(mr, readerCache, l.Digest) // TODO: use directory cache
-			if err != nil {
-				return err
-			}
-			if !noPrefetch {
-				prefetchWaiter := newWaiter()
-				prefetcheg.Go(func() error {
-					if err := prefetchWaiter.wait(prefetchTimeout); err != nil {
-						log.Printf("failed to wait for prefetch: %v\n", err)
-					}
-					return nil
-				})
-				go func() {
-					if err := esgzPrefetch(ctx, tm, prefetchWaiter, b, vr); err != nil {
-						log.Printf("failed to prefetch layer %v\n", l.Digest)
-						return
-					}
-					log.Printf("completed prefetch of layer %v\n", l.Digest)
-				}()
-			}
-			if !noBackgroundFetch {
-				go func() {
-					if err := esgzBackgroundFetch(ctx, tm, b, vr); err != nil {
-						log.Printf("failed background fetching of layer %v\n", l.Digest)
-						return
-					}
-					log.Printf("completed background fetch of layer %v\n", l.Digest)
-				}()
-			}
-			var rr esgzreader.Reader
-			if checkChunkDigests {
-				tocDgstStr, ok := l.Annotations[estargz.TOCJSONDigestAnnotation]
-				if !ok {
-					return fmt.Errorf("digest of TOC JSON must be passed")
-				}
-				tocDgst, err := digest.Parse(tocDgstStr)
-				if err != nil {
-					return fmt.Errorf("invalid TOC digest: %v: %w", tocDgst, err)
-				}
-				rr, err = vr.VerifyTOC(tocDgst)
-				if err != nil {
-					return fmt.Errorf("invalid estargz layer: %w", err)
-				}
-			} else {
-				rr = vr.SkipVerify() // TODO: verify TOC digest using layer annotation
-			}
-			n, err := newESGZNode(rr, rr.Metadata().RootID(), uint32(i), "")
-			if err != nil {
-				return err
+	b, err := esgzresolver.Resolve(ctx, hosts, refspec, l, cache.forLayer(l.Digest, "blob"))
+	if err != nil {
+		return nil, err
+	}
+	mr, err := esgzmetadatamemory.NewReader(
+		io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+			tm.DoPrioritizedTask()
+			defer tm.DonePrioritizedTask()
+			return b.ReadAt(p, offset)
+		}), 0, b.Size()),
+		esgzmetadata.WithDecompressors(newGzipDecompressor(), new(zstdchunked.Decompressor)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	vr, err := esgzreader.NewReader(mr, cache.forLayer(l.Digest, "reader"), l.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if !noPrefetch {
+		prefetchWaiter := newWaiter()
+		prefetcheg.Go(func() error {
+			if err := prefetchWaiter.wait(prefetchTimeout); err != nil {
+				log.Printf("failed to wait for prefetch: %v\n", err)
 			}
-			layers[i] = *n
 			return nil
 		})
+		go func() {
+			if err := esgzPrefetch(ctx, tm, prefetchWaiter, b, vr); err != nil {
+				log.Printf("failed to prefetch layer %v\n", l.Digest)
+				return
+			}
+			log.Printf("completed prefetch of layer %v\n", l.Digest)
+		}()
 	}
-	if err := eg.Wait(); err != nil {
-		return nil, nil, err
+	if !noBackgroundFetch {
+		go func() {
+			if err := esgzBackgroundFetch(ctx, tm, b, vr); err != nil {
+				log.Printf("failed background fetching of layer %v\n", l.Digest)
+				return
+			}
+			log.Printf("completed background fetch of layer %v\n", l.Digest)
+		}()
 	}
-	return layers, func() {
-		prefetcheg.Wait()
-	}, nil
+	var rr esgzreader.Reader
+	if checkChunkDigests {
+		tocDgstStr, ok := l.Annotations[tocDigestAnnotation(format)]
+		if !ok {
+			return nil, fmt.Errorf("digest of TOC JSON must be passed")
+		}
+		tocDgst, err := digest.Parse(tocDgstStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TOC digest: %v: %w", tocDgst, err)
+		}
+		rr, err = vr.VerifyTOC(tocDgst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v layer: %w", format, err)
+		}
+	} else {
+		rr = vr.SkipVerify()
+	}
+	return newESGZNode(rr, rr.Metadata().RootID(), uint32(i), "")
 }
 
 func esgzPrefetch(ctx context.Context, tm *esgztask.BackgroundTaskManager, prefetchWaiter *waiter, blob esgzremote.Blob, r *esgzreader.VerifiableReader) error {
@@ -2102,12 +1943,6 @@ type readerAtFunc func([]byte, int64) (int, error)
 
 func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
 
-type wasmRoundTripper struct{}
-
-func (tr wasmRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	return doHttpRoundTrip(req)
-}
-
 type layerOCILayoutURLHandler struct {
 	addr string
 }
@@ -2136,63 +1971,15 @@ func (f *layerOCILayoutURLFetcher) GenID(off int64, size int64) string {
 	return fmt.Sprintf("%x", sum)
 }
 
-//go:wasmimport env layer_request
-func layer_request(addressP uint32, addresslen uint32, digestP uint32, digestlen uint32, withDecompression uint32, idP uint32) uint32
-
-//go:wasmimport env layer_isreadable
-func layer_isreadable(id uint32, isOKP uint32, sizeP uint32) uint32
-
-//go:wasmimport env layer_readat
-func layer_readat(id uint32, respP uint32, offset uint32, len uint32, respsizeP uint32) uint32
+// hostABIVersion is the version of the host ABI required by imagemounter.
+// The functions imported from the host aren't optional on WASI: the host needs to export all of them
+// (layer_*64 since version 2, cache_* since version 3 and credentials_* since version 4) for instantiating
+// imagemounter even if the flags using them (-cache-host, -registry-auth-host) aren't specified.
+const hostABIVersion = 4
 
 func newLayerOCILayoutExternalReaderAt(addr string) func(l imagespec.Descriptor, withDecompression bool) (io.ReaderAt, error) {
 	return func(l imagespec.Descriptor, withDecompression bool) (io.ReaderAt, error) {
-		dgst := l.Digest.Encoded()
-		layerAddr := addr + "/blobs/sha256/" + dgst
-		var id uint32
-		var withDecompressionN uint32 = 0
-		if withDecompression {
-			withDecompressionN = 1
-		}
-		res := layer_request(
-			uint32(uintptr(unsafe.Pointer(&[]byte(layerAddr)[0]))),
-			uint32(len(layerAddr)),
-			uint32(uintptr(unsafe.Pointer(&[]byte(dgst)[0]))),
-			uint32(len(dgst)),
-			uint32(withDecompressionN),
-			uint32(uintptr(unsafe.Pointer(&id))),
-		)
-		if res != 0 {
-			return nil, fmt.Errorf("failed to send layer request")
-		}
-		var isOK uint32 = 0
-		var size uint32
-		for {
-			res := layer_isreadable(id,
-				uint32(uintptr(unsafe.Pointer(&isOK))),
-				uint32(uintptr(unsafe.Pointer(&size))))
-			if res != 0 {
-				return nil, fmt.Errorf("layer is not readable")
-			}
-			if isOK == 1 {
-				break
-			}
-			time.Sleep(1 * time.Millisecond)
-		}
-		return io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (retN int, retErr error) {
-			var respsize uint32
-			res := layer_readat(
-				id,
-				uint32(uintptr(unsafe.Pointer(&[]byte(p)[0]))),
-				uint32(offset), // TODO: FIXME: 64bits
-				uint32(len(p)),
-				uint32(uintptr(unsafe.Pointer(&respsize))),
-			)
-			if res != 0 {
-				return 0, fmt.Errorf("failed to receive layer response")
-			}
-			return int(respsize), nil
-		}), 0, int64(size)), nil
+		return hostlayer.Open(addr+"/blobs/sha256/"+l.Digest.Encoded(), l.Digest, withDecompression)
 	}
 }
 
@@ -2383,6 +2170,7 @@ type wasmDecompressor struct {
 	id     uint32
 	raw    io.Reader
 	rawEOF bool
+	eof    bool // the host has released the decompressor
 }
 
 func newWasmDecompressor(r io.Reader) (io.Reader, error) {
@@ -2395,6 +2183,9 @@ func newWasmDecompressor(r io.Reader) (io.Reader, error) {
 }
 
 func (d *wasmDecompressor) Read(p []byte) (n int, _ error) {
+	if d.eof {
+		return 0, io.EOF
+	}
 	if !d.rawEOF {
 		n, err := d.raw.Read(p)
 		if err != nil && err != io.EOF {
@@ -2427,6 +2218,7 @@ func (d *wasmDecompressor) Read(p []byte) (n int, _ error) {
 	}
 	var err error
 	if isEOF == 1 {
+		d.eof = true
 		err = io.EOF
 	}
 	return int(recvLen), err
@@ -2448,6 +2240,22 @@ func (gz *gzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
 	return io.NopCloser(zr), nil
 }
 
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) pos() int64 {
+	return r.n
+}
+
 type readerWithCloser struct {
 	r         io.Reader
 	closeFunc func() error
@@ -0,0 +1,74 @@
+// Package ocilayout resolves the images in the OCI layouts served over HTTP.
+//
+// See also https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+package ocilayout
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/platforms"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ParseAddr splits the address of the OCI layout into the base address of the layout and the
+// reference of the image in the layout. The reference is written after the last path element as a tag
+// ("<addr>:<tag>"), a digest ("<addr>@sha256:<hex>") or both ("<addr>:<tag>@sha256:<hex>").
+// Trailing slashes of the address are ignored.
+func ParseAddr(addr string) (base, tag string, dgst digest.Digest, _ error) {
+	addr = strings.TrimRight(addr, "/")
+	_, rest, _ := strings.Cut(addr, "://")
+	if !strings.Contains(rest, "/") {
+		return addr, "", "", nil // no path
+	}
+	i := strings.LastIndex(addr, "/") + 1
+	base, elem := addr[:i], addr[i:]
+	if name, d, ok := strings.Cut(elem, "@"); ok {
+		var err error
+		if dgst, err = digest.Parse(d); err != nil {
+			return "", "", "", fmt.Errorf("invalid digest of %q: %w", addr, err)
+		}
+		elem = name
+	}
+	if j := strings.LastIndex(elem, ":"); j >= 0 {
+		if tag = elem[j+1:]; tag == "" {
+			return "", "", "", fmt.Errorf("empty tag in %q", addr)
+		}
+		elem = elem[:j]
+	}
+	if elem == "" {
+		return "", "", "", fmt.Errorf("no path before the reference in %q", addr)
+	}
+	return base + elem, tag, dgst, nil
+}
+
+// SelectManifest returns the entry of index.json chosen by the digest and by the tag
+// ("org.opencontainers.image.ref.name" annotation written as "<tag>" or "<name>:<tag>"). The first entry
+// for the platform is chosen if neither is specified. Signatures and attestations aren't chosen.
+func SelectManifest(index imagespec.Index, tag string, dgst digest.Digest, platform platforms.Platform) (imagespec.Descriptor, bool) {
+	for _, m := range index.Manifests {
+		if imagepolicy.IsSignature(m) {
+			continue
+		}
+		if dgst != "" && m.Digest != dgst {
+			continue
+		}
+		if tag != "" {
+			if name := m.Annotations[imagespec.AnnotationRefName]; name != tag && !strings.HasSuffix(name, ":"+tag) {
+				continue
+			}
+		} else if dgst == "" {
+			p := platform
+			if m.Platform != nil {
+				p = *m.Platform
+			}
+			if !platforms.NewMatcher(platform).Match(p) {
+				continue
+			}
+		}
+		return m, true
+	}
+	return imagespec.Descriptor{}, false
+}
@@ -0,0 +1,202 @@
+package ocilayout
+
+import (
+	"testing"
+
+	"github.com/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseAddr(t *testing.T) {
+	dgst := digest.FromString("test")
+	for _, tt := range []struct {
+		name     string
+		addr     string
+		wantBase string
+		wantTag  string
+		wantDgst digest.Digest
+		wantErr  bool
+	}{
+		{
+			name:     "host:port without path",
+			addr:     "http://localhost:8080",
+			wantBase: "http://localhost:8080",
+		},
+		{
+			name:     "host:port with trailing slash",
+			addr:     "http://localhost:8080/",
+			wantBase: "http://localhost:8080",
+		},
+		{
+			name:     "path",
+			addr:     "http://localhost:8080/images/layout",
+			wantBase: "http://localhost:8080/images/layout",
+		},
+		{
+			name:     "trailing slash",
+			addr:     "https://example.com/layout/",
+			wantBase: "https://example.com/layout",
+		},
+		{
+			name:     "tag",
+			addr:     "http://localhost:8080/layout:v1",
+			wantBase: "http://localhost:8080/layout",
+			wantTag:  "v1",
+		},
+		{
+			name:     "digest",
+			addr:     "http://localhost:8080/layout@" + dgst.String(),
+			wantBase: "http://localhost:8080/layout",
+			wantDgst: dgst,
+		},
+		{
+			name:     "tag and digest",
+			addr:     "http://localhost:8080/layout:v1@" + dgst.String(),
+			wantBase: "http://localhost:8080/layout",
+			wantTag:  "v1",
+			wantDgst: dgst,
+		},
+		{
+			name:    "empty tag",
+			addr:    "http://localhost:8080/layout:",
+			wantErr: true,
+		},
+		{
+			name:    "empty tag with digest",
+			addr:    "http://localhost:8080/layout:@" + dgst.String(),
+			wantErr: true,
+		},
+		{
+			name:    "invalid digest",
+			addr:    "http://localhost:8080/layout@sha256:invalid",
+			wantErr: true,
+		},
+		{
+			name:    "no path before tag",
+			addr:    "http://localhost:8080/:v1",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			base, tag, dgst, err := ParseAddr(tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("must be an error; got %q, %q, %q", base, tag, dgst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if base != tt.wantBase || tag != tt.wantTag || dgst != tt.wantDgst {
+				t.Fatalf("unexpected result %q, %q, %q; want %q, %q, %q", base, tag, dgst, tt.wantBase, tt.wantTag, tt.wantDgst)
+			}
+		})
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	amd64 := platforms.Platform{OS: "linux", Architecture: "amd64"}
+	riscv64 := platforms.Platform{OS: "linux", Architecture: "riscv64"}
+	desc := func(s string, p *platforms.Platform, refName string) imagespec.Descriptor {
+		d := imagespec.Descriptor{MediaType: imagespec.MediaTypeImageManifest, Digest: digest.FromString(s), Platform: p}
+		if refName != "" {
+			d.Annotations = map[string]string{imagespec.AnnotationRefName: refName}
+		}
+		return d
+	}
+	sig := desc("sig", nil, "sha256-"+digest.FromString("amd64").Encoded()+".sig")
+	index := imagespec.Index{Manifests: []imagespec.Descriptor{
+		sig,
+		desc("amd64", &amd64, "v1"),
+		desc("riscv64", &riscv64, "example.com/test:v2"),
+		desc("nopf", nil, "latest"),
+	}}
+	for _, tt := range []struct {
+		name      string
+		tag       string
+		dgst      digest.Digest
+		platform  platforms.Platform
+		want      string
+		wantFound bool
+	}{
+		{
+			name:      "platform",
+			platform:  riscv64,
+			want:      "riscv64",
+			wantFound: true,
+		},
+		{
+			name:      "signature isn't chosen",
+			platform:  amd64,
+			want:      "amd64",
+			wantFound: true,
+		},
+		{
+			name:      "ref.name as tag",
+			tag:       "v1",
+			platform:  riscv64,
+			want:      "amd64",
+			wantFound: true,
+		},
+		{
+			name:      "ref.name as name:tag",
+			tag:       "v2",
+			platform:  amd64,
+			want:      "riscv64",
+			wantFound: true,
+		},
+		{
+			name:     "unknown tag",
+			tag:      "v3",
+			platform: amd64,
+		},
+		{
+			name:     "tag isn't matched by the suffix of the name",
+			tag:      "test:v2",
+			platform: amd64,
+		},
+		{
+			name:      "digest",
+			dgst:      digest.FromString("nopf"),
+			platform:  amd64,
+			want:      "nopf",
+			wantFound: true,
+		},
+		{
+			name:      "digest and tag",
+			tag:       "v2",
+			dgst:      digest.FromString("riscv64"),
+			platform:  amd64,
+			want:      "riscv64",
+			wantFound: true,
+		},
+		{
+			name:     "digest and tag of another entry",
+			tag:      "v1",
+			dgst:     digest.FromString("riscv64"),
+			platform: amd64,
+		},
+		{
+			name:     "digest matching no entry",
+			dgst:     digest.FromString("unknown"),
+			platform: amd64,
+		},
+		{
+			name:     "digest of signature",
+			dgst:     sig.Digest,
+			platform: amd64,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := SelectManifest(index, tt.tag, tt.dgst, tt.platform)
+			if found != tt.wantFound {
+				t.Fatalf("unexpected result %v (found: %v); want found: %v", got.Digest, found, tt.wantFound)
+			}
+			if found && got.Digest != digest.FromString(tt.want) {
+				t.Fatalf("unexpected manifest %v; want %q", got.Digest, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// imagePolicy is the policy of the images allowed to be served. Any image is served if nil.
+var imagePolicy *imagepolicy.Policy
+
+// verifyImage verifies the image is allowed by imagePolicy before it's served. digests are the digest
+// resolved from the image reference and the digest of the platform-specific manifest.
+func verifyImage(ctx context.Context, store imagepolicy.Store, digests ...digest.Digest) error {
+	if imagePolicy == nil {
+		return nil
+	}
+	res, err := imagepolicy.Verify(ctx, store, imagePolicy, digests...)
+	if err != nil {
+		return err
+	}
+	log.Printf("image %v is verified by %s (provenance builder: %q)\n", res.Digest, res.Signer, res.ProvenanceBuilderID)
+	return nil
+}
+
+// policyRegistryHosts returns the endpoints of the registry of ref used by imagepolicy.
+func policyRegistryHosts(ref reference.Spec) ([]imagepolicy.RegistryHost, error) {
+	hosts, err := wasmRegistryHosts(ref)
+	if err != nil {
+		return nil, err
+	}
+	var res []imagepolicy.RegistryHost
+	for _, host := range hosts {
+		if !host.Capabilities.Has(docker.HostCapabilityPull) {
+			continue
+		}
+		res = append(res, imagepolicy.RegistryHost{
+			Client:     host.Client,
+			Authorizer: host.Authorizer,
+			Scheme:     host.Scheme,
+			Host:       host.Host,
+			Path:       host.Path,
+			Header:     host.Header,
+		})
+	}
+	return res, nil
+}
+
+// ociLayoutStore returns the store of the OCI layout served at addr. The image is fetched from it as well as verified.
+func ociLayoutStore(addr string) *imagepolicy.LayoutStore {
+	return &imagepolicy.LayoutStore{Open: func(name string) (io.ReadCloser, error) {
+		resp, err := defaultClient.Get(addr + "/" + strings.TrimPrefix(name, "/"))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to fetch %q: %v", name, resp.Status)
+		}
+		return resp.Body, nil
+	}}
+}
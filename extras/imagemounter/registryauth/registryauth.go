@@ -0,0 +1,195 @@
+// Package registryauth provides the credentials of the registries and the authorizer of the requests using them.
+package registryauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// Credentials are the credentials of a registry.
+type Credentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// IdentityToken is used for fetching the bearer tokens instead of the username and the password.
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// Func returns the credentials of the registry host. It returns nil if it doesn't have them.
+type Func func(host string) (*Credentials, error)
+
+// Chain returns Func that returns the credentials returned by the first of fs that has them.
+// nil elements of fs are ignored.
+func Chain(fs ...Func) Func {
+	return func(host string) (*Credentials, error) {
+		for _, f := range fs {
+			if f == nil {
+				continue
+			}
+			if c, err := f(host); err != nil || c != nil {
+				return c, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+// dockerHubHost is the name used for Docker Hub in the credentials.
+const dockerHubHost = "docker.io"
+
+// normalizeHost returns the registry host used as the key of the credentials.
+// host can be a URL (e.g. "https://index.docker.io/v1/") as in the keys of docker config.json.
+func normalizeHost(host string) string {
+	if strings.Contains(host, "://") {
+		if u, err := url.Parse(host); err == nil {
+			host = u.Host
+		}
+	}
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubHost
+	}
+	return host
+}
+
+// FromDockerConfig returns the credentials in the contents of docker config.json.
+// Only "auths" is used. Credential helpers and stores aren't supported.
+func FromDockerConfig(data []byte) (Func, error) {
+	var config struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config: %w", err)
+	}
+	creds := make(map[string]*Credentials)
+	for host, a := range config.Auths {
+		c := &Credentials{Username: a.Username, Password: a.Password, IdentityToken: a.IdentityToken}
+		if a.Auth != "" {
+			b, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth of %q: %w", host, err)
+			}
+			var ok bool
+			c.Username, c.Password, ok = strings.Cut(string(b), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth of %q: no separator", host)
+			}
+		}
+		creds[normalizeHost(host)] = c
+	}
+	return func(host string) (*Credentials, error) {
+		return creds[normalizeHost(host)], nil
+	}, nil
+}
+
+// Flag is flag.Value of the credentials specified as HOST=USERNAME:PASSWORD. It can be specified multiple times.
+type Flag struct {
+	creds map[string]*Credentials
+}
+
+func (f *Flag) String() string {
+	var hosts []string
+	for h := range f.creds {
+		hosts = append(hosts, h)
+	}
+	return strings.Join(hosts, ",") // passwords aren't shown
+}
+
+func (f *Flag) Set(value string) error {
+	host, userpass, ok := strings.Cut(value, "=")
+	if !ok || host == "" {
+		return fmt.Errorf("credentials must be HOST=USERNAME:PASSWORD")
+	}
+	username, password, ok := strings.Cut(userpass, ":")
+	if !ok || username == "" {
+		return fmt.Errorf("credentials of %q must be USERNAME:PASSWORD", host)
+	}
+	if f.creds == nil {
+		f.creds = make(map[string]*Credentials)
+	}
+	f.creds[normalizeHost(host)] = &Credentials{Username: username, Password: password}
+	return nil
+}
+
+// Lookup returns the credentials of the host specified by the flag.
+func (f *Flag) Lookup(host string) (*Credentials, error) {
+	return f.creds[normalizeHost(host)], nil
+}
+
+// NewAuthorizer returns the authorizer of the requests to the registries using creds.
+// Both basic auth and bearer tokens are supported. Requests are sent anonymously if creds is nil or
+// doesn't have the credentials of the host.
+//
+// Unlike docker.NewDockerAuthorizer, the bearer token rejected by the registry (e.g. expired) is
+// discarded so that a new one is fetched on the retry of the request.
+func NewAuthorizer(client *http.Client, creds Func) docker.Authorizer {
+	newAuthorizer := func() docker.Authorizer {
+		opts := []docker.AuthorizerOpt{docker.WithAuthClient(client)}
+		if creds != nil {
+			opts = append(opts, docker.WithAuthCreds(func(host string) (string, string, error) {
+				c, err := creds(host)
+				if err != nil || c == nil {
+					return "", "", err
+				}
+				if c.IdentityToken != "" {
+					return "", c.IdentityToken, nil // used as the refresh token
+				}
+				return c.Username, c.Password, nil
+			}))
+		}
+		return docker.NewDockerAuthorizer(opts...)
+	}
+	return &authorizer{
+		cur:      newAuthorizer(),
+		new:      newAuthorizer,
+		rejected: make(map[string]struct{}),
+	}
+}
+
+type authorizer struct {
+	mu       sync.Mutex
+	cur      docker.Authorizer
+	new      func() docker.Authorizer
+	rejected map[string]struct{} // Authorization headers rejected by the registries
+}
+
+func (a *authorizer) current() docker.Authorizer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cur
+}
+
+func (a *authorizer) Authorize(ctx context.Context, req *http.Request) error {
+	return a.current().Authorize(ctx, req)
+}
+
+func (a *authorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	last := responses[len(responses)-1]
+	if last.StatusCode == http.StatusUnauthorized && last.Request != nil {
+		if h := last.Request.Header.Get("Authorization"); h != "" {
+			a.mu.Lock()
+			if _, ok := a.rejected[h]; !ok {
+				// Discard the cached tokens only once per rejected header so that concurrent
+				// requests don't discard the new token and invalid credentials aren't retried forever.
+				a.rejected[h] = struct{}{}
+				a.cur = a.new()
+			}
+			a.mu.Unlock()
+		}
+	}
+	return a.current().AddResponses(ctx, responses)
+}
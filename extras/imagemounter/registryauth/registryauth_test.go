@@ -0,0 +1,254 @@
+package registryauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestFromDockerConfig(t *testing.T) {
+	config := fmt.Sprintf(`{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": %q},
+    "localhost:5000": {"username": "user", "password": "pass"},
+    "https://registry.example.com/v2/": {"identitytoken": "token"}
+  },
+  "credsStore": "desktop"
+}`, base64.StdEncoding.EncodeToString([]byte("hub:pass:word")))
+	f, err := FromDockerConfig([]byte(config))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	for _, tt := range []struct {
+		host string
+		want *Credentials
+	}{
+		{"registry-1.docker.io", &Credentials{Username: "hub", Password: "pass:word"}},
+		{"docker.io", &Credentials{Username: "hub", Password: "pass:word"}},
+		{"localhost:5000", &Credentials{Username: "user", Password: "pass"}},
+		{"registry.example.com", &Credentials{IdentityToken: "token"}},
+		{"localhost:5001", nil},
+	} {
+		got, err := f(tt.host)
+		if err != nil {
+			t.Fatalf("failed to get credentials of %q: %v", tt.host, err)
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("unexpected credentials of %q: %+v; want %+v", tt.host, got, tt.want)
+		}
+	}
+	if _, err := FromDockerConfig([]byte(`{"auths": {"a": {"auth": "bm9zZXBhcmF0b3I="}}}`)); err == nil {
+		t.Errorf("auth without separator must be an error")
+	}
+}
+
+func TestFlagAndChain(t *testing.T) {
+	var flag Flag
+	for _, v := range []string{"localhost:5000=user:pa:ss", "docker.io=hub:pass"} {
+		if err := flag.Set(v); err != nil {
+			t.Fatalf("failed to set %q: %v", v, err)
+		}
+	}
+	for _, v := range []string{"localhost:5000", "=user:pass", "localhost:5000=user", "localhost:5000=:pass"} {
+		if err := flag.Set(v); err == nil {
+			t.Errorf("%q must be an error", v)
+		}
+	}
+	fallback := func(host string) (*Credentials, error) {
+		return &Credentials{Username: "fallback", Password: host}, nil
+	}
+	f := Chain(flag.Lookup, nil, fallback)
+	for host, want := range map[string]Credentials{
+		"localhost:5000":       {Username: "user", Password: "pa:ss"},
+		"registry-1.docker.io": {Username: "hub", Password: "pass"},
+		"example.com":          {Username: "fallback", Password: "example.com"},
+	} {
+		got, err := f(host)
+		if err != nil || got == nil || *got != want {
+			t.Errorf("unexpected credentials of %q: %+v, %v; want %+v", host, got, err, want)
+		}
+	}
+	if s := flag.String(); strings.Contains(s, "pass") {
+		t.Errorf("flag must not show passwords: %q", s)
+	}
+}
+
+// registry is a fake registry serving a manifest. If basic is set, basic auth is required (like
+// registry:2 with htpasswd). Otherwise, bearer tokens issued by the token endpoint are required.
+type registry struct {
+	basic              bool
+	username, password string
+
+	mu     sync.Mutex
+	tokens map[string]bool // valid tokens
+	issued int
+}
+
+const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`
+
+func (r *registry) expireTokens() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens = nil
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path == "/token" {
+		username, password, _ := req.BasicAuth()
+		if req.Method == http.MethodPost {
+			req.ParseForm()
+			username, password = req.Form.Get("username"), req.Form.Get("password")
+		}
+		if username != r.username || password != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.issued++
+		token := fmt.Sprintf("token-%d", r.issued)
+		if r.tokens == nil {
+			r.tokens = make(map[string]bool)
+		}
+		r.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]string{"token": token, "access_token": token})
+		return
+	}
+	authorized := false
+	if r.basic {
+		username, password, ok := req.BasicAuth()
+		authorized = ok && username == r.username && password == r.password
+	} else if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		authorized = r.tokens[token]
+	}
+	if !authorized {
+		if r.basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="registry",scope="repository:test:pull"`, req.Host))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path != "/v2/test/manifests/latest" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", imagespec.MediaTypeImageManifest)
+	w.Header().Set("Docker-Content-Digest", digest.FromString(manifest).String())
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest)))
+	if req.Method == http.MethodGet {
+		w.Write([]byte(manifest))
+	}
+}
+
+func resolve(host string, authorizer docker.Authorizer) error {
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       http.DefaultClient,
+				Host:         host,
+				Scheme:       "http",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+				Authorizer:   authorizer,
+			}}, nil
+		},
+	})
+	_, desc, err := resolver.Resolve(context.Background(), host+"/test:latest")
+	if err != nil {
+		return err
+	}
+	if desc.Digest != digest.FromString(manifest) {
+		return fmt.Errorf("unexpected digest %v", desc.Digest)
+	}
+	return nil
+}
+
+func TestBasicAuth(t *testing.T) {
+	r := &registry{basic: true, username: "user", password: "pass"}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	var flag Flag
+	if err := flag.Set(host + "=user:pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve(host, NewAuthorizer(http.DefaultClient, flag.Lookup)); err != nil {
+		t.Fatalf("failed to resolve with basic auth: %v", err)
+	}
+
+	var wrong Flag
+	if err := wrong.Set(host + "=user:wrong"); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolve(host, NewAuthorizer(http.DefaultClient, wrong.Lookup)); err == nil {
+		t.Fatalf("wrong password must be an error")
+	}
+	if err := resolve(host, NewAuthorizer(http.DefaultClient, nil)); err == nil {
+		t.Fatalf("anonymous request must be an error")
+	}
+}
+
+func TestBearerTokenRefresh(t *testing.T) {
+	r := &registry{username: "user", password: "pass"}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	authorizer := NewAuthorizer(http.DefaultClient, func(string) (*Credentials, error) {
+		return &Credentials{Username: "user", Password: "pass"}, nil
+	})
+	if err := resolve(host, authorizer); err != nil {
+		t.Fatalf("failed to resolve with bearer token: %v", err)
+	}
+	if err := resolve(host, authorizer); err != nil {
+		t.Fatalf("failed to resolve with the cached token: %v", err)
+	}
+	if r.issued != 1 {
+		t.Fatalf("token must be cached: issued %d tokens", r.issued)
+	}
+
+	r.expireTokens()
+	if err := resolve(host, authorizer); err != nil {
+		t.Fatalf("failed to resolve after the token expired: %v", err)
+	}
+	if r.issued != 2 {
+		t.Fatalf("new token must be fetched after expiration: issued %d tokens", r.issued)
+	}
+
+	// The stargz-snapshotter fetcher retries the request once after AddResponses.
+	r.expireTokens()
+	ctx := context.Background()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v2/test/manifests/latest", nil)
+	for i := 0; i < 2; i++ {
+		if err := authorizer.Authorize(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		} else if i == 1 {
+			t.Fatalf("failed to retry with a new token: %v", resp.Status)
+		}
+		if err := authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+			t.Fatal(err)
+		}
+		req = req.Clone(ctx)
+	}
+}
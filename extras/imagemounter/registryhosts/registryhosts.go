@@ -0,0 +1,288 @@
+// Package registryhosts provides the endpoints of the registries (mirrors, plain HTTP registries, CA certificates,
+// path prefixes, etc.) configured by hosts.toml files laid out as the hosts directory of containerd
+// (e.g. /etc/containerd/certs.d).
+//
+// See also https://github.com/containerd/containerd/blob/main/docs/hosts.md
+package registryhosts
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/pelletier/go-toml"
+)
+
+// Host is an endpoint of a registry.
+type Host struct {
+	Scheme       string
+	Host         string
+	Path         string
+	Capabilities docker.HostCapabilities
+	Header       http.Header
+
+	// CACerts are PEM-encoded CA certificates trusted in addition to the roots of the system.
+	CACerts [][]byte
+
+	// SkipVerify skips the verification of the certificate of the server.
+	SkipVerify bool
+}
+
+// defaultCapabilities are the capabilities of the hosts not configured explicitly.
+// Only pulling is needed by imagemounter.
+const defaultCapabilities = docker.HostCapabilityPull | docker.HostCapabilityResolve
+
+// Hosts returns the endpoints of the registry host in the order to try.
+// The configuration is read from <dir>/<host>/hosts.toml (":port" in host is "_port_" or ":port" in the
+// directory name) or <dir>/_default/hosts.toml if the former doesn't exist. The mirrors configured as
+// [host."..."] are tried first and the registry itself (or "server" if configured) is the last.
+// CA certificates (*.crt) in the directory are used if it doesn't have hosts.toml as Docker's certs.d.
+//
+// If dir is empty or has no configuration of the host, the registry itself is returned; "docker.io" is
+// "registry-1.docker.io" and localhost uses plain HTTP.
+func Hosts(dir, host string) ([]Host, error) {
+	var hosts []Host
+	if dir != "" {
+		hostDir, err := findHostDir(dir, host)
+		if err != nil {
+			return nil, err
+		}
+		if hostDir != "" {
+			hosts, err = loadHostDir(hostDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load the configuration of %q: %w", host, err)
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = []Host{{}}
+	}
+	if last := &hosts[len(hosts)-1]; last.Host == "" {
+		// the registry itself
+		last.Host, last.Scheme = host, "https"
+		if host == "docker.io" {
+			last.Host = "registry-1.docker.io"
+		} else if localhost, _ := docker.MatchLocalhost(host); localhost {
+			last.Scheme = "http"
+		}
+		last.Path = "/v2"
+		if last.Capabilities == 0 {
+			last.Capabilities = defaultCapabilities
+		}
+	}
+	return hosts, nil
+}
+
+// findHostDir returns the directory of the configuration of host. It returns "" if it isn't found.
+func findHostDir(dir, host string) (string, error) {
+	var names []string
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		names = append(names, host[:i]+"_"+host[i+1:]+"_")
+	}
+	names = append(names, host, "_default")
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func loadHostDir(dir string) ([]Host, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "hosts.toml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return loadCertFiles(dir)
+	} else if err != nil {
+		return nil, err
+	}
+	return parseHostsFile(dir, b)
+}
+
+// loadCertFiles loads the CA certificates (*.crt) in dir. Client certificates (*.cert and *.key) aren't supported.
+func loadCertFiles(dir string) ([]Host, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var h Host
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch filepath.Ext(e.Name()) {
+		case ".crt":
+			b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			h.CACerts = append(h.CACerts, b)
+		case ".cert", ".key":
+			return nil, fmt.Errorf("client certificate %q isn't supported", e.Name())
+		}
+	}
+	return []Host{h}, nil
+}
+
+// hostFileConfig is the configuration of a host in hosts.toml.
+type hostFileConfig struct {
+	// Capabilities are the operations the host can perform ("pull", "resolve" and "push").
+	Capabilities []string `toml:"capabilities"`
+
+	// CACert is the file (string) or files ([]string) of the CA certificates.
+	CACert interface{} `toml:"ca"`
+
+	// Client is the client certificates. This isn't supported.
+	Client interface{} `toml:"client"`
+
+	// SkipVerify skips the verification of the certificate of the server.
+	SkipVerify bool `toml:"skip_verify"`
+
+	// Header is the header fields sent to the host. The value is string or []string.
+	Header map[string]interface{} `toml:"header"`
+
+	// OverridePath indicates the path of the host is the API root instead of the path followed by "/v2".
+	OverridePath bool `toml:"override_path"`
+}
+
+// parseHostsFile parses hosts.toml in dir. Relative paths in the file are relative to dir.
+func parseHostsFile(dir string, b []byte) ([]Host, error) {
+	tree, err := toml.LoadBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TOML: %w", err)
+	}
+	// go-toml doesn't decode embedded unexported structs
+	type HostFileConfig = hostFileConfig
+	var c struct {
+		HostFileConfig
+		Server      string                    `toml:"server"`
+		HostConfigs map[string]hostFileConfig `toml:"host"`
+	}
+	if err := tree.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+
+	// the mirrors are tried in the order of the definitions in the file
+	var servers []string
+	if t, ok := tree.Get("host").(*toml.Tree); ok {
+		servers = t.Keys()
+		sort.Slice(servers, func(i, j int) bool {
+			return t.GetPath([]string{servers[i]}).(*toml.Tree).Position().Line < t.GetPath([]string{servers[j]}).(*toml.Tree).Position().Line
+		})
+	}
+	var hosts []Host
+	for _, server := range servers {
+		h, err := parseHostConfig(dir, server, c.HostConfigs[server])
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	h, err := parseHostConfig(dir, c.Server, c.HostFileConfig)
+	if err != nil {
+		return nil, err
+	}
+	return append(hosts, h), nil
+}
+
+// parseHostConfig parses the configuration of server. The host is left empty if server is empty.
+func parseHostConfig(dir, server string, config hostFileConfig) (h Host, _ error) {
+	if server != "" {
+		if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+			server = "https://" + server
+		}
+		u, err := url.Parse(server)
+		if err != nil {
+			return h, fmt.Errorf("invalid server %q: %w", server, err)
+		}
+		h.Scheme, h.Host = u.Scheme, u.Host
+		h.Path = "/v2"
+		if u.Path != "" {
+			h.Path = path.Clean(u.Path)
+			if !config.OverridePath && !strings.HasSuffix(h.Path, "/v2") {
+				h.Path += "/v2"
+			}
+		} else if config.OverridePath {
+			h.Path = ""
+		}
+	}
+
+	h.Capabilities = defaultCapabilities
+	if len(config.Capabilities) > 0 {
+		h.Capabilities = 0
+		for _, c := range config.Capabilities {
+			switch strings.ToLower(c) {
+			case "pull":
+				h.Capabilities |= docker.HostCapabilityPull
+			case "resolve":
+				h.Capabilities |= docker.HostCapabilityResolve
+			case "push":
+				h.Capabilities |= docker.HostCapabilityPush
+			default:
+				return h, fmt.Errorf("unknown capability %q of %q", c, server)
+			}
+		}
+	}
+
+	h.SkipVerify = config.SkipVerify
+	if config.Client != nil {
+		return h, fmt.Errorf("client certificates of %q aren't supported", server)
+	}
+	caFiles, err := stringOrSlice(config.CACert)
+	if err != nil {
+		return h, fmt.Errorf("invalid ca of %q: %w", server, err)
+	}
+	for _, f := range caFiles {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(dir, f)
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return h, fmt.Errorf("failed to read CA certificate of %q: %w", server, err)
+		}
+		h.CACerts = append(h.CACerts, b)
+	}
+
+	if config.Header != nil {
+		h.Header = make(http.Header)
+		for k, v := range config.Header {
+			values, err := stringOrSlice(v)
+			if err != nil {
+				return h, fmt.Errorf("invalid header %q of %q: %w", k, server, err)
+			}
+			h.Header[k] = values
+		}
+	}
+	return h, nil
+}
+
+// stringOrSlice returns v decoded from string or []string of TOML.
+func stringOrSlice(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		res := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value %v", e)
+			}
+			res[i] = s
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unexpected type %T", v)
+}
@@ -0,0 +1,129 @@
+package registryhosts
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+const (
+	pull    = docker.HostCapabilityPull
+	resolve = docker.HostCapabilityResolve
+)
+
+func writeFile(t *testing.T, p, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostsDefault(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"", dir} {
+		for host, want := range map[string]Host{
+			"docker.io":      {Scheme: "https", Host: "registry-1.docker.io", Path: "/v2", Capabilities: pull | resolve},
+			"ghcr.io":        {Scheme: "https", Host: "ghcr.io", Path: "/v2", Capabilities: pull | resolve},
+			"localhost:5000": {Scheme: "http", Host: "localhost:5000", Path: "/v2", Capabilities: pull | resolve},
+			"127.0.0.1:5000": {Scheme: "http", Host: "127.0.0.1:5000", Path: "/v2", Capabilities: pull | resolve},
+		} {
+			got, err := Hosts(d, host)
+			if err != nil {
+				t.Fatalf("failed to get hosts of %q: %v", host, err)
+			}
+			if !reflect.DeepEqual(got, []Host{want}) {
+				t.Errorf("unexpected hosts of %q (dir %q): %+v; want %+v", host, d, got, want)
+			}
+		}
+	}
+}
+
+func TestHostsMirrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "docker.io", "ca.crt"), "mirror-ca")
+	writeFile(t, filepath.Join(dir, "docker.io", "hosts.toml"), `
+server = "https://registry-1.docker.io"
+
+[host."https://mirror-b.example.com"]
+  capabilities = ["pull"]
+  ca = "ca.crt"
+  [host."https://mirror-b.example.com".header]
+    x-custom = "a"
+    x-multi = ["b", "c"]
+
+[host."http://mirror-a.example.com:5000/prefix"]
+  capabilities = ["pull", "resolve"]
+
+[host."https://proxy.example.com/api/v2/docker"]
+  override_path = true
+  skip_verify = true
+`)
+	got, err := Hosts(dir, "docker.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{
+		{Scheme: "https", Host: "mirror-b.example.com", Path: "/v2", Capabilities: pull, CACerts: [][]byte{[]byte("mirror-ca")},
+			Header: http.Header{"x-custom": {"a"}, "x-multi": {"b", "c"}}},
+		{Scheme: "http", Host: "mirror-a.example.com:5000", Path: "/prefix/v2", Capabilities: pull | resolve},
+		{Scheme: "https", Host: "proxy.example.com", Path: "/api/v2/docker", Capabilities: pull | resolve, SkipVerify: true},
+		{Scheme: "https", Host: "registry-1.docker.io", Path: "/v2", Capabilities: pull | resolve},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected hosts: %+v; want %+v", got, want)
+	}
+}
+
+func TestHostsDirs(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "registry.example.com_5000_", "hosts.toml"), `server = "http://registry.example.com:5000"`)
+	writeFile(t, filepath.Join(dir, "insecure.example.com", "hosts.toml"), `
+server = "https://insecure.example.com"
+skip_verify = true
+`)
+	writeFile(t, filepath.Join(dir, "certs.example.com", "ca.crt"), "certs-ca")
+	writeFile(t, filepath.Join(dir, "_default", "hosts.toml"), `
+[host."https://cache.example.com"]
+  capabilities = ["pull", "resolve"]
+`)
+	for host, want := range map[string][]Host{
+		"registry.example.com:5000": {{Scheme: "http", Host: "registry.example.com:5000", Path: "/v2", Capabilities: pull | resolve}},
+		"insecure.example.com":      {{Scheme: "https", Host: "insecure.example.com", Path: "/v2", Capabilities: pull | resolve, SkipVerify: true}},
+		"certs.example.com":         {{Scheme: "https", Host: "certs.example.com", Path: "/v2", Capabilities: pull | resolve, CACerts: [][]byte{[]byte("certs-ca")}}},
+		"ghcr.io": {
+			{Scheme: "https", Host: "cache.example.com", Path: "/v2", Capabilities: pull | resolve},
+			{Scheme: "https", Host: "ghcr.io", Path: "/v2", Capabilities: pull | resolve},
+		},
+	} {
+		got, err := Hosts(dir, host)
+		if err != nil {
+			t.Fatalf("failed to get hosts of %q: %v", host, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected hosts of %q: %+v; want %+v", host, got, want)
+		}
+	}
+}
+
+func TestHostsInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"toml":       `server = `,
+		"capability": `[host."https://mirror.example.com"]` + "\n" + `capabilities = ["fetch"]`,
+		"client":     `client = "client.pem"`,
+		"ca":         `ca = "notfound.crt"`,
+		"header":     `[header]` + "\n" + `x-custom = 1`,
+	} {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "example.com", "hosts.toml"), config)
+		if _, err := Hosts(dir, "example.com"); err == nil {
+			t.Errorf("%s: invalid configuration must be an error", name)
+		}
+	}
+}
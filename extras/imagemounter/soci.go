@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	esgzremote "github.com/containerd/stargz-snapshotter/fs/remote"
+	esgzsource "github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/ktock/container2wasm/extras/imagemounter/soci"
+	"github.com/ktock/container2wasm/internal/imagepolicy"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// sociIndex is the SOCI index of the image. It contains the zTOCs of the layers.
+type sociIndex struct {
+	ztocs map[digest.Digest]imagespec.Descriptor // keyed by the digest of the layer
+	fetch func(imagespec.Descriptor) (io.ReadCloser, error)
+}
+
+// has returns true if the index contains the zTOC of the layer.
+func (idx *sociIndex) has(dgst digest.Digest) bool {
+	if idx == nil {
+		return false
+	}
+	_, ok := idx.ztocs[dgst]
+	return ok
+}
+
+func (idx *sociIndex) ztoc(dgst digest.Digest) (*soci.Ztoc, error) {
+	desc, ok := idx.ztocs[dgst]
+	if !ok {
+		return nil, fmt.Errorf("zTOC of layer %v not found", dgst)
+	}
+	b, err := fetchVerified(idx.fetch, desc)
+	if err != nil {
+		return nil, err
+	}
+	return soci.ParseZtoc(b)
+}
+
+// fetchSOCIIndex fetches the SOCI index manifest.
+func fetchSOCIIndex(desc imagespec.Descriptor, fetch func(imagespec.Descriptor) (io.ReadCloser, error)) (*sociIndex, error) {
+	b, err := fetchVerified(fetch, desc)
+	if err != nil {
+		return nil, err
+	}
+	var manifest imagespec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	idx := &sociIndex{ztocs: make(map[digest.Digest]imagespec.Descriptor), fetch: fetch}
+	for _, l := range manifest.Layers {
+		if d, ok := l.Annotations[soci.ImageLayerDigestAnnotation]; ok {
+			dgst, err := digest.Parse(d)
+			if err != nil {
+				return nil, fmt.Errorf("invalid layer digest of zTOC %v: %w", l.Digest, err)
+			}
+			idx.ztocs[dgst] = l
+		}
+	}
+	return idx, nil
+}
+
+// fetchVerified fetches the blob and verifies its digest.
+func fetchVerified(fetch func(imagespec.Descriptor) (io.ReadCloser, error), desc imagespec.Descriptor) ([]byte, error) {
+	r, err := fetch(desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if got := desc.Digest.Algorithm().FromBytes(b); got != desc.Digest {
+		return nil, fmt.Errorf("unexpected digest %v of %v", got, desc.Digest)
+	}
+	return b, nil
+}
+
+// findSOCIIndexOCILayout returns the SOCI index of the image in the OCI layout served at addr.
+// SOCI index manifest v2 is supported. It returns nil if the image doesn't have the index.
+func findSOCIIndexOCILayout(addr string, manifest imagespec.Manifest) (*sociIndex, error) {
+	d, ok := manifest.Annotations[soci.IndexDigestAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	dgst, err := digest.Parse(d)
+	if err != nil {
+		return nil, err
+	}
+	return fetchSOCIIndex(imagespec.Descriptor{MediaType: imagespec.MediaTypeImageManifest, Digest: dgst}, func(desc imagespec.Descriptor) (io.ReadCloser, error) {
+		resp, err := defaultClient.Get(addr + "/blobs/" + desc.Digest.Algorithm().String() + "/" + desc.Digest.Encoded())
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to fetch %v: %v", desc.Digest, resp.Status)
+		}
+		return resp.Body, nil
+	})
+}
+
+// findSOCIIndexRegistry returns the SOCI index of the image manifest in the registry.
+// SOCI index manifest v2 is found by the annotation of the manifest. v1 is found by the referrers API.
+// It returns nil if the image doesn't have the index.
+func findSOCIIndexRegistry(ctx context.Context, refspec reference.Spec, fetcher remotes.Fetcher, manifestDesc imagespec.Descriptor, manifest imagespec.Manifest) (*sociIndex, error) {
+	fetch := func(desc imagespec.Descriptor) (io.ReadCloser, error) {
+		if f, ok := fetcher.(remotes.FetcherByDigest); ok && desc.Size == 0 {
+			// the size of the index referred by the annotation is unknown
+			r, _, err := f.FetchByDigest(ctx, desc.Digest)
+			return r, err
+		}
+		return fetcher.Fetch(ctx, desc)
+	}
+	if d, ok := manifest.Annotations[soci.IndexDigestAnnotation]; ok {
+		dgst, err := digest.Parse(d)
+		if err != nil {
+			return nil, err
+		}
+		return fetchSOCIIndex(imagespec.Descriptor{MediaType: imagespec.MediaTypeImageManifest, Digest: dgst}, fetch)
+	}
+	hosts, err := policyRegistryHosts(refspec)
+	if err != nil {
+		return nil, err
+	}
+	referrers, err := imagepolicy.FetchReferrers(ctx, hosts, refspec.Locator, manifestDesc.Digest, soci.IndexArtifactTypeV1)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range referrers {
+		if m.ArtifactType == soci.IndexArtifactTypeV1 { // registries may not filter by the artifact type
+			return fetchSOCIIndex(m, fetch)
+		}
+	}
+	return nil, nil
+}
+
+// newSOCILayer makes the node of the gzip layer lazily pulled using the zTOC in the SOCI index.
+func newSOCILayer(ctx context.Context, q *qidSet, l imagespec.Descriptor, index *sociIndex, esgzresolver *esgzremote.Resolver, hosts esgzsource.RegistryHosts, refspec reference.Spec, cache *layerCache) (*NodeLayer, error) {
+	z, err := index.ztoc(l.Digest)
+	if err != nil {
+		return nil, err
+	}
+	b, err := esgzresolver.Resolve(ctx, hosts, refspec, l, cache.forLayer(l.Digest, "blob"))
+	if err != nil {
+		return nil, err
+	}
+	r, err := soci.NewReader(z, readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return b.ReadAt(p, offset)
+	}), cache.forLayer(l.Digest, "soci"))
+	if err != nil {
+		return nil, err
+	}
+	files := z.Files
+	n, err := newNodeLayer(q, func() (*tar.Header, int64, error) {
+		if len(files) == 0 {
+			return nil, 0, io.EOF
+		}
+		f := files[0]
+		files = files[1:]
+		h, err := f.Header()
+		if err != nil {
+			return nil, 0, err
+		}
+		return h, f.UncompressedOffset, nil
+	}, r)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("lazily pulling layer %v using SOCI index\n", l.Digest)
+	return n, nil
+}
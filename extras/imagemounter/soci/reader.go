@@ -0,0 +1,268 @@
+package soci
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	esgzcache "github.com/containerd/stargz-snapshotter/cache"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sync/singleflight"
+)
+
+// windowSize is the size of the window of deflate stored in the checkpoints.
+const windowSize = 32768
+
+// checkpoint is the position in the gzip stream where decompression can be started.
+type checkpoint struct {
+	in     int64  // offset in the compressed stream
+	out    int64  // offset in the uncompressed stream
+	bits   uint8  // number of bits of the byte before in that belong to the next block
+	window []byte // last uncompressed data before out
+}
+
+// parseCheckpoints parses the checkpoints of gzip serialized in the zTOC.
+// The format is the header (int32 number of checkpoints, int64 span size) followed by the
+// checkpoints (int64 in, int64 out, uint8 bits, window), in little endian.
+func parseCheckpoints(b []byte) ([]checkpoint, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("checkpoints are too short")
+	}
+	n := int(int32(binary.LittleEndian.Uint32(b)))
+	b = b[12:]
+	const headerSize = 8 + 8 + 1
+	firstWindow := true
+	switch len(b) {
+	case n * (headerSize + windowSize):
+	case n*(headerSize+windowSize) - windowSize:
+		firstWindow = false // the first checkpoint is the beginning of the stream so the window is omitted
+	default:
+		return nil, fmt.Errorf("unexpected size of %d checkpoints: %d", n, len(b))
+	}
+	cps := make([]checkpoint, n)
+	for i := range cps {
+		cps[i] = checkpoint{
+			in:   int64(binary.LittleEndian.Uint64(b)),
+			out:  int64(binary.LittleEndian.Uint64(b[8:])),
+			bits: b[16],
+		}
+		b = b[headerSize:]
+		if i > 0 || firstWindow {
+			cps[i].window, b = b[:windowSize], b[windowSize:]
+		}
+		if cps[i].bits > 7 {
+			return nil, fmt.Errorf("invalid bits %d of checkpoint %d", cps[i].bits, i)
+		}
+		if i > 0 && (cps[i].in < cps[i-1].in || cps[i].out < cps[i-1].out) {
+			return nil, fmt.Errorf("checkpoints are not sorted")
+		}
+	}
+	return cps, nil
+}
+
+// Reader reads the uncompressed layer from the compressed blob using the zTOC.
+// The spans (the ranges between the checkpoints) are decompressed on demand and cached.
+// The compressed data of each span is verified by the digest of the span in the zTOC before decompression.
+type Reader struct {
+	blob    io.ReaderAt
+	z       *Ztoc
+	cps     []checkpoint
+	digests []digest.Digest
+	cache   esgzcache.BlobCache
+
+	g singleflight.Group
+}
+
+// NewReader returns the reader of the layer. blob is the compressed layer indexed by z.
+func NewReader(z *Ztoc, blob io.ReaderAt, cache esgzcache.BlobCache) (*Reader, error) {
+	if z.CompressionAlgorithm != CompressionGzip {
+		return nil, fmt.Errorf("unsupported compression algorithm %d of zTOC", z.CompressionAlgorithm)
+	}
+	cps, err := parseCheckpoints(z.Checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	if len(cps) == 0 || cps[0].out != 0 {
+		cps = append([]checkpoint{{}}, cps...) // the beginning of the stream
+	}
+	if len(z.SpanDigests) != len(cps) {
+		return nil, fmt.Errorf("zTOC has %d span digests for %d spans", len(z.SpanDigests), len(cps))
+	}
+	digests := make([]digest.Digest, len(cps))
+	for i, d := range z.SpanDigests {
+		dgst, err := digest.Parse(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest of span %d: %w", i, err)
+		}
+		digests[i] = dgst
+	}
+	return &Reader{blob: blob, z: z, cps: cps, digests: digests, cache: cache}, nil
+}
+
+// Size returns the size of the uncompressed layer.
+func (r *Reader) Size() int64 {
+	return r.z.UncompressedArchiveSize
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off+int64(n) < r.Size() {
+		cur := off + int64(n)
+		i := sort.Search(len(r.cps), func(i int) bool { return r.cps[i].out > cur }) - 1
+		span, err := r.span(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], span[cur-r.cps[i].out:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// spanEnd returns the end offset of the span in the uncompressed stream.
+func (r *Reader) spanEnd(i int) int64 {
+	if i+1 < len(r.cps) {
+		return r.cps[i+1].out
+	}
+	return r.Size()
+}
+
+func (r *Reader) span(i int) ([]byte, error) {
+	key := strconv.Itoa(i)
+	if cr, err := r.cache.Get(key); err == nil {
+		defer cr.Close()
+		b := make([]byte, r.spanEnd(i)-r.cps[i].out)
+		if n, err := cr.ReadAt(b, 0); n == len(b) {
+			return b, nil
+		} else if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read span %d from cache: %w", i, err)
+	}
+	b, err, _ := r.g.Do(key, func() (interface{}, error) {
+		b, err := r.decompressSpan(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress span %d: %w", i, err)
+		}
+		if w, err := r.cache.Add(key); err == nil {
+			if _, err := w.Write(b); err == nil {
+				w.Commit()
+			} else {
+				w.Abort()
+			}
+			w.Close()
+		}
+		return b, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.([]byte), nil
+}
+
+// compressedSpan returns the range of the span in the compressed stream that is covered by the span digest.
+// The span starts at the byte containing the first bit of the checkpoint and ends at the next checkpoint.
+func (r *Reader) compressedSpan(i int) (start, end int64) {
+	start = r.cps[i].in
+	if r.cps[i].bits > 0 {
+		start--
+	}
+	end = r.z.CompressedArchiveSize
+	if i+1 < len(r.cps) {
+		end = r.cps[i+1].in
+	}
+	return start, end
+}
+
+func (r *Reader) decompressSpan(i int) ([]byte, error) {
+	cp := r.cps[i]
+	start, end := r.compressedSpan(i)
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid range of span %d: %d-%d", i, start, end)
+	}
+	compressed := make([]byte, end-start)
+	if _, err := r.blob.ReadAt(compressed, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if d := r.digests[i].Algorithm().FromBytes(compressed); d != r.digests[i] {
+		return nil, fmt.Errorf("unexpected digest %v of span %d; want %v", d, i, r.digests[i])
+	}
+	var zr io.Reader
+	if cp.in == 0 {
+		gr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		zr = gr
+	} else {
+		br := bytes.NewReader(compressed)
+		var src io.Reader = br
+		if cp.bits > 0 {
+			sr, err := newShiftReader(br, 8-uint(cp.bits))
+			if err != nil {
+				return nil, err
+			}
+			src = sr
+		}
+		zr = flate.NewReaderDict(src, cp.window)
+	}
+	b := make([]byte, r.spanEnd(i)-cp.out)
+	if _, err := io.ReadFull(zr, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// shiftReader skips the lower shift bits of the first byte and returns the following bits
+// as the stream of the bytes. This allows deflate to start from a block not aligned to bytes.
+type shiftReader struct {
+	r     io.ByteReader
+	shift uint
+	cur   byte
+	eof   bool
+}
+
+func newShiftReader(r io.ByteReader, shift uint) (*shiftReader, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return &shiftReader{r: r, shift: shift, cur: c}, nil
+}
+
+func (s *shiftReader) ReadByte() (byte, error) {
+	if s.eof {
+		return 0, io.EOF
+	}
+	next, err := s.r.ReadByte()
+	if err == io.EOF {
+		s.eof = true
+		return s.cur >> s.shift, nil // remaining bits
+	} else if err != nil {
+		return 0, err
+	}
+	b := s.cur>>s.shift | next<<(8-s.shift)
+	s.cur = next
+	return b, nil
+}
+
+func (s *shiftReader) Read(p []byte) (int, error) {
+	for i := range p {
+		b, err := s.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		p[i] = b
+	}
+	return len(p), nil
+}
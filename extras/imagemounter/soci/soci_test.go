@@ -0,0 +1,331 @@
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"testing"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/ktock/container2wasm/extras/imagemounter/layercache"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func testData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"container", "wasm", "layer", "span", "checkpoint", "\n"}
+	var b bytes.Buffer
+	for b.Len() < size {
+		b.WriteString(words[rnd.Intn(len(words))])
+	}
+	return b.Bytes()[:size]
+}
+
+func serializeCheckpoints(cps []checkpoint, firstWindow bool) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(cps)))
+	b = binary.LittleEndian.AppendUint64(b, 1024*1024)
+	for i, cp := range cps {
+		b = binary.LittleEndian.AppendUint64(b, uint64(cp.in))
+		b = binary.LittleEndian.AppendUint64(b, uint64(cp.out))
+		b = append(b, cp.bits)
+		if i > 0 || firstWindow {
+			w := make([]byte, windowSize)
+			copy(w[windowSize-len(cp.window):], cp.window)
+			b = append(b, w...)
+		}
+	}
+	return b
+}
+
+// spanDigests returns the digests of the compressed spans between the checkpoints.
+func spanDigests(blob []byte, cps []checkpoint) (digests []string) {
+	for i, cp := range cps {
+		start, end := cp.in, int64(len(blob))
+		if cp.bits > 0 {
+			start--
+		}
+		if i+1 < len(cps) {
+			end = cps[i+1].in
+		}
+		digests = append(digests, digest.FromBytes(blob[start:end]).String())
+	}
+	return digests
+}
+
+// buildZtoc serializes the zTOC in the same layout as ztoc.fbs of soci-snapshotter.
+func buildZtoc(z *Ztoc) []byte {
+	b := flatbuffers.NewBuilder(0)
+	var files []flatbuffers.UOffsetT
+	for _, f := range z.Files {
+		var xattrs []flatbuffers.UOffsetT
+		for k, v := range f.Xattrs {
+			key, value := b.CreateString(k), b.CreateString(v)
+			b.StartObject(2)
+			b.PrependUOffsetTSlot(0, key, 0)
+			b.PrependUOffsetTSlot(1, value, 0)
+			xattrs = append(xattrs, b.EndObject())
+		}
+		xattrsV := createVector(b, xattrs)
+		name, typ, linkname, modTime := b.CreateString(f.Name), b.CreateString(f.Type), b.CreateString(f.Linkname), b.CreateString(f.ModTime)
+		b.StartObject(14)
+		b.PrependUOffsetTSlot(0, name, 0)
+		b.PrependUOffsetTSlot(1, typ, 0)
+		b.PrependInt64Slot(2, f.UncompressedOffset, 0)
+		b.PrependInt64Slot(3, f.UncompressedSize, 0)
+		b.PrependUOffsetTSlot(4, linkname, 0)
+		b.PrependInt64Slot(5, f.Mode, 0)
+		b.PrependUint32Slot(6, f.UID, 0)
+		b.PrependUint32Slot(7, f.GID, 0)
+		b.PrependUOffsetTSlot(10, modTime, 0)
+		b.PrependUOffsetTSlot(13, xattrsV, 0)
+		files = append(files, b.EndObject())
+	}
+	filesV := createVector(b, files)
+	b.StartObject(1)
+	b.PrependUOffsetTSlot(0, filesV, 0)
+	toc := b.EndObject()
+
+	var digests []flatbuffers.UOffsetT
+	for _, d := range z.SpanDigests {
+		digests = append(digests, b.CreateString(d))
+	}
+	digestsV := createVector(b, digests)
+	checkpoints := b.CreateByteVector(z.Checkpoints)
+	b.StartObject(4)
+	b.PrependInt32Slot(0, z.MaxSpanID, 0)
+	b.PrependUOffsetTSlot(1, digestsV, 0)
+	b.PrependUOffsetTSlot(2, checkpoints, 0)
+	b.PrependInt8Slot(3, int8(z.CompressionAlgorithm), 0)
+	ci := b.EndObject()
+
+	version := b.CreateString(z.Version)
+	b.StartObject(6)
+	b.PrependUOffsetTSlot(0, version, 0)
+	b.PrependInt64Slot(2, z.CompressedArchiveSize, 0)
+	b.PrependInt64Slot(3, z.UncompressedArchiveSize, 0)
+	b.PrependUOffsetTSlot(4, toc, 0)
+	b.PrependUOffsetTSlot(5, ci, 0)
+	b.Finish(b.EndObject())
+	return b.FinishedBytes()
+}
+
+func createVector(b *flatbuffers.Builder, offs []flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	b.StartVector(flatbuffers.SizeUOffsetT, len(offs), flatbuffers.SizeUOffsetT)
+	for i := len(offs) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(offs[i])
+	}
+	return b.EndVector(len(offs))
+}
+
+func TestParseZtoc(t *testing.T) {
+	want := &Ztoc{
+		Version:                 "0.9",
+		CompressedArchiveSize:   100,
+		UncompressedArchiveSize: 1000,
+		Files: []FileMetadata{
+			{Name: "dir/", Type: "dir", Mode: 0755, ModTime: "2024-01-02T03:04:05.123456789Z"},
+			{Name: "dir/file", Type: "reg", UncompressedOffset: 1024, UncompressedSize: 10, Mode: 0644, UID: 1000, GID: 1000,
+				Xattrs: map[string]string{"user.foo": "bar"}},
+			{Name: "dir/link", Type: "symlink", Linkname: "file", Mode: 0777},
+		},
+		MaxSpanID:   1,
+		SpanDigests: []string{"sha256:aaa", "sha256:bbb"},
+		Checkpoints: []byte{1, 2, 3},
+	}
+	got, err := ParseZtoc(buildZtoc(want))
+	if err != nil {
+		t.Fatalf("failed to parse zTOC: %v", err)
+	}
+	if got.Version != want.Version || got.CompressedArchiveSize != want.CompressedArchiveSize ||
+		got.UncompressedArchiveSize != want.UncompressedArchiveSize || got.MaxSpanID != want.MaxSpanID ||
+		!bytes.Equal(got.Checkpoints, want.Checkpoints) || len(got.SpanDigests) != 2 || got.SpanDigests[1] != "sha256:bbb" {
+		t.Fatalf("unexpected zTOC %+v; want %+v", got, want)
+	}
+	if len(got.Files) != len(want.Files) {
+		t.Fatalf("unexpected number of files %d; want %d", len(got.Files), len(want.Files))
+	}
+	h, err := got.Files[1].Header()
+	if err != nil {
+		t.Fatalf("failed to get header: %v", err)
+	}
+	if h.Typeflag != tar.TypeReg || h.Name != "dir/file" || h.Size != 10 || h.Mode != 0644 || h.Uid != 1000 ||
+		h.PAXRecords["SCHILY.xattr.user.foo"] != "bar" {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	h, err = got.Files[0].Header()
+	if err != nil {
+		t.Fatalf("failed to get header: %v", err)
+	}
+	if h.Typeflag != tar.TypeDir || h.ModTime.Nanosecond() != 123456789 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	if h, err := got.Files[2].Header(); err != nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "file" {
+		t.Fatalf("unexpected header %+v: %v", h, err)
+	}
+	if _, err := ParseZtoc([]byte{0xff, 0xff, 0xff, 0x0f}); err == nil {
+		t.Fatalf("invalid zTOC must be an error")
+	}
+}
+
+func checkReader(t *testing.T, r *Reader, data []byte) {
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		off := rnd.Int63n(int64(len(data)))
+		size := rnd.Intn(300000)
+		got := make([]byte, size)
+		n, err := r.ReadAt(got, off)
+		want := data[off:min(off+int64(size), int64(len(data)))]
+		if n != len(want) || (n < size && err != io.EOF) || (n == size && err != nil) {
+			t.Fatalf("unexpected result of reading %d bytes at %d: %d, %v", size, off, n, err)
+		}
+		if !bytes.Equal(got[:n], want) {
+			t.Fatalf("unexpected data at %d", off)
+		}
+	}
+}
+
+// TestReaderGzip tests the checkpoints aligned to bytes using the gzip stream flushed at the checkpoints.
+func TestReaderGzip(t *testing.T) {
+	for _, firstWindow := range []bool{true, false} {
+		data := testData(5*1024*1024 + 123)
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		var cps []checkpoint
+		const spanSize = 1024 * 1024
+		for off := 0; off < len(data); off += spanSize {
+			if off > 0 {
+				if err := zw.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				cps = append(cps, checkpoint{in: int64(compressed.Len()), out: int64(off), window: data[max(0, off-windowSize):off]})
+			} else {
+				cps = append(cps, checkpoint{in: 10, out: 0}) // after the gzip header
+			}
+			if _, err := zw.Write(data[off:min(off+spanSize, len(data))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		z, err := ParseZtoc(buildZtoc(&Ztoc{
+			CompressedArchiveSize:   int64(compressed.Len()),
+			UncompressedArchiveSize: int64(len(data)),
+			MaxSpanID:               int32(len(cps) - 1),
+			SpanDigests:             spanDigests(compressed.Bytes(), cps),
+			Checkpoints:             serializeCheckpoints(cps, firstWindow),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache := layercache.NewMemoryCache(2 * spanSize)
+		r, err := NewReader(z, bytes.NewReader(compressed.Bytes()), cache)
+		if err != nil {
+			t.Fatalf("failed to make reader: %v", err)
+		}
+		if r.Size() != int64(len(data)) {
+			t.Fatalf("unexpected size %d; want %d", r.Size(), len(data))
+		}
+		checkReader(t, r, data)
+		if cache.Size() > 2*spanSize {
+			t.Fatalf("cache size %d exceeds the limit", cache.Size())
+		}
+	}
+}
+
+func TestReaderVerify(t *testing.T) {
+	data := testData(3 * 1024 * 1024)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(data[:1024*1024]); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	cps := []checkpoint{{in: 10}, {in: int64(compressed.Len()), out: 1024 * 1024, window: data[1024*1024-windowSize : 1024*1024]}}
+	if _, err := zw.Write(data[1024*1024:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	z := &Ztoc{
+		CompressedArchiveSize:   int64(compressed.Len()),
+		UncompressedArchiveSize: int64(len(data)),
+		MaxSpanID:               1,
+		SpanDigests:             spanDigests(compressed.Bytes(), cps),
+		Checkpoints:             serializeCheckpoints(cps, false),
+	}
+	if _, err := NewReader(&Ztoc{
+		CompressedArchiveSize:   z.CompressedArchiveSize,
+		UncompressedArchiveSize: z.UncompressedArchiveSize,
+		Checkpoints:             z.Checkpoints,
+	}, bytes.NewReader(compressed.Bytes()), layercache.NewMemoryCache(0)); err == nil {
+		t.Fatalf("zTOC without span digests must be an error")
+	}
+
+	// Corrupt the second span. The first span is still readable.
+	blob := bytes.Clone(compressed.Bytes())
+	blob[cps[1].in+100] ^= 0xff
+	r, err := NewReader(z, bytes.NewReader(blob), layercache.NewMemoryCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 100)
+	if _, err := r.ReadAt(got, 0); err != nil || !bytes.Equal(got, data[:100]) {
+		t.Fatalf("failed to read the first span: %v", err)
+	}
+	if _, err := r.ReadAt(got, 2*1024*1024); err == nil {
+		t.Fatalf("corrupted span must be an error")
+	}
+}
+
+// TestReaderBits tests the checkpoint not aligned to bytes.
+func TestReaderBits(t *testing.T) {
+	data := testData(3 * 1024 * 1024)
+	const out = 1024 * 1024
+	window := data[out-windowSize : out]
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriterDict(&deflated, flate.DefaultCompression, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(data[out:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d := deflated.Bytes()
+	for bits := uint8(1); bits <= 7; bits++ {
+		// The block starts at the higher bits of the byte followed by the garbage (lower) bits.
+		shift := 8 - bits
+		blob := []byte{0xde, 0xad, 0xbe, 0xef, 0x5a>>bits | d[0]<<shift}
+		for i := 1; i < len(d); i++ {
+			blob = append(blob, d[i-1]>>bits|d[i]<<shift)
+		}
+		blob = append(blob, d[len(d)-1]>>bits)
+		cps := []checkpoint{{}, {in: 5, out: out, bits: bits, window: window}}
+		r, err := NewReader(&Ztoc{
+			CompressedArchiveSize:   int64(len(blob)),
+			UncompressedArchiveSize: int64(len(data)),
+			SpanDigests:             spanDigests(blob, cps),
+			Checkpoints:             serializeCheckpoints(cps, false),
+		}, bytes.NewReader(blob), layercache.NewMemoryCache(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(data)-out)
+		if _, err := r.ReadAt(got, out); err != nil {
+			t.Fatalf("failed to read with %d bits: %v", bits, err)
+		}
+		if !bytes.Equal(got, data[out:]) {
+			t.Fatalf("unexpected data with %d bits", bits)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Package soci reads the layers indexed by SOCI (Seekable OCI) zTOCs.
+// See also: https://github.com/awslabs/soci-snapshotter
+package soci
+
+import (
+	"archive/tar"
+	"fmt"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+const (
+	// IndexArtifactTypeV1 is the artifact type of SOCI index manifest v1 that refers to the image as the subject.
+	IndexArtifactTypeV1 = "application/vnd.amazon.soci.index.v1+json"
+
+	// IndexArtifactTypeV2 is the artifact type of SOCI index manifest v2.
+	IndexArtifactTypeV2 = "application/vnd.amazon.soci.index.v2+json"
+
+	// IndexDigestAnnotation is the annotation of the image manifest that contains the digest of SOCI index manifest v2.
+	IndexDigestAnnotation = "com.amazon.soci.index-digest"
+
+	// ImageLayerDigestAnnotation is the annotation of the zTOC that contains the digest of the layer.
+	ImageLayerDigestAnnotation = "com.amazon.soci.image-layer-digest"
+)
+
+// CompressionAlgorithm is the compression algorithm of the layer indexed by the zTOC.
+type CompressionAlgorithm int8
+
+const (
+	CompressionGzip CompressionAlgorithm = iota
+	CompressionZstd
+	CompressionUncompressed
+)
+
+// Ztoc is the zTOC of a layer. It contains the metadata of the files in the layer and
+// the checkpoints of the compressed stream for seeking in the layer.
+type Ztoc struct {
+	Version                 string
+	BuildToolIdentifier     string
+	CompressedArchiveSize   int64
+	UncompressedArchiveSize int64
+	Files                   []FileMetadata
+
+	MaxSpanID            int32
+	SpanDigests          []string
+	Checkpoints          []byte
+	CompressionAlgorithm CompressionAlgorithm
+}
+
+// FileMetadata is the metadata of a file in the layer.
+type FileMetadata struct {
+	Name               string
+	Type               string
+	UncompressedOffset int64
+	UncompressedSize   int64
+	Linkname           string
+	Mode               int64
+	UID                uint32
+	GID                uint32
+	Uname              string
+	Gname              string
+	ModTime            string
+	Devmajor           int64
+	Devminor           int64
+	Xattrs             map[string]string
+}
+
+// ParseZtoc parses the zTOC serialized in flatbuffers (ztoc.fbs of soci-snapshotter).
+func ParseZtoc(b []byte) (z *Ztoc, retErr error) {
+	if len(b) < flatbuffers.SizeUOffsetT {
+		return nil, fmt.Errorf("zTOC is too short")
+	}
+	defer func() {
+		// flatbuffers panics on the out of range access
+		if r := recover(); r != nil {
+			z, retErr = nil, fmt.Errorf("invalid zTOC: %v", r)
+		}
+	}()
+	root := table{flatbuffers.Table{Bytes: b, Pos: flatbuffers.GetUOffsetT(b)}}
+	z = &Ztoc{
+		Version:                 root.string(0),
+		BuildToolIdentifier:     root.string(1),
+		CompressedArchiveSize:   root.int64(2),
+		UncompressedArchiveSize: root.int64(3),
+	}
+	if toc, ok := root.table(4); ok {
+		for _, m := range toc.tables(0) {
+			f := FileMetadata{
+				Name:               m.string(0),
+				Type:               m.string(1),
+				UncompressedOffset: m.int64(2),
+				UncompressedSize:   m.int64(3),
+				Linkname:           m.string(4),
+				Mode:               m.int64(5),
+				UID:                m.uint32(6),
+				GID:                m.uint32(7),
+				Uname:              m.string(8),
+				Gname:              m.string(9),
+				ModTime:            m.string(10),
+				Devmajor:           m.int64(11),
+				Devminor:           m.int64(12),
+			}
+			for _, x := range m.tables(13) {
+				if f.Xattrs == nil {
+					f.Xattrs = make(map[string]string)
+				}
+				f.Xattrs[x.string(0)] = x.string(1)
+			}
+			z.Files = append(z.Files, f)
+		}
+	}
+	if ci, ok := root.table(5); ok {
+		z.MaxSpanID = ci.int32(0)
+		z.SpanDigests = ci.strings(1)
+		z.Checkpoints = ci.bytes(2)
+		z.CompressionAlgorithm = CompressionAlgorithm(ci.int8(3))
+	}
+	return z, nil
+}
+
+var typeflags = map[string]byte{
+	"reg":      tar.TypeReg,
+	"dir":      tar.TypeDir,
+	"symlink":  tar.TypeSymlink,
+	"hardlink": tar.TypeLink,
+	"char":     tar.TypeChar,
+	"block":    tar.TypeBlock,
+	"fifo":     tar.TypeFifo,
+}
+
+// Header returns the tar header of the file.
+func (f *FileMetadata) Header() (*tar.Header, error) {
+	typeflag, ok := typeflags[f.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q of %q", f.Type, f.Name)
+	}
+	h := &tar.Header{
+		Typeflag: typeflag,
+		Name:     f.Name,
+		Linkname: f.Linkname,
+		Size:     f.UncompressedSize,
+		Mode:     f.Mode,
+		Uid:      int(f.UID),
+		Gid:      int(f.GID),
+		Uname:    f.Uname,
+		Gname:    f.Gname,
+		Devmajor: f.Devmajor,
+		Devminor: f.Devminor,
+	}
+	if f.ModTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, f.ModTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time of %q: %w", f.Name, err)
+		}
+		h.ModTime = t
+	}
+	for k, v := range f.Xattrs {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords["SCHILY.xattr."+k] = v
+	}
+	return h, nil
+}
+
+// table reads the fields of a flatbuffers table by their indexes in the schema.
+type table struct {
+	flatbuffers.Table
+}
+
+// field returns the offset of the field relative to the table. It's 0 if the field isn't set.
+func (t table) field(i int) flatbuffers.UOffsetT {
+	return flatbuffers.UOffsetT(t.Offset(flatbuffers.VOffsetT(4 + 2*i)))
+}
+
+func (t table) string(i int) string {
+	if o := t.field(i); o != 0 {
+		return t.String(o + t.Pos)
+	}
+	return ""
+}
+
+func (t table) bytes(i int) []byte {
+	if o := t.field(i); o != 0 {
+		return t.ByteVector(o + t.Pos)
+	}
+	return nil
+}
+
+func (t table) int64(i int) int64 {
+	if o := t.field(i); o != 0 {
+		return t.GetInt64(o + t.Pos)
+	}
+	return 0
+}
+
+func (t table) int32(i int) int32 {
+	if o := t.field(i); o != 0 {
+		return t.GetInt32(o + t.Pos)
+	}
+	return 0
+}
+
+func (t table) uint32(i int) uint32 {
+	if o := t.field(i); o != 0 {
+		return t.GetUint32(o + t.Pos)
+	}
+	return 0
+}
+
+func (t table) int8(i int) int8 {
+	if o := t.field(i); o != 0 {
+		return t.GetInt8(o + t.Pos)
+	}
+	return 0
+}
+
+func (t table) table(i int) (table, bool) {
+	o := t.field(i)
+	if o == 0 {
+		return table{}, false
+	}
+	return table{flatbuffers.Table{Bytes: t.Bytes, Pos: t.Indirect(o + t.Pos)}}, true
+}
+
+func (t table) tables(i int) (tables []table) {
+	o := t.field(i)
+	if o == 0 {
+		return nil
+	}
+	v := t.Vector(o)
+	for j := 0; j < t.VectorLen(o); j++ {
+		x := v + flatbuffers.UOffsetT(j)*flatbuffers.SizeUOffsetT
+		tables = append(tables, table{flatbuffers.Table{Bytes: t.Bytes, Pos: t.Indirect(x)}})
+	}
+	return tables
+}
+
+func (t table) strings(i int) (strs []string) {
+	o := t.field(i)
+	if o == 0 {
+		return nil
+	}
+	v := t.Vector(o)
+	for j := 0; j < t.VectorLen(o); j++ {
+		strs = append(strs, t.String(v+flatbuffers.UOffsetT(j)*flatbuffers.SizeUOffsetT))
+	}
+	return strs
+}
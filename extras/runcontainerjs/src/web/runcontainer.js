@@ -1,11 +1,11 @@
 let stackWorker = null;
 
-export async function createContainerWASI(vmImage, imageAddr, stackWorkerPath, mounterWasmURL) {
+export async function createContainerWASI(vmImage, imageAddr, stackWorkerPath, mounterWasmURL, options) {
     stackWorker = new Worker(stackWorkerPath);
     let cert = null;
     let net = null;
     await new Promise((resolve) => {
-        net = createStack(stackWorker, imageAddr, mounterWasmURL, (c) => { cert = c; resolve(); });
+        net = createStack(stackWorker, imageAddr, mounterWasmURL, (c) => { cert = c; resolve(); }, options && options.log, options && options.onImageDigest);
     });
     return {vmImage: vmImage, net: net, cert: cert};
 }
@@ -43,7 +43,7 @@ export async function createContainerQEMUWasm(Module, outJsAddr, imageAddr, stac
                     mod.FS.writeFile('/.wasmenv/proxy.crt', cert);
                 });
                 resolve();
-            }, options.log);
+            }, options.log, options.onImageDigest);
         });
         let info = "t:" + Math.round(new Date() / 1000) + "\n";
         info += 'n:' + genmac() + '\n';
@@ -122,7 +122,7 @@ function emscriptenMockWebSocket(address, onconnection) {
     window.WebSocket = EmscriptenMockWebSocket;
 }
 
-function startQEMUWasm(address, stackWorkerFile, mounterWasmURL, imageAddr, readyCallback, log) {
+function startQEMUWasm(address, stackWorkerFile, mounterWasmURL, imageAddr, readyCallback, log, imageDigestCallback) {
     emscriptenMockWebSocket(address, (client) => {
         if (curSocket != null) {
             console.log("duplicated");
@@ -144,7 +144,7 @@ function startQEMUWasm(address, stackWorkerFile, mounterWasmURL, imageAddr, read
 
     stackWorker = new Worker(stackWorkerFile);
 
-    let conn = createStack(stackWorker, imageAddr, mounterWasmURL, readyCallback, log);
+    let conn = createStack(stackWorker, imageAddr, mounterWasmURL, readyCallback, log, imageDigestCallback);
     registerConnBuffer(conn.toNet, conn.fromNet);
     registerMetaBuffer(conn.metaFromNet);
 }
@@ -318,7 +318,7 @@ export function RecvCert(){
     });
 }
 
-function createStack(stackWorker, imageAddr, mounterWasmURL, readyCallback, log) {
+function createStack(stackWorker, imageAddr, mounterWasmURL, readyCallback, log, imageDigestCallback) {
     var proxyShared = new SharedArrayBuffer(12 + 1024 * 1024);
 
     var toShared = new SharedArrayBuffer(1024 * 1024);
@@ -355,7 +355,7 @@ function createStack(stackWorker, imageAddr, mounterWasmURL, readyCallback, log)
         buf: new Uint8Array(0),
         readyCallback: readyCallback
     }
-    stackWorker.onmessage = connect("proxy", proxyShared, toShared, certbuf, log);
+    stackWorker.onmessage = connect("proxy", proxyShared, toShared, certbuf, log, imageDigestCallback);
     stackWorker.postMessage({type: "init", buf: proxyShared, toBuf: toShared, fromBuf: fromShared, imageAddr: imageAddr, mounterWasmURL: mounterWasmURL, metaFromBuf: metaFromShared});
     return {
         toNet: toShared,
@@ -364,7 +364,7 @@ function createStack(stackWorker, imageAddr, mounterWasmURL, readyCallback, log)
     };
 }
 
-function connect(name, shared, toNet, certbuf, log) {
+function connect(name, shared, toNet, certbuf, log, imageDigestCallback) {
     var streamCtrl = new Int32Array(shared, 0, 1);
     var streamStatus = new Int32Array(shared, 4, 1);
     var streamLen = new Int32Array(shared, 8, 1);
@@ -439,6 +439,101 @@ function connect(name, shared, toNet, certbuf, log) {
             return false;
         }
     }
+    var httpEvents = []; // IDs of the requests that have a response or body to read
+    function notifyHTTPEvent(id) {
+        if (!httpEvents.includes(id)) {
+            httpEvents.push(id);
+        }
+        if (timeoutHandler) {
+            // complete the pending "recv-is-readable" request
+            clearTimeout(timeoutHandler);
+            timeoutHandler = null;
+            Atomics.store(toNetNotify, 0, 2); // http events are available
+            Atomics.notify(toNetNotify, 0);
+        }
+    }
+    function respHeaderList(resp) {
+        var list = [];
+        var encoded = resp.headers.has("content-encoding");
+        for (const [key, value] of resp.headers) {
+            if (encoded && ((key == "content-encoding") || (key == "content-length"))) {
+                continue; // the body is decoded by the browser
+            }
+            list.push([key, value]);
+        }
+        return list;
+    }
+    function readRespBody(id) {
+        var connObj = httpConnections[id];
+        if ((connObj == undefined) || connObj.reading || connObj.done) {
+            return;
+        }
+        if (connObj.respBodybuf.byteLength >= maxRespBodybufSize) {
+            return; // resumed by http_readbody
+        }
+        connObj.reading = true;
+        connObj.bodyReader.read().then(({done, value}) => {
+            connObj.reading = false;
+            if (done) {
+                connObj.done = true;
+            } else {
+                connObj.respBodybuf = appendData(connObj.respBodybuf, value);
+            }
+            notifyHTTPEvent(id);
+            readRespBody(id);
+        }).catch((error) => {
+            connObj.reading = false;
+                connObj.respBodyError = error;
+            connObj.done = true;
+            console.log("failed to fetch body: " + error);
+            notifyHTTPEvent(id);
+        });
+    }
+    function startFetch(id) {
+        var connObj = httpConnections[id];
+        connObj.requestSent = true;
+        fetch(connObj.address, connObj.request).then((resp) => {
+            var headerList = respHeaderList(resp);
+            connObj.response = new TextEncoder().encode(JSON.stringify({
+                bodyUsed: resp.bodyUsed,
+                headers: Object.fromEntries(headerList),
+                headerList: headerList,
+                redirected: resp.redirected,
+                status: resp.status,
+                statusText: resp.statusText,
+                type: resp.type,
+                url: resp.url
+            }));
+            connObj.done = false;
+            connObj.respBodybuf = new Uint8Array(0);
+            if (resp.body == null) {
+                connObj.done = true;
+            } else {
+                connObj.bodyReader = resp.body.getReader();
+                readRespBody(id);
+            }
+            notifyHTTPEvent(id);
+        }).catch((error) => {
+            if (connObj.reqBodyController && !connObj.response && (connObj.reqBodybuf != null)) {
+                // Streaming request body can fail (e.g. on HTTP/1.1). Retry with the buffered body.
+                connObj.reqBodyController = null;
+                connObj.request.duplex = undefined;
+                connObj.requestSent = false;
+                if (connObj.reqBodyEOF) {
+                    connObj.request.body = connObj.reqBodybuf;
+                    startFetch(id);
+                }
+                return;
+            }
+            connObj.response = new TextEncoder().encode(JSON.stringify({
+                status: 503,
+                statusText: "Service Unavailable",
+            }))
+            connObj.respBodybuf = new Uint8Array(0);
+            connObj.done = true;
+            notifyHTTPEvent(id);
+        });
+    }
     return function(msg){
         const req_ = msg.data;
         if (typeof req_ == "object" && req_.type) {
@@ -454,6 +549,10 @@ function connect(name, shared, toNet, certbuf, log) {
                         streamStatus[0] = 1; // ready for reading
                         Atomics.store(toNetNotify, 0, 1);
                         Atomics.notify(toNetNotify, 0);
+                    } else if (httpEvents.length > 0) {
+                        streamStatus[0] = 0;
+                        Atomics.store(toNetNotify, 0, 2); // http events are available
+                        Atomics.notify(toNetNotify, 0);
                     } else {
                         if ((req_.timeout != undefined) && (req_.timeout > 0)) {
                             if (timeoutHandler) {
@@ -490,6 +589,17 @@ function connect(name, shared, toNet, certbuf, log) {
                 case "notify-send-from-net":
                     sockRecvWS(req_.len);
                     break;
+                case "http_events":
+                    var n = Math.min(httpEvents.length, Math.floor(Math.min(req_.len, streamData.byteLength) / 4));
+                    var ids = new DataView(new ArrayBuffer(n * 4));
+                    for (var i = 0; i < n; i++) {
+                        ids.setUint32(i * 4, httpEvents[i], true);
+                    }
+                    httpEvents = httpEvents.slice(n);
+                    streamData.set(new Uint8Array(ids.buffer), 0);
+                    streamLen[0] = n * 4;
+                    streamStatus[0] = 0;
+                    break;
                 case "http_send":
                     var reqObj = JSON.parse(new TextDecoder().decode(req_.req));
                     reqObj.mode = "cors";
@@ -497,6 +607,11 @@ function connect(name, shared, toNet, certbuf, log) {
                     if (reqObj.headers && reqObj.headers["User-Agent"] != "") {
                         delete reqObj.headers["User-Agent"]; // Browser will add its own value.
                     }
+                    if (reqObj.headerList) {
+                        // headerList preserves multiple values of a field so prefer it to headers.
+                        reqObj.headers = reqObj.headerList.filter(([key, value]) => key.toLowerCase() != "user-agent");
+                        delete reqObj.headerList;
+                    }
                     var reqID = getID();
                     if (reqID < 0) {
                         console.log(name + ":" + "failed to get id");
@@ -515,96 +630,56 @@ function connect(name, shared, toNet, certbuf, log) {
                         respBodybuf: null,
                     };
                     httpConnections[reqID] = connObj;
+                    if (supportsRequestStreams && (reqObj.method != "HEAD") && (reqObj.method != "GET")) {
+                        // Stream the request body. The body is also buffered (up to maxRetryReqBodySize)
+                        // to retry without streaming if the server doesn't support it.
+                        reqObj.body = new ReadableStream({
+                            start(controller) {
+                                connObj.reqBodyController = controller;
+                            }
+                        });
+                        reqObj.duplex = "half";
+                        startFetch(reqID);
+                    }
                     streamStatus[0] = reqID;
                     break;
                 case "http_writebody":
-                    var s;
                     if (httpConnections[req_.id] == undefined) {
-                        s = newUint8Array(0);
-                    } else {
-                        s = httpConnections[req_.id].reqBodybuf;
+                        console.log(name + ":" + "request is not available");
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    var connObj = httpConnections[req_.id];
+                    if (connObj.reqBodyController) {
+                        try {
+                            if (req_.body.byteLength > 0) {
+                                connObj.reqBodyController.enqueue(new Uint8Array(req_.body));
+                            }
+                            if (req_.isEOF) {
+                                connObj.reqBodyController.close();
+                            }
+                        } catch (error) {
+                            console.log("failed to stream request body: " + error); // the request has been finished
+                        }
+                    }
+                    if (connObj.reqBodybuf != null) {
+                        connObj.reqBodybuf = appendData(connObj.reqBodybuf, req_.body);
+                        if (connObj.reqBodyController && (connObj.reqBodybuf.byteLength > maxRetryReqBodySize)) {
+                            connObj.reqBodybuf = null; // too large to retry
+                        }
                     }
-                    httpConnections[req_.id].reqBodybuf = appendData(s, req_.body)
-                    httpConnections[req_.id].reqBodyEOF = req_.isEOF;
+                    connObj.reqBodyEOF = req_.isEOF;
                     streamStatus[0] = 0;
-                    if (req_.isEOF && !httpConnections[req_.id].requestSent) {
-                        httpConnections[req_.id].requestSent = true;
-                        var connObj = httpConnections[req_.id];
+                    if (req_.isEOF && !connObj.requestSent) {
+                        if (connObj.reqBodybuf == null) {
+                            console.log(name + ":" + "request body is too large to retry");
+                            streamStatus[0] = -1;
+                            break;
+                        }
                         if ((connObj.request.method != "HEAD") && (connObj.request.method != "GET")) {
                             connObj.request.body = connObj.reqBodybuf;
                         }
-                        fetch(connObj.address, connObj.request).then((resp) => {
-                            connObj.done = false;
-                            connObj.respBodybuf = new Uint8Array(0);
-                            if (resp.ok) {
-                                resp.arrayBuffer().then((data) => {
-                                    var headers = {};
-                                    for (const key of resp.headers.keys()) {
-                                        if (data.byteLength > 0) {
-                                            if (key == "content-encoding") {
-                                                continue;
-                                            }
-                                            if (key == "content-length") {
-                                                headers[key] = data.byteLength.toString();
-                                                continue;
-                                            }
-                                        }
-                                        headers[key] = resp.headers.get(key);
-                                    }
-                                    connObj.response = new TextEncoder().encode(JSON.stringify({
-                                        bodyUsed: resp.bodyUsed,
-                                        headers: headers,
-                                        redirected: resp.redirected,
-                                        status: resp.status,
-                                        statusText: resp.statusText,
-                                        type: resp.type,
-                                        url: resp.url
-                                    }));
-                                    connObj.respBodybuf = new Uint8Array(data);
-                                    connObj.done = true;
-                                }).catch((error) => {
-                                    var headers = {};
-                                    for (const key of resp.headers.keys()) {
-                                        headers[key] = resp.headers.get(key);
-                                    }
-                                    connObj.response = new TextEncoder().encode(JSON.stringify({
-                                        bodyUsed: resp.bodyUsed,
-                                        headers: headers,
-                                        redirected: resp.redirected,
-                                        status: resp.status,
-                                        statusText: resp.statusText,
-                                        type: resp.type,
-                                        url: resp.url
-                                    }));
-                                    connObj.respBodybuf = new Uint8Array(0);
-                                    connObj.respBodyError = error;
-                                    connObj.done = true;
-                                    console.log("failed to fetch body: " + error);
-                                });
-                            } else {
-                                var headers = {};
-                                for (const key of resp.headers.keys()) {
-                                    headers[key] = resp.headers.get(key);
-                                }
-                                connObj.response = new TextEncoder().encode(JSON.stringify({
-                                    bodyUsed: resp.bodyUsed,
-                                    headers: headers,
-                                    redirected: resp.redirected,
-                                    status: resp.status,
-                                    statusText: resp.statusText,
-                                    type: resp.type,
-                                    url: resp.url
-                                }));
-                                connObj.done = true;
-                            }
-                        }).catch((error) => {
-                            connObj.response = new TextEncoder().encode(JSON.stringify({
-                                status: 503,
-                                statusText: "Service Unavailable",
-                            }))
-                            connObj.respBodybuf = new Uint8Array(0);
-                            connObj.done = true;
-                        });
+                        startFetch(req_.id);
                     }
                     break;
                 case "http_isreadable":
@@ -643,6 +718,8 @@ function connect(name, shared, toNet, certbuf, log) {
                     if ((httpConnections[req_.id].done) && (httpConnections[req_.id].respBodybuf.byteLength == 0)) {
                         streamStatus[0] = 1;
                         delete httpConnections[req_.id]; // connection done
+                    } else {
+                        readRespBody(req_.id);
                     }
                     break;
                 case "send_cert":
@@ -728,6 +805,8 @@ function connect(name, shared, toNet, certbuf, log) {
                                 });
                             })
                         } else {
+                            connObj.respBodybuf = new Uint8Array(0);
+                            connObj.respBodyError = new Error("unexpected status " + resp.status);
                             connObj.done = true;
                         }
                     }).catch((error) => {
@@ -736,6 +815,7 @@ function connect(name, shared, toNet, certbuf, log) {
                             statusText: "Service Unavailable",
                         }))
                         connObj.respBodybuf = new Uint8Array(0);
+                        connObj.respBodyError = error;
                         connObj.done = true;
                     });
                     streamStatus[0] = reqID;
@@ -743,12 +823,12 @@ function connect(name, shared, toNet, certbuf, log) {
                 case "layer_isreadable":
                     if ((httpConnections[req_.id] != undefined) && (httpConnections[req_.id].response != null) && (httpConnections[req_.id].done)) {
                         streamData[0] = 1; // ready for reading
-                        streamStatus[0] = httpConnections[req_.id].respBodybuf.byteLength;
-
+                        // the size can exceed 32bits so it's passed as 64bits integer in streamData
+                        new DataView(streamData.buffer, streamData.byteOffset).setBigUint64(8, BigInt(httpConnections[req_.id].respBodybuf.byteLength), true);
                     } else {
                         streamData[0] = 0; // nothing to read
-                        streamStatus[0] = 0;
                     }
+                    streamStatus[0] = 0;
                     break;
                 case "layer_readat":
                     if ((httpConnections[req_.id] == undefined) || (httpConnections[req_.id].response == null) && (httpConnections[req_.id].done)) {
@@ -765,6 +845,166 @@ function connect(name, shared, toNet, certbuf, log) {
                     streamStatus[0] = 0;
                     break;
 
+                case "cache_get":
+                    var entry = {done: false, data: null};
+                    var key = new TextDecoder().decode(req_.key);
+                    if (pendingCacheEntries[key] != undefined) {
+                        entry.data = pendingCacheEntries[key];
+                        entry.done = true;
+                    } else if (typeof caches == "undefined") {
+                        entry.done = true; // Cache API is unavailable (e.g. insecure context)
+                    } else {
+                        caches.open(cacheName).then((c) => c.match(cacheRequest(key))).then((resp) => {
+                            if (resp == undefined) {
+                                return null;
+                            }
+                            return resp.arrayBuffer();
+                        }).then((data) => {
+                            if (data != null) {
+                                entry.data = new Uint8Array(data);
+                            }
+                            entry.done = true;
+                        }).catch((error) => {
+                            console.log(name + ":" + "failed to get cache: " + error);
+                            entry.done = true;
+                        });
+                    }
+                    cacheEntries[cacheID] = entry;
+                    streamStatus[0] = cacheID;
+                    cacheID++;
+                    break;
+                case "cache_isreadable":
+                    var entry = cacheEntries[req_.id];
+                    if (entry == undefined) {
+                        console.log(name + ":" + "unknown cache id", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    streamData[0] = entry.done ? 1 : 0;
+                    streamData[1] = (entry.data != null) ? 1 : 0;
+                    if (entry.data != null) {
+                        new DataView(streamData.buffer, streamData.byteOffset).setBigUint64(8, BigInt(entry.data.byteLength), true);
+                    }
+                    streamStatus[0] = 0;
+                    break;
+                case "cache_readat":
+                    var entry = cacheEntries[req_.id];
+                    if ((entry == undefined) || (entry.data == null)) {
+                        console.log(name + ":" + "cache is not available", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    serveDataOffset(entry.data, req_.offset, req_.len);
+                    streamStatus[0] = 0;
+                    break;
+                case "cache_release":
+                    if (cacheEntries[req_.id] == undefined) {
+                        console.log(name + ":" + "unknown cache id", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    delete cacheEntries[req_.id];
+                    streamStatus[0] = 0;
+                    break;
+                case "cache_add":
+                    cacheEntries[cacheID] = {
+                        key: new TextDecoder().decode(req_.key),
+                        chunks: [],
+                    };
+                    streamStatus[0] = cacheID;
+                    cacheID++;
+                    break;
+                case "cache_write":
+                    if ((cacheEntries[req_.id] == undefined) || (cacheEntries[req_.id].chunks == undefined)) {
+                        console.log(name + ":" + "unknown cache id", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    cacheEntries[req_.id].chunks.push(req_.chunk);
+                    streamStatus[0] = 0;
+                    break;
+                case "cache_commit":
+                    var entry = cacheEntries[req_.id];
+                    if ((entry == undefined) || (entry.chunks == undefined)) {
+                        console.log(name + ":" + "unknown cache id", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    delete cacheEntries[req_.id];
+                    streamStatus[0] = 0;
+                    if ((req_.commit != 1) || (typeof caches == "undefined")) {
+                        break;
+                    }
+                    var data = new Uint8Array(entry.chunks.reduce((n, c) => n + c.byteLength, 0));
+                    var off = 0;
+                    for (const c of entry.chunks) {
+                        data.set(c, off);
+                        off += c.byteLength;
+                    }
+                    // available until the Cache API completes storing it
+                    var key = entry.key;
+                    pendingCacheEntries[key] = data;
+                    caches.open(cacheName).then((c) => c.put(cacheRequest(key), new Response(data))).catch((error) => {
+                        console.log(name + ":" + "failed to store cache: " + error);
+                    }).finally(() => {
+                        delete pendingCacheEntries[key];
+                    });
+                    break;
+
+                case "credentials_get":
+                    var entry = {done: false, data: null};
+                    var host = new TextDecoder().decode(req_.host);
+                    if (registryCredentials == null) {
+                        entry.done = true;
+                    } else {
+                        Promise.resolve().then(() => registryCredentials(host)).then((c) => {
+                            if (c != null) {
+                                entry.data = new TextEncoder().encode(JSON.stringify(c));
+                            }
+                            entry.done = true;
+                        }).catch((error) => {
+                            console.log(name + ":" + "failed to get credentials: " + error);
+                            entry.done = true;
+                        });
+                    }
+                    credentialsEntries[credentialsID] = entry;
+                    streamStatus[0] = credentialsID;
+                    credentialsID++;
+                    break;
+                case "credentials_isreadable":
+                    var entry = credentialsEntries[req_.id];
+                    if (entry == undefined) {
+                        console.log(name + ":" + "unknown credentials id", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    streamData[0] = entry.done ? 1 : 0;
+                    streamData[1] = (entry.data != null) ? 1 : 0;
+                    if (entry.data != null) {
+                        new DataView(streamData.buffer, streamData.byteOffset).setUint32(8, entry.data.byteLength, true);
+                    }
+                    streamStatus[0] = 0;
+                    break;
+                case "credentials_read":
+                    var entry = credentialsEntries[req_.id];
+                    if ((entry == undefined) || (entry.data == null) || (req_.len < entry.data.byteLength)) {
+                        console.log(name + ":" + "credentials are not available", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    serveDataOffset(entry.data, 0, req_.len);
+                    streamStatus[0] = 0;
+                    break;
+                case "credentials_release":
+                    if (credentialsEntries[req_.id] == undefined) {
+                        console.log(name + ":" + "unknown credentials id", req_.id);
+                        streamStatus[0] = -1;
+                        break;
+                    }
+                    delete credentialsEntries[req_.id];
+                    streamStatus[0] = 0;
+                    break;
+
                 case "decompress_init":
                     var ds = new DecompressionStream("gzip");
                     var r = ds.readable.getReader();
@@ -860,6 +1100,9 @@ function connect(name, shared, toNet, certbuf, log) {
                 case "log":
                     if (log != null) log(req_.msg);
                     break;
+                case "image_digest":
+                    if (imageDigestCallback != null) imageDigestCallback(req_.digest);
+                    break;
                 default:
                     console.log(name + ":" + "unknown request: " +  req_.type)
                     return;
@@ -872,9 +1115,56 @@ function connect(name, shared, toNet, certbuf, log) {
     }
 }
 
+// maxRespBodybufSize is the size of the response body buffered before the stack reads it.
+const maxRespBodybufSize = 16 * 1024 * 1024;
+
+// maxRetryReqBodySize is the max size of the streamed request body buffered for retrying without streaming.
+const maxRetryReqBodySize = 16 * 1024 * 1024;
+
+// supportsRequestStreams is true if the browser supports streaming request bodies.
+// https://developer.chrome.com/docs/capabilities/web-apis/fetch-streaming-requests
+const supportsRequestStreams = (() => {
+    let duplexAccessed = false;
+    const hasContentType = new Request(location.origin, {
+        body: new ReadableStream(),
+        method: 'POST',
+        get duplex() {
+            duplexAccessed = true;
+            return 'half';
+        },
+    }).headers.has('Content-Type');
+    return duplexAccessed && !hasContentType;
+})();
+
 var decompressID = 0;
 var decompressors = {};
 
+// registryCredentials returns the credentials of the registry host (or its Promise) requested by imagemounter.
+// See setRegistryCredentials.
+var registryCredentials = null;
+
+var credentialsID = 0;
+var credentialsEntries = {};
+
+// setRegistryCredentials sets the function that returns the credentials of the registry host (e.g. "ghcr.io")
+// used for pulling the container image. The function returns {username: ..., password: ...}, {identitytoken: ...}
+// or null (anonymous), or a Promise of them.
+export function setRegistryCredentials(f) {
+    registryCredentials = f;
+}
+
+// cacheName is the name of the cache (Cache API) storing the layers cached by imagemounter.
+const cacheName = "container2wasm-imagemounter";
+
+var cacheID = 0;
+var cacheEntries = {};
+var pendingCacheEntries = {};
+
+// cacheRequest returns the request used as the key of the cache. Cache API only accepts HTTP(S) URLs.
+function cacheRequest(key) {
+    return new Request(location.origin + "/.container2wasm-cache/" + encodeURIComponent(key));
+}
+
 function appendData(data1, data2) {
     let buf2 = new Uint8Array(data1.byteLength + data2.byteLength);
     buf2.set(new Uint8Array(data1), 0);
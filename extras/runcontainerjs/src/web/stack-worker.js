@@ -14,14 +14,18 @@ onmessage = (msg) => {
         undefined, // 3: receive certificates
         undefined, // 4: socket listenfd
         undefined, // 5: accepted socket fd (multi-connection is unsupported)
-        // 6...: used by wasi shim
+        undefined, // 6: notification of http events
+        undefined, // 7: receive the image digest
+        // 8...: used by wasi shim
     ];
     var certfd = 3;
     var listenfd = 4;
-    var args = ['arg0', '--certfd='+certfd, '--net-listenfd='+listenfd, '--image-addr='+info.imageAddr];
+    var httpeventfd = 6;
+    var imagedigestfd = 7;
+    var args = ['arg0', '--certfd='+certfd, '--net-listenfd='+listenfd, '--http-eventfd='+httpeventfd, '--image-addr='+info.imageAddr, '--image-digest-fd='+imagedigestfd, '--cache-host', '--registry-auth-host'];
     var env = [];
     var wasi = new WASI(args, env, fds);
-    wasiHack(wasi, certfd, 5);
+    wasiHack(wasi, certfd, 5, httpeventfd, imagedigestfd);
     wasiHackSocket(wasi, listenfd, 5, sockAccept, sockSend, sockRecv);
     fetch(info.mounterWasmURL).then((resp) => {
         resp['blob']().then((blob) => {
@@ -43,23 +47,66 @@ onmessage = (msg) => {
 const ERRNO_INVAL = 28;
 const ERRNO_AGAIN= 6;
 
-function wasiHack(wasi, certfd, connfd) {
+// version of the host ABI implemented by envHack (see docs/host-abi.md in container2wasm repo)
+const ABI_VERSION = 4;
+
+function wasiHack(wasi, certfd, connfd, httpeventfd, imagedigestfd) {
     var certbuf = new Uint8Array(0);
+    var imagedigest = "";
     var _fd_close = wasi.wasiImport.fd_close;
     wasi.wasiImport.fd_close = (fd) => {
         if (fd == certfd) {
             sendCert(certbuf);
             return 0;
         }
+        if (fd == imagedigestfd) {
+            postMessage({type: "image_digest", digest: imagedigest});
+            return 0;
+        }
         return _fd_close.apply(wasi.wasiImport, [fd]);
     }
     var _fd_fdstat_get = wasi.wasiImport.fd_fdstat_get;
     wasi.wasiImport.fd_fdstat_get = (fd, fdstat_ptr) => {
-        if (fd == certfd) {
+        if ((fd == certfd) || (fd == imagedigestfd)) {
+            return 0;
+        }
+        if (fd == httpeventfd) {
+            let buffer = new DataView(wasi.inst.exports.memory.buffer);
+            // https://github.com/WebAssembly/WASI/blob/snapshot-01/phases/snapshot/docs.md#-fdstat-struct
+            buffer.setUint8(fdstat_ptr, 2); // filetype = 2 (character_device)
+            buffer.setUint16(fdstat_ptr + 2, 4, true); // fdflags = 4 (nonblock)
             return 0;
         }
         return _fd_fdstat_get.apply(wasi.wasiImport, [fd, fdstat_ptr]);
     }
+    var _fd_read = wasi.wasiImport.fd_read;
+    wasi.wasiImport.fd_read = (fd, iovs_ptr, iovs_len, nread_ptr) => {
+        if (fd == httpeventfd) {
+            var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            var buffer8 = new Uint8Array(wasi.inst.exports.memory.buffer);
+            var iovecs = wasitype.wasi.Iovec.read_bytes_array(buffer, iovs_ptr, iovs_len);
+            var nread = 0;
+            for (var i = 0; i < iovecs.length; i++) {
+                var iovec = iovecs[i];
+                if (iovec.buf_len < 4) {
+                    continue;
+                }
+                var data = httpRecvEvents(iovec.buf_len);
+                if (data == errStatus) {
+                    return ERRNO_INVAL;
+                }
+                buffer8.set(data, iovec.buf);
+                nread = data.length;
+                break;
+            }
+            if (nread == 0) {
+                return ERRNO_AGAIN;
+            }
+            buffer.setUint32(nread_ptr, nread, true);
+            return 0;
+        }
+        return _fd_read.apply(wasi.wasiImport, [fd, iovs_ptr, iovs_len, nread_ptr]);
+    }
     wasi.wasiImport.fd_fdstat_set_flags = (fd, fdflags) => {
         // TODO
         return 0;
@@ -78,7 +125,7 @@ function wasiHack(wasi, certfd, connfd) {
     }
     var _fd_write = wasi.wasiImport.fd_write;
     wasi.wasiImport.fd_write = (fd, iovs_ptr, iovs_len, nwritten_ptr) => {
-        if ((fd == 1) || (fd == 2) || (fd == certfd)) {
+        if ((fd == 1) || (fd == 2) || (fd == certfd) || (fd == imagedigestfd)) {
             var buffer = new DataView(wasi.inst.exports.memory.buffer);
             var buffer8 = new Uint8Array(wasi.inst.exports.memory.buffer);
             var iovecs = wasitype.wasi.Ciovec.read_bytes_array(buffer, iovs_ptr, iovs_len);
@@ -107,6 +154,9 @@ function wasiHack(wasi, certfd, connfd) {
                 if (fd == certfd) {
                     certbuf = appendData(certbuf, buf);
                 }
+                if (fd == imagedigestfd) {
+                    imagedigest += msg;
+                }
                 wtotal += buf.length;
             }
             buffer.setUint32(nwritten_ptr, wtotal, true);
@@ -123,17 +173,22 @@ function wasiHack(wasi, certfd, connfd) {
         let in_ = Subscription.read_bytes_array(buffer, in_ptr, nsubscriptions);
         let isReadPollStdin = false;
         let isReadPollConn = false;
+        let isReadPollHTTPEvent = false;
         let isClockPoll = false;
         let pollSubStdin;
         let pollSubConn;
+        let pollSubHTTPEvent;
         let clockSub;
         let timeout = Number.MAX_VALUE;
         for (let sub of in_) {
             if (sub.u.tag.variant == "fd_read") {
-                if ((sub.u.data.fd != 0) && (sub.u.data.fd != connfd)) {
-                    return ERRNO_INVAL; // only fd=0 and connfd is supported as of now (FIXME)
+                if ((sub.u.data.fd != 0) && (sub.u.data.fd != connfd) && (sub.u.data.fd != httpeventfd)) {
+                    return ERRNO_INVAL; // only fd=0, connfd and httpeventfd are supported as of now (FIXME)
                 }
-                if (sub.u.data.fd == 0) {
+                if (sub.u.data.fd == httpeventfd) {
+                    isReadPollHTTPEvent = true;
+                    pollSubHTTPEvent = sub;
+                } else if (sub.u.data.fd == 0) {
                     isReadPollStdin = true;
                     pollSubStdin = sub;
                 } else {
@@ -154,8 +209,15 @@ function wasiHack(wasi, certfd, connfd) {
             timeout = 0;
         }
         let events = [];
-        if (isReadPollStdin || isReadPollConn || isClockPoll) {
+        if (isReadPollStdin || isReadPollConn || isReadPollHTTPEvent || isClockPoll) {
             var sockreadable = sockWaitForReadable(timeout / 1000000000);
+            if (isReadPollHTTPEvent && httpEventsReadable) {
+                let event = new Event();
+                event.userdata = pollSubHTTPEvent.userdata;
+                event.error = 0;
+                event.type = new EventType("fd_read");
+                events.push(event);
+            }
             if (isReadPollConn) {
                 if (sockreadable == errStatus) {
                     return ERRNO_INVAL;
@@ -182,8 +244,23 @@ function wasiHack(wasi, certfd, connfd) {
     }
 }
 
+function httpRecvEvents(len){
+    streamCtrl[0] = 0;
+    postMessage({type: "http_events", len: len});
+    Atomics.wait(streamCtrl, 0, 0);
+    if (streamStatus[0] < 0) {
+        errStatus.val = streamStatus[0]
+        return errStatus;
+    }
+    let ddlen = streamLen[0];
+    return streamData.slice(0, ddlen);
+}
+
 function envHack(wasi){
     return {
+        abi_version: function(){
+            return ABI_VERSION;
+        },
         http_send: function(addressP, addresslen, reqP, reqlen, idP){
             var buffer = new DataView(wasi.inst.exports.memory.buffer);
             var address = new Uint8Array(wasi.inst.exports.memory.buffer, addressP, addresslen);
@@ -364,46 +441,171 @@ function envHack(wasi){
         },
         layer_isreadable: function(id, isOKP, sizeP) {
             var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            var res = layerIsReadable(id);
+            if (res.errno != 0) {
+                return res.errno;
+            }
+            if (res.size > 0xffffffff) {
+                console.log("layer is too large; layer_isreadable64 is required");
+                return ERRNO_INVAL;
+            }
+            buffer.setUint32(isOKP, res.readable, true);
+            buffer.setUint32(sizeP, res.size, true);
+            return 0;
+        },
+        layer_readat: function(id, respP, offset, len, respsizeP) {
+            return readAt("layer_readat", id, respP, offset >>> 0, len, respsizeP);
+        },
+        layer_isreadable64: function(id, isOKP, sizeP) {
+            var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            var res = layerIsReadable(id);
+            if (res.errno != 0) {
+                return res.errno;
+            }
+            buffer.setUint32(isOKP, res.readable, true);
+            buffer.setBigUint64(sizeP, BigInt(res.size), true);
+            return 0;
+        },
+        layer_readat64: function(id, respP, offset, len, respsizeP) {
+            return readAt("layer_readat", id, respP, Number(offset), len, respsizeP); // offset is BigInt
+        },
+        cache_get: function(keyP, keylen, idP) {
+            var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            var key = new Uint8Array(wasi.inst.exports.memory.buffer, keyP, keylen);
             streamCtrl[0] = 0;
-            postMessage({type: "layer_isreadable", id: id});
+            postMessage({type: "cache_get", key: key.slice(0, key.length)});
             Atomics.wait(streamCtrl, 0, 0);
             if (streamStatus[0] < 0) {
                 return ERRNO_INVAL;
             }
-            var readable = 0;
-            if (streamData[0] == 1) {
-                readable = 1;
+            buffer.setUint32(idP, streamStatus[0], true);
+            return 0;
+        },
+        cache_isreadable: function(id, isOKP, foundP, sizeP) {
+            var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            streamCtrl[0] = 0;
+            postMessage({type: "cache_isreadable", id: id});
+            Atomics.wait(streamCtrl, 0, 0);
+            if (streamStatus[0] < 0) {
+                return ERRNO_INVAL;
+            }
+            buffer.setUint32(isOKP, streamData[0], true);
+            buffer.setUint32(foundP, streamData[1], true);
+            if (streamData[1] == 1) {
+                buffer.setBigUint64(sizeP, new DataView(streamData.buffer, streamData.byteOffset).getBigUint64(8, true), true);
             }
-            buffer.setUint32(isOKP, readable, true);
-            var size = streamStatus[0];
-            buffer.setUint32(sizeP, size, true);
             return 0;
         },
-        layer_readat: function(id, respP, offset, len, respsizeP) {
+        cache_readat: function(id, respP, offset, len, respsizeP) {
+            return readAt("cache_readat", id, respP, Number(offset), len, respsizeP); // offset is BigInt
+        },
+        cache_release: function(id) {
+            return request({type: "cache_release", id: id});
+        },
+        cache_add: function(keyP, keylen, idP) {
             var buffer = new DataView(wasi.inst.exports.memory.buffer);
-            var buffer8 = new Uint8Array(wasi.inst.exports.memory.buffer);
-
+            var key = new Uint8Array(wasi.inst.exports.memory.buffer, keyP, keylen);
             streamCtrl[0] = 0;
-            postMessage({
-                type: "layer_readat",
-                id: id,
-                offset: offset,
-                len: len,
-            });
+            postMessage({type: "cache_add", key: key.slice(0, key.length)});
             Atomics.wait(streamCtrl, 0, 0);
             if (streamStatus[0] < 0) {
                 return ERRNO_INVAL;
             }
-            var ddlen = streamLen[0];
-            if (ddlen > len) {
-                ddlen = len
+            buffer.setUint32(idP, streamStatus[0], true);
+            return 0;
+        },
+        cache_write: function(id, bufP, buflen) {
+            var buf = new Uint8Array(wasi.inst.exports.memory.buffer, bufP, buflen);
+            return request({type: "cache_write", id: id, chunk: buf.slice(0, buf.length)});
+        },
+        cache_commit: function(id, commit) {
+            return request({type: "cache_commit", id: id, commit: commit});
+        },
+        credentials_get: function(hostP, hostlen, idP) {
+            var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            var host = new Uint8Array(wasi.inst.exports.memory.buffer, hostP, hostlen);
+            streamCtrl[0] = 0;
+            postMessage({type: "credentials_get", host: host.slice(0, host.length)});
+            Atomics.wait(streamCtrl, 0, 0);
+            if (streamStatus[0] < 0) {
+                return ERRNO_INVAL;
+            }
+            buffer.setUint32(idP, streamStatus[0], true);
+            return 0;
+        },
+        credentials_isreadable: function(id, isOKP, foundP, sizeP) {
+            var buffer = new DataView(wasi.inst.exports.memory.buffer);
+            streamCtrl[0] = 0;
+            postMessage({type: "credentials_isreadable", id: id});
+            Atomics.wait(streamCtrl, 0, 0);
+            if (streamStatus[0] < 0) {
+                return ERRNO_INVAL;
+            }
+            buffer.setUint32(isOKP, streamData[0], true);
+            buffer.setUint32(foundP, streamData[1], true);
+            if (streamData[1] == 1) {
+                buffer.setUint32(sizeP, new DataView(streamData.buffer, streamData.byteOffset).getUint32(8, true), true);
             }
-            var body = streamData.subarray(0, ddlen);
-            buffer8.set(body, respP);
-            buffer.setUint32(respsizeP, ddlen, true);
             return 0;
         },
+        credentials_read: function(id, respP, bufsize, respsizeP) {
+            return readAt("credentials_read", id, respP, 0, bufsize, respsizeP);
+        },
+        credentials_release: function(id) {
+            return request({type: "credentials_release", id: id});
+        },
     };
+
+    function request(msg) {
+        streamCtrl[0] = 0;
+        postMessage(msg);
+        Atomics.wait(streamCtrl, 0, 0);
+        if (streamStatus[0] < 0) {
+            return ERRNO_INVAL;
+        }
+        return 0;
+    }
+
+    function layerIsReadable(id) {
+        streamCtrl[0] = 0;
+        postMessage({type: "layer_isreadable", id: id});
+        Atomics.wait(streamCtrl, 0, 0);
+        if (streamStatus[0] < 0) {
+            return {errno: ERRNO_INVAL};
+        }
+        var readable = 0;
+        var size = 0;
+        if (streamData[0] == 1) {
+            readable = 1;
+            size = Number(new DataView(streamData.buffer, streamData.byteOffset).getBigUint64(8, true));
+        }
+        return {errno: 0, readable: readable, size: size};
+    }
+
+    function readAt(type, id, respP, offset, len, respsizeP) {
+        var buffer = new DataView(wasi.inst.exports.memory.buffer);
+        var buffer8 = new Uint8Array(wasi.inst.exports.memory.buffer);
+
+        streamCtrl[0] = 0;
+        postMessage({
+            type: type,
+            id: id,
+            offset: offset,
+            len: len,
+        });
+        Atomics.wait(streamCtrl, 0, 0);
+        if (streamStatus[0] < 0) {
+            return ERRNO_INVAL;
+        }
+        var ddlen = streamLen[0];
+        if (ddlen > len) {
+            ddlen = len
+        }
+        var body = streamData.subarray(0, ddlen);
+        buffer8.set(body, respP);
+        buffer.setUint32(respsizeP, ddlen, true);
+        return 0;
+    }
 }
 
 var streamCtrl;
@@ -580,7 +782,11 @@ function sockRecv(targetBuf, targetOffset, targetLen){
     return (len + round);
 }
 
+// httpEventsReadable is set by sockWaitForReadable when it's woken up by http events.
+var httpEventsReadable = false;
+
 function sockWaitForReadable(timeout){
+    httpEventsReadable = false;
     if (!accepted) {
         errStatus.val = -1;
         return errStatus;
@@ -633,6 +839,7 @@ function sockWaitForReadable(timeout){
     Atomics.wait(streamCtrl, 0, 0);
 
     Atomics.store(toNetNotify, 0, 0);
+    httpEventsReadable = (res == 2);
     return res == 1;
 }
 
@@ -0,0 +1,310 @@
+package imagepolicy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// cosignSignatureAnnotation is the annotation of the layer of the signature manifest that has the signature of the layer.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// cosignSignatureType is the type of the payload of cosign signatures (simple signing).
+	cosignSignatureType = "cosign container image signature"
+
+	// dsseMediaType is the media type of the layers of the attestation manifest.
+	dsseMediaType = "application/vnd.dsse.envelope.v1+json"
+
+	// inTotoPayloadType is the payload type of the DSSE envelopes of the attestations.
+	inTotoPayloadType = "application/vnd.in-toto+json"
+
+	// slsaProvenancePrefix is the prefix of the predicate types of SLSA provenance (v0.1, v0.2 and v1).
+	slsaProvenancePrefix = "https://slsa.dev/provenance/"
+)
+
+// publicKey is a public key trusted by the policy.
+type publicKey struct {
+	key crypto.PublicKey
+	id  string // SHA256 fingerprint of the key
+}
+
+func (k publicKey) String() string {
+	return "cosign key " + k.id
+}
+
+// verifiers are the keys and the certificates trusted by the policy.
+type verifiers struct {
+	cosignKeys    []publicKey
+	notationRoots []*x509.Certificate
+}
+
+func parsePublicKeys(data []byte) (res []publicKey, _ error) {
+	blocks, err := pemBlocks(data, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		k, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", k)
+		}
+		sum := sha256.Sum256(b)
+		res = append(res, publicKey{key: k, id: "SHA256:" + hex.EncodeToString(sum[:])})
+	}
+	return res, nil
+}
+
+// verify verifies the signature of msg in the same way as cosign (SHA256 is used for ECDSA and RSA PKCS #1 v1.5).
+func (k publicKey) verify(msg, sig []byte) error {
+	h := sha256.Sum256(msg)
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, h[:], sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, msg, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", k.key)
+}
+
+// verifyWithAny returns the key that verifies the signature.
+func verifyWithAny(keys []publicKey, msg, sig []byte) (publicKey, bool) {
+	for _, k := range keys {
+		if k.verify(msg, sig) == nil {
+			return k, true
+		}
+	}
+	return publicKey{}, false
+}
+
+// cosignTag returns the tag of the signatures (suffix ".sig") or the attestations (suffix ".att") of dgst.
+func cosignTag(dgst digest.Digest, suffix string) string {
+	return dgst.Algorithm().String() + "-" + dgst.Encoded() + suffix
+}
+
+// verifyCosignSignature verifies the cosign signatures of dgst stored in the signature manifest tagged
+// "<alg>-<hex>.sig". It returns the key that verified the signature.
+func verifyCosignSignature(ctx context.Context, s Store, v *verifiers, dgst digest.Digest) (string, error) {
+	desc, err := s.Resolve(ctx, cosignTag(dgst, ".sig"))
+	if err != nil {
+		return "", fmt.Errorf("signature not found: %w", err)
+	}
+	m, err := fetchManifest(ctx, s, desc)
+	if err != nil {
+		return "", err
+	}
+	var errs []error
+	for _, l := range m.Layers {
+		sigB64, ok := l.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(sigB64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid signature of %v: %w", l.Digest, err))
+			continue
+		}
+		payload, err := FetchVerified(ctx, s, l)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		k, ok := verifyWithAny(v.cosignKeys, payload, sig)
+		if !ok {
+			errs = append(errs, fmt.Errorf("signature of %v isn't verified by the trusted keys", l.Digest))
+			continue
+		}
+		var p struct {
+			Critical struct {
+				Image struct {
+					DockerManifestDigest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+				Type string `json:"type"`
+			} `json:"critical"`
+		}
+		if err := json.Unmarshal(payload, &p); err != nil {
+			errs = append(errs, fmt.Errorf("invalid payload %v: %w", l.Digest, err))
+			continue
+		}
+		if !strings.EqualFold(p.Critical.Type, cosignSignatureType) {
+			errs = append(errs, fmt.Errorf("unexpected type %q of payload %v", p.Critical.Type, l.Digest))
+			continue
+		}
+		if p.Critical.Image.DockerManifestDigest != dgst.String() {
+			errs = append(errs, fmt.Errorf("payload %v is signing %q", l.Digest, p.Critical.Image.DockerManifestDigest))
+			continue
+		}
+		return k.String(), nil
+	}
+	if len(errs) == 0 {
+		return "", fmt.Errorf("no signature found in %v", desc.Digest)
+	}
+	return "", errors.Join(errs...)
+}
+
+// dsseEnvelope is the DSSE envelope of an attestation.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// pae returns the pre-authentication encoding of the DSSE envelope signed by the signatures.
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// inTotoStatement is the in-toto statement in an attestation.
+type inTotoStatement struct {
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// builderID returns the ID of the builder in SLSA provenance v0.1, v0.2 or v1.
+func (st *inTotoStatement) builderID() string {
+	var p struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"` // v0.1, v0.2
+		RunDetails struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+		} `json:"runDetails"` // v1
+	}
+	if err := json.Unmarshal(st.Predicate, &p); err != nil {
+		return ""
+	}
+	if p.RunDetails.Builder.ID != "" {
+		return p.RunDetails.Builder.ID
+	}
+	return p.Builder.ID
+}
+
+// verifyProvenance verifies the SLSA provenance of dgst in the cosign attestations stored in the
+// manifest tagged "<alg>-<hex>.att". It returns the ID of the builder.
+func verifyProvenance(ctx context.Context, s Store, v *verifiers, dgst digest.Digest, builderIDs []string) (string, error) {
+	desc, err := s.Resolve(ctx, cosignTag(dgst, ".att"))
+	if err != nil {
+		return "", fmt.Errorf("attestation not found: %w", err)
+	}
+	m, err := fetchManifest(ctx, s, desc)
+	if err != nil {
+		return "", err
+	}
+	var errs []error
+	for _, l := range m.Layers {
+		if l.MediaType != dsseMediaType {
+			continue
+		}
+		st, err := verifyAttestation(ctx, s, v, l)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !strings.HasPrefix(st.PredicateType, slsaProvenancePrefix) {
+			continue
+		}
+		subject := false
+		for _, sub := range st.Subject {
+			if sub.Digest[dgst.Algorithm().String()] == dgst.Encoded() {
+				subject = true
+				break
+			}
+		}
+		if !subject {
+			errs = append(errs, fmt.Errorf("provenance %v isn't about %v", l.Digest, dgst))
+			continue
+		}
+		id := st.builderID()
+		if len(builderIDs) > 0 && !contains(builderIDs, id) {
+			errs = append(errs, fmt.Errorf("builder %q of provenance %v isn't allowed", id, l.Digest))
+			continue
+		}
+		return id, nil
+	}
+	if len(errs) == 0 {
+		return "", fmt.Errorf("no SLSA provenance found in %v", desc.Digest)
+	}
+	return "", errors.Join(errs...)
+}
+
+// verifyAttestation verifies the DSSE envelope in the layer and returns the statement.
+func verifyAttestation(ctx context.Context, s Store, v *verifiers, l ocispec.Descriptor) (*inTotoStatement, error) {
+	b, err := FetchVerified(ctx, s, l)
+	if err != nil {
+		return nil, err
+	}
+	var env dsseEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("invalid attestation %v: %w", l.Digest, err)
+	}
+	if env.PayloadType != inTotoPayloadType {
+		return nil, fmt.Errorf("unexpected payload type %q of attestation %v", env.PayloadType, l.Digest)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload of attestation %v: %w", l.Digest, err)
+	}
+	verified := false
+	for _, sig := range env.Signatures {
+		sigB, err := base64.StdEncoding.DecodeString(sig.Sig)
+		if err != nil {
+			continue
+		}
+		if _, ok := verifyWithAny(v.cosignKeys, pae(env.PayloadType, payload), sigB); ok {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("attestation %v isn't verified by the trusted keys", l.Digest)
+	}
+	var st inTotoStatement
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return nil, fmt.Errorf("invalid statement of attestation %v: %w", l.Digest, err)
+	}
+	return &st, nil
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
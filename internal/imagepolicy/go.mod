@@ -0,0 +1,8 @@
+module github.com/ktock/container2wasm/internal/imagepolicy
+
+go 1.23.0
+
+require (
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.1.1
+)
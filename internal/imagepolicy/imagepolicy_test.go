@@ -0,0 +1,581 @@
+package imagepolicy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// memoryStore is Store keeping the blobs and the tags in memory.
+type memoryStore struct {
+	blobs     map[digest.Digest][]byte
+	tags      map[string]ocispec.Descriptor
+	referrers map[digest.Digest][]ocispec.Descriptor
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		blobs:     make(map[digest.Digest][]byte),
+		tags:      make(map[string]ocispec.Descriptor),
+		referrers: make(map[digest.Digest][]ocispec.Descriptor),
+	}
+}
+
+func (s *memoryStore) Resolve(ctx context.Context, tag string) (ocispec.Descriptor, error) {
+	desc, ok := s.tags[tag]
+	if !ok {
+		return ocispec.Descriptor{}, fmt.Errorf("%q not found", tag)
+	}
+	return desc, nil
+}
+
+func (s *memoryStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	b, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%v not found", desc.Digest)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memoryStore) Referrers(ctx context.Context, dgst digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	return s.referrers[dgst], nil
+}
+
+func (s *memoryStore) add(mediaType string, b []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	s.blobs[desc.Digest] = b
+	return desc
+}
+
+func (s *memoryStore) addJSON(t *testing.T, mediaType string, v interface{}) ocispec.Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.add(mediaType, b)
+}
+
+// addImage adds an image manifest and returns its descriptor.
+func (s *memoryStore) addImage(t *testing.T, name string) ocispec.Descriptor {
+	config := s.add(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := s.add(ocispec.MediaTypeImageLayer, []byte(name))
+	return s.addJSON(t, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+}
+
+// addCosignManifest adds the manifest of the layers tagged as cosign does.
+func (s *memoryStore) addCosignManifest(t *testing.T, dgst digest.Digest, suffix string, layers []ocispec.Descriptor) {
+	config := s.add(ocispec.MediaTypeImageConfig, []byte(`{}`))
+	s.tags[cosignTag(dgst, suffix)] = s.addJSON(t, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+}
+
+func signECDSA(t *testing.T, key *ecdsa.PrivateKey, msg []byte) []byte {
+	h := sha256.Sum256(msg)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// signCosign adds the cosign signature of dgst signed by key.
+func (s *memoryStore) signCosign(t *testing.T, key *ecdsa.PrivateKey, dgst digest.Digest, signed digest.Digest) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example.com/test"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, signed))
+	l := s.add("application/vnd.dev.cosign.simplesigning.v1+json", payload)
+	l.Annotations = map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signECDSA(t, key, payload))}
+	s.addCosignManifest(t, dgst, ".sig", []ocispec.Descriptor{l})
+}
+
+// attestCosign adds the cosign attestation of the provenance of dgst built by builderID.
+func (s *memoryStore) attestCosign(t *testing.T, key *ecdsa.PrivateKey, dgst digest.Digest, predicateType, predicate string) {
+	statement := []byte(fmt.Sprintf(`{"_type":"https://in-toto.io/Statement/v0.1","subject":[{"name":"example.com/test","digest":{"sha256":%q}}],"predicateType":%q,"predicate":%s}`, dgst.Encoded(), predicateType, predicate))
+	env := dsseEnvelope{PayloadType: inTotoPayloadType, Payload: base64.StdEncoding.EncodeToString(statement)}
+	env.Signatures = append(env.Signatures, struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	}{Sig: base64.StdEncoding.EncodeToString(signECDSA(t, key, pae(inTotoPayloadType, statement)))})
+	l := s.addJSON(t, dsseMediaType, env)
+	s.addCosignManifest(t, dgst, ".att", []ocispec.Descriptor{l})
+}
+
+func generateECDSAKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestCosign(t *testing.T) {
+	ctx := context.Background()
+	key, pubPEM := generateECDSAKey(t)
+	otherKey, otherPubPEM := generateECDSAKey(t)
+	policy, err := ParsePolicy([]byte(fmt.Sprintf(`{"cosignPublicKeys":[%q]}`, pubPEM)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMemoryStore()
+	signed := s.addImage(t, "signed")
+	s.signCosign(t, key, signed.Digest, signed.Digest)
+	res, err := Verify(ctx, s, policy, signed.Digest)
+	if err != nil {
+		t.Fatalf("signed image must be verified: %v", err)
+	}
+	if res.Digest != signed.Digest || !strings.HasPrefix(res.Signer, "cosign key SHA256:") {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	unsigned := s.addImage(t, "unsigned")
+	if _, err := Verify(ctx, s, policy, unsigned.Digest); err == nil || !strings.Contains(err.Error(), "signature not found") {
+		t.Errorf("unsigned image must be refused: %v", err)
+	}
+	// one of the digests (e.g. the platform-specific manifest) needs to be signed
+	if _, err := Verify(ctx, s, policy, unsigned.Digest, signed.Digest); err != nil {
+		t.Errorf("signed manifest must be verified: %v", err)
+	}
+
+	otherSigned := s.addImage(t, "other-key")
+	s.signCosign(t, otherKey, otherSigned.Digest, otherSigned.Digest)
+	if _, err := Verify(ctx, s, policy, otherSigned.Digest); err == nil {
+		t.Errorf("image signed by untrusted key must be refused")
+	}
+	otherPolicy, err := ParsePolicy([]byte(fmt.Sprintf(`{"cosignPublicKeys":[%q]}`, pubPEM+otherPubPEM)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(ctx, s, otherPolicy, otherSigned.Digest); err != nil {
+		t.Errorf("image signed by trusted key must be verified: %v", err)
+	}
+
+	// signature of another image copied to the tag
+	copied := s.addImage(t, "copied")
+	s.signCosign(t, key, copied.Digest, signed.Digest)
+	if _, err := Verify(ctx, s, policy, copied.Digest); err == nil {
+		t.Errorf("signature of another image must be refused")
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	ctx := context.Background()
+	key, pubPEM := generateECDSAKey(t)
+	otherKey, _ := generateECDSAKey(t)
+	policy, err := ParsePolicy([]byte(fmt.Sprintf(`{"cosignPublicKeys":[%q],"requireProvenance":true,"provenanceBuilderIDs":["https://example.com/builder"]}`, pubPEM)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newMemoryStore()
+	for _, tt := range []struct {
+		name          string
+		key           *ecdsa.PrivateKey
+		predicateType string
+		predicate     string
+		ok            bool
+	}{
+		{"v0.2", key, "https://slsa.dev/provenance/v0.2", `{"builder":{"id":"https://example.com/builder"}}`, true},
+		{"v1", key, "https://slsa.dev/provenance/v1", `{"buildDefinition":{},"runDetails":{"builder":{"id":"https://example.com/builder"}}}`, true},
+		{"builder", key, "https://slsa.dev/provenance/v1", `{"runDetails":{"builder":{"id":"https://example.com/other"}}}`, false},
+		{"key", otherKey, "https://slsa.dev/provenance/v0.2", `{"builder":{"id":"https://example.com/builder"}}`, false},
+		{"predicate", key, "https://spdx.dev/Document", `{}`, false},
+		{"none", nil, "", "", false},
+	} {
+		img := s.addImage(t, tt.name)
+		s.signCosign(t, key, img.Digest, img.Digest)
+		if tt.key != nil {
+			s.attestCosign(t, tt.key, img.Digest, tt.predicateType, tt.predicate)
+		}
+		res, err := Verify(ctx, s, policy, img.Digest)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: provenance must be verified: %v", tt.name, err)
+			} else if res.ProvenanceBuilderID != "https://example.com/builder" {
+				t.Errorf("%s: unexpected builder %q", tt.name, res.ProvenanceBuilderID)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "no trusted provenance") {
+			t.Errorf("%s: image must be refused: %v", tt.name, err)
+		}
+	}
+}
+
+// notationCA is a CA issuing the certificates of Notation signatures.
+type notationCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newNotationCA(t *testing.T) *notationCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &notationCA{cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+func (ca *notationCA) issue(t *testing.T, pub crypto.PublicKey, usage x509.ExtKeyUsage) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// signNotation adds the Notation signature of target referring to dgst.
+func (s *memoryStore) signNotation(t *testing.T, signer crypto.Signer, alg string, cert []byte, dgst digest.Digest, target ocispec.Descriptor, referrersAPI bool, protected map[string]interface{}) {
+	if protected == nil {
+		protected = map[string]interface{}{
+			"alg":                        alg,
+			"crit":                       []string{notationHeaderSigningScheme},
+			"cty":                        notationPayloadType,
+			notationHeaderSigningScheme:  notationSigningSchemeX509,
+			"io.cncf.notary.signingTime": time.Now().Format(time.RFC3339),
+		}
+	}
+	protectedB, err := json.Marshal(protected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadB, err := json.Marshal(map[string]interface{}{"targetArtifact": target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(protectedB) + "." + base64.RawURLEncoding.EncodeToString(payloadB)
+	h := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch signer := signer.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPSS(rand.Reader, signer, crypto.SHA256, h[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case *ecdsa.PrivateKey:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, signer, h[:])
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]interface{}{
+		"payload":   base64.RawURLEncoding.EncodeToString(payloadB),
+		"protected": base64.RawURLEncoding.EncodeToString(protectedB),
+		"header":    map[string]interface{}{"x5c": [][]byte{cert}},
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	}
+	l := s.addJSON(t, notationJWSMediaType, env)
+	config := s.add("application/vnd.oci.empty.v1+json", []byte(`{}`))
+	m := s.addJSON(t, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: notationArtifactType,
+		Config:       config,
+		Layers:       []ocispec.Descriptor{l},
+		Subject:      &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst},
+	})
+	m.ArtifactType = notationArtifactType
+	if referrersAPI {
+		s.referrers[dgst] = append(s.referrers[dgst], m)
+	} else {
+		s.tags[dgst.Algorithm().String()+"-"+dgst.Encoded()] = s.addJSON(t, ocispec.MediaTypeImageIndex, ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: []ocispec.Descriptor{m},
+		})
+	}
+}
+
+func TestNotation(t *testing.T) {
+	ctx := context.Background()
+	ca := newNotationCA(t)
+	otherCA := newNotationCA(t)
+	policy, err := ParsePolicy([]byte(fmt.Sprintf(`{"notationRootCertificates":[%q]}`, ca.pem)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newMemoryStore()
+	for _, tt := range []struct {
+		name         string
+		signer       crypto.Signer
+		alg          string
+		cert         []byte
+		referrersAPI bool
+		protected    map[string]interface{}
+		other        bool
+		ok           bool
+	}{
+		{name: "rsa", signer: rsaKey, alg: "PS256", cert: ca.issue(t, rsaKey.Public(), x509.ExtKeyUsageCodeSigning), referrersAPI: true, ok: true},
+		{name: "ecdsa", signer: ecKey, alg: "ES256", cert: ca.issue(t, ecKey.Public(), x509.ExtKeyUsageCodeSigning), referrersAPI: true, ok: true},
+		{name: "tag-schema", signer: ecKey, alg: "ES256", cert: ca.issue(t, ecKey.Public(), x509.ExtKeyUsageCodeSigning), ok: true},
+		{name: "untrusted", signer: ecKey, alg: "ES256", cert: otherCA.issue(t, ecKey.Public(), x509.ExtKeyUsageCodeSigning), referrersAPI: true},
+		{name: "usage", signer: ecKey, alg: "ES256", cert: ca.issue(t, ecKey.Public(), x509.ExtKeyUsageServerAuth), referrersAPI: true},
+		{name: "alg", signer: ecKey, alg: "PS256", cert: ca.issue(t, ecKey.Public(), x509.ExtKeyUsageCodeSigning), referrersAPI: true},
+		{name: "other-image", signer: ecKey, alg: "ES256", cert: ca.issue(t, ecKey.Public(), x509.ExtKeyUsageCodeSigning), referrersAPI: true, other: true},
+		{name: "expired", signer: ecKey, alg: "ES256", cert: ca.issue(t, ecKey.Public(), x509.ExtKeyUsageCodeSigning), referrersAPI: true, protected: map[string]interface{}{
+			"alg":                       "ES256",
+			"crit":                      []string{notationHeaderSigningScheme, notationHeaderExpiry},
+			"cty":                       notationPayloadType,
+			notationHeaderSigningScheme: notationSigningSchemeX509,
+			notationHeaderExpiry:        time.Now().Add(-time.Minute).Format(time.RFC3339),
+		}},
+		{name: "crit", signer: ecKey, alg: "ES256", cert: ca.issue(t, ecKey.Public(), x509.ExtKeyUsageCodeSigning), referrersAPI: true, protected: map[string]interface{}{
+			"alg":                       "ES256",
+			"crit":                      []string{notationHeaderSigningScheme, "io.cncf.notary.unknown"},
+			"cty":                       notationPayloadType,
+			notationHeaderSigningScheme: notationSigningSchemeX509,
+			"io.cncf.notary.unknown":    "x",
+		}},
+	} {
+		img := s.addImage(t, tt.name)
+		target := img
+		if tt.other {
+			target = s.addImage(t, tt.name+"-other")
+		}
+		s.signNotation(t, tt.signer, tt.alg, tt.cert, img.Digest, target, tt.referrersAPI, tt.protected)
+		res, err := Verify(ctx, s, policy, img.Digest)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: signature must be verified: %v", tt.name, err)
+			} else if res.Signer != "notation certificate CN=test signer" {
+				t.Errorf("%s: unexpected signer %q", tt.name, res.Signer)
+			}
+		} else if err == nil {
+			t.Errorf("%s: image must be refused", tt.name)
+		}
+	}
+	unsigned := s.addImage(t, "unsigned")
+	if _, err := Verify(ctx, s, policy, unsigned.Digest); err == nil || !strings.Contains(err.Error(), "no signature found") {
+		t.Errorf("unsigned image must be refused: %v", err)
+	}
+}
+
+func TestLayoutStore(t *testing.T) {
+	ctx := context.Background()
+	key, pubPEM := generateECDSAKey(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cosign.pub"), []byte(pubPEM), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "policy.json"), []byte(`{"cosignPublicKeys":["cosign.pub"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicyFile(filepath.Join(dir, "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OCI layout saved by "cosign save"
+	s := newMemoryStore()
+	img := s.addImage(t, "image")
+	unsigned := s.addImage(t, "unsigned")
+	s.signCosign(t, key, img.Digest, img.Digest)
+	sig := s.tags[cosignTag(img.Digest, ".sig")]
+	img.Annotations = map[string]string{cosignKindAnnotation: "dev.cosignproject.cosign/image"}
+	sig.Annotations = map[string]string{cosignKindAnnotation: cosignKindSignatures}
+	layoutDir := filepath.Join(dir, "layout")
+	for dgst, b := range s.blobs {
+		p := filepath.Join(layoutDir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{sig, img},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layoutDir, "index.json"), idx, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ls := &LayoutStore{Open: func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(layoutDir, name))
+	}}
+	images, err := ls.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Digest != img.Digest {
+		t.Fatalf("unexpected images %+v", images)
+	}
+	if _, err := Verify(ctx, ls, policy, img.Digest); err != nil {
+		t.Errorf("signed image must be verified: %v", err)
+	}
+
+	// tagged as in the registry
+	sig.Annotations = map[string]string{ocispec.AnnotationRefName: cosignTag(img.Digest, ".sig")}
+	idx, err = json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{img, sig, unsigned},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layoutDir, "index.json"), idx, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if images, err := ls.Images(); err != nil || len(images) != 2 {
+		t.Fatalf("unexpected images %+v: %v", images, err)
+	}
+	if _, err := Verify(ctx, ls, policy, img.Digest); err != nil {
+		t.Errorf("signed image must be verified: %v", err)
+	}
+	if _, err := Verify(ctx, ls, policy, unsigned.Digest); err == nil {
+		t.Errorf("unsigned image must be refused")
+	}
+}
+
+// tokenAuthorizer sends the token after the registry answers 401.
+type tokenAuthorizer struct {
+	token string
+}
+
+func (a *tokenAuthorizer) Authorize(ctx context.Context, req *http.Request) error {
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	return nil
+}
+
+func (a *tokenAuthorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	a.token = "token"
+	return nil
+}
+
+func TestRegistryStore(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore()
+	img := s.addImage(t, "image")
+	sig := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: "application/example", Digest: digest.FromString("sig")}
+	var mirrorRequests int
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorRequests++
+		http.NotFound(w, r) // the referrers API isn't supported
+	}))
+	defer mirror.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/library/test/referrers/"+img.Digest.String() || r.URL.Query().Get("artifactType") != sig.ArtifactType {
+			t.Errorf("unexpected request %v", r.URL)
+		}
+		json.NewEncoder(w).Encode(ocispec.Index{Manifests: []ocispec.Descriptor{sig}})
+	}))
+	defer registry.Close()
+	host := func(u string) RegistryHost {
+		return RegistryHost{Authorizer: &tokenAuthorizer{}, Scheme: "http", Host: strings.TrimPrefix(u, "http://"), Path: "/v2"}
+	}
+	rs := &RegistryStore{
+		Locator: "example.com/library/test",
+		Fetcher: s,
+		Hosts: func() ([]RegistryHost, error) {
+			return []RegistryHost{host(mirror.URL), host(registry.URL)}, nil
+		},
+	}
+	descs, err := rs.Referrers(ctx, img.Digest, sig.ArtifactType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 1 || descs[0].Digest != sig.Digest || mirrorRequests != 1 {
+		t.Fatalf("unexpected referrers %+v (%d requests to the mirror)", descs, mirrorRequests)
+	}
+	if descs, err := FetchReferrers(ctx, []RegistryHost{host(mirror.URL)}, rs.Locator, img.Digest, sig.ArtifactType); err != nil || len(descs) != 0 {
+		t.Fatalf("unexpected referrers %+v: %v", descs, err)
+	}
+
+	if _, err := FetchVerified(ctx, rs, img); err != nil {
+		t.Fatalf("failed to fetch the manifest: %v", err)
+	}
+	s.blobs[img.Digest] = []byte("modified")
+	if _, err := FetchVerified(ctx, rs, img); err == nil {
+		t.Fatalf("modified manifest must be an error")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	_, pubPEM := generateECDSAKey(t)
+	for name, data := range map[string]string{
+		"empty":      `{}`,
+		"json":       `{`,
+		"path":       `{"cosignPublicKeys":["cosign.pub"]}`,
+		"key":        `{"cosignPublicKeys":["-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"]}`,
+		"cert":       fmt.Sprintf(`{"notationRootCertificates":[%q]}`, pubPEM),
+		"provenance": fmt.Sprintf(`{"notationRootCertificates":[%q],"requireProvenance":true}`, newNotationCA(t).pem),
+	} {
+		if _, err := ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("%s: invalid policy must be an error", name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package imagepolicy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// cosignKindAnnotation is the annotation of the manifests in the OCI layouts saved by "cosign save".
+	cosignKindAnnotation = "kind"
+
+	cosignKindSignatures   = "dev.cosignproject.cosign/sigs"
+	cosignKindAttestations = "dev.cosignproject.cosign/atts"
+)
+
+// LayoutStore is Store of an OCI layout. The signatures need to be stored in the layout with the tags
+// (the "org.opencontainers.image.ref.name" annotation) as in the registry (e.g. "oras copy --recursive"
+// or "cosign save").
+type LayoutStore struct {
+	// Open opens the file in the layout (e.g. "index.json", "blobs/sha256/<hex>").
+	Open func(name string) (io.ReadCloser, error)
+}
+
+func (s *LayoutStore) index() (*ocispec.Index, error) {
+	r, err := s.Open("index.json")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var idx ocispec.Index
+	if err := json.NewDecoder(io.LimitReader(r, maxBlobSize)).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("invalid index.json: %w", err)
+	}
+	return &idx, nil
+}
+
+// Resolve returns the manifest tagged in index.json. The signatures and the attestations saved by
+// "cosign save" are also resolved by their tags.
+func (s *LayoutStore) Resolve(ctx context.Context, tag string) (ocispec.Descriptor, error) {
+	idx, err := s.index()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for _, m := range idx.Manifests {
+		if name := m.Annotations[ocispec.AnnotationRefName]; name == tag || strings.HasSuffix(name, ":"+tag) {
+			return m, nil
+		}
+	}
+	kind := ""
+	if strings.HasSuffix(tag, ".sig") {
+		kind = cosignKindSignatures
+	} else if strings.HasSuffix(tag, ".att") {
+		kind = cosignKindAttestations
+	}
+	if kind != "" {
+		for _, m := range idx.Manifests {
+			if m.Annotations[cosignKindAnnotation] == kind {
+				return m, nil
+			}
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("%q not found in the OCI layout", tag)
+}
+
+// Fetch opens the blob in the layout.
+func (s *LayoutStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	return s.Open(path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+}
+
+// Referrers returns the manifests in index.json whose subject is dgst.
+func (s *LayoutStore) Referrers(ctx context.Context, dgst digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	idx, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+	var res []ocispec.Descriptor
+	for _, m := range idx.Manifests {
+		if m.MediaType != ocispec.MediaTypeImageManifest || m.ArtifactType == "" {
+			continue
+		}
+		manifest, err := fetchManifest(ctx, s, m)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Subject != nil && manifest.Subject.Digest == dgst {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+// Images returns the images in index.json excluding the signatures and the attestations.
+func (s *LayoutStore) Images() ([]ocispec.Descriptor, error) {
+	idx, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+	var res []ocispec.Descriptor
+	for _, m := range idx.Manifests {
+		if IsSignature(m) {
+			continue
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// IsSignature returns true if desc in index.json of an OCI layout is a signature, an attestation or another
+// artifact referring to an image (e.g. tagged "sha256-<hex>.sig").
+func IsSignature(desc ocispec.Descriptor) bool {
+	if desc.ArtifactType != "" {
+		return true
+	}
+	switch desc.Annotations[cosignKindAnnotation] {
+	case cosignKindSignatures, cosignKindAttestations:
+		return true
+	}
+	name := desc.Annotations[ocispec.AnnotationRefName]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+	alg, rest, ok := strings.Cut(name, "-")
+	if !ok || !digest.Algorithm(alg).Available() {
+		return false
+	}
+	rest = strings.TrimSuffix(strings.TrimSuffix(rest, ".sig"), ".att")
+	return digest.Algorithm(alg).Validate(rest) == nil
+}
@@ -0,0 +1,240 @@
+package imagepolicy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// notationArtifactType is the artifact type of Notation signatures.
+	notationArtifactType = "application/vnd.cncf.notary.signature"
+
+	// notationJWSMediaType is the media type of the JWS envelope of Notation signatures.
+	notationJWSMediaType = "application/jose+json"
+
+	// notationCOSEMediaType is the media type of the COSE envelope of Notation signatures. This isn't supported.
+	notationCOSEMediaType = "application/cose"
+
+	// notationPayloadType is the content type of the payload of Notation signatures.
+	notationPayloadType = "application/vnd.cncf.notary.payload.v1+json"
+
+	// notationSigningSchemeX509 is the signing scheme verified by the trusted root certificates.
+	notationSigningSchemeX509 = "notary.x509"
+
+	notationHeaderSigningScheme = "io.cncf.notary.signingScheme"
+	notationHeaderExpiry        = "io.cncf.notary.expiry"
+)
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	blocks, err := pemBlocks(data, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	var res []*x509.Certificate
+	for _, b := range blocks {
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// verifyNotationSignature verifies the Notation signatures (JWS envelopes with the notary.x509 signing scheme)
+// referring to dgst. It returns the subject of the certificate that signed the signature.
+func verifyNotationSignature(ctx context.Context, s Store, v *verifiers, dgst digest.Digest) (string, error) {
+	descs, err := referrers(ctx, s, dgst, notationArtifactType)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the signatures: %w", err)
+	}
+	var errs []error
+	for _, desc := range descs {
+		m, err := fetchManifest(ctx, s, desc)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if m.Subject == nil || m.Subject.Digest != dgst {
+			errs = append(errs, fmt.Errorf("signature %v doesn't refer to the image", desc.Digest))
+			continue
+		}
+		for _, l := range m.Layers {
+			switch l.MediaType {
+			case notationJWSMediaType:
+			case notationCOSEMediaType:
+				errs = append(errs, fmt.Errorf("COSE signature %v isn't supported", l.Digest))
+				continue
+			default:
+				continue
+			}
+			b, err := FetchVerified(ctx, s, l)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			signer, err := verifyJWSEnvelope(b, v.notationRoots, dgst, time.Now())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("signature %v: %w", l.Digest, err))
+				continue
+			}
+			return signer, nil
+		}
+	}
+	if len(errs) == 0 {
+		return "", fmt.Errorf("no signature found")
+	}
+	return "", errors.Join(errs...)
+}
+
+// jwsEnvelope is the JWS envelope (JSON serialization) of a Notation signature.
+type jwsEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		CertChain [][]byte `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+// verifyJWSEnvelope verifies the envelope signs dgst with the certificate chained to one of roots.
+func verifyJWSEnvelope(b []byte, roots []*x509.Certificate, dgst digest.Digest, now time.Time) (string, error) {
+	var env jwsEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return "", fmt.Errorf("invalid envelope: %w", err)
+	}
+	protectedB, err := base64.RawURLEncoding.DecodeString(env.Protected)
+	if err != nil {
+		return "", fmt.Errorf("invalid protected header: %w", err)
+	}
+	var protected map[string]interface{}
+	if err := json.Unmarshal(protectedB, &protected); err != nil {
+		return "", fmt.Errorf("invalid protected header: %w", err)
+	}
+	if cty, _ := protected["cty"].(string); cty != notationPayloadType {
+		return "", fmt.Errorf("unexpected content type %q", cty)
+	}
+	if scheme, _ := protected[notationHeaderSigningScheme].(string); scheme != notationSigningSchemeX509 {
+		return "", fmt.Errorf("unsupported signing scheme %q", scheme)
+	}
+	if crit, ok := protected["crit"].([]interface{}); ok {
+		for _, c := range crit {
+			switch c {
+			case notationHeaderSigningScheme, notationHeaderExpiry:
+			default:
+				return "", fmt.Errorf("unsupported critical header %v", c)
+			}
+		}
+	}
+	if e, ok := protected[notationHeaderExpiry].(string); ok {
+		expiry, err := time.Parse(time.RFC3339, e)
+		if err != nil {
+			return "", fmt.Errorf("invalid expiry %q: %w", e, err)
+		}
+		if now.After(expiry) {
+			return "", fmt.Errorf("signature expired at %v", expiry)
+		}
+	}
+
+	if len(env.Header.CertChain) == 0 {
+		return "", fmt.Errorf("no certificate found")
+	}
+	var certs []*x509.Certificate
+	for _, der := range env.Header.CertChain {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", fmt.Errorf("invalid certificate: %w", err)
+		}
+		certs = append(certs, c)
+	}
+	rootPool, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, r := range roots {
+		rootPool.AddCert(r)
+	}
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return "", fmt.Errorf("certificate isn't trusted: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	alg, _ := protected["alg"].(string)
+	if err := verifyJWS(alg, certs[0].PublicKey, []byte(env.Protected+"."+env.Payload), sig); err != nil {
+		return "", err
+	}
+
+	payloadB, err := base64.RawURLEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	var payload struct {
+		TargetArtifact ocispec.Descriptor `json:"targetArtifact"`
+	}
+	if err := json.Unmarshal(payloadB, &payload); err != nil {
+		return "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if payload.TargetArtifact.Digest != dgst {
+		return "", fmt.Errorf("signing %v", payload.TargetArtifact.Digest)
+	}
+	return "notation certificate " + certs[0].Subject.String(), nil
+}
+
+// verifyJWS verifies the JWS signature of the signing input with the algorithm allowed by Notation.
+func verifyJWS(alg string, key crypto.PublicKey, input, sig []byte) error {
+	var h crypto.Hash
+	switch alg {
+	case "PS256", "ES256":
+		h = crypto.SHA256
+	case "PS384", "ES384":
+		h = crypto.SHA384
+	case "PS512", "ES512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hh := h.New()
+	hh.Write(input)
+	sum := hh.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'P' {
+			return fmt.Errorf("algorithm %q doesn't match RSA key", alg)
+		}
+		return rsa.VerifyPSS(key, h, sum, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			return fmt.Errorf("algorithm %q doesn't match ECDSA key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature size %d", len(sig))
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, sum, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
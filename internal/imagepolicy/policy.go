@@ -0,0 +1,282 @@
+// Package imagepolicy verifies the signatures and the provenance of container images before they are run.
+// cosign signatures and attestations verified by public keys and Notation signatures verified by
+// root certificates are supported. Images are read through Store so that the same policy applies to
+// the images in registries (imagemounter, c2w) and in OCI layouts (imagemounter, create-spec).
+package imagepolicy
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Policy is the policy of the images allowed to run. It's written as JSON.
+// An image is allowed if it has a signature verified by any of CosignPublicKeys or NotationRootCertificates.
+type Policy struct {
+	// CosignPublicKeys are the PEM-encoded public keys (ECDSA, RSA or Ed25519) of cosign signatures and attestations.
+	CosignPublicKeys []string `json:"cosignPublicKeys,omitempty"`
+
+	// NotationRootCertificates are the PEM-encoded root certificates of Notation signatures.
+	NotationRootCertificates []string `json:"notationRootCertificates,omitempty"`
+
+	// RequireProvenance requires the SLSA provenance attestation of the image signed by CosignPublicKeys.
+	RequireProvenance bool `json:"requireProvenance,omitempty"`
+
+	// ProvenanceBuilderIDs are the IDs of the builders allowed in the provenance. Any builder is allowed if empty.
+	ProvenanceBuilderIDs []string `json:"provenanceBuilderIDs,omitempty"`
+}
+
+// ParsePolicy parses the policy written as JSON. The keys and the certificates need to be PEM.
+func ParsePolicy(data []byte) (*Policy, error) {
+	return parsePolicy(data, "")
+}
+
+// LoadPolicyFile loads the policy from the file. The keys and the certificates can be the paths of
+// PEM files. Relative paths are relative to the directory of the policy file.
+func LoadPolicyFile(p string) (*Policy, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicy(data, filepath.Dir(p))
+}
+
+func parsePolicy(data []byte, dir string) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse image policy: %w", err)
+	}
+	for _, l := range [][]string{p.CosignPublicKeys, p.NotationRootCertificates} {
+		for i, v := range l {
+			if strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN") {
+				continue
+			}
+			if dir == "" {
+				return nil, fmt.Errorf("image policy must contain PEM instead of %q", v)
+			}
+			if !filepath.IsAbs(v) {
+				v = filepath.Join(dir, v)
+			}
+			b, err := os.ReadFile(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %q of image policy: %w", v, err)
+			}
+			l[i] = string(b)
+		}
+	}
+	if _, err := p.verifiers(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// verifiers returns the verifiers of the signatures trusted by the policy.
+func (p *Policy) verifiers() (*verifiers, error) {
+	var v verifiers
+	for _, k := range p.CosignPublicKeys {
+		keys, err := parsePublicKeys([]byte(k))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cosign public key: %w", err)
+		}
+		v.cosignKeys = append(v.cosignKeys, keys...)
+	}
+	for _, c := range p.NotationRootCertificates {
+		certs, err := parseCertificates([]byte(c))
+		if err != nil {
+			return nil, fmt.Errorf("invalid notation root certificate: %w", err)
+		}
+		v.notationRoots = append(v.notationRoots, certs...)
+	}
+	if len(v.cosignKeys) == 0 && len(v.notationRoots) == 0 {
+		return nil, fmt.Errorf("image policy has neither cosign public keys nor notation root certificates")
+	}
+	if p.RequireProvenance && len(v.cosignKeys) == 0 {
+		return nil, fmt.Errorf("provenance requires cosign public keys")
+	}
+	return &v, nil
+}
+
+func pemBlocks(data []byte, typ string) (res [][]byte, _ error) {
+	for rest := data; ; {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil {
+			break
+		}
+		if b.Type != typ {
+			return nil, fmt.Errorf("unexpected PEM block %q (want %q)", b.Type, typ)
+		}
+		res = append(res, b.Bytes)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no PEM block %q found", typ)
+	}
+	return res, nil
+}
+
+// Store provides the image and the artifacts referring to it (e.g. a registry or an OCI layout).
+type Store interface {
+	// Resolve returns the descriptor of the tag in the repository of the image.
+	Resolve(ctx context.Context, tag string) (ocispec.Descriptor, error)
+
+	// Fetch fetches the blob.
+	Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
+
+	// Referrers returns the manifests referring to dgst using the referrers API.
+	// It returns an empty list if the API isn't supported.
+	Referrers(ctx context.Context, dgst digest.Digest, artifactType string) ([]ocispec.Descriptor, error)
+}
+
+// Result is the result of the verification.
+type Result struct {
+	// Digest is the verified digest.
+	Digest digest.Digest
+
+	// Signer describes the key or the certificate that verified the signature.
+	Signer string
+
+	// ProvenanceBuilderID is the builder in the verified provenance. Empty if the provenance isn't required.
+	ProvenanceBuilderID string
+}
+
+// maxBlobSize is the max size of the manifests and the signatures read for verification.
+const maxBlobSize = 4 << 20
+
+// Verify verifies that one of digests (e.g. the digest of the index and of the platform-specific manifest
+// of the image) is signed as required by the policy. It returns an error describing why each digest
+// isn't verified if none of them is.
+func Verify(ctx context.Context, s Store, p *Policy, digests ...digest.Digest) (*Result, error) {
+	v, err := p.verifiers()
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for i, dgst := range digests {
+		if containsDigest(digests[:i], dgst) {
+			continue // e.g. the image isn't multi-platform
+		}
+		res, err := verify(ctx, s, p, v, dgst)
+		if err == nil {
+			return res, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", dgst, err))
+	}
+	return nil, fmt.Errorf("image isn't allowed by the policy: %w", errors.Join(errs...))
+}
+
+func containsDigest(l []digest.Digest, dgst digest.Digest) bool {
+	for _, d := range l {
+		if d == dgst {
+			return true
+		}
+	}
+	return false
+}
+
+func verify(ctx context.Context, s Store, p *Policy, v *verifiers, dgst digest.Digest) (*Result, error) {
+	var signer string
+	var errs []error
+	if len(v.cosignKeys) > 0 {
+		var err error
+		if signer, err = verifyCosignSignature(ctx, s, v, dgst); err != nil {
+			errs = append(errs, fmt.Errorf("cosign: %w", err))
+		}
+	}
+	if signer == "" && len(v.notationRoots) > 0 {
+		var err error
+		if signer, err = verifyNotationSignature(ctx, s, v, dgst); err != nil {
+			errs = append(errs, fmt.Errorf("notation: %w", err))
+		}
+	}
+	if signer == "" {
+		return nil, fmt.Errorf("no trusted signature: %w", errors.Join(errs...))
+	}
+	res := &Result{Digest: dgst, Signer: signer}
+	if p.RequireProvenance {
+		builderID, err := verifyProvenance(ctx, s, v, dgst, p.ProvenanceBuilderIDs)
+		if err != nil {
+			return nil, fmt.Errorf("no trusted provenance: %w", err)
+		}
+		res.ProvenanceBuilderID = builderID
+	}
+	return res, nil
+}
+
+// FetchVerified fetches the blob (e.g. a manifest or an index) from s and verifies its digest.
+func FetchVerified(ctx context.Context, s Store, desc ocispec.Descriptor) ([]byte, error) {
+	if desc.Size > maxBlobSize {
+		return nil, fmt.Errorf("%v is too large (%d bytes)", desc.Digest, desc.Size)
+	}
+	r, err := s.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, maxBlobSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxBlobSize {
+		return nil, fmt.Errorf("%v is too large", desc.Digest)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	if got := desc.Digest.Algorithm().FromBytes(b); got != desc.Digest {
+		return nil, fmt.Errorf("unexpected digest %v of %v", got, desc.Digest)
+	}
+	return b, nil
+}
+
+// fetchManifest fetches the image manifest.
+func fetchManifest(ctx context.Context, s Store, desc ocispec.Descriptor) (*ocispec.Manifest, error) {
+	b, err := FetchVerified(ctx, s, desc)
+	if err != nil {
+		return nil, err
+	}
+	var m ocispec.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %v: %w", desc.Digest, err)
+	}
+	return &m, nil
+}
+
+// referrers returns the manifests referring to dgst. The referrers tag schema is used if the
+// referrers API isn't supported.
+func referrers(ctx context.Context, s Store, dgst digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	descs, err := s.Referrers(ctx, dgst, artifactType)
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) == 0 {
+		idxDesc, err := s.Resolve(ctx, dgst.Algorithm().String()+"-"+dgst.Encoded())
+		if err != nil {
+			return nil, nil // no referrers
+		}
+		b, err := FetchVerified(ctx, s, idxDesc)
+		if err != nil {
+			return nil, err
+		}
+		var idx ocispec.Index
+		if err := json.Unmarshal(b, &idx); err != nil {
+			return nil, err
+		}
+		descs = idx.Manifests
+	}
+	var res []ocispec.Descriptor
+	for _, d := range descs {
+		if d.ArtifactType == artifactType { // registries may not filter by the artifact type
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,145 @@
+package imagepolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Authorizer authorizes the requests to the registry (e.g. docker.Authorizer of containerd).
+type Authorizer interface {
+	// Authorize sets the credentials of the request.
+	Authorize(ctx context.Context, req *http.Request) error
+
+	// AddResponses updates the state of the authorizer with the unauthorized responses.
+	AddResponses(ctx context.Context, responses []*http.Response) error
+}
+
+// RegistryHost is an endpoint of the registry (e.g. the registry or its mirror).
+// The fields are the same as docker.RegistryHost of containerd.
+type RegistryHost struct {
+	Client     *http.Client
+	Authorizer Authorizer
+	Scheme     string
+	Host       string
+	Path       string
+	Header     http.Header
+}
+
+// Resolver resolves the reference (e.g. remotes.Resolver of containerd).
+type Resolver interface {
+	Resolve(ctx context.Context, ref string) (name string, desc ocispec.Descriptor, err error)
+}
+
+// Fetcher fetches the blob (e.g. remotes.Fetcher of containerd).
+type Fetcher interface {
+	Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
+}
+
+// RegistryStore is Store of the repository of the image in the registry.
+type RegistryStore struct {
+	// Locator is the repository including the registry host (e.g. "docker.io/library/ubuntu").
+	Locator string
+
+	Resolver Resolver
+	Fetcher  Fetcher
+
+	// Hosts returns the endpoints of the registry used for the referrers API.
+	Hosts func() ([]RegistryHost, error)
+}
+
+func (s *RegistryStore) Resolve(ctx context.Context, tag string) (ocispec.Descriptor, error) {
+	_, desc, err := s.Resolver.Resolve(ctx, s.Locator+":"+tag)
+	return desc, err
+}
+
+func (s *RegistryStore) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return s.Fetcher.Fetch(ctx, desc)
+}
+
+func (s *RegistryStore) Referrers(ctx context.Context, dgst digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	hosts, err := s.Hosts()
+	if err != nil {
+		return nil, err
+	}
+	return FetchReferrers(ctx, hosts, s.Locator, dgst, artifactType)
+}
+
+// FetchReferrers fetches the manifests referring to dgst in the repository (e.g. "docker.io/library/ubuntu")
+// using the referrers API. hosts (e.g. mirrors) are tried in order until the manifests are found.
+// The list is empty if the registry doesn't support the API.
+func FetchReferrers(ctx context.Context, hosts []RegistryHost, locator string, dgst digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	hostname, repo, _ := strings.Cut(locator, "/")
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no host found for %q", hostname)
+	}
+	var errs []error
+	answered := false
+	for _, host := range hosts {
+		descs, err := fetchReferrersFromHost(ctx, host, repo, dgst, artifactType)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host.Host, err))
+			continue
+		}
+		if len(descs) > 0 {
+			return descs, nil
+		}
+		answered = true // a mirror may not support the API so the next one is tried
+	}
+	if answered {
+		return nil, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func fetchReferrersFromHost(ctx context.Context, host RegistryHost, repo string, dgst digest.Digest, artifactType string) ([]ocispec.Descriptor, error) {
+	u := fmt.Sprintf("%s://%s%s/%s/referrers/%s?artifactType=%s", host.Scheme, host.Host, host.Path, repo, dgst, url.QueryEscape(artifactType))
+	for retry := true; ; retry = false {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range host.Header {
+			req.Header[k] = append([]string{}, v...)
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+		if host.Authorizer != nil {
+			if err := host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		client := host.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && retry && host.Authorizer != nil:
+			if err := host.Authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+				return nil, err
+			}
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, nil
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("failed to fetch referrers of %v: %v", dgst, resp.Status)
+		}
+		var idx ocispec.Index
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxBlobSize)).Decode(&idx); err != nil {
+			return nil, err
+		}
+		return idx.Manifests, nil
+	}
+}
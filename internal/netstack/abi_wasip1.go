@@ -0,0 +1,20 @@
+package netstack
+
+import "fmt"
+
+// ABIVersion is the version of the host ABI (the functions imported from the "env" module) required by
+// the network stack. Hosts implementing a newer version are compatible.
+// The ABI is specified in docs/host-abi.md.
+const ABIVersion = 1
+
+//go:wasmimport env abi_version
+func abi_version() uint32
+
+// CheckHostABI returns an error if the host doesn't implement the required version.
+// The programs pass ABIVersion or newer if they import the functions of that version.
+func CheckHostABI(required uint32) error {
+	if v := abi_version(); v < required {
+		return fmt.Errorf("host implements ABI version %d but version %d is required", v, required)
+	}
+	return nil
+}
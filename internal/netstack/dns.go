@@ -0,0 +1,227 @@
+package netstack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// serveDNS serves DNS on port 53 of the addresses. Names in the zones are resolved using the records
+// and the others are resolved using the host's resolver. It returns the handler of gvisor-tap-vsock's
+// DNS API (/all and /add).
+func serveDNS(s *stack.Stack, addrs []string, zones []gvntypes.Zone) (http.Handler, error) {
+	h := &dnsHandler{zones: zones}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		fa := tcpip.FullAddress{NIC: 1, Addr: tcpipAddr(ip), Port: 53}
+		udpConn, err := gonet.DialUDP(s, &fa, nil, protocolNumber(ip))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen DNS on %s (udp): %w", a, err)
+		}
+		tcpLn, err := gonet.ListenTCP(s, fa, protocolNumber(ip))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen DNS on %s (tcp): %w", a, err)
+		}
+		for _, srv := range []*dns.Server{
+			{PacketConn: udpConn, Handler: h.handler(dns.MinMsgSize)},
+			{Listener: tcpLn, Handler: h.handler(dns.MaxMsgSize)},
+		} {
+			go func() {
+				if err := srv.ActivateAndServe(); err != nil {
+					log.Printf("DNS server on %s stopped: %v\n", a, err)
+				}
+			}()
+		}
+	}
+	return h.mux(), nil
+}
+
+type dnsHandler struct {
+	zones   []gvntypes.Zone
+	zonesMu sync.RWMutex
+}
+
+// handler returns the handler of the queries. The responses are truncated to size unless the query
+// specifies the size using EDNS0.
+func (h *dnsHandler) handler(size int) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		for _, q := range m.Question {
+			if !h.addLocalAnswers(m, q) {
+				addResolvedAnswers(m, q)
+			}
+			if m.Rcode != dns.RcodeSuccess {
+				break
+			}
+		}
+		maxSize := size
+		if edns0 := r.IsEdns0(); edns0 != nil {
+			maxSize = int(edns0.UDPSize())
+		}
+		m.Truncate(maxSize)
+		if err := w.WriteMsg(m); err != nil {
+			log.Printf("failed to write DNS response: %v\n", err)
+		}
+	})
+}
+
+// addLocalAnswers answers the question using the zones. It returns false if the name isn't in the zones.
+func (h *dnsHandler) addLocalAnswers(m *dns.Msg, q dns.Question) bool {
+	h.zonesMu.RLock()
+	defer h.zonesMu.RUnlock()
+	for _, zone := range h.zones {
+		suffix := "." + zone.Name
+		if !strings.HasSuffix(q.Name, suffix) {
+			continue
+		}
+		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+			return false
+		}
+		name := strings.TrimSuffix(q.Name, suffix)
+		found := false
+		for _, record := range zone.Records {
+			if (record.Name != "" && record.Name == name) || (record.Regexp != nil && record.Regexp.MatchString(name)) {
+				found = true
+				if rr := addressRR(q, record.IP); rr != nil {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+		}
+		if !found && zone.DefaultIP != nil {
+			found = true
+			if rr := addressRR(q, zone.DefaultIP); rr != nil {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if !found {
+			m.Rcode = dns.RcodeNameError
+		}
+		// The name without the record of the queried family is answered with no record (NODATA).
+		return true
+	}
+	return false
+}
+
+// addressRR returns A or AAAA record of ip answering q. It returns nil if ip doesn't match the type of q.
+func addressRR(q dns.Question, ip net.IP) dns.RR {
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+	ip4 := ip.To4()
+	switch {
+	case q.Qtype == dns.TypeA && ip4 != nil:
+		return &dns.A{Hdr: hdr, A: ip4}
+	case q.Qtype == dns.TypeAAAA && ip4 == nil && ip.To16() != nil:
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}
+	}
+	return nil
+}
+
+// addResolvedAnswers answers the question using the host's resolver.
+func addResolvedAnswers(m *dns.Msg, q dns.Question) {
+	var resolver net.Resolver
+	ctx := context.TODO()
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+	var err error
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		network := "ip4"
+		if q.Qtype == dns.TypeAAAA {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = resolver.LookupIP(ctx, network, q.Name)
+		for _, ip := range ips {
+			if rr := addressRR(q, ip); rr != nil {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if err != nil {
+			// The name that has only the addresses of the other family is answered with no record (NODATA).
+			if _, err2 := resolver.LookupIPAddr(ctx, q.Name); err2 == nil {
+				err = nil
+			}
+		}
+	case dns.TypeCNAME:
+		var cname string
+		cname, err = resolver.LookupCNAME(ctx, q.Name)
+		if err == nil {
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr, Target: cname})
+		}
+	case dns.TypeMX:
+		var records []*net.MX
+		records, err = resolver.LookupMX(ctx, q.Name)
+		for _, mx := range records {
+			m.Answer = append(m.Answer, &dns.MX{Hdr: hdr, Mx: mx.Host, Preference: mx.Pref})
+		}
+	case dns.TypeNS:
+		var records []*net.NS
+		records, err = resolver.LookupNS(ctx, q.Name)
+		for _, ns := range records {
+			m.Answer = append(m.Answer, &dns.NS{Hdr: hdr, Ns: ns.Host})
+		}
+	case dns.TypeSRV:
+		var records []*net.SRV
+		_, records, err = resolver.LookupSRV(ctx, "", "", q.Name)
+		for _, srv := range records {
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: hdr, Port: srv.Port, Priority: srv.Priority, Target: srv.Target, Weight: srv.Weight})
+		}
+	case dns.TypeTXT:
+		var records []string
+		records, err = resolver.LookupTXT(ctx, q.Name)
+		if err == nil {
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: records})
+		}
+	}
+	if err != nil {
+		m.Rcode = dns.RcodeNameError
+	}
+}
+
+// mux returns the handler of gvisor-tap-vsock's DNS API.
+func (h *dnsHandler) mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/all", func(w http.ResponseWriter, _ *http.Request) {
+		h.zonesMu.RLock()
+		defer h.zonesMu.RUnlock()
+		_ = json.NewEncoder(w).Encode(h.zones)
+	})
+	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "post only", http.StatusBadRequest)
+			return
+		}
+		var zone gvntypes.Zone
+		if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.addZone(zone)
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+func (h *dnsHandler) addZone(zone gvntypes.Zone) {
+	h.zonesMu.Lock()
+	defer h.zonesMu.Unlock()
+	for i, z := range h.zones {
+		if z.Name == zone.Name {
+			zone.Records = append(zone.Records, z.Records...)
+			h.zones[i] = zone
+			return
+		}
+	}
+	h.zones = append(h.zones, zone)
+}
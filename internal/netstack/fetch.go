@@ -0,0 +1,369 @@
+package netstack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Host is the host functions that perform HTTP requests (e.g. using browser's Fetch API).
+// WasmHost implements this on WASI.
+type Host interface {
+	// Send starts the request to address. req is the JSON-encoded FetchParameters.
+	Send(address string, req []byte) (id uint32, err error)
+	// WriteBody writes the request body. isEOF is true for the last chunk.
+	// This returns the size of chunk accepted by the host.
+	WriteBody(id uint32, chunk []byte, isEOF bool) (n int, err error)
+	// IsReadable returns true if the response is available.
+	IsReadable(id uint32) (bool, error)
+	// Recv reads the JSON-encoded FetchResponse.
+	Recv(id uint32, buf []byte) (n int, isEOF bool, err error)
+	// ReadBody reads the response body. This returns no data without EOF if the body isn't available yet.
+	ReadBody(id uint32, buf []byte) (n int, isEOF bool, err error)
+}
+
+// FetchParameters is the request passed to the host (http_send).
+// Headers has multiple values of a field joined with ", " and is kept for hosts that don't support HeaderList.
+// HeaderList preserves each field (name and value) in order.
+type FetchParameters struct {
+	Method     string            `json:"method,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	HeaderList [][2]string       `json:"headerList,omitempty"`
+	TLS        *FetchTLSConfig   `json:"tls,omitempty"`
+}
+
+// FetchTLSConfig configures TLS of the request performed by the host.
+// Hosts that can't configure TLS (e.g. browser) ignore it and verify the server with the roots they trust.
+type FetchTLSConfig struct {
+	// CACerts are PEM-encoded CA certificates trusted in addition to the roots of the host.
+	CACerts []string `json:"caCerts,omitempty"`
+
+	// InsecureSkipVerify skips the verification of the certificate of the server.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// FetchResponse is the response returned from the host (http_recv).
+// HeaderList is preferred over Headers if the host provides it.
+type FetchResponse struct {
+	Headers    map[string]string `json:"headers,omitempty"`
+	HeaderList [][2]string       `json:"headerList,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	StatusText string            `json:"statusText,omitempty"`
+}
+
+func encodeHeader(h http.Header) map[string]string {
+	res := make(map[string]string)
+	for k, vs := range h {
+		res[k] = strings.Join(vs, ", ")
+	}
+	return res
+}
+
+func encodeHeaderList(h http.Header) [][2]string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var res [][2]string
+	for _, k := range keys {
+		for _, v := range h[k] {
+			res = append(res, [2]string{k, v})
+		}
+	}
+	return res
+}
+
+func decodeHeader(h map[string]string, list [][2]string) http.Header {
+	res := make(http.Header)
+	if list != nil {
+		for _, f := range list {
+			res.Add(f[0], f[1])
+		}
+		return res
+	}
+	for k, v := range h {
+		res.Add(k, v) // multiple values can't be separated
+	}
+	return res
+}
+
+func httpRequestToFetchParameters(req *http.Request, tls *FetchTLSConfig) *FetchParameters {
+	return &FetchParameters{
+		Method:     req.Method,
+		Headers:    encodeHeader(req.Header),
+		HeaderList: encodeHeaderList(req.Header),
+		TLS:        tls,
+	}
+}
+
+func fetchResponseToHTTPResponse(req *http.Request, resp *FetchResponse) *http.Response {
+	h := decodeHeader(resp.Headers, resp.HeaderList)
+	contentLength := int64(-1)
+	if i, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = i // required by containerd resolver
+	}
+	return &http.Response{
+		Request:       req,
+		Status:        resp.StatusText,
+		StatusCode:    resp.Status,
+		Header:        h,
+		ContentLength: contentLength,
+	}
+}
+
+const (
+	// DefaultPollInterval is the interval to poll the host for the response if the host doesn't notify events.
+	DefaultPollInterval = 10 * time.Millisecond
+
+	// DefaultChunkSize is the max size of the data exchanged with the host at once.
+	DefaultChunkSize = 64 * 1024
+
+	// eventTimeout is the max duration to wait for an event before rechecking the request.
+	eventTimeout = time.Second
+)
+
+// FetchTransport is an http.RoundTripper that performs requests via the host.
+type FetchTransport struct {
+	// Host performs the requests.
+	Host Host
+
+	// Events notifies the events of the requests. If nil, the host is polled every PollInterval.
+	Events *EventNotifier
+
+	// PollInterval is the interval to poll the host (DefaultPollInterval if zero).
+	PollInterval time.Duration
+
+	// ChunkSize is the max size of the data exchanged with the host at once (DefaultChunkSize if zero).
+	ChunkSize int
+
+	// TLS configures TLS of the requests. The default configuration of the host is used if nil.
+	TLS *FetchTLSConfig
+}
+
+// RoundTrip implements http.RoundTripper.
+// The response body is streamed from the host as it arrives.
+func (t *FetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer func() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}()
+
+	address := req.URL.String()
+	if address == "" {
+		return nil, fmt.Errorf("specify destination address")
+	}
+
+	fetchReqD, err := json.Marshal(httpRequestToFetchParameters(req, t.TLS))
+	if err != nil {
+		return nil, err
+	}
+	id, err := t.Host.Send(address, fetchReqD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	events := t.Events.register(id)
+	bodyStarted := false
+	defer func() {
+		if !bodyStarted {
+			t.Events.unregister(id)
+		}
+	}()
+
+	buf := make([]byte, t.chunkSize())
+	var body io.Reader = http.NoBody
+	if req.Body != nil {
+		body = req.Body
+	}
+	for {
+		n, err := body.Read(buf)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		isEOF := err == io.EOF
+		for idx := 0; ; {
+			nwritten, err := t.Host.WriteBody(id, buf[idx:n], isEOF)
+			if err != nil {
+				return nil, fmt.Errorf("failed to write request body: %w", err)
+			}
+			idx += nwritten
+			if idx >= n {
+				break
+			}
+			// not fully written. retry for the remaining.
+			if nwritten == 0 {
+				// the host doesn't notify when it can accept the body so wait before retrying.
+				time.Sleep(t.pollInterval())
+			}
+		}
+		if isEOF {
+			break
+		}
+	}
+
+	for {
+		ok, err := t.Host.IsReadable(id)
+		if err != nil {
+			return nil, fmt.Errorf("response is not readable: %w", err)
+		}
+		if ok {
+			break
+		}
+		t.wait(events)
+	}
+
+	var respFull []byte
+	for {
+		n, isEOF, err := t.Host.Recv(id, buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive response: %w", err)
+		}
+		respFull = append(respFull, buf[:n]...)
+		if isEOF {
+			break
+		}
+	}
+	var resp FetchResponse
+	if err := json.Unmarshal(respFull, &resp); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	bodyStarted = true
+	go func() {
+		defer t.Events.unregister(id)
+		for {
+			n, isEOF, err := t.Host.ReadBody(id, buf)
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("failed to read response body: %w", err))
+				return
+			}
+			if n == 0 && !isEOF {
+				t.wait(events)
+				continue
+			}
+			if n > 0 {
+				if _, err := pw.Write(buf[:n]); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			if isEOF {
+				break
+			}
+		}
+		pw.Close()
+	}()
+	r := fetchResponseToHTTPResponse(req, &resp)
+	r.Body = pr
+	return r, nil
+}
+
+func (t *FetchTransport) chunkSize() int {
+	if t.ChunkSize > 0 {
+		return t.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+func (t *FetchTransport) pollInterval() time.Duration {
+	if t.PollInterval > 0 {
+		return t.PollInterval
+	}
+	return DefaultPollInterval
+}
+
+// wait waits for the next event of the request registered as ch.
+// This polls the host if the host doesn't notify events.
+func (t *FetchTransport) wait(ch chan struct{}) {
+	if ch == nil {
+		time.Sleep(t.pollInterval())
+		return
+	}
+	select {
+	case _, ok := <-ch:
+		if !ok {
+			// the host stopped notifying events
+			time.Sleep(t.pollInterval())
+		}
+	case <-time.After(eventTimeout):
+		// recheck the request in case of missing events
+	}
+}
+
+// EventNotifier wakes up the requests waiting for the host.
+// The host writes the IDs (little endian uint32) of the requests that have a response or body to read.
+type EventNotifier struct {
+	mu      sync.Mutex
+	waiters map[uint32]chan struct{}
+	failed  bool
+}
+
+// NewEventNotifier starts to read the events from r.
+// If reading fails, the requests fall back to polling the host.
+func NewEventNotifier(r io.Reader) *EventNotifier {
+	n := &EventNotifier{waiters: make(map[uint32]chan struct{})}
+	go n.serve(r)
+	return n
+}
+
+func (n *EventNotifier) serve(r io.Reader) {
+	br := bufio.NewReader(r)
+	var b [4]byte
+	for {
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			log.Printf("failed to read http events; falling back to polling: %v\n", err)
+			n.mu.Lock()
+			n.failed = true
+			for _, ch := range n.waiters {
+				close(ch)
+			}
+			n.waiters = nil
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Lock()
+		if ch, ok := n.waiters[binary.LittleEndian.Uint32(b[:])]; ok {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// register returns the channel notified on the events of the request.
+// This returns nil if the host doesn't notify events.
+func (n *EventNotifier) register(id uint32) chan struct{} {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.failed {
+		return nil
+	}
+	ch := make(chan struct{}, 1)
+	n.waiters[id] = ch
+	return ch
+}
+
+func (n *EventNotifier) unregister(id uint32) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.waiters, id)
+}
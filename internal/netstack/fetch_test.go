@@ -0,0 +1,235 @@
+package netstack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHost is a Host serving the requests with handler in memory.
+type fakeHost struct {
+	handler func(address string, params FetchParameters, body []byte) (FetchResponse, []byte)
+
+	// events is notified with the ID of the request when its response becomes available.
+	events io.Writer
+	// async makes the response available asynchronously after the body is written.
+	async bool
+
+	mu     sync.Mutex
+	nextID uint32
+	reqs   map[uint32]*fakeRequest
+}
+
+type fakeRequest struct {
+	address    string
+	params     FetchParameters
+	body       []byte
+	writeCalls int
+	resp       []byte
+	respBody   []byte
+	readCalls  int
+}
+
+func (h *fakeHost) Send(address string, req []byte) (uint32, error) {
+	var params FetchParameters
+	if err := json.Unmarshal(req, &params); err != nil {
+		return 0, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reqs == nil {
+		h.reqs = make(map[uint32]*fakeRequest)
+	}
+	h.nextID++
+	h.reqs[h.nextID] = &fakeRequest{address: address, params: params}
+	return h.nextID, nil
+}
+
+// WriteBody accepts nothing on every other call and at most 3 bytes otherwise.
+func (h *fakeHost) WriteBody(id uint32, chunk []byte, isEOF bool) (int, error) {
+	h.mu.Lock()
+	r, err := h.request(id)
+	if err != nil {
+		h.mu.Unlock()
+		return 0, err
+	}
+	r.writeCalls++
+	if r.writeCalls%2 == 1 && len(chunk) > 0 {
+		h.mu.Unlock()
+		return 0, nil
+	}
+	n := min(len(chunk), 3)
+	r.body = append(r.body, chunk[:n]...)
+	h.mu.Unlock()
+	if isEOF && n == len(chunk) {
+		respond := func() {
+			resp, body := h.handler(r.address, r.params, r.body)
+			d, _ := json.Marshal(resp)
+			h.mu.Lock()
+			r.resp, r.respBody = d, body
+			h.mu.Unlock()
+			if h.events != nil {
+				h.events.Write(binary.LittleEndian.AppendUint32(nil, id))
+			}
+		}
+		if h.async {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				respond()
+			}()
+		} else {
+			respond()
+		}
+	}
+	return n, nil
+}
+
+func (h *fakeHost) IsReadable(id uint32) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, err := h.request(id)
+	if err != nil {
+		return false, err
+	}
+	return r.resp != nil, nil
+}
+
+func (h *fakeHost) Recv(id uint32, buf []byte) (int, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, err := h.request(id)
+	if err != nil {
+		return 0, false, err
+	}
+	n := copy(buf, r.resp)
+	r.resp = r.resp[n:]
+	return n, len(r.resp) == 0, nil
+}
+
+// ReadBody returns no data on every other call.
+func (h *fakeHost) ReadBody(id uint32, buf []byte) (int, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, err := h.request(id)
+	if err != nil {
+		return 0, false, err
+	}
+	r.readCalls++
+	if r.readCalls%2 == 1 {
+		return 0, false, nil
+	}
+	n := copy(buf, r.respBody)
+	r.respBody = r.respBody[n:]
+	return n, len(r.respBody) == 0, nil
+}
+
+func (h *fakeHost) request(id uint32) (*fakeRequest, error) {
+	r, ok := h.reqs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown request %d", id)
+	}
+	return r, nil
+}
+
+func echoHandler(address string, params FetchParameters, body []byte) (FetchResponse, []byte) {
+	respBody := []byte(params.Method + " " + address + " " + string(body))
+	return FetchResponse{
+		Status:     http.StatusOK,
+		StatusText: "200 OK",
+		HeaderList: [][2]string{
+			{"Content-Length", fmt.Sprint(len(respBody))},
+			{"X-Values", "a"},
+			{"X-Values", "b"},
+		},
+	}, respBody
+}
+
+func TestFetchTransport(t *testing.T) {
+	host := &fakeHost{handler: echoHandler}
+	transport := &FetchTransport{Host: host, PollInterval: time.Millisecond, ChunkSize: 4}
+
+	req, err := http.NewRequest("POST", "http://example.com/path", strings.NewReader("request body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Test", "1")
+	req.Header.Add("X-Test", "2")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "POST http://example.com/path request body"
+	if string(body) != want {
+		t.Errorf("body %q; want %q", body, want)
+	}
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(want)) {
+		t.Errorf("status %d, content length %d; want 200, %d", resp.StatusCode, resp.ContentLength, len(want))
+	}
+	if v := resp.Header.Values("X-Values"); len(v) != 2 || v[0] != "a" || v[1] != "b" {
+		t.Errorf("X-Values %q; want [a b]", v)
+	}
+
+	r := host.reqs[1]
+	if got := r.params.HeaderList; len(got) != 2 || got[0] != [2]string{"X-Test", "1"} || got[1] != [2]string{"X-Test", "2"} {
+		t.Errorf("header list %q", got)
+	}
+	if got := r.params.Headers["X-Test"]; got != "1, 2" {
+		t.Errorf("header %q; want %q", got, "1, 2")
+	}
+}
+
+func TestFetchTransportError(t *testing.T) {
+	host := &fakeHost{handler: echoHandler}
+	transport := &FetchTransport{Host: host, PollInterval: time.Millisecond}
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.mu.Lock()
+	delete(host.reqs, 1) // the host forgets the request
+	host.mu.Unlock()
+	if _, err := io.ReadAll(resp.Body); err == nil || !strings.Contains(err.Error(), "failed to read response body") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestFetchTransportEvents(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	host := &fakeHost{handler: echoHandler, events: pw, async: true}
+	transport := &FetchTransport{Host: host, Events: NewEventNotifier(pr), PollInterval: time.Millisecond}
+
+	req, err := http.NewRequest("PUT", "http://example.com/", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if d := time.Since(start); d >= eventTimeout {
+		t.Fatalf("response took %v; the event isn't notified", d)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d; want 200", resp.StatusCode)
+	}
+}
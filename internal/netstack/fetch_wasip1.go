@@ -0,0 +1,89 @@
+package netstack
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+//go:wasmimport env http_send
+func http_send(addressP uint32, addresslen uint32, reqP, reqlen uint32, idP uint32) uint32
+
+//go:wasmimport env http_writebody
+func http_writebody(id uint32, chunkP, len uint32, nwrittenP uint32, isEOF uint32) uint32
+
+//go:wasmimport env http_isreadable
+func http_isreadable(id uint32, isOKP uint32) uint32
+
+//go:wasmimport env http_recv
+func http_recv(id uint32, respP uint32, bufsize uint32, respsizeP uint32, isEOFP uint32) uint32
+
+//go:wasmimport env http_readbody
+func http_readbody(id uint32, bodyP uint32, bufsize uint32, bodysizeP uint32, isEOFP uint32) uint32
+
+// WasmHost is the host functions imported from the "env" module.
+var WasmHost Host = wasmHost{}
+
+type wasmHost struct{}
+
+func ptr(b []byte) uint32 {
+	return uint32(uintptr(unsafe.Pointer(unsafe.SliceData(b))))
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (wasmHost) Send(address string, req []byte) (uint32, error) {
+	if len(req) == 0 {
+		return 0, fmt.Errorf("empty request")
+	}
+	addr := []byte(address)
+	var id uint32
+	if res := http_send(ptr(addr), uint32(len(addr)), ptr(req), uint32(len(req)), uint32(uintptr(unsafe.Pointer(&id)))); res != 0 {
+		return 0, fmt.Errorf("http_send returned %d", res)
+	}
+	return id, nil
+}
+
+func (wasmHost) WriteBody(id uint32, chunk []byte, isEOF bool) (int, error) {
+	var nwritten uint32
+	if res := http_writebody(id, ptr(chunk), uint32(len(chunk)), uint32(uintptr(unsafe.Pointer(&nwritten))), boolToUint32(isEOF)); res != 0 {
+		return 0, fmt.Errorf("http_writebody returned %d", res)
+	}
+	return int(nwritten), nil
+}
+
+func (wasmHost) IsReadable(id uint32) (bool, error) {
+	var isOK uint32
+	if res := http_isreadable(id, uint32(uintptr(unsafe.Pointer(&isOK)))); res != 0 {
+		return false, fmt.Errorf("http_isreadable returned %d", res)
+	}
+	return isOK == 1, nil
+}
+
+func (wasmHost) Recv(id uint32, buf []byte) (int, bool, error) {
+	var respsize, isEOF uint32
+	if res := http_recv(id, ptr(buf), uint32(len(buf)), uint32(uintptr(unsafe.Pointer(&respsize))), uint32(uintptr(unsafe.Pointer(&isEOF)))); res != 0 {
+		return 0, false, fmt.Errorf("http_recv returned %d", res)
+	}
+	return int(respsize), isEOF == 1, nil
+}
+
+func (wasmHost) ReadBody(id uint32, buf []byte) (int, bool, error) {
+	var bodysize, isEOF uint32
+	if res := http_readbody(id, ptr(buf), uint32(len(buf)), uint32(uintptr(unsafe.Pointer(&bodysize))), uint32(uintptr(unsafe.Pointer(&isEOF)))); res != 0 {
+		return 0, false, fmt.Errorf("http_readbody returned %d", res)
+	}
+	return int(bodysize), isEOF == 1, nil
+}
+
+// OpenEventFD returns the notifier of the events that the host writes to fd (e.g. -http-eventfd).
+func OpenEventFD(fd int) *EventNotifier {
+	syscall.SetNonblock(fd, true)
+	return NewEventNotifier(os.NewFile(uintptr(fd), "http-events"))
+}
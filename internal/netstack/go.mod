@@ -0,0 +1,40 @@
+module github.com/ktock/container2wasm/internal/netstack
+
+go 1.23.0
+
+require (
+	github.com/containers/gvisor-tap-vsock v0.8.5
+	github.com/miekg/dns v1.1.63
+	golang.org/x/time v0.5.0
+	gvisor.dev/gvisor v0.0.0-20240916094835-a174eb65023f
+)
+
+require (
+	github.com/Microsoft/go-winio v0.6.2 // indirect
+	github.com/apparentlymart/go-cidr v1.1.0 // indirect
+	github.com/google/btree v1.1.2 // indirect
+	github.com/google/gopacket v1.1.19 // indirect
+	github.com/insomniacslk/dhcp v0.0.0-20240710054256-ddd8a41251c9 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/sirupsen/logrus v1.9.3 // indirect
+	github.com/u-root/uio v0.0.0-20240224005618-d2acac8f3701 // indirect
+	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/mod v0.24.0 // indirect
+	golang.org/x/net v0.36.0 // indirect
+	golang.org/x/sync v0.12.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/tools v0.28.0 // indirect
+)
+
+replace github.com/sirupsen/logrus => github.com/sirupsen/logrus v1.9.3-0.20230531171720-7165f5e779a5
+
+// Patched for enabling to compile it to wasi
+replace github.com/u-root/uio => github.com/ktock/u-root-uio v0.0.0-20230911142931-5cf720bc8a29
+
+// github.com/insomniacslk/dhcp isn't replaced with the fork patched for wasi because the fork doesn't
+// compile for linux and this module is also used by c2w-net and tested on the host.
+// Check this for wasi from the modules replacing it, e.g.:
+//   cd extras/c2w-net-proxy && GOOS=wasip1 GOARCH=wasm go vet github.com/ktock/container2wasm/internal/netstack
+
+// FIXME: Temporary use a forked repostory which removed an unused package for reducing dependencies (see #454).
+replace github.com/containers/gvisor-tap-vsock => github.com/ktock/gvisor-tap-vsock v0.0.0-20250428083527-5f02d9ba79d4
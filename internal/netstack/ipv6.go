@@ -0,0 +1,240 @@
+package netstack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// raInterval is the interval of the unsolicited router advertisements.
+	raInterval = 10 * time.Minute
+	// raLifetime is the router lifetime and the lifetime of the DNS server in the router advertisements.
+	raLifetime = 3 * raInterval
+	// raMinDelay is the min interval of the router advertisements sent in response to router solicitations.
+	raMinDelay = time.Second
+)
+
+// linkEndpoint is the gateway's endpoint connected to the switch.
+// The switch forwards only unicast and broadcast frames so the multicast frames sent by the gateway
+// (e.g. neighbor solicitations) are sent as broadcast frames. The stack spoofs any address so
+// neighbor advertisements about the addresses other than the gateway's ones are dropped as
+// tap.LinkEndpoint does for ARP replies. Otherwise, the gateway would take the addresses of the VMs.
+type linkEndpoint struct {
+	*tap.LinkEndpoint
+	addrs map[tcpip.Address]struct{}
+}
+
+func newLinkEndpoint(ep *tap.LinkEndpoint, virtualIPs []string) (*linkEndpoint, error) {
+	e := &linkEndpoint{
+		LinkEndpoint: ep,
+		addrs: map[tcpip.Address]struct{}{
+			tcpipAddr(net.ParseIP(GatewayIP6)):     {},
+			header.LinkLocalAddr(ep.LinkAddress()): {},
+		},
+	}
+	for _, a := range virtualIPs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid virtual IP %q", a)
+		}
+		if ip.To4() == nil {
+			e.addrs[tcpipAddr(ip)] = struct{}{}
+		}
+	}
+	return e, nil
+}
+
+func (e *linkEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	var out stack.PacketBufferList
+	for _, p := range pkts.AsSlice() {
+		if p.NetworkProtocolNumber == header.IPv6ProtocolNumber && e.isSpoofedNA(p) {
+			continue
+		}
+		if header.IsMulticastEthernetAddress(p.EgressRoute.RemoteLinkAddress) {
+			p.EgressRoute.RemoteLinkAddress = header.EthernetBroadcastAddress
+		}
+		out.PushBack(p)
+	}
+	if n, err := e.LinkEndpoint.WritePackets(out); err != nil {
+		return n, err
+	}
+	return pkts.Len(), nil
+}
+
+// isSpoofedNA returns true if the packet is a neighbor advertisement about the address not owned by the gateway.
+func (e *linkEndpoint) isSpoofedNA(p *stack.PacketBuffer) bool {
+	ip := header.IPv6(p.NetworkHeader().Slice())
+	if len(ip) < header.IPv6MinimumSize || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+		return false
+	}
+	icmp := header.ICMPv6(p.TransportHeader().Slice())
+	if len(icmp) < header.ICMPv6NeighborAdvertMinimumSize || icmp.Type() != header.ICMPv6NeighborAdvert {
+		return false
+	}
+	_, ok := e.addrs[header.NDPNeighborAdvert(icmp.MessageBody()).TargetAddress()]
+	return !ok
+}
+
+// router sends router advertisements of Subnet6 to the VMs so that they configure their addresses
+// using SLAAC and use the gateway as the default router.
+type router struct {
+	networkSwitch *tap.Switch
+	frame         []byte
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newRouter(networkSwitch *tap.Switch, mac tcpip.LinkAddress) (*router, error) {
+	_, subnet, err := net.ParseCIDR(Subnet6)
+	if err != nil {
+		return nil, err
+	}
+	prefixLen, _ := subnet.Mask.Size()
+
+	// Prefix Information option (RFC 4861 section 4.6.2) with on-link and autonomous flags.
+	// The prefix is valid forever.
+	prefix := make([]byte, 30)
+	prefix[0] = uint8(prefixLen)
+	prefix[1] = 1<<7 | 1<<6
+	binary.BigEndian.PutUint32(prefix[2:], ^uint32(0))
+	binary.BigEndian.PutUint32(prefix[6:], ^uint32(0))
+	copy(prefix[14:], subnet.IP.To16())
+
+	// Recursive DNS Server option (RFC 8106 section 5.1) advertising the gateway.
+	rdnss := make([]byte, 6+net.IPv6len)
+	binary.BigEndian.PutUint32(rdnss[2:], uint32(raLifetime/time.Second))
+	copy(rdnss[6:], net.ParseIP(GatewayIP6).To16())
+
+	opts := header.NDPOptionsSerializer{
+		header.NDPSourceLinkLayerAddressOption(mac),
+		header.NDPPrefixInformation(prefix),
+		header.NDPRecursiveDNSServer(rdnss),
+	}
+	icmpSize := header.ICMPv6HeaderSize + header.NDPRAMinimumSize + opts.Length()
+	frame := make([]byte, header.EthernetMinimumSize+header.IPv6MinimumSize+icmpSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: mac,
+		DstAddr: header.EthernetBroadcastAddress,
+		Type:    header.IPv6ProtocolNumber,
+	})
+	src, dst := header.LinkLocalAddr(mac), header.IPv6AllNodesMulticastAddress
+	ip := header.IPv6(frame[header.EthernetMinimumSize:])
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(icmpSize),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          header.NDPHopLimit,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	icmp := header.ICMPv6(ip.Payload())
+	icmp.SetType(header.ICMPv6RouterAdvert)
+	ra := icmp.MessageBody()
+	ra[0] = 64 // current hop limit
+	binary.BigEndian.PutUint16(ra[2:], uint16(raLifetime/time.Second))
+	header.NDPOptions(ra[header.NDPRAMinimumSize:]).Serialize(opts)
+	icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: icmp, Src: src, Dst: dst}))
+
+	return &router{networkSwitch: networkSwitch, frame: frame}, nil
+}
+
+// run sends unsolicited router advertisements periodically.
+func (r *router) run() {
+	for {
+		r.advertise()
+		time.Sleep(raInterval)
+	}
+}
+
+// solicited sends a router advertisement in response to a router solicitation.
+func (r *router) solicited() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.last) < raMinDelay {
+		return
+	}
+	r.last = time.Now()
+	go r.advertise()
+}
+
+func (r *router) advertise() {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(r.frame)})
+	defer pkt.DecRef()
+	r.networkSwitch.DeliverNetworkPacket(header.IPv6ProtocolNumber, pkt)
+}
+
+// multicastConn is the connection of a VM. The multicast frames sent by the VM (e.g. neighbor
+// solicitations) are rewritten to broadcast frames so that the switch delivers them to the gateway
+// and the other VMs. Router solicitations are answered with router advertisements.
+type multicastConn struct {
+	net.Conn
+	r *router
+
+	br   *bufio.Reader
+	buf  []byte
+	rbuf []byte
+}
+
+func newMulticastConn(conn net.Conn, r *router) net.Conn {
+	return &multicastConn{Conn: conn, r: r, br: bufio.NewReader(conn)}
+}
+
+// Read returns the frames sent by the VM in the QEMU protocol (4 bytes length header followed by an ethernet frame).
+func (c *multicastConn) Read(b []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > MaxFrameSize {
+			return 0, fmt.Errorf("frame size %d exceeds the limit %d", size, MaxFrameSize)
+		}
+		if cap(c.buf) < 4+int(size) {
+			c.buf = make([]byte, 4+size)
+		}
+		frame := c.buf[:4+size]
+		copy(frame, hdr[:])
+		if _, err := io.ReadFull(c.br, frame[4:]); err != nil {
+			return 0, err
+		}
+		c.handleFrame(frame[4:])
+		c.rbuf = frame
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *multicastConn) handleFrame(frame []byte) {
+	if len(frame) < header.EthernetMinimumSize {
+		return
+	}
+	eth := header.Ethernet(frame)
+	dst := eth.DestinationAddress()
+	if !header.IsMulticastEthernetAddress(dst) || dst == header.EthernetBroadcastAddress {
+		return
+	}
+	copy(frame, header.EthernetBroadcastAddress)
+	if eth.Type() != header.IPv6ProtocolNumber {
+		return
+	}
+	ip := header.IPv6(frame[header.EthernetMinimumSize:])
+	if !ip.IsValid(len(ip)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber || ip.HopLimit() != header.NDPHopLimit {
+		return
+	}
+	if icmp := header.ICMPv6(ip.Payload()); len(icmp) >= header.ICMPv6MinimumSize && icmp.Type() == header.ICMPv6RouterSolicit {
+		c.r.solicited()
+	}
+}
@@ -0,0 +1,35 @@
+package netstack
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// FindListener returns the listener of the socket at listenFd. If listenFd is 0, the first preopened
+// listening socket is used. This returns nil if no socket is found.
+func FindListener(listenFd int) (net.Listener, error) {
+	if listenFd == 0 {
+		for preopenFd := 3; ; preopenFd++ {
+			var stat syscall.Stat_t
+			if err := syscall.Fstat(preopenFd, &stat); err != nil {
+				var se syscall.Errno
+				if errors.As(err, &se) && se == syscall.EBADF {
+					err = nil
+				}
+				log.Printf("findListner failed (fd=%d): %v\n", preopenFd, err)
+				return nil, err
+			} else if stat.Filetype == syscall.FILETYPE_SOCKET_STREAM {
+				listenFd = preopenFd
+				break
+			}
+		}
+	}
+	syscall.SetNonblock(listenFd, true)
+	f := os.NewFile(uintptr(listenFd), "")
+	defer f.Close()
+	log.Printf("using socket at fd=%d\n", listenFd)
+	return net.FileListener(f)
+}
@@ -0,0 +1,311 @@
+// Package netstack provides the virtual network connecting the containers, the HTTP(S) proxy
+// forwarding the requests from the containers via the host (e.g. browser's Fetch API) and the
+// packet capture of the network.
+package netstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	// Subnet is the subnet of the network.
+	Subnet = "192.168.127.0/24"
+	// GatewayIP is the address of the gateway.
+	GatewayIP = "192.168.127.1"
+	// GatewayMAC is the MAC address of the gateway.
+	GatewayMAC = "5a:94:ef:e4:0c:dd"
+	// VMIP is the address assigned to the first VM.
+	VMIP = "192.168.127.3"
+	// VMMAC is the default MAC address of the first VM.
+	VMMAC = "02:00:00:00:00:01"
+	// HostVirtualIP is the address of the gateway translated to the host's localhost (see WithHostAccess).
+	HostVirtualIP = "192.168.127.254"
+	// ProxyIP is the address of the HTTP(S) proxy (see Proxy).
+	ProxyIP = "192.168.127.253"
+	// MTU is the MTU of the network.
+	MTU = 1500
+	// MaxFrameSize is the max size of the ethernet frames sent by the VMs. The connection of a VM
+	// sending a larger frame is closed.
+	MaxFrameSize = 65535
+
+	// Subnet6 is the IPv6 subnet (ULA) of the network advertised to the VMs by the gateway's router
+	// advertisements. VMs configure their addresses using SLAAC (see VMIP6).
+	Subnet6 = "fdc2:127::/64"
+	// GatewayIP6 is the IPv6 address of the gateway. The gateway also has the link-local address
+	// derived from GatewayMAC, which is the source of the router advertisements.
+	GatewayIP6 = "fdc2:127::1"
+	// HostVirtualIP6 is the IPv6 address of the gateway translated to the host's localhost (see WithHostAccess).
+	HostVirtualIP6 = "fdc2:127::fe"
+)
+
+// VMIP6 returns the IPv6 address that the VM with the MAC address configures using SLAAC
+// (Subnet6 and the modified EUI-64 interface identifier of the MAC address).
+func VMIP6(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	if len(hw) != 6 {
+		return "", fmt.Errorf("%q is not an ethernet address", mac)
+	}
+	_, subnet, err := net.ParseCIDR(Subnet6)
+	if err != nil {
+		return "", err
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, subnet.IP)
+	iid := header.EthernetAddressToModifiedEUI64(tcpip.LinkAddress(hw))
+	copy(ip[header.IIDOffsetInIPv6Address:], iid[:])
+	return ip.String(), nil
+}
+
+// Network is the virtual network that VMs connect to using the QEMU protocol (see AcceptQemu).
+// The network is dual-stack. The gateway serves DHCPv4 and router advertisements for SLAAC of Subnet6,
+// and the DNS server on the gateway answers both A and AAAA queries.
+type Network struct {
+	stack         *stack.Stack
+	networkSwitch *tap.Switch
+	ipPool        *tap.IPPool
+	servicesMux   http.Handler
+	router        *router
+}
+
+// Option configures the network.
+type Option func(*gvntypes.Configuration)
+
+// WithDebug enables debug logs of the network stack.
+func WithDebug(debug bool) Option {
+	return func(c *gvntypes.Configuration) {
+		c.Debug = debug
+	}
+}
+
+// WithDHCPStaticLeases assigns the addresses to the MAC addresses (IP to MAC).
+func WithDHCPStaticLeases(leases map[string]string) Option {
+	return func(c *gvntypes.Configuration) {
+		if c.DHCPStaticLeases == nil {
+			c.DHCPStaticLeases = make(map[string]string)
+		}
+		for ip, mac := range leases {
+			c.DHCPStaticLeases[ip] = mac
+		}
+	}
+}
+
+// WithForwards forwards the host addresses to the guest addresses.
+// The host address is prefixed by "udp:" for UDP.
+func WithForwards(forwards map[string]string) Option {
+	return func(c *gvntypes.Configuration) {
+		if c.Forwards == nil {
+			c.Forwards = make(map[string]string)
+		}
+		for host, guest := range forwards {
+			c.Forwards[host] = guest
+		}
+	}
+}
+
+// WithHostAccess allows the VMs to access the host's localhost via HostVirtualIP and HostVirtualIP6.
+func WithHostAccess() Option {
+	return func(c *gvntypes.Configuration) {
+		if c.NAT == nil {
+			c.NAT = make(map[string]string)
+		}
+		c.NAT[HostVirtualIP] = "127.0.0.1"
+		c.NAT[HostVirtualIP6] = "::1"
+		c.GatewayVirtualIPs = append(c.GatewayVirtualIPs, HostVirtualIP, HostVirtualIP6)
+	}
+}
+
+// WithVirtualIPs adds the addresses served by the network stack (e.g. ProxyIP) that can be listened on with Listen.
+func WithVirtualIPs(ips ...string) Option {
+	return func(c *gvntypes.Configuration) {
+		c.GatewayVirtualIPs = append(c.GatewayVirtualIPs, ips...)
+	}
+}
+
+// WithDNS configures the static DNS records served by the gateway and the search domains provided via DHCP.
+// Records of IPv4 addresses are served as A records and ones of IPv6 addresses are served as AAAA records.
+func WithDNS(zones []gvntypes.Zone, searchDomains []string) Option {
+	return func(c *gvntypes.Configuration) {
+		c.DNS = append(c.DNS, zones...)
+		c.DNSSearchDomains = append(c.DNSSearchDomains, searchDomains...)
+	}
+}
+
+// New creates a network.
+func New(opts ...Option) (*Network, error) {
+	config := &gvntypes.Configuration{
+		MTU:               MTU,
+		Subnet:            Subnet,
+		GatewayIP:         GatewayIP,
+		GatewayMacAddress: GatewayMAC,
+		Protocol:          gvntypes.QemuProtocol,
+	}
+	for _, o := range opts {
+		o(config)
+	}
+	_, subnet, err := net.ParseCIDR(config.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse subnet: %w", err)
+	}
+	ipPool := tap.NewIPPool(subnet)
+	ipPool.Reserve(net.ParseIP(config.GatewayIP), config.GatewayMacAddress)
+	for ip, mac := range config.DHCPStaticLeases {
+		ipPool.Reserve(net.ParseIP(ip), mac)
+	}
+	tapEndpoint, err := tap.NewLinkEndpoint(config.Debug, config.MTU, config.GatewayMacAddress, config.GatewayIP, config.GatewayVirtualIPs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create tap endpoint: %w", err)
+	}
+	networkSwitch := tap.NewSwitch(config.Debug, config.MTU)
+	tapEndpoint.Connect(networkSwitch)
+	networkSwitch.Connect(tapEndpoint)
+	ep, err := newLinkEndpoint(tapEndpoint, config.GatewayVirtualIPs)
+	if err != nil {
+		return nil, err
+	}
+	s, err := createStack(config, ep)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create network stack: %w", err)
+	}
+	mux, err := addServices(config, s, ipPool)
+	if err != nil {
+		return nil, fmt.Errorf("cannot add network services: %w", err)
+	}
+	r, err := newRouter(networkSwitch, tapEndpoint.LinkAddress())
+	if err != nil {
+		return nil, err
+	}
+	go r.run()
+	return &Network{
+		stack:         s,
+		networkSwitch: networkSwitch,
+		ipPool:        ipPool,
+		servicesMux:   mux,
+		router:        r,
+	}, nil
+}
+
+func createStack(config *gvntypes.Configuration, ep stack.LinkEndpoint) (*stack.Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{
+			ipv4.NewProtocol,
+			arp.NewProtocol,
+			ipv6.NewProtocol,
+		},
+		TransportProtocols: []stack.TransportProtocolFactory{
+			tcp.NewProtocol,
+			udp.NewProtocol,
+			icmp.NewProtocol4,
+			icmp.NewProtocol6,
+		},
+	})
+	if err := s.CreateNIC(1, ep); err != nil {
+		return nil, errors.New(err.String())
+	}
+	addrs := []tcpip.ProtocolAddress{
+		{Protocol: ipv4.ProtocolNumber, AddressWithPrefix: tcpipAddr(net.ParseIP(config.GatewayIP)).WithPrefix()},
+		{Protocol: ipv6.ProtocolNumber, AddressWithPrefix: tcpipAddr(net.ParseIP(GatewayIP6)).WithPrefix()},
+		{Protocol: ipv6.ProtocolNumber, AddressWithPrefix: header.LinkLocalAddr(ep.LinkAddress()).WithPrefix()},
+	}
+	for _, a := range addrs {
+		if err := s.AddProtocolAddress(1, a, stack.AddressProperties{}); err != nil {
+			return nil, errors.New(err.String())
+		}
+	}
+	s.SetSpoofing(1, true)
+	s.SetPromiscuousMode(1, true)
+	var routes []tcpip.Route
+	for _, cidr := range []string{config.Subnet, Subnet6, "fe80::/64"} {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse subnet: %w", err)
+		}
+		dst, err := tcpip.NewSubnet(tcpipAddr(subnet.IP), tcpip.MaskFromBytes(subnet.Mask))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse subnet: %w", err)
+		}
+		routes = append(routes, tcpip.Route{Destination: dst, NIC: 1})
+	}
+	s.SetRouteTable(routes)
+	return s, nil
+}
+
+// AcceptQemu connects a VM to the network. conn must use the QEMU protocol (4 bytes length header
+// followed by an ethernet frame) e.g. qemu's "-netdev socket".
+func (n *Network) AcceptQemu(ctx context.Context, conn net.Conn) error {
+	return n.networkSwitch.Accept(ctx, newMulticastConn(conn, n.router), gvntypes.QemuProtocol)
+}
+
+// Listen listens on the address of the network stack (e.g. GatewayIP and the addresses specified by
+// WithVirtualIPs). Only "tcp" is supported as the network.
+func (n *Network) Listen(network, addr string) (net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("unsupported network %q: only tcp is supported", network)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q: must be an IP", addr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q: %w", addr, err)
+	}
+	return gonet.ListenTCP(n.stack, tcpip.FullAddress{NIC: 1, Addr: tcpipAddr(ip), Port: uint16(p)}, protocolNumber(ip))
+}
+
+// ServicesMux returns the handler of gvisor-tap-vsock's services API (/services/forwarder, /services/dhcp
+// and /services/dns) and the statistics of the network (/stats, /cam and /leases).
+func (n *Network) ServicesMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/services/", http.StripPrefix("/services", n.servicesMux))
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(statsAsJSON(n.networkSwitch.Sent, n.networkSwitch.Received, n.stack.Stats()))
+	})
+	mux.HandleFunc("/cam", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(n.networkSwitch.CAM())
+	})
+	mux.HandleFunc("/leases", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(n.ipPool.Leases())
+	})
+	return mux
+}
+
+// tcpipAddr converts ip to the address of the network stack. IPv4-mapped IPv6 addresses are treated as IPv4.
+func tcpipAddr(ip net.IP) tcpip.Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.AddrFrom4Slice(ip4)
+	}
+	return tcpip.AddrFrom16Slice(ip.To16())
+}
+
+func protocolNumber(ip net.IP) tcpip.NetworkProtocolNumber {
+	if ip.To4() != nil {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
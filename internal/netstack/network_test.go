@@ -0,0 +1,230 @@
+package netstack
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// testVM is an IPv6 host connected to the network using the QEMU protocol.
+type testVM struct {
+	*stack.Stack
+	ip string
+}
+
+func newTestVM(ctx context.Context, t *testing.T, n *Network, mac string) *testVM {
+	t.Helper()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := channel.New(256, MTU, tcpip.LinkAddress(hw))
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{ipv6.NewProtocolWithOptions(ipv6.Options{
+			NDPConfigs: ipv6.NDPConfigurations{
+				MaxRtrSolicitations:     3,
+				RtrSolicitationInterval: time.Second,
+				HandleRAs:               ipv6.HandlingRAsAlwaysEnabled,
+				DiscoverDefaultRouters:  true,
+				DiscoverOnLinkPrefixes:  true,
+				AutoGenGlobalAddresses:  true,
+			},
+			AutoGenLinkLocal: true,
+			// The gateway must not answer DAD of the addresses of the VM.
+			DADConfigs: stack.DADConfigurations{DupAddrDetectTransmits: 1, RetransmitTimer: 100 * time.Millisecond},
+		})},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol6},
+	})
+	t.Cleanup(s.Destroy)
+	if err := s.CreateNIC(1, ethernet.New(ch)); err != nil {
+		t.Fatal(err)
+	}
+	// gvisor leaves the routes of the discovered prefix to the integrator.
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv6EmptySubnet, NIC: 1}})
+	vmConn, netConn := net.Pipe()
+	t.Cleanup(func() { vmConn.Close() })
+	go n.AcceptQemu(ctx, netConn)
+	go func() {
+		for {
+			pkt := ch.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+			frame := pkt.ToView().AsSlice()
+			pkt.DecRef()
+			b := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+			if _, err := vmConn.Write(append(b, frame...)); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			var hdr [4]byte
+			if _, err := io.ReadFull(vmConn, hdr[:]); err != nil {
+				return
+			}
+			frame := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+			if _, err := io.ReadFull(vmConn, frame); err != nil {
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(frame)})
+			ch.InjectInbound(0, pkt)
+			pkt.DecRef()
+		}
+	}()
+	ip, err := VMIP6(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tcpipAddr(net.ParseIP(ip))
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if a, err := s.GetMainNICAddress(1, ipv6.ProtocolNumber); err == nil && a.Address == want {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("%s isn't configured using the router advertisement", ip)
+		}
+	}
+	return &testVM{Stack: s, ip: ip}
+}
+
+func (vm *testVM) dial(ctx context.Context, addr string, port uint16) (net.Conn, error) {
+	return gonet.DialContextTCP(ctx, vm.Stack, tcpip.FullAddress{NIC: 1, Addr: tcpipAddr(net.ParseIP(addr)), Port: port}, ipv6.ProtocolNumber)
+}
+
+func TestIPv6(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	zones := []gvntypes.Zone{{
+		Name: "c2w.internal.",
+		Records: []gvntypes.Record{
+			{Name: "dual", IP: net.ParseIP("192.168.127.10")},
+			{Name: "dual", IP: net.ParseIP("fdc2:127::10")},
+			{Name: "v4only", IP: net.ParseIP("192.168.127.11")},
+		},
+	}}
+	n, err := New(WithDNS(zones, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm1 := newTestVM(ctx, t, n, "02:00:00:00:00:01")
+	vm2 := newTestVM(ctx, t, n, "02:00:00:00:00:02")
+
+	t.Run("gateway", func(t *testing.T) {
+		l, err := n.Listen("tcp", net.JoinHostPort(GatewayIP6, "8080"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		testEcho(ctx, t, l, func() (net.Conn, error) { return vm1.dial(ctx, GatewayIP6, 8080) })
+	})
+
+	t.Run("between VMs", func(t *testing.T) {
+		l, err := gonet.ListenTCP(vm2.Stack, tcpip.FullAddress{NIC: 1, Port: 8080}, ipv6.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		testEcho(ctx, t, l, func() (net.Conn, error) { return vm1.dial(ctx, vm2.ip, 8080) })
+	})
+
+	t.Run("dns", func(t *testing.T) {
+		for _, tt := range []struct {
+			name  string
+			qtype uint16
+			want  []string
+			rcode int
+		}{
+			{name: "dual.c2w.internal.", qtype: dns.TypeAAAA, want: []string{"fdc2:127::10"}},
+			{name: "dual.c2w.internal.", qtype: dns.TypeA, want: []string{"192.168.127.10"}},
+			{name: "v4only.c2w.internal.", qtype: dns.TypeAAAA},
+			{name: "unknown.c2w.internal.", qtype: dns.TypeAAAA, rcode: dns.RcodeNameError},
+		} {
+			var q dns.Msg
+			q.SetQuestion(tt.name, tt.qtype)
+			res := exchangeDNS(ctx, t, vm1, &q)
+			if res.Rcode != tt.rcode {
+				t.Errorf("%s %s: unexpected rcode %d; want %d", tt.name, dns.TypeToString[tt.qtype], res.Rcode, tt.rcode)
+			}
+			var got []string
+			for _, rr := range res.Answer {
+				switch v := rr.(type) {
+				case *dns.A:
+					got = append(got, v.A.String())
+				case *dns.AAAA:
+					got = append(got, v.AAAA.String())
+				}
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("%s %s: unexpected answers %v; want %v", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+			}
+		}
+	})
+}
+
+func exchangeDNS(ctx context.Context, t *testing.T, vm *testVM, q *dns.Msg) *dns.Msg {
+	t.Helper()
+	conn, err := gonet.DialUDP(vm.Stack, nil, &tcpip.FullAddress{NIC: 1, Addr: tcpipAddr(net.ParseIP(GatewayIP6)), Port: 53}, ipv6.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c := &dns.Conn{Conn: conn}
+	if err := c.WriteMsg(q); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func testEcho(ctx context.Context, t *testing.T, l net.Listener, dial func() (net.Conn, error)) {
+	t.Helper()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("unexpected echo %q", b)
+	}
+}
@@ -0,0 +1,277 @@
+package netstack
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	pcapngSectionHeaderBlock    = 0x0A0D0D0A
+	pcapngInterfaceDescBlock    = 0x00000001
+	pcapngEnhancedPacketBlock   = 0x00000006
+	pcapngByteOrderMagic        = 0x1A2B3C4D
+	pcapngLinkTypeEthernet      = 1
+	pcapngOptEndOfOpt           = 0
+	pcapngOptIfName             = 2
+	pcapngOptEPBFlags           = 2
+	pcapngEPBFlagInbound        = 0x1
+	pcapngEPBFlagOutbound       = 0x2
+	pcapngDefaultTimeResolution = time.Microsecond
+)
+
+// DebugPcapPath is the path on the gateway IP that serves the recently captured frames in pcapng format.
+const DebugPcapPath = "/debug/pcap"
+
+// Frame is an Ethernet frame exchanged with a VM.
+// Outbound is true if the frame is sent by the VM.
+type Frame struct {
+	Time     time.Time
+	Data     []byte
+	Outbound bool
+}
+
+// PcapngWriter writes Ethernet frames in pcapng format.
+type PcapngWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	ifNum uint32
+}
+
+// NewPcapngWriter writes the pcapng header to w and returns the writer of the frames.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // major version
+	body = binary.LittleEndian.AppendUint16(body, 0) // minor version
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0))
+	p := &PcapngWriter{w: w}
+	if err := p.writeBlock(pcapngSectionHeaderBlock, body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AddInterface adds an Ethernet interface and returns its ID.
+func (p *PcapngWriter) AddInterface(name string) (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	body := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeEthernet)
+	body = binary.LittleEndian.AppendUint16(body, 0) // reserved
+	body = binary.LittleEndian.AppendUint32(body, 0) // no snap length limit
+	body = appendPcapngOption(body, pcapngOptIfName, []byte(name))
+	body = appendPcapngOption(body, pcapngOptEndOfOpt, nil)
+	if err := p.writeBlock(pcapngInterfaceDescBlock, body); err != nil {
+		return 0, err
+	}
+	id := p.ifNum
+	p.ifNum++
+	return id, nil
+}
+
+// WriteFrame writes a frame captured on the interface.
+func (p *PcapngWriter) WriteFrame(ifID uint32, f Frame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ts := uint64(f.Time.UnixNano() / int64(pcapngDefaultTimeResolution))
+	body := binary.LittleEndian.AppendUint32(nil, ifID)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(f.Data))) // captured length
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(f.Data))) // original length
+	body = append(body, f.Data...)
+	body = append(body, make([]byte, pad4(len(f.Data)))...)
+	flags := uint32(pcapngEPBFlagInbound)
+	if f.Outbound {
+		flags = pcapngEPBFlagOutbound
+	}
+	body = appendPcapngOption(body, pcapngOptEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	body = appendPcapngOption(body, pcapngOptEndOfOpt, nil)
+	return p.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+// Capture returns the connection of a VM that records all frames exchanged over conn to the interface
+// named name. conn must use the QEMU protocol.
+func (p *PcapngWriter) Capture(conn net.Conn, name string) (net.Conn, error) {
+	ifID, err := p.AddInterface(name)
+	if err != nil {
+		return nil, err
+	}
+	return CaptureConn(conn, func(f Frame) {
+		if err := p.WriteFrame(ifID, f); err != nil {
+			log.Printf("failed to write captured frame: %v\n", err)
+		}
+	}), nil
+}
+
+func (p *PcapngWriter) writeBlock(typ uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := binary.LittleEndian.AppendUint32(nil, typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	_, err := p.w.Write(b)
+	return err
+}
+
+func appendPcapngOption(b []byte, code uint16, val []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(val)))
+	b = append(b, val...)
+	return append(b, make([]byte, pad4(len(val)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// FrameRing keeps the recently captured frames.
+type FrameRing struct {
+	mu     sync.Mutex
+	frames []Frame
+	next   int
+	full   bool
+}
+
+// NewFrameRing returns a ring keeping the last size frames.
+func NewFrameRing(size int) *FrameRing {
+	return &FrameRing{frames: make([]Frame, size)}
+}
+
+// Add adds the frame to the ring, dropping the oldest one if the ring is full.
+func (r *FrameRing) Add(f Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames[r.next] = f
+	r.next = (r.next + 1) % len(r.frames)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// ServeHTTP serves the frames in the ring in pcapng format.
+func (r *FrameRing) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	frames := append([]Frame{}, r.frames[:r.next]...)
+	if r.full {
+		frames = append(append([]Frame{}, r.frames[r.next:]...), frames...)
+	}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", `attachment; filename="c2w.pcapng"`)
+	p, err := NewPcapngWriter(w)
+	if err != nil {
+		log.Printf("failed to write pcapng: %v\n", err)
+		return
+	}
+	ifID, err := p.AddInterface("vm")
+	if err != nil {
+		log.Printf("failed to write pcapng: %v\n", err)
+		return
+	}
+	for _, f := range frames {
+		if err := p.WriteFrame(ifID, f); err != nil {
+			log.Printf("failed to write pcapng: %v\n", err)
+			return
+		}
+	}
+}
+
+// FrameSplitter splits the stream of the QEMU protocol (4 bytes length header followed by an ethernet frame)
+// into frames and passes them to OnFrame. Frames larger than MaxFrameSize are skipped without being buffered.
+type FrameSplitter struct {
+	OnFrame func(frame []byte)
+
+	buf  []byte
+	skip uint32 // remaining bytes of the skipped frame
+}
+
+// Write passes the frames completed by b to OnFrame.
+func (s *FrameSplitter) Write(b []byte) {
+	for len(b) > 0 {
+		if s.skip > 0 {
+			if uint64(len(b)) <= uint64(s.skip) {
+				s.skip -= uint32(len(b))
+				return
+			}
+			b = b[s.skip:]
+			s.skip = 0
+		}
+		s.buf = append(s.buf, b...)
+		b = nil
+		for len(s.buf) >= 4 {
+			size := binary.BigEndian.Uint32(s.buf)
+			if size > MaxFrameSize {
+				log.Printf("skipping frame of size %d exceeding the limit %d\n", size, MaxFrameSize)
+				s.skip = size
+				b = s.buf[4:]
+				s.buf = nil
+				break
+			}
+			if len(s.buf) < 4+int(size) {
+				break
+			}
+			s.OnFrame(s.buf[4 : 4+size])
+			s.buf = s.buf[4+size:]
+		}
+	}
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+}
+
+// Pending returns true if a frame is partially written.
+func (s *FrameSplitter) Pending() bool {
+	return len(s.buf) > 0 || s.skip > 0
+}
+
+// CaptureConn returns the connection of a VM that passes all frames exchanged over conn to onFrame.
+// conn must use the QEMU protocol.
+func CaptureConn(conn net.Conn, onFrame func(Frame)) net.Conn {
+	record := func(outbound bool) func([]byte) {
+		return func(frame []byte) {
+			onFrame(Frame{
+				Time:     time.Now(),
+				Data:     append([]byte{}, frame...),
+				Outbound: outbound,
+			})
+		}
+	}
+	return &captureConn{
+		Conn: conn,
+		rx:   FrameSplitter{OnFrame: record(true)},
+		tx:   FrameSplitter{OnFrame: record(false)},
+	}
+}
+
+type captureConn struct {
+	net.Conn
+
+	rMu sync.Mutex
+	rx  FrameSplitter // frames sent by the VM
+
+	wMu sync.Mutex
+	tx  FrameSplitter // frames sent to the VM
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rMu.Lock()
+	c.rx.Write(b[:n])
+	c.rMu.Unlock()
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.wMu.Lock()
+	c.tx.Write(b[:n])
+	c.wMu.Unlock()
+	return n, err
+}
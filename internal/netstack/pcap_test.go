@@ -0,0 +1,187 @@
+package netstack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func qemuFrame(data []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+func TestFrameSplitter(t *testing.T) {
+	var got [][]byte
+	s := FrameSplitter{OnFrame: func(frame []byte) {
+		got = append(got, append([]byte{}, frame...))
+	}}
+
+	stream := append(qemuFrame([]byte("first")), qemuFrame([]byte("second"))...)
+	for _, b := range stream[:7] {
+		s.Write([]byte{b})
+	}
+	if !s.Pending() {
+		t.Fatalf("partially written frame must be pending")
+	}
+	s.Write(stream[7:])
+	if s.Pending() {
+		t.Fatalf("no frame must be pending")
+	}
+	if len(got) != 2 || string(got[0]) != "first" || string(got[1]) != "second" {
+		t.Fatalf("unexpected frames %q", got)
+	}
+}
+
+func TestFrameSplitterOversized(t *testing.T) {
+	var got [][]byte
+	s := FrameSplitter{OnFrame: func(frame []byte) {
+		got = append(got, append([]byte{}, frame...))
+	}}
+
+	big := make([]byte, MaxFrameSize+1)
+	stream := append(qemuFrame(big), qemuFrame([]byte("next"))...)
+	for len(stream) > 0 {
+		n := min(len(stream), 1000)
+		s.Write(stream[:n])
+		stream = stream[n:]
+		if len(s.buf) > 1000 {
+			t.Fatalf("oversized frame must not be buffered (buffered %d bytes)", len(s.buf))
+		}
+	}
+	if len(got) != 1 || string(got[0]) != "next" {
+		t.Fatalf("unexpected frames %q", got)
+	}
+
+	// The header claiming the largest size must not make the splitter buffer the following bytes.
+	s.Write(binary.BigEndian.AppendUint32(nil, 0xFFFFFFFF))
+	s.Write(make([]byte, 1<<20))
+	if len(s.buf) != 0 || !s.Pending() {
+		t.Fatalf("oversized frame must be skipped (buffered %d bytes)", len(s.buf))
+	}
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	p, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifID, err := p.AddInterface("vm0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456000)
+	if err := p.WriteFrame(ifID, Frame{Time: ts, Data: []byte("abcde"), Outbound: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteFrame(ifID, Frame{Time: ts, Data: []byte("fghi")}); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readPcapngBlocks(t, buf.Bytes())
+	if len(blocks) != 4 {
+		t.Fatalf("got %d blocks; want 4", len(blocks))
+	}
+
+	if blocks[0].typ != pcapngSectionHeaderBlock || binary.LittleEndian.Uint32(blocks[0].body) != pcapngByteOrderMagic {
+		t.Fatalf("invalid section header block %x", blocks[0].body)
+	}
+	idb := blocks[1].body
+	if blocks[1].typ != pcapngInterfaceDescBlock || binary.LittleEndian.Uint16(idb) != pcapngLinkTypeEthernet {
+		t.Fatalf("invalid interface description block %x", idb)
+	}
+	if opt := idb[8:]; binary.LittleEndian.Uint16(opt) != pcapngOptIfName || string(opt[4:4+binary.LittleEndian.Uint16(opt[2:])]) != "vm0" {
+		t.Fatalf("invalid interface name option %x", opt)
+	}
+
+	for i, want := range []struct {
+		data  string
+		flags uint32
+	}{
+		{"abcde", pcapngEPBFlagOutbound},
+		{"fghi", pcapngEPBFlagInbound},
+	} {
+		epb := blocks[2+i].body
+		if blocks[2+i].typ != pcapngEnhancedPacketBlock {
+			t.Fatalf("block %d: type %x; want enhanced packet block", 2+i, blocks[2+i].typ)
+		}
+		if id := binary.LittleEndian.Uint32(epb); id != ifID {
+			t.Fatalf("frame %d: interface %d; want %d", i, id, ifID)
+		}
+		gotTS := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+		if wantTS := uint64(ts.UnixMicro()); gotTS != wantTS {
+			t.Fatalf("frame %d: timestamp %d; want %d", i, gotTS, wantTS)
+		}
+		capLen, origLen := binary.LittleEndian.Uint32(epb[12:]), binary.LittleEndian.Uint32(epb[16:])
+		if int(capLen) != len(want.data) || int(origLen) != len(want.data) {
+			t.Fatalf("frame %d: lengths %d/%d; want %d", i, capLen, origLen, len(want.data))
+		}
+		if data := string(epb[20 : 20+capLen]); data != want.data {
+			t.Fatalf("frame %d: data %q; want %q", i, data, want.data)
+		}
+		opt := epb[20+int(capLen)+pad4(int(capLen)):]
+		if binary.LittleEndian.Uint16(opt) != pcapngOptEPBFlags || binary.LittleEndian.Uint32(opt[4:]) != want.flags {
+			t.Fatalf("frame %d: invalid flags option %x", i, opt)
+		}
+	}
+}
+
+type pcapngBlock struct {
+	typ  uint32
+	body []byte
+}
+
+func readPcapngBlocks(t *testing.T, b []byte) (blocks []pcapngBlock) {
+	t.Helper()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block %x", b)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		total := binary.LittleEndian.Uint32(b[4:])
+		if total%4 != 0 || int(total) > len(b) {
+			t.Fatalf("invalid block length %d", total)
+		}
+		if trailer := binary.LittleEndian.Uint32(b[total-4:]); trailer != total {
+			t.Fatalf("block length %d doesn't match the trailer %d", total, trailer)
+		}
+		blocks = append(blocks, pcapngBlock{typ, b[8 : total-4]})
+		b = b[total:]
+	}
+	return blocks
+}
+
+func TestFrameRing(t *testing.T) {
+	r := NewFrameRing(3)
+	frames := func() (res []string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", DebugPcapPath, nil))
+		for _, b := range readPcapngBlocks(t, w.Body.Bytes()) {
+			if b.typ == pcapngEnhancedPacketBlock {
+				res = append(res, string(b.body[20:20+binary.LittleEndian.Uint32(b.body[12:])]))
+			}
+		}
+		return res
+	}
+	check := func(want ...string) {
+		t.Helper()
+		if got := frames(); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("frames %q; want %q", got, want)
+		}
+	}
+
+	check()
+	for _, f := range []string{"a", "b"} {
+		r.Add(Frame{Time: time.Now(), Data: []byte(f)})
+	}
+	check("a", "b")
+	for _, f := range []string{"c", "d", "e"} {
+		r.Add(Frame{Time: time.Now(), Data: []byte(f)})
+	}
+	check("c", "d", "e")
+	r.Add(Frame{Time: time.Now(), Data: []byte("f")})
+	check("d", "e", "f")
+}
@@ -0,0 +1,200 @@
+package netstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Rule is an allow or deny rule applied to the requests or the connections from the container.
+type Rule struct {
+	allow bool
+	raw   string
+
+	// Either of ipnet or host is set. Both are empty if the rule matches any destination.
+	ipnet *net.IPNet
+	host  string // "*.example.com" matches subdomains of example.com
+
+	port string // empty matches any port
+}
+
+// ParseRule parses a rule formatted as "TARGET[:PORT]".
+// TARGET is a CIDR, an IP address, a hostname, "*.DOMAIN" or "*".
+// IPv6 address must be enclosed by brackets.
+func ParseRule(s string, allow bool) (r Rule, _ error) {
+	r.allow, r.raw = allow, s
+	target := s
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "]")
+		if i < 0 || (i+1 != len(s) && s[i+1] != ':') {
+			return r, fmt.Errorf("invalid rule %q: must be TARGET[:PORT]", s)
+		}
+		target, r.port = s[1:i], strings.TrimPrefix(s[i+1:], ":")
+	} else if c := strings.Count(s, ":"); c > 1 {
+		return r, fmt.Errorf("invalid rule %q: IPv6 address must be enclosed by brackets", s)
+	} else if c == 1 {
+		target, r.port, _ = strings.Cut(s, ":")
+	}
+	if r.port != "" {
+		if p, err := strconv.ParseUint(r.port, 10, 16); err != nil || p == 0 {
+			return r, fmt.Errorf("invalid port in rule %q", s)
+		}
+	}
+	switch {
+	case target == "*":
+	case strings.Contains(target, "/"):
+		_, ipnet, err := net.ParseCIDR(target)
+		if err != nil {
+			return r, fmt.Errorf("invalid CIDR in rule %q: %w", s, err)
+		}
+		r.ipnet = ipnet
+	case net.ParseIP(target) != nil:
+		ip := net.ParseIP(target)
+		r.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	case target != "":
+		r.host = strings.ToLower(strings.TrimSuffix(target, "."))
+	default:
+		return r, fmt.Errorf("invalid rule %q: empty target", s)
+	}
+	return r, nil
+}
+
+// Allowed returns true if the rule is an allow rule.
+func (r Rule) Allowed() bool { return r.allow }
+
+// String returns the rule as specified to ParseRule.
+func (r Rule) String() string { return r.raw }
+
+// match returns true if the rule matches the destination. host is the IP address or the lowercased
+// hostname of the destination. names are the lowercased DNS names of the IP address; they are matched
+// only against the hostname rules.
+func (r Rule) match(host, port string, names ...string) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+	if r.ipnet != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.ipnet.Contains(ip)
+	}
+	if r.host != "" {
+		for _, n := range append([]string{host}, names...) {
+			if n == r.host || (strings.HasPrefix(r.host, "*.") && strings.HasSuffix(n, r.host[1:])) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// MatchRule returns the first rule in rules matching the destination (see Rule.match).
+// It returns false if no rule matches.
+func MatchRule(rules []Rule, host, port string, names ...string) (Rule, bool) {
+	for _, r := range rules {
+		if r.match(host, port, names...) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// RuleFlag is a flag that appends allow (Allow is true) or deny rules to Rules.
+type RuleFlag struct {
+	Rules *[]Rule
+	Allow bool
+}
+
+func (f *RuleFlag) String() string { return "" }
+
+func (f *RuleFlag) Set(value string) error {
+	r, err := ParseRule(value, f.Allow)
+	if err != nil {
+		return err
+	}
+	*f.Rules = append(*f.Rules, r)
+	return nil
+}
+
+// Policy decides whether the requests from the container are allowed.
+type Policy struct {
+	// rules are evaluated in order and the first matching rule is applied.
+	rules []Rule
+	// defaultAllow is false if any allow rule is specified.
+	defaultAllow bool
+	limiter      *rate.Limiter
+	auditMu      sync.Mutex
+	audit        io.Writer
+}
+
+// NewPolicy returns the policy applying rules. requestRate limits the number of requests per second
+// (0 means unlimited). The blocked requests are recorded to audit as JSON lines if audit isn't nil.
+func NewPolicy(rules []Rule, requestRate float64, audit io.Writer) *Policy {
+	p := &Policy{rules: rules, defaultAllow: true, audit: audit}
+	for _, r := range rules {
+		if r.allow {
+			p.defaultAllow = false
+		}
+	}
+	if requestRate > 0 {
+		p.limiter = rate.NewLimiter(rate.Limit(requestRate), max(int(requestRate), 1))
+	}
+	return p
+}
+
+// Allow returns whether the request to u is allowed. If not allowed, the request is logged and the
+// reason is returned. nil Policy allows all requests.
+func (p *Policy) Allow(method string, u *url.URL) (bool, string) {
+	if p == nil {
+		return true, ""
+	}
+	host, port := strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	allowed, reason := p.defaultAllow, "no allow rule matched"
+	if r, ok := MatchRule(p.rules, host, port); ok {
+		allowed, reason = r.allow, fmt.Sprintf("denied by %q", r.raw)
+	}
+	if allowed && p.limiter != nil && !p.limiter.Allow() {
+		allowed, reason = false, "request rate limit exceeded"
+	}
+	if allowed {
+		return true, ""
+	}
+	p.logBlocked(method, net.JoinHostPort(host, port), reason)
+	return false, reason
+}
+
+func (p *Policy) logBlocked(method, dst, reason string) {
+	log.Printf("blocked %s %s: %s\n", method, dst, reason)
+	if p.audit == nil {
+		return
+	}
+	d, err := json.Marshal(struct {
+		Time   time.Time `json:"time"`
+		Method string    `json:"method"`
+		Dst    string    `json:"dst"`
+		Reason string    `json:"reason"`
+	}{time.Now(), method, dst, reason})
+	if err != nil {
+		log.Printf("failed to marshal audit log: %v\n", err)
+		return
+	}
+	p.auditMu.Lock()
+	defer p.auditMu.Unlock()
+	if _, err := p.audit.Write(append(d, '\n')); err != nil {
+		log.Printf("failed to write audit log: %v\n", err)
+	}
+}
@@ -0,0 +1,179 @@
+package netstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, s := range []string{
+		"*",
+		"*:443",
+		"example.com",
+		"*.example.com:8080",
+		"10.0.0.0/8",
+		"192.168.1.1:22",
+		"[::1]",
+		"[fd00::/8]:53",
+	} {
+		r, err := ParseRule(s, true)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if r.String() != s || !r.Allowed() {
+			t.Errorf("%q: parsed as %q (allowed: %v)", s, r.String(), r.Allowed())
+		}
+	}
+	for _, s := range []string{
+		"",
+		":80",
+		"::1",
+		"[::1",
+		"[::1]x",
+		"example.com:0",
+		"example.com:http",
+		"example.com:65536",
+		"10.0.0.0/33",
+	} {
+		if _, err := ParseRule(s, false); err == nil {
+			t.Errorf("%q must be invalid", s)
+		}
+	}
+}
+
+func mustParseRules(t *testing.T, allow bool, ss ...string) (rules []Rule) {
+	t.Helper()
+	for _, s := range ss {
+		r, err := ParseRule(s, allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func TestMatchRule(t *testing.T) {
+	rules := append(
+		mustParseRules(t, false, "evil.example.com", "10.0.0.1"),
+		mustParseRules(t, true, "*.example.com:443", "10.0.0.0/8", "[fd00::/8]:53")...,
+	)
+	for _, tt := range []struct {
+		host, port string
+		names      []string
+		want       string // empty if no rule matches
+	}{
+		{host: "evil.example.com", port: "443", want: "evil.example.com"},
+		{host: "www.example.com", port: "443", want: "*.example.com:443"},
+		{host: "www.example.com", port: "80"},
+		{host: "example.com", port: "443"},
+		{host: "10.0.0.1", port: "80", want: "10.0.0.1"},
+		{host: "10.1.2.3", port: "80", want: "10.0.0.0/8"},
+		{host: "fd00::1", port: "53", want: "[fd00::/8]:53"},
+		{host: "fd00::1", port: "80"},
+		// DNS names of the IP address are matched against hostname rules only.
+		{host: "192.168.0.1", port: "443", names: []string{"www.example.com"}, want: "*.example.com:443"},
+		{host: "192.168.0.1", port: "443", names: []string{"10.0.0.1"}},
+	} {
+		r, ok := MatchRule(rules, tt.host, tt.port, tt.names...)
+		if got := r.String(); ok != (tt.want != "") || got != tt.want {
+			t.Errorf("%s:%s %v: matched %q (%v); want %q", tt.host, tt.port, tt.names, got, ok, tt.want)
+		}
+	}
+}
+
+func TestRuleFlag(t *testing.T) {
+	var rules []Rule
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&RuleFlag{Rules: &rules, Allow: true}, "allow", "")
+	fs.Var(&RuleFlag{Rules: &rules, Allow: false}, "deny", "")
+	if err := fs.Parse([]string{"--deny=a.example.com", "--allow=*.example.com", "--deny=*"}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range rules {
+		got = append(got, r.String()+" "+map[bool]string{true: "allow", false: "deny"}[r.Allowed()])
+	}
+	if want := "a.example.com deny,*.example.com allow,* deny"; strings.Join(got, ",") != want {
+		t.Errorf("rules %q; want %q", strings.Join(got, ","), want)
+	}
+	if err := fs.Parse([]string{"--allow=[::1"}); err == nil {
+		t.Errorf("invalid rule must be rejected")
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestPolicy(t *testing.T) {
+	var audit bytes.Buffer
+	p := NewPolicy(append(
+		mustParseRules(t, false, "bad.example.com"),
+		mustParseRules(t, true, "*.example.com:443", "example.org")...,
+	), 0, &audit)
+
+	for _, tt := range []struct {
+		u    string
+		want bool
+	}{
+		{"https://www.example.com/", true},
+		{"https://WWW.EXAMPLE.COM./", true},
+		{"http://www.example.com/", false},
+		{"https://bad.example.com/", false},
+		{"http://example.org:8080/", true},
+		{"https://other.test/", false}, // an allow rule exists so the others are denied
+	} {
+		if ok, reason := p.Allow("GET", mustParseURL(t, tt.u)); ok != tt.want {
+			t.Errorf("%s: allowed %v (%s); want %v", tt.u, ok, reason, tt.want)
+		}
+	}
+
+	dec := json.NewDecoder(&audit)
+	var blocked []string
+	for dec.More() {
+		var e struct {
+			Method string `json:"method"`
+			Dst    string `json:"dst"`
+			Reason string `json:"reason"`
+		}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		blocked = append(blocked, e.Method+" "+e.Dst+" "+e.Reason)
+	}
+	want := []string{
+		"GET www.example.com:80 no allow rule matched",
+		`GET bad.example.com:443 denied by "bad.example.com"`,
+		"GET other.test:443 no allow rule matched",
+	}
+	if strings.Join(blocked, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit log:\n%s\nwant:\n%s", strings.Join(blocked, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPolicyRequestRate(t *testing.T) {
+	p := NewPolicy(nil, 1, nil)
+	u := mustParseURL(t, "http://example.com/")
+	if ok, reason := p.Allow("GET", u); !ok {
+		t.Fatalf("first request must be allowed: %s", reason)
+	}
+	if ok, _ := p.Allow("GET", u); ok {
+		t.Fatalf("request exceeding the rate must be denied")
+	}
+
+	var nilPolicy *Policy
+	if ok, _ := nilPolicy.Allow("GET", u); !ok {
+		t.Fatalf("nil policy must allow all requests")
+	}
+}
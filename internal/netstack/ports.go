@@ -0,0 +1,103 @@
+package netstack
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+)
+
+// PortForward is a port forward from the host to a VM.
+type PortForward struct {
+	// Proto is gvntypes.TCP or gvntypes.UDP.
+	Proto gvntypes.TransportProtocol
+	// HostAddr is the address (IP:PORT) listened on the host.
+	HostAddr string
+	// GuestPort is the port of the VM that the connections are forwarded to.
+	GuestPort string
+}
+
+// Local returns the host address used as the key of WithForwards ("udp:" prefix for UDP).
+func (f PortForward) Local() string {
+	if f.Proto == gvntypes.UDP {
+		return "udp:" + f.HostAddr
+	}
+	return f.HostAddr
+}
+
+// ParsePortForward parses a port forward formatted as "[IP:]HOSTPORT:GUESTPORT[/PROTO]".
+// IP defaults to 0.0.0.0 and IPv6 address must be enclosed by brackets (e.g. "[::1]:8080:80").
+// PROTO is tcp (default) or udp.
+func ParsePortForward(s string) (f PortForward, _ error) {
+	m, proto, err := cutProto(s)
+	if err != nil {
+		return f, err
+	}
+	i := strings.LastIndex(m, ":")
+	if i < 0 {
+		return f, fmt.Errorf("invalid port mapping %q: must be [IP:]PORT1:PORT2[/PROTO]", s)
+	}
+	hostAddr, err := parseHostAddr(m[:i])
+	if err != nil {
+		return f, fmt.Errorf("invalid port mapping %q: %w", s, err)
+	}
+	guestPort := m[i+1:]
+	if err := checkPort(guestPort); err != nil {
+		return f, fmt.Errorf("invalid guest port in %q: %w", s, err)
+	}
+	return PortForward{Proto: proto, HostAddr: hostAddr, GuestPort: guestPort}, nil
+}
+
+// ParseHostAddr parses the host address of a port forward formatted as "[IP:]HOSTPORT[/PROTO]".
+func ParseHostAddr(s string) (proto gvntypes.TransportProtocol, hostAddr string, _ error) {
+	m, proto, err := cutProto(s)
+	if err != nil {
+		return "", "", err
+	}
+	hostAddr, err = parseHostAddr(m)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	return proto, hostAddr, nil
+}
+
+func parseHostAddr(s string) (string, error) {
+	if !strings.Contains(s, ":") {
+		// PORT
+		if err := checkPort(s); err != nil {
+			return "", err
+		}
+		return net.JoinHostPort("0.0.0.0", s), nil
+	}
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", fmt.Errorf("IPv6 address must be enclosed by brackets: %w", err)
+	}
+	if err := checkPort(port); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+func checkPort(p string) error {
+	if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid port %q", p)
+	}
+	return nil
+}
+
+// cutProto cuts "/tcp" or "/udp" suffix of s. The protocol defaults to TCP.
+func cutProto(s string) (_ string, proto gvntypes.TransportProtocol, _ error) {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return s, gvntypes.TCP, nil
+	}
+	switch p := gvntypes.TransportProtocol(s[i+1:]); p {
+	case gvntypes.TCP, gvntypes.UDP:
+		return s[:i], p, nil
+	default:
+		return "", "", fmt.Errorf("unsupported protocol %q in %q (must be tcp or udp)", p, s)
+	}
+}
@@ -0,0 +1,58 @@
+package netstack
+
+import (
+	"testing"
+
+	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+)
+
+func TestParsePortForward(t *testing.T) {
+	for _, tt := range []struct {
+		s     string
+		want  PortForward
+		local string
+	}{
+		{"8080:80", PortForward{gvntypes.TCP, "0.0.0.0:8080", "80"}, "0.0.0.0:8080"},
+		{"127.0.0.1:8080:80", PortForward{gvntypes.TCP, "127.0.0.1:8080", "80"}, "127.0.0.1:8080"},
+		{"localhost:8000:80/tcp", PortForward{gvntypes.TCP, "localhost:8000", "80"}, "localhost:8000"},
+		{"[::1]:5353:53/udp", PortForward{gvntypes.UDP, "[::1]:5353", "53"}, "udp:[::1]:5353"},
+	} {
+		f, err := ParsePortForward(tt.s)
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if f != tt.want || f.Local() != tt.local {
+			t.Errorf("%q: parsed as %+v (local %q); want %+v (local %q)", tt.s, f, f.Local(), tt.want, tt.local)
+		}
+	}
+	for _, s := range []string{
+		"80",
+		"8080:0",
+		"8080:http",
+		"0:80",
+		"::1:8080:80",
+		"8080:80/sctp",
+		"127.0.0.1:70000:80",
+	} {
+		if _, err := ParsePortForward(s); err == nil {
+			t.Errorf("%q must be invalid", s)
+		}
+	}
+}
+
+func TestParseHostAddr(t *testing.T) {
+	proto, addr, err := ParseHostAddr("[::1]:8080/udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto != gvntypes.UDP || addr != "[::1]:8080" {
+		t.Errorf("parsed as %s %s; want udp [::1]:8080", proto, addr)
+	}
+	if _, addr, err := ParseHostAddr("8080"); err != nil || addr != "0.0.0.0:8080" {
+		t.Errorf("parsed as %s (%v); want 0.0.0.0:8080", addr, err)
+	}
+	if _, _, err := ParseHostAddr("::1:8080"); err == nil {
+		t.Errorf("unbracketed IPv6 address must be invalid")
+	}
+}
@@ -0,0 +1,450 @@
+package netstack
+
+import (
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultLeafCertValidity is the default validity period of the certificates generated for the destinations.
+const DefaultLeafCertValidity = 365 * 24 * time.Hour
+
+// maxCachedCerts is the max number of the certificates cached by the proxy.
+const maxCachedCerts = 1024
+
+// Proxy is the HTTP(S) proxy that serves the requests from the container using a transport
+// (e.g. FetchTransport). HTTPS requests are terminated with the certificates signed by the proxy's CA
+// (man-in-the-middle) and re-sent by the transport.
+type Proxy struct {
+	transport        http.RoundTripper
+	caCert           *x509.Certificate
+	caKey            crypto.PrivateKey
+	leafCertValidity time.Duration
+	policy           *Policy
+	frameRing        *FrameRing
+
+	certCache   map[string]*list.Element // values are *cachedCert
+	certLRU     *list.List               // front is the most recently used
+	maxCerts    int
+	certCacheMu sync.Mutex
+
+	// tunnels passes the connections of the tunnels established by CONNECT to the tunnel server.
+	tunnels *listener
+}
+
+// ProxyOption configures the proxy.
+type ProxyOption func(*Proxy)
+
+// WithCA makes the proxy sign the certificates with the CA. A CA is generated if not specified.
+func WithCA(cert *x509.Certificate, key crypto.PrivateKey) ProxyOption {
+	return func(p *Proxy) {
+		p.caCert, p.caKey = cert, key
+	}
+}
+
+// WithLeafCertValidity sets the validity period of the certificates generated for the destinations.
+func WithLeafCertValidity(d time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		p.leafCertValidity = d
+	}
+}
+
+// WithPolicy applies the policy to the requests.
+func WithPolicy(policy *Policy) ProxyOption {
+	return func(p *Proxy) {
+		p.policy = policy
+	}
+}
+
+// WithFrameRing serves the frames of the ring at http://GatewayIP/DebugPcapPath via the proxy.
+func WithFrameRing(r *FrameRing) ProxyOption {
+	return func(p *Proxy) {
+		p.frameRing = r
+	}
+}
+
+// NewProxy returns the proxy sending the requests using transport.
+func NewProxy(transport http.RoundTripper, opts ...ProxyOption) (*Proxy, error) {
+	p := &Proxy{
+		transport:        transport,
+		leafCertValidity: DefaultLeafCertValidity,
+		certCache:        make(map[string]*list.Element),
+		certLRU:          list.New(),
+		maxCerts:         maxCachedCerts,
+		tunnels:          newListener(&stringAddr{"tcp", ProxyIP + ":443"}),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	if p.leafCertValidity <= 0 {
+		return nil, fmt.Errorf("leaf certificate validity must be positive")
+	}
+	if p.caCert == nil {
+		var err error
+		if p.caCert, p.caKey, err = GenerateCA(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// CACert returns the CA certificate that needs to be trusted by the container.
+func (p *Proxy) CACert() *x509.Certificate {
+	return p.caCert
+}
+
+// Serve serves the proxy on ProxyIP:80 (HTTP) and ProxyIP:443 (HTTPS) of the network.
+// ProxyIP needs to be added to the network using WithVirtualIPs.
+func (p *Proxy) Serve(n *Network) error {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				p.handleTunneling(w, r)
+			} else {
+				p.handleHTTP(w, r)
+			}
+		}),
+		// Disable HTTP/2 as CONNECT requires hijacking the connection.
+		// HTTP/2 is available in the tunnels (see serveTunnels).
+		// https://pkg.go.dev/net/http#hdr-HTTP_2
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		TLSConfig: &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return p.getCert(ProxyIP)
+			},
+		},
+	}
+	httpL, err := n.Listen("tcp", ProxyIP+":80")
+	if err != nil {
+		return err
+	}
+	httpsL, err := n.Listen("tcp", ProxyIP+":443")
+	if err != nil {
+		httpL.Close()
+		return err
+	}
+	errCh := make(chan error, 3)
+	go func() {
+		errCh <- p.serveTunnels()
+	}()
+	go func() {
+		log.Println("serving proxy with http")
+		errCh <- server.Serve(httpL)
+	}()
+	go func() {
+		log.Println("serving proxy with https")
+		errCh <- server.ServeTLS(httpsL, "", "")
+	}()
+	return <-errCh
+}
+
+func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
+	serverURL := r.URL
+	if !p.allowRequest(w, r, &url.URL{Scheme: "https", Host: serverURL.Host}) {
+		return
+	}
+	if _, err := p.getCert(serverURL.Hostname()); err != nil {
+		log.Printf("failed to generate cert: %v\n", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client_conn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("serving tunnel for %s...\n", serverURL.Host)
+	if err := p.tunnels.push(&tunnelConn{client_conn, serverURL.Host}); err != nil {
+		log.Printf("failed to serve tunnel for %s: %v\n", serverURL.Host, err)
+		client_conn.Close()
+	}
+}
+
+// tunnelConn is a connection of a tunnel to host (HOST:PORT).
+type tunnelConn struct {
+	net.Conn
+	host string
+}
+
+type tunnelHostKey struct{}
+
+// serveTunnels serves the requests sent over the tunnels established by CONNECT.
+// A single server serves all tunnels so connections are kept alive and HTTP/2 is available.
+func (p *Proxy) serveTunnels() error {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Scheme == "" {
+				r.URL.Scheme = "https"
+			}
+			if host, ok := r.Context().Value(tunnelHostKey{}).(string); ok && r.URL.Host == "" {
+				r.URL.Host = host
+			}
+			p.handleHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			if tc, ok := c.(*tunnelConn); ok {
+				ctx = context.WithValue(ctx, tunnelHostKey{}, tc.host)
+			}
+			return ctx
+		},
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				tc, ok := hello.Conn.(*tunnelConn)
+				if !ok {
+					return nil, fmt.Errorf("unknown tunnel")
+				}
+				host, _, err := net.SplitHostPort(tc.host)
+				if err != nil {
+					return nil, err
+				}
+				return p.getCert(host)
+			},
+		},
+	}
+	return server.ServeTLS(p.tunnels, "", "")
+}
+
+func (p *Proxy) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	if p.frameRing != nil && req.URL.Hostname() == GatewayIP && req.URL.Path == DebugPcapPath {
+		// The container reaches the debug endpoint through the proxy when http_proxy is configured.
+		p.frameRing.ServeHTTP(w, req)
+		return
+	}
+	if !p.allowRequest(w, req, req.URL) {
+		return
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("failed to proxy request: %v\n", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// allowRequest applies the policy to the request from the container.
+// If the request isn't allowed, it responds with an error and returns false.
+func (p *Proxy) allowRequest(w http.ResponseWriter, req *http.Request, u *url.URL) bool {
+	allowed, reason := p.policy.Allow(req.Method, u)
+	if !allowed {
+		http.Error(w, "blocked by network policy: "+reason, http.StatusForbidden)
+	}
+	return allowed
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// cachedCert is the certificate cached for the host.
+type cachedCert struct {
+	host    string
+	cert    *tls.Certificate
+	renewAt time.Time
+}
+
+// getCert returns the certificate for host signed by the proxy. Certificates are cached
+// and renewed after the half of their validity period (from the issuance to NotAfter that can be
+// clamped to the expiry of the CA) passes. The least recently used certificates are evicted
+// when more than maxCerts are cached.
+func (p *Proxy) getCert(host string) (*tls.Certificate, error) {
+	p.certCacheMu.Lock()
+	defer p.certCacheMu.Unlock()
+	now := time.Now()
+	if e, ok := p.certCache[host]; ok {
+		c := e.Value.(*cachedCert)
+		if now.Before(c.renewAt) {
+			p.certLRU.MoveToFront(e)
+			return c.cert, nil
+		}
+		p.certLRU.Remove(e)
+		delete(p.certCache, host)
+	}
+	cert, err := p.generateCert(host)
+	if err != nil {
+		return nil, err
+	}
+	c := &cachedCert{host: host, cert: cert, renewAt: now.Add(cert.Leaf.NotAfter.Sub(now) / 2)}
+	p.certCache[host] = p.certLRU.PushFront(c)
+	for p.certLRU.Len() > p.maxCerts {
+		e := p.certLRU.Back()
+		p.certLRU.Remove(e)
+		delete(p.certCache, e.Value.(*cachedCert).host)
+	}
+	return cert, nil
+}
+
+func (p *Proxy) generateCert(host string) (*tls.Certificate, error) {
+	ser, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 60))
+	if err != nil {
+		return nil, err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: ser,
+		Subject: pkix.Name{
+			CommonName: host,
+		},
+		NotAfter:    time.Now().Add(p.leafCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		// IP SAN only; IP addresses (e.g. IPv6) aren't valid DNS names
+		cert.IPAddresses = append(cert.IPAddresses, ip)
+	} else {
+		cert.DNSNames = append(cert.DNSNames, host)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if cert.NotAfter.After(p.caCert.NotAfter) {
+		cert.NotAfter = p.caCert.NotAfter
+	}
+	certD, err := x509.CreateCertificate(rand.Reader, cert, p.caCert, key.Public(), p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certD)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{certD},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// GenerateCA generates a self-signed CA certificate of the proxy.
+func GenerateCA() (*x509.Certificate, crypto.PrivateKey, error) {
+	ser, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 60))
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: ser,
+		Subject: pkix.Name{
+			CommonName:         ProxyIP,
+			OrganizationalUnit: []string{"proxy"},
+			Organization:       []string{"proxy"},
+			Country:            []string{"US"},
+		},
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{ProxyIP},
+		IPAddresses:           []net.IP{net.ParseIP(ProxyIP)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	certD, err := x509.CreateCertificate(rand.Reader, cert, cert, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err = x509.ParseCertificate(certD)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// LoadCA loads the CA certificate and its private key from PEM files.
+func LoadCA(certFile, keyFile string) (*x509.Certificate, crypto.PrivateKey, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, nil, fmt.Errorf("both of CA certificate and key must be specified")
+	}
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, nil, fmt.Errorf("%q isn't a CA certificate allowed to sign certificates", certFile)
+	}
+	return cert, tlsCert.PrivateKey, nil
+}
+
+type listener struct {
+	ch        chan net.Conn
+	addr      net.Addr
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newListener(addr net.Addr) *listener {
+	return &listener{
+		ch:      make(chan net.Conn),
+		addr:    addr,
+		closeCh: make(chan struct{}),
+	}
+}
+
+// push passes the connection to Accept.
+func (l *listener) push(c net.Conn) error {
+	select {
+	case l.ch <- c:
+		return nil
+	case <-l.closeCh:
+		return fmt.Errorf("closed")
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.closeCh:
+		return nil, fmt.Errorf("closed")
+	}
+}
+
+func (l *listener) Close() error { l.closeOnce.Do(func() { close(l.closeCh) }); return nil }
+
+func (l *listener) Addr() net.Addr { return l.addr }
+
+type stringAddr struct {
+	network string
+	address string
+}
+
+func (a *stringAddr) Network() string { return a.network }
+func (a *stringAddr) String() string  { return a.address }
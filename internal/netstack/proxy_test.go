@@ -0,0 +1,156 @@
+package netstack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyCertCache(t *testing.T) {
+	const validity = 2 * time.Second
+	p, err := NewProxy(nil, WithLeafCertValidity(validity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CACert())
+
+	cert, err := p.getCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+		t.Fatalf("certificate isn't valid for the host: %v", err)
+	}
+	if cached, err := p.getCert("example.com"); err != nil || cached != cert {
+		t.Fatalf("certificate must be cached (err: %v)", err)
+	}
+
+	ipCert, err := p.getCert("::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipCert == cert || len(ipCert.Leaf.DNSNames) != 0 || len(ipCert.Leaf.IPAddresses) != 1 || !ipCert.Leaf.IPAddresses[0].Equal(net.ParseIP("::1")) {
+		t.Fatalf("certificate for IP address must have the IP SAN only: %v %v", ipCert.Leaf.DNSNames, ipCert.Leaf.IPAddresses)
+	}
+
+	// The certificate is renewed after the half of the validity period.
+	time.Sleep(validity/2 + 100*time.Millisecond)
+	renewed, err := p.getCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == cert {
+		t.Fatalf("certificate must be renewed")
+	}
+	if !renewed.Leaf.NotAfter.After(cert.Leaf.NotAfter) {
+		t.Fatalf("renewed certificate expires at %v; must be after %v", renewed.Leaf.NotAfter, cert.Leaf.NotAfter)
+	}
+}
+
+func TestProxyCertValidity(t *testing.T) {
+	if _, err := NewProxy(nil, WithLeafCertValidity(-time.Second)); err == nil {
+		t.Fatalf("non-positive validity must be rejected")
+	}
+
+	caCert, caKey, err := GenerateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(nil, WithCA(caCert, caKey), WithLeafCertValidity(100*365*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := p.getCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.NotAfter.After(caCert.NotAfter) {
+		t.Fatalf("certificate expires at %v after the CA (%v)", cert.Leaf.NotAfter, caCert.NotAfter)
+	}
+}
+
+func TestProxyCertCacheClampedValidity(t *testing.T) {
+	// The certificates are clamped to the CA expiring soon so they're renewed by their own validity period.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotAfter:              time.Now().Add(4 * time.Second),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(nil, WithCA(caCert, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := p.getCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Leaf.NotAfter.Equal(caCert.NotAfter) {
+		t.Fatalf("certificate expires at %v; must be clamped to %v", cert.Leaf.NotAfter, caCert.NotAfter)
+	}
+	if cached, err := p.getCert("example.com"); err != nil || cached != cert {
+		t.Fatalf("clamped certificate must be cached (err: %v)", err)
+	}
+	time.Sleep(time.Until(cert.Leaf.NotAfter)/2 + 100*time.Millisecond)
+	if renewed, err := p.getCert("example.com"); err != nil || renewed == cert {
+		t.Fatalf("certificate must be renewed after the half of its validity period (err: %v)", err)
+	}
+}
+
+func TestProxyCertCacheEvict(t *testing.T) {
+	p, err := NewProxy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.maxCerts = 2
+	certs := make(map[string]*tls.Certificate)
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com", "c.example.com"} {
+		cert, err := p.getCert(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs[host] = cert
+	}
+	if len(p.certCache) != 2 || p.certLRU.Len() != 2 {
+		t.Fatalf("unexpected number of cached certificates %d, %d; want 2", len(p.certCache), p.certLRU.Len())
+	}
+	// a.example.com was used more recently than b.example.com so b.example.com is evicted.
+	for _, tt := range []struct {
+		host       string
+		wantCached bool
+	}{
+		{"a.example.com", true},
+		{"c.example.com", true},
+		{"b.example.com", false},
+	} {
+		cert, err := p.getCert(tt.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached := cert == certs[tt.host]; cached != tt.wantCached {
+			t.Errorf("certificate of %q cached: %v; want %v", tt.host, cached, tt.wantCached)
+		}
+	}
+}
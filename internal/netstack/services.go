@@ -0,0 +1,178 @@
+package netstack
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dhcp"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/forwarder"
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	"github.com/containers/gvisor-tap-vsock/pkg/tcpproxy"
+	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// addServices adds the forwarders of the connections from the VMs to the host, the DNS and DHCP servers
+// and the port forwards from the host to the VMs. It returns the handler of the services API.
+func addServices(config *gvntypes.Configuration, s *stack.Stack, ipPool *tap.IPPool) (http.Handler, error) {
+	nat := make(map[tcpip.Address]string)
+	for src, dst := range config.NAT {
+		nat[tcpipAddr(net.ParseIP(src))] = dst
+	}
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder(s, nat).HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder(s, nat).HandlePacket)
+
+	dnsMux, err := serveDNS(s, []string{config.GatewayIP, GatewayIP6}, config.DNS)
+	if err != nil {
+		return nil, err
+	}
+	dhcpServer, err := dhcp.New(config, s, ipPool)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		log.Printf("DHCP server stopped: %v\n", dhcpServer.Serve())
+	}()
+	fw := forwarder.NewPortsForwarder(s)
+	for local, remote := range config.Forwards {
+		proto := gvntypes.TCP
+		if l, ok := strings.CutPrefix(local, "udp:"); ok {
+			proto, local = gvntypes.UDP, l
+		}
+		if err := fw.Expose(proto, local, remote); err != nil {
+			return nil, err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/forwarder/", http.StripPrefix("/forwarder", fw.Mux()))
+	mux.Handle("/dhcp/", http.StripPrefix("/dhcp", dhcpServer.Mux()))
+	mux.Handle("/dns/", http.StripPrefix("/dns", dnsMux))
+	return mux, nil
+}
+
+// remoteAddr returns the host's address that the connection to addr is forwarded to.
+// The address is translated if nat has it.
+func remoteAddr(nat map[tcpip.Address]string, addr tcpip.Address, port uint16) string {
+	host := addr.String()
+	if h, ok := nat[addr]; ok {
+		host = h
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// isLinkLocal returns true if the connection to addr must not be forwarded
+// (e.g. CoreOS VM tries to connect to Amazon EC2 metadata service at 169.254.169.254).
+func isLinkLocal(addr tcpip.Address) bool {
+	return header.IsV4LinkLocalUnicastAddress(addr) || header.IsV6LinkLocalUnicastAddress(addr)
+}
+
+// tcpForwarder forwards TCP connections from the VMs to the destinations via the host.
+func tcpForwarder(s *stack.Stack, nat map[tcpip.Address]string) *tcp.Forwarder {
+	return tcp.NewForwarder(s, 0, 10, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		if isLinkLocal(id.LocalAddress) {
+			r.Complete(true)
+			return
+		}
+		outbound, err := net.Dial("tcp", remoteAddr(nat, id.LocalAddress, id.LocalPort))
+		if err != nil {
+			r.Complete(true)
+			return
+		}
+		var wq waiter.Queue
+		ep, tcpErr := r.CreateEndpoint(&wq)
+		r.Complete(false)
+		if tcpErr != nil {
+			log.Printf("failed to create endpoint of TCP forwarder: %v\n", tcpErr)
+			outbound.Close()
+			return
+		}
+		remote := tcpproxy.DialProxy{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return outbound, nil
+			},
+		}
+		remote.HandleConn(gonet.NewTCPConn(&wq, ep))
+	})
+}
+
+// udpForwarder forwards UDP packets from the VMs to the destinations via the host.
+func udpForwarder(s *stack.Stack, nat map[tcpip.Address]string) *udp.Forwarder {
+	return udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		id := r.ID()
+		if isLinkLocal(id.LocalAddress) || id.LocalAddress == header.IPv4Broadcast || header.IsV6MulticastAddress(id.LocalAddress) {
+			return
+		}
+		var wq waiter.Queue
+		ep, tcpErr := r.CreateEndpoint(&wq)
+		if tcpErr != nil {
+			log.Printf("failed to create endpoint of UDP forwarder: %v\n", tcpErr)
+			return
+		}
+		addr := remoteAddr(nat, id.LocalAddress, id.LocalPort)
+		p, err := forwarder.NewUDPProxy(&udpIdleConn{gonet.NewUDPConn(&wq, ep)}, func() (net.Conn, error) {
+			return net.Dial("udp", addr)
+		})
+		if err != nil {
+			log.Printf("failed to create UDP proxy: %v\n", err)
+			ep.Close()
+			return
+		}
+		go func() {
+			p.Run()
+			// packets sent to this flow are dropped until the next forwarder request creates a new proxy.
+			ep.Close()
+		}()
+	})
+}
+
+// udpIdleConn stops the UDP proxy when the flow is idle for forwarder.UDPConnTrackTimeout.
+type udpIdleConn struct {
+	*gonet.UDPConn
+}
+
+func (c *udpIdleConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	_ = c.SetReadDeadline(time.Now().Add(forwarder.UDPConnTrackTimeout))
+	return c.UDPConn.ReadFrom(b)
+}
+
+func (c *udpIdleConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	_ = c.SetReadDeadline(time.Now().Add(forwarder.UDPConnTrackTimeout))
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+// statsAsJSON returns the statistics in the same format as gvisor-tap-vsock.
+func statsAsJSON(sent, received uint64, stats tcpip.Stats) map[string]interface{} {
+	root := make(map[string]interface{})
+	iterateStats(root, reflect.ValueOf(stats))
+	root["BytesSent"] = sent
+	root["BytesReceived"] = received
+	return root
+}
+
+func iterateStats(ret map[string]interface{}, v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field, name := v.Field(i), v.Type().Field(i).Name
+		if field.Kind() == reflect.Struct {
+			m := make(map[string]interface{})
+			ret[name] = m
+			iterateStats(m, field)
+			continue
+		}
+		if counter, ok := field.Interface().(*tcpip.StatCounter); ok {
+			ret[name] = counter.Value()
+		}
+	}
+}
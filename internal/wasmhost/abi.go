@@ -0,0 +1,20 @@
+// Package wasmhost implements the host functions imported by c2w-net-proxy and imagemounter
+// from the "env" module on wazero.
+// The ABI is specified in docs/host-abi.md.
+package wasmhost
+
+// ABIVersion is the version of the ABI implemented by this package.
+// It's returned by the "abi_version" function.
+//
+//   - 1: initial version
+//   - 2: layer_isreadable64 and layer_readat64 (64-bit sizes and offsets of layers)
+//   - 3: cache_* (cache of the layers provided by the host)
+//   - 4: credentials_* (credentials of the registries provided by the host)
+const ABIVersion = 4
+
+// ModuleName is the name of the module that provides the host functions.
+const ModuleName = "env"
+
+// errnoInval is returned by the host functions on errors.
+// definition from wasi-libc https://github.com/WebAssembly/wasi-libc/blob/wasi-sdk-19/expected/wasm32-wasi/predefined-macros.txt
+const errnoInval = 28
@@ -0,0 +1,243 @@
+package wasmhost
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// cacheReader is an entry of the cache opened by cache_get.
+type cacheReader struct {
+	r     io.ReaderAt
+	size  int64
+	found bool
+	close func() error
+}
+
+// cacheWriter is an entry of the cache being added by cache_add.
+type cacheWriter struct {
+	io.Writer
+	commit func() error
+	abort  func() error
+}
+
+// cachePath returns the file of the entry in the cache directory.
+// Keys are hashed because they can contain any characters.
+func (h *Host) cachePath(key string) string {
+	return filepath.Join(h.cacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
+}
+
+func (h *Host) openCache(key string) (*cacheReader, error) {
+	if h.cacheDir == "" {
+		h.mu.Lock()
+		data, ok := h.cache[key]
+		h.mu.Unlock()
+		if !ok {
+			return &cacheReader{}, nil
+		}
+		return &cacheReader{r: bytes.NewReader(data), size: int64(len(data)), found: true}, nil
+	}
+	f, err := os.Open(h.cachePath(key))
+	if os.IsNotExist(err) {
+		return &cacheReader{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &cacheReader{r: f, size: fi.Size(), found: true, close: f.Close}, nil
+}
+
+func (h *Host) createCache(key string) (*cacheWriter, error) {
+	if h.cacheDir == "" {
+		var buf bytes.Buffer
+		return &cacheWriter{
+			Writer: &buf,
+			commit: func() error {
+				h.mu.Lock()
+				h.cache[key] = buf.Bytes()
+				h.mu.Unlock()
+				return nil
+			},
+			abort: func() error { return nil },
+		}, nil
+	}
+	f, err := os.CreateTemp(h.cacheDir, "wip-")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{
+		Writer: f,
+		commit: func() error {
+			if err := f.Close(); err != nil {
+				os.Remove(f.Name())
+				return err
+			}
+			return os.Rename(f.Name(), h.cachePath(key))
+		},
+		abort: func() error {
+			f.Close()
+			return os.Remove(f.Name())
+		},
+	}, nil
+}
+
+func (h *Host) cacheGet(ctx context.Context, m api.Module, keyP uint32, keylen uint32, idP uint32) uint32 {
+	keyB, ok := m.Memory().Read(keyP, keylen)
+	if !ok {
+		log.Println("failed to get cache key")
+		return errnoInval
+	}
+	r, err := h.openCache(string(keyB))
+	if err != nil {
+		log.Println("failed to open cache:", err)
+		return errnoInval
+	}
+	id := h.newID()
+	h.mu.Lock()
+	h.cacheReaders[id] = r
+	h.mu.Unlock()
+	if !writeUint32(m, idP, id, "id") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) getCacheReader(id uint32) *cacheReader {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cacheReaders[id]
+}
+
+func (h *Host) cacheIsReadable(ctx context.Context, m api.Module, id uint32, isOKP uint32, foundP uint32, sizeP uint32) uint32 {
+	r := h.getCacheReader(id)
+	if r == nil {
+		log.Println("cache entry not found:", id)
+		return errnoInval
+	}
+	if r.found && !m.Memory().WriteUint64Le(sizeP, uint64(r.size)) {
+		log.Println("failed to write cache size")
+		return errnoInval
+	}
+	if !writeUint32(m, foundP, boolToUint32(r.found), "found") {
+		return errnoInval
+	}
+	if !writeUint32(m, isOKP, 1, "status") { // lookups complete synchronously
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) cacheReadAt(ctx context.Context, m api.Module, id uint32, respP uint32, offset uint64, wantlen uint32, respsizeP uint32) uint32 {
+	r := h.getCacheReader(id)
+	if r == nil || !r.found {
+		log.Println("cache entry not available:", id)
+		return errnoInval
+	}
+	var data []byte
+	if offset < uint64(r.size) {
+		data = make([]byte, min(int64(wantlen), r.size-int64(offset)))
+		if _, err := r.r.ReadAt(data, int64(offset)); err != nil && err != io.EOF {
+			log.Println("failed to read cache:", err)
+			return errnoInval
+		}
+	}
+	if !m.Memory().Write(respP, data) {
+		log.Println("failed to write cache data")
+		return errnoInval
+	}
+	if !writeUint32(m, respsizeP, uint32(len(data)), "cache data size") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) cacheRelease(ctx context.Context, m api.Module, id uint32) uint32 {
+	h.mu.Lock()
+	r := h.cacheReaders[id]
+	delete(h.cacheReaders, id)
+	h.mu.Unlock()
+	if r == nil {
+		log.Println("cache entry not found:", id)
+		return errnoInval
+	}
+	if r.close != nil {
+		if err := r.close(); err != nil {
+			log.Println("failed to close cache:", err)
+		}
+	}
+	return 0
+}
+
+func (h *Host) cacheAdd(ctx context.Context, m api.Module, keyP uint32, keylen uint32, idP uint32) uint32 {
+	keyB, ok := m.Memory().Read(keyP, keylen)
+	if !ok {
+		log.Println("failed to get cache key")
+		return errnoInval
+	}
+	w, err := h.createCache(string(keyB))
+	if err != nil {
+		log.Println("failed to create cache:", err)
+		return errnoInval
+	}
+	id := h.newID()
+	h.mu.Lock()
+	h.cacheWriters[id] = w
+	h.mu.Unlock()
+	if !writeUint32(m, idP, id, "id") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) cacheWrite(ctx context.Context, m api.Module, id uint32, bufP uint32, buflen uint32) uint32 {
+	h.mu.Lock()
+	w := h.cacheWriters[id]
+	h.mu.Unlock()
+	if w == nil {
+		log.Println("cache entry not found:", id)
+		return errnoInval
+	}
+	buf, ok := m.Memory().Read(bufP, buflen)
+	if !ok {
+		log.Println("failed to get cache data")
+		return errnoInval
+	}
+	if _, err := w.Write(buf); err != nil {
+		log.Println("failed to write cache:", err)
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) cacheCommit(ctx context.Context, m api.Module, id uint32, commit uint32) uint32 {
+	h.mu.Lock()
+	w := h.cacheWriters[id]
+	delete(h.cacheWriters, id)
+	h.mu.Unlock()
+	if w == nil {
+		log.Println("cache entry not found:", id)
+		return errnoInval
+	}
+	if commit != 1 {
+		if err := w.abort(); err != nil {
+			log.Println("failed to abort cache:", err)
+		}
+		return 0
+	}
+	if err := w.commit(); err != nil {
+		log.Println("failed to commit cache:", err)
+		return errnoInval
+	}
+	return 0
+}
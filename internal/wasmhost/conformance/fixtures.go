@@ -0,0 +1,155 @@
+// Package conformance provides the conformance test suite of the host ABI specified in docs/host-abi.md.
+// The suite is a WASI program (./guest) that calls the host functions against the fixtures served by Handler
+// (e.g. ./server). Any host implementation (wazero, browser, etc.) can be checked by running the suite on it.
+package conformance
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Paths of the fixtures served by Handler.
+const (
+	// HelloPath responds HelloBody with the header MultiHeader that has two values ("a" and "b").
+	HelloPath = "/hello"
+
+	// EchoPath responds the request body. The value of TestHeader in the request is returned as EchoHeader.
+	EchoPath = "/echo"
+
+	// BlobPath responds Blob().
+	BlobPath = "/blob"
+
+	// GzipBlobPath responds Blob() compressed by gzip.
+	GzipBlobPath = "/blob.gz"
+
+	// LargeBlobPath responds LargeBlob().
+	LargeBlobPath = "/large"
+)
+
+// Fixture values.
+const (
+	HelloBody   = "hello"
+	MultiHeader = "X-Multi"
+	TestHeader  = "X-Test"
+	EchoHeader  = "X-Echo"
+)
+
+// Credentials of the registry checked by the suite with -credentials flag.
+// The host needs to be configured to return them for CredentialsHost.
+const (
+	CredentialsHost     = "registry.conformance.test"
+	CredentialsUsername = "conformance"
+	CredentialsPassword = "p@ss:word"
+)
+
+// blobSize isn't aligned to the buffers used by the suite for testing partial reads.
+const blobSize = 1<<20 + 123
+
+// Blob returns the deterministic data served as a layer.
+func Blob() []byte {
+	b := make([]byte, blobSize)
+	x := uint32(1)
+	for i := range b {
+		x = x*1103515245 + 12345
+		b[i] = byte(x >> 16)
+	}
+	return b
+}
+
+// LargeBlobSize is the size of LargeBlob. This exceeds 4GiB for testing 64-bit offsets.
+const LargeBlobSize = 1<<32 + 12345
+
+// LargeBlobDigest is the SHA256 digest (hex-encoded) of LargeBlob.
+// This needs to be updated when LargeBlob is changed.
+const LargeBlobDigest = "8040061ae99ff2d5ba2a7738d5deb405603d2faec54b11c3afa35a1cd00e93e4"
+
+// largeBlobMarkers are the offsets of the non-zero data in LargeBlob.
+// One straddles the 4GiB boundary.
+var largeBlobMarkers = []int64{0, 1 << 31, 1<<32 - 50, LargeBlobSize - 100}
+
+// LargeBlobMarkerSize is the size of each non-zero data in LargeBlob.
+const LargeBlobMarkerSize = 100
+
+// LargeBlobMarkers returns the offsets of the non-zero data in LargeBlob.
+func LargeBlobMarkers() []int64 {
+	return append([]int64{}, largeBlobMarkers...)
+}
+
+// LargeBlob returns the sparse data served as a large layer.
+// This is filled with zeros except LargeBlobMarkerSize bytes at each of LargeBlobMarkers.
+func LargeBlob() *io.SectionReader {
+	return io.NewSectionReader(largeBlob{}, 0, LargeBlobSize)
+}
+
+type largeBlob struct{}
+
+func (largeBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= LargeBlobSize {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), LargeBlobSize-off))
+	clear(p[:n])
+	for i, m := range largeBlobMarkers {
+		for j := max(m, off); j < min(m+LargeBlobMarkerSize, off+int64(n)); j++ {
+			p[j-off] = byte(i+1)*31 + byte(j-m)
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+var gzipBlob = sync.OnceValue(func() []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(Blob()); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+})
+
+// Handler serves the fixtures. CORS is allowed from any origin for testing hosts on browser.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HelloPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add(MultiHeader, "a")
+		w.Header().Add(MultiHeader, "b")
+		io.WriteString(w, HelloBody)
+	})
+	mux.HandleFunc(EchoPath, func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(EchoHeader, r.Header.Get(TestHeader))
+		w.Write(body)
+	})
+	mux.HandleFunc(BlobPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(Blob())
+	})
+	mux.HandleFunc(GzipBlobPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipBlob())
+	})
+	mux.HandleFunc(LargeBlobPath, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, LargeBlob())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", MultiHeader+", "+EchoHeader)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", TestHeader)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
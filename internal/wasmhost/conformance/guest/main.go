@@ -0,0 +1,818 @@
+//go:build wasip1
+
+// guest is the conformance test suite of the host ABI.
+// Run it on the host with the address of the server of the fixtures (-addr).
+// It exits with non-zero code if any check fails.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/ktock/container2wasm/internal/wasmhost/conformance"
+)
+
+//go:wasmimport env abi_version
+func abi_version() uint32
+
+//go:wasmimport env http_send
+func http_send(addressP uint32, addresslen uint32, reqP, reqlen uint32, idP uint32) uint32
+
+//go:wasmimport env http_writebody
+func http_writebody(id uint32, chunkP, len uint32, nwrittenP uint32, isEOF uint32) uint32
+
+//go:wasmimport env http_isreadable
+func http_isreadable(id uint32, isOKP uint32) uint32
+
+//go:wasmimport env http_recv
+func http_recv(id uint32, respP uint32, bufsize uint32, respsizeP uint32, isEOFP uint32) uint32
+
+//go:wasmimport env http_readbody
+func http_readbody(id uint32, bodyP uint32, bufsize uint32, bodysizeP uint32, isEOFP uint32) uint32
+
+//go:wasmimport env layer_request
+func layer_request(addressP uint32, addresslen uint32, digestP uint32, digestlen uint32, withDecompression uint32, idP uint32) uint32
+
+//go:wasmimport env layer_isreadable
+func layer_isreadable(id uint32, isOKP uint32, sizeP uint32) uint32
+
+//go:wasmimport env layer_readat
+func layer_readat(id uint32, respP uint32, offset uint32, len uint32, respsizeP uint32) uint32
+
+//go:wasmimport env layer_isreadable64
+func layer_isreadable64(id uint32, isOKP uint32, sizeP uint32) uint32
+
+//go:wasmimport env layer_readat64
+func layer_readat64(id uint32, respP uint32, offset uint64, len uint32, respsizeP uint32) uint32
+
+//go:wasmimport env decompress_init
+func decompress_init(idP uint32) uint32
+
+//go:wasmimport env decompress_write
+func decompress_write(id uint32, bufP uint32, buflen uint32, isEOF uint32) uint32
+
+//go:wasmimport env decompress_read
+func decompress_read(id uint32, bufP uint32, buflen uint32, recvLenP uint32, isEOFP uint32) uint32
+
+//go:wasmimport env cache_get
+func cache_get(keyP uint32, keylen uint32, idP uint32) uint32
+
+//go:wasmimport env cache_isreadable
+func cache_isreadable(id uint32, isOKP uint32, foundP uint32, sizeP uint32) uint32
+
+//go:wasmimport env cache_readat
+func cache_readat(id uint32, respP uint32, offset uint64, len uint32, respsizeP uint32) uint32
+
+//go:wasmimport env cache_release
+func cache_release(id uint32) uint32
+
+//go:wasmimport env cache_add
+func cache_add(keyP uint32, keylen uint32, idP uint32) uint32
+
+//go:wasmimport env cache_write
+func cache_write(id uint32, bufP uint32, buflen uint32) uint32
+
+//go:wasmimport env cache_commit
+func cache_commit(id uint32, commit uint32) uint32
+
+//go:wasmimport env credentials_get
+func credentials_get(hostP uint32, hostlen uint32, idP uint32) uint32
+
+//go:wasmimport env credentials_isreadable
+func credentials_isreadable(id uint32, isOKP uint32, foundP uint32, sizeP uint32) uint32
+
+//go:wasmimport env credentials_read
+func credentials_read(id uint32, respP uint32, bufsize uint32, respsizeP uint32) uint32
+
+//go:wasmimport env credentials_release
+func credentials_release(id uint32) uint32
+
+// minABIVersion is the oldest ABI version checked by this suite.
+// The checks of the newer versions are skipped if the host doesn't implement them.
+const minABIVersion = 1
+
+var (
+	addr    string
+	timeout time.Duration
+
+	tlsAddr string
+	tlsCA   string
+)
+
+type check struct {
+	name    string
+	version uint32 // ABI version required by the check
+	fn      func() error
+}
+
+func main() {
+	flag.StringVar(&addr, "addr", "", "address of the server of the fixtures (e.g. http://localhost:8080)")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "time to wait for a request or a layer to become readable")
+	large := flag.Bool("large", false, "check the layer larger than 4GiB (the host needs to store it)")
+	credentials := flag.Bool("credentials", false, "check the credentials of "+conformance.CredentialsHost+" (the host needs to be configured with them)")
+	flag.StringVar(&tlsAddr, "tls-addr", "", "address of the server of the fixtures over HTTPS with a certificate not trusted by the host (e.g. https://localhost:8443). The TLS configuration of the requests is checked if specified.")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM-encoded CA certificate of -tls-addr")
+	flag.Parse()
+	if addr == "" {
+		fmt.Fprintln(os.Stderr, "specify -addr")
+		os.Exit(2)
+	}
+	addr = strings.TrimSuffix(addr, "/")
+
+	checks := []check{
+		{"abi_version", 1, checkABIVersion},
+		{"http/get", 1, checkHTTPGet},
+		{"http/post", 1, checkHTTPPost},
+		{"http/status", 1, checkHTTPStatus},
+		{"layer/raw", 1, checkLayerRaw},
+		{"layer/decompression", 1, checkLayerDecompression},
+		{"layer/digest-mismatch", 1, checkLayerDigestMismatch},
+		{"layer/unknown-id", 1, checkLayerUnknownID},
+		{"decompress", 1, checkDecompress},
+		{"layer64/raw", 2, checkLayer64Raw},
+		{"cache/miss", 3, checkCacheMiss},
+		{"cache/roundtrip", 3, checkCacheRoundtrip},
+		{"cache/abort", 3, checkCacheAbort},
+		{"credentials/unknown", 4, checkCredentialsUnknown},
+	}
+	if *large {
+		checks = append(checks, check{"layer64/large", 2, checkLayer64Large})
+	}
+	if *credentials {
+		checks = append(checks, check{"credentials/found", 4, checkCredentialsFound})
+	}
+	if tlsAddr != "" {
+		checks = append(checks,
+			check{"http/tls-untrusted", 1, checkTLSUntrusted},
+			check{"http/tls-ca", 1, checkTLSCA},
+			check{"http/tls-skip-verify", 1, checkTLSSkipVerify},
+		)
+	}
+	version := abi_version()
+	failed := false
+	for _, c := range checks {
+		if version < c.version {
+			fmt.Printf("skip %s: requires ABI version %d\n", c.name, c.version)
+		} else if err := c.fn(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			failed = true
+		} else {
+			fmt.Printf("ok   %s\n", c.name)
+		}
+	}
+	if failed {
+		fmt.Println("FAIL")
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+func ptr(b []byte) uint32 {
+	return uint32(uintptr(unsafe.Pointer(unsafe.SliceData(b))))
+}
+
+func u32ptr(v *uint32) uint32 {
+	return uint32(uintptr(unsafe.Pointer(v)))
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// waitFor calls f until it returns true or an error.
+func waitFor(f func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if ok, err := f(); err != nil || ok {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return fmt.Errorf("timed out")
+}
+
+type response struct {
+	Headers    map[string]string `json:"headers,omitempty"`
+	HeaderList [][2]string       `json:"headerList,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	StatusText string            `json:"statusText,omitempty"`
+}
+
+// values returns the values of the header. The values may be combined by the host (e.g. browser).
+func (r *response) values(key string) (res []string) {
+	if r.HeaderList != nil {
+		for _, f := range r.HeaderList {
+			if strings.EqualFold(f[0], key) {
+				res = append(res, f[1])
+			}
+		}
+		return res
+	}
+	for k, v := range r.Headers {
+		if strings.EqualFold(k, key) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// doHTTP sends a request with the body written in chunks of chunkSize.
+// The response is received with small buffers for testing partial reads.
+func doHTTP(method, path string, headers [][2]string, body []byte, chunkSize int) (*response, []byte, error) {
+	return doRequest(addr+path, request{Method: method, HeaderList: headers}, body, chunkSize)
+}
+
+type request struct {
+	Method     string      `json:"method"`
+	HeaderList [][2]string `json:"headerList,omitempty"`
+	TLS        *tlsConfig  `json:"tls,omitempty"`
+}
+
+type tlsConfig struct {
+	CACerts            []string `json:"caCerts,omitempty"`
+	InsecureSkipVerify bool     `json:"insecureSkipVerify,omitempty"`
+}
+
+func doRequest(url string, r request, body []byte, chunkSize int) (*response, []byte, error) {
+	req, err := json.Marshal(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	address := []byte(url)
+	var id uint32
+	if res := http_send(ptr(address), uint32(len(address)), ptr(req), uint32(len(req)), u32ptr(&id)); res != 0 {
+		return nil, nil, fmt.Errorf("http_send returned %d", res)
+	}
+	for {
+		chunk := body[:min(chunkSize, len(body))]
+		isEOF := len(chunk) == len(body)
+		var nwritten uint32
+		if res := http_writebody(id, ptr(chunk), uint32(len(chunk)), u32ptr(&nwritten), boolToUint32(isEOF)); res != 0 {
+			return nil, nil, fmt.Errorf("http_writebody returned %d", res)
+		}
+		if int(nwritten) > len(chunk) {
+			return nil, nil, fmt.Errorf("http_writebody wrote %d bytes of %d bytes", nwritten, len(chunk))
+		}
+		body = body[nwritten:]
+		if isEOF && int(nwritten) == len(chunk) {
+			break
+		}
+	}
+	if err := waitFor(func() (bool, error) {
+		var isOK uint32
+		if res := http_isreadable(id, u32ptr(&isOK)); res != 0 {
+			return false, fmt.Errorf("http_isreadable returned %d", res)
+		}
+		return isOK == 1, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	respB, err := readAll(func(buf []byte, n, isEOF *uint32) uint32 {
+		return http_recv(id, ptr(buf), uint32(len(buf)), u32ptr(n), u32ptr(isEOF))
+	}, 5)
+	if err != nil {
+		return nil, nil, fmt.Errorf("http_recv: %w", err)
+	}
+	var resp response
+	if err := json.Unmarshal(respB, &resp); err != nil {
+		return nil, nil, fmt.Errorf("invalid response %q: %w", string(respB), err)
+	}
+	respBody, err := readAll(func(buf []byte, n, isEOF *uint32) uint32 {
+		return http_readbody(id, ptr(buf), uint32(len(buf)), u32ptr(n), u32ptr(isEOF))
+	}, 4096)
+	if err != nil {
+		return nil, nil, fmt.Errorf("http_readbody: %w", err)
+	}
+	return &resp, respBody, nil
+}
+
+// readAll calls read with the buffer of bufSize until EOF.
+func readAll(read func(buf []byte, n, isEOF *uint32) uint32, bufSize int) ([]byte, error) {
+	var res []byte
+	buf := make([]byte, bufSize)
+	err := waitFor(func() (bool, error) {
+		var n, isEOF uint32
+		if errno := read(buf, &n, &isEOF); errno != 0 {
+			return false, fmt.Errorf("errno %d", errno)
+		}
+		if int(n) > len(buf) {
+			return false, fmt.Errorf("read %d bytes to the buffer of %d bytes", n, len(buf))
+		}
+		res = append(res, buf[:n]...)
+		return isEOF == 1, nil
+	})
+	return res, err
+}
+
+func fetch(path string) ([]byte, error) {
+	resp, body, err := doHTTP("GET", path, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != 200 {
+		return nil, fmt.Errorf("unexpected status %d", resp.Status)
+	}
+	return body, nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func checkABIVersion() error {
+	if v := abi_version(); v < minABIVersion {
+		return fmt.Errorf("ABI version %d is older than %d", v, minABIVersion)
+	}
+	return nil
+}
+
+func checkHTTPGet() error {
+	resp, body, err := doHTTP("GET", conformance.HelloPath, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.Status != 200 {
+		return fmt.Errorf("unexpected status %d", resp.Status)
+	}
+	if string(body) != conformance.HelloBody {
+		return fmt.Errorf("unexpected body %q", string(body))
+	}
+	if v := resp.values(conformance.MultiHeader); !slices.Equal(v, []string{"a", "b"}) && !slices.Equal(v, []string{"a, b"}) {
+		return fmt.Errorf("unexpected values of %s: %q", conformance.MultiHeader, v)
+	}
+	return nil
+}
+
+func checkHTTPPost() error {
+	want := conformance.Blob()[:200000]
+	resp, body, err := doHTTP("POST", conformance.EchoPath, [][2]string{{conformance.TestHeader, "c2w"}}, want, 7000)
+	if err != nil {
+		return err
+	}
+	if resp.Status != 200 {
+		return fmt.Errorf("unexpected status %d", resp.Status)
+	}
+	if !bytes.Equal(body, want) {
+		return fmt.Errorf("unexpected body (%d bytes; want %d bytes)", len(body), len(want))
+	}
+	if v := resp.values(conformance.EchoHeader); !slices.Equal(v, []string{"c2w"}) {
+		return fmt.Errorf("request header isn't passed: %q", v)
+	}
+	return nil
+}
+
+func checkHTTPStatus() error {
+	resp, _, err := doHTTP("GET", "/notfound", nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.Status != 404 {
+		return fmt.Errorf("unexpected status %d", resp.Status)
+	}
+	return nil
+}
+
+// layerFuncs are the layer functions of an ABI version.
+type layerFuncs struct {
+	isReadable func(id uint32) (isOK bool, size int64, errno uint32)
+	readAt     func(id uint32, p []byte, offset int64) (n int, errno uint32)
+}
+
+var layerV1 = layerFuncs{
+	isReadable: func(id uint32) (bool, int64, uint32) {
+		var isOK, size uint32
+		res := layer_isreadable(id, u32ptr(&isOK), u32ptr(&size))
+		return isOK == 1, int64(size), res
+	},
+	readAt: func(id uint32, p []byte, offset int64) (int, uint32) {
+		var n uint32
+		res := layer_readat(id, ptr(p), uint32(offset), uint32(len(p)), u32ptr(&n))
+		return int(n), res
+	},
+}
+
+var layerV2 = layerFuncs{
+	isReadable: func(id uint32) (bool, int64, uint32) {
+		var isOK uint32
+		var size uint64
+		res := layer_isreadable64(id, u32ptr(&isOK), uint32(uintptr(unsafe.Pointer(&size))))
+		return isOK == 1, int64(size), res
+	},
+	readAt: func(id uint32, p []byte, offset int64) (int, uint32) {
+		var n uint32
+		res := layer_readat64(id, ptr(p), uint64(offset), uint32(len(p)), u32ptr(&n))
+		return int(n), res
+	},
+}
+
+// requestLayer requests the layer and waits for it.
+func requestLayer(f layerFuncs, path string, dgst string, withDecompression bool) (id uint32, size int64, _ error) {
+	address := []byte(addr + path)
+	dgstB := []byte(dgst)
+	if res := layer_request(ptr(address), uint32(len(address)), ptr(dgstB), uint32(len(dgstB)), boolToUint32(withDecompression), u32ptr(&id)); res != 0 {
+		return 0, 0, fmt.Errorf("layer_request returned %d", res)
+	}
+	err := waitFor(func() (bool, error) {
+		isOK, s, res := f.isReadable(id)
+		if res != 0 {
+			return false, fmt.Errorf("layer_isreadable returned %d", res)
+		}
+		size = s
+		return isOK, nil
+	})
+	return id, size, err
+}
+
+func readLayerAt(f layerFuncs, id uint32, p []byte, offset int64) (int, error) {
+	n, res := f.readAt(id, p, offset)
+	if res != 0 {
+		return 0, fmt.Errorf("layer_readat returned %d", res)
+	}
+	if n > len(p) {
+		return 0, fmt.Errorf("layer_readat read %d bytes to the buffer of %d bytes", n, len(p))
+	}
+	return n, nil
+}
+
+// checkLayerAt checks that the layer has the data of want at the offsets.
+// The data beyond the end of want must not be read.
+func checkLayerAt(f layerFuncs, id uint32, want io.ReaderAt, size int64, offsets []int64) error {
+	buf := make([]byte, 100)
+	wantBuf := make([]byte, len(buf))
+	for _, off := range offsets {
+		n, err := readLayerAt(f, id, buf, off)
+		if err != nil {
+			return fmt.Errorf("read at %d: %w", off, err)
+		}
+		wantN := int(min(int64(len(buf)), max(size-off, 0)))
+		if wantN > 0 {
+			if _, err := want.ReadAt(wantBuf[:wantN], off); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if n != wantN || !bytes.Equal(buf[:n], wantBuf[:wantN]) {
+			return fmt.Errorf("unexpected data at %d (%d bytes; want %d bytes)", off, n, wantN)
+		}
+	}
+	return nil
+}
+
+// checkLayer checks that the layer has the contents of want.
+func checkLayer(f layerFuncs, id uint32, size int64, want []byte) error {
+	if size != int64(len(want)) {
+		return fmt.Errorf("unexpected size %d (want %d)", size, len(want))
+	}
+	var got []byte
+	buf := make([]byte, 65536)
+	for len(got) < len(want) {
+		n, err := readLayerAt(f, id, buf, int64(len(got)))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("unexpected EOF at %d", len(got))
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("unexpected contents")
+	}
+	return checkLayerAt(f, id, bytes.NewReader(want), size, []int64{size / 3, size - 10, size, size + 10})
+}
+
+func checkLayerRaw() error {
+	return checkLayerRawWith(layerV1)
+}
+
+func checkLayer64Raw() error {
+	return checkLayerRawWith(layerV2)
+}
+
+func checkLayerRawWith(f layerFuncs) error {
+	blob, err := fetch(conformance.BlobPath)
+	if err != nil {
+		return err
+	}
+	id, size, err := requestLayer(f, conformance.BlobPath, sha256Hex(blob), false)
+	if err != nil {
+		return err
+	}
+	return checkLayer(f, id, size, conformance.Blob())
+}
+
+func checkLayerDecompression() error {
+	gzipBlob, err := fetch(conformance.GzipBlobPath)
+	if err != nil {
+		return err
+	}
+	id, size, err := requestLayer(layerV1, conformance.GzipBlobPath, sha256Hex(gzipBlob), true)
+	if err != nil {
+		return err
+	}
+	return checkLayer(layerV1, id, size, conformance.Blob())
+}
+
+func checkLayer64Large() error {
+	id, size, err := requestLayer(layerV2, conformance.LargeBlobPath, conformance.LargeBlobDigest, false)
+	if err != nil {
+		return err
+	}
+	if size != conformance.LargeBlobSize {
+		return fmt.Errorf("unexpected size %d (want %d)", size, int64(conformance.LargeBlobSize))
+	}
+	if _, _, res := layerV1.isReadable(id); res == 0 {
+		return fmt.Errorf("layer_isreadable must fail for the layer larger than 4GiB")
+	}
+	var offsets []int64
+	for _, m := range conformance.LargeBlobMarkers() {
+		offsets = append(offsets, max(m-10, 0), m+conformance.LargeBlobMarkerSize/2)
+	}
+	offsets = append(offsets, 1<<32, size-10, size)
+	return checkLayerAt(layerV2, id, conformance.LargeBlob(), size, offsets)
+}
+
+func checkLayerDigestMismatch() error {
+	id, _, err := requestLayer(layerV1, conformance.BlobPath, sha256Hex([]byte("invalid")), false)
+	if err != nil {
+		return nil // failed on layer_isreadable
+	}
+	if _, err := readLayerAt(layerV1, id, make([]byte, 100), 0); err == nil {
+		return fmt.Errorf("the layer that doesn't match to the digest is readable")
+	}
+	return nil
+}
+
+func checkLayerUnknownID() error {
+	if _, err := readLayerAt(layerV1, 0xffffffff, make([]byte, 100), 0); err == nil {
+		return fmt.Errorf("unknown layer is readable")
+	}
+	return nil
+}
+
+func checkDecompress() error {
+	gzipBlob, err := fetch(conformance.GzipBlobPath)
+	if err != nil {
+		return err
+	}
+	var id uint32
+	if res := decompress_init(u32ptr(&id)); res != 0 {
+		return fmt.Errorf("decompress_init returned %d", res)
+	}
+	var got []byte
+	buf := make([]byte, 4096)
+	read := func(buf []byte, n, isEOF *uint32) uint32 {
+		return decompress_read(id, ptr(buf), uint32(len(buf)), u32ptr(n), u32ptr(isEOF))
+	}
+	for len(gzipBlob) > 0 {
+		chunk := gzipBlob[:min(10000, len(gzipBlob))]
+		gzipBlob = gzipBlob[len(chunk):]
+		if res := decompress_write(id, ptr(chunk), uint32(len(chunk)), boolToUint32(len(gzipBlob) == 0)); res != 0 {
+			return fmt.Errorf("decompress_write returned %d", res)
+		}
+		// reads can be interleaved with writes
+		var n, isEOF uint32
+		if res := read(buf, &n, &isEOF); res != 0 {
+			return fmt.Errorf("decompress_read returned %d", res)
+		}
+		if int(n) > len(buf) {
+			return fmt.Errorf("decompress_read read %d bytes to the buffer of %d bytes", n, len(buf))
+		}
+		got = append(got, buf[:n]...)
+		if isEOF == 1 {
+			if len(gzipBlob) > 0 {
+				return fmt.Errorf("decompress_read reached to EOF before all data is written")
+			}
+			break
+		}
+		if len(gzipBlob) == 0 {
+			rest, err := readAll(read, len(buf))
+			if err != nil {
+				return fmt.Errorf("decompress_read: %w", err)
+			}
+			got = append(got, rest...)
+		}
+	}
+	if !bytes.Equal(got, conformance.Blob()) {
+		return fmt.Errorf("unexpected decompressed data (%d bytes; want %d bytes)", len(got), len(conformance.Blob()))
+	}
+	return nil
+}
+
+// cacheKey returns a key not used by the previous runs because the host can persist the cache.
+func cacheKey(name string) string {
+	return fmt.Sprintf("conformance-%s-%d", name, time.Now().UnixNano())
+}
+
+// getCache looks up the cache. The returned id needs to be released even if the entry isn't found.
+func getCache(key string) (id uint32, found bool, size int64, _ error) {
+	keyB := []byte(key)
+	if res := cache_get(ptr(keyB), uint32(len(keyB)), u32ptr(&id)); res != 0 {
+		return 0, false, 0, fmt.Errorf("cache_get returned %d", res)
+	}
+	err := waitFor(func() (bool, error) {
+		var isOK, foundN uint32
+		var s uint64
+		if res := cache_isreadable(id, u32ptr(&isOK), u32ptr(&foundN), uint32(uintptr(unsafe.Pointer(&s)))); res != 0 {
+			return false, fmt.Errorf("cache_isreadable returned %d", res)
+		}
+		found, size = foundN == 1, int64(s)
+		return isOK == 1, nil
+	})
+	return id, found, size, err
+}
+
+// addCache adds data to the cache in chunks. If commit is false, the entry is aborted.
+func addCache(key string, data []byte, commit bool) error {
+	keyB := []byte(key)
+	var id uint32
+	if res := cache_add(ptr(keyB), uint32(len(keyB)), u32ptr(&id)); res != 0 {
+		return fmt.Errorf("cache_add returned %d", res)
+	}
+	for len(data) > 0 {
+		chunk := data[:min(100000, len(data))]
+		data = data[len(chunk):]
+		if res := cache_write(id, ptr(chunk), uint32(len(chunk))); res != 0 {
+			return fmt.Errorf("cache_write returned %d", res)
+		}
+	}
+	if res := cache_commit(id, boolToUint32(commit)); res != 0 {
+		return fmt.Errorf("cache_commit returned %d", res)
+	}
+	return nil
+}
+
+func checkCacheMiss() error {
+	id, found, _, err := getCache(cacheKey("miss"))
+	if err != nil {
+		return err
+	}
+	if res := cache_release(id); res != 0 {
+		return fmt.Errorf("cache_release returned %d", res)
+	}
+	if found {
+		return fmt.Errorf("unknown key is found")
+	}
+	return nil
+}
+
+func checkCacheRoundtrip() error {
+	key := cacheKey("roundtrip")
+	want := conformance.Blob()
+	if err := addCache(key, want, true); err != nil {
+		return err
+	}
+	id, found, size, err := getCache(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("committed entry is not found")
+	}
+	err = checkCacheData(id, size, want)
+	if res := cache_release(id); res != 0 && err == nil {
+		err = fmt.Errorf("cache_release returned %d", res)
+	}
+	return err
+}
+
+func checkCacheData(id uint32, size int64, want []byte) error {
+	if size != int64(len(want)) {
+		return fmt.Errorf("unexpected size %d (want %d)", size, len(want))
+	}
+	buf := make([]byte, 100)
+	for _, off := range []int64{0, size / 3, size - 10, size, size + 10} {
+		var n uint32
+		if res := cache_readat(id, ptr(buf), uint64(off), uint32(len(buf)), u32ptr(&n)); res != 0 {
+			return fmt.Errorf("cache_readat returned %d", res)
+		}
+		wantB := want[min(off, size):min(off+int64(len(buf)), size)]
+		if int(n) != len(wantB) || !bytes.Equal(buf[:n], wantB) {
+			return fmt.Errorf("unexpected data at %d (%d bytes; want %d bytes)", off, n, len(wantB))
+		}
+	}
+	return nil
+}
+
+func checkCacheAbort() error {
+	key := cacheKey("abort")
+	if err := addCache(key, []byte(conformance.HelloBody), false); err != nil {
+		return err
+	}
+	id, found, _, err := getCache(key)
+	if err != nil {
+		return err
+	}
+	if res := cache_release(id); res != 0 {
+		return fmt.Errorf("cache_release returned %d", res)
+	}
+	if found {
+		return fmt.Errorf("aborted entry is found")
+	}
+	return nil
+}
+
+// getCredentials looks up the credentials of the registry host. nil is returned if they aren't found.
+func getCredentials(host string) (map[string]string, error) {
+	hostB := []byte(host)
+	var id uint32
+	if res := credentials_get(ptr(hostB), uint32(len(hostB)), u32ptr(&id)); res != 0 {
+		return nil, fmt.Errorf("credentials_get returned %d", res)
+	}
+	defer credentials_release(id)
+	var found, size uint32
+	err := waitFor(func() (bool, error) {
+		var isOK uint32
+		if res := credentials_isreadable(id, u32ptr(&isOK), u32ptr(&found), u32ptr(&size)); res != 0 {
+			return false, fmt.Errorf("credentials_isreadable returned %d", res)
+		}
+		return isOK == 1, nil
+	})
+	if err != nil || found != 1 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	var n uint32
+	if res := credentials_read(id, ptr(buf), size, u32ptr(&n)); res != 0 {
+		return nil, fmt.Errorf("credentials_read returned %d", res)
+	}
+	if n != size {
+		return nil, fmt.Errorf("unexpected size of credentials %d (want %d)", n, size)
+	}
+	var c map[string]string
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	return c, nil
+}
+
+func checkCredentialsUnknown() error {
+	c, err := getCredentials("unknown.conformance.test")
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		return fmt.Errorf("credentials of unknown host are found")
+	}
+	return nil
+}
+
+func checkCredentialsFound() error {
+	c, err := getCredentials(conformance.CredentialsHost)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return fmt.Errorf("credentials are not found")
+	}
+	if c["username"] != conformance.CredentialsUsername || c["password"] != conformance.CredentialsPassword {
+		return fmt.Errorf("unexpected credentials %q", c)
+	}
+	return nil
+}
+
+// fetchTLS fetches HelloPath from the server of -tls-addr with the TLS configuration.
+func fetchTLS(c *tlsConfig) error {
+	resp, body, err := doRequest(strings.TrimSuffix(tlsAddr, "/")+conformance.HelloPath, request{Method: "GET", TLS: c}, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.Status != 200 {
+		return fmt.Errorf("unexpected status %d", resp.Status)
+	}
+	if string(body) != conformance.HelloBody {
+		return fmt.Errorf("unexpected body %q", string(body))
+	}
+	return nil
+}
+
+func checkTLSUntrusted() error {
+	if err := fetchTLS(nil); err == nil {
+		return fmt.Errorf("request to the untrusted server succeeded")
+	}
+	return nil
+}
+
+func checkTLSCA() error {
+	if tlsCA == "" {
+		return fmt.Errorf("specify -tls-ca")
+	}
+	return fetchTLS(&tlsConfig{CACerts: []string{tlsCA}})
+}
+
+func checkTLSSkipVerify() error {
+	return fetchTLS(&tlsConfig{InsecureSkipVerify: true})
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/ktock/container2wasm/internal/wasmhost/conformance"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address to serve the fixtures of the conformance test suite")
+	flag.Parse()
+	log.Printf("serving fixtures on %s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, conformance.Handler()))
+}
@@ -0,0 +1,91 @@
+package wasmhost_test
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ktock/container2wasm/internal/wasmhost"
+	"github.com/ktock/container2wasm/internal/wasmhost/conformance"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// TestConformance runs the conformance test suite of the host ABI on Host.
+func TestConformance(t *testing.T) {
+	runConformance(t, wasmhost.NewHost())
+}
+
+// TestConformanceCacheDir checks the cache stored in a directory.
+func TestConformanceCacheDir(t *testing.T) {
+	runConformance(t, wasmhost.NewHost(wasmhost.WithCacheDir(t.TempDir())))
+}
+
+// TestConformanceCredentials checks the credentials returned by the host.
+func TestConformanceCredentials(t *testing.T) {
+	runConformance(t, wasmhost.NewHost(wasmhost.WithCredentials(func(host string) (*wasmhost.Credentials, error) {
+		if host != conformance.CredentialsHost {
+			return nil, nil
+		}
+		return &wasmhost.Credentials{Username: conformance.CredentialsUsername, Password: conformance.CredentialsPassword}, nil
+	})), "-credentials")
+}
+
+// TestConformanceTLS checks the TLS configuration of the requests.
+func TestConformanceTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(conformance.Handler())
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	runConformance(t, wasmhost.NewHost(), "-tls-addr", srv.URL, "-tls-ca", string(ca))
+}
+
+// TestConformanceLarge checks the layer larger than 4GiB.
+// The layer is stored as a sparse file so this doesn't consume the disk space much.
+func TestConformanceLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the large layer test in short mode")
+	}
+	runConformance(t, wasmhost.NewHost(wasmhost.WithLayerDir(t.TempDir())), "-large", "-timeout=10m")
+}
+
+func runConformance(t *testing.T, h *wasmhost.Host, args ...string) {
+	guest := filepath.Join(t.TempDir(), "guest.wasm")
+	cmd := exec.Command("go", "build", "-o", guest, "./conformance/guest")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the test suite: %v: %s", err, out)
+	}
+	wasm, err := os.ReadFile(guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(conformance.Handler())
+	defer srv.Close()
+
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	if _, err := h.Instantiate(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	conf := wazero.NewModuleConfig().WithSysWalltime().WithSysNanotime().WithSysNanosleep().WithRandSource(crand.Reader).WithStdout(&out).WithStderr(&out).WithArgs(append([]string{"arg0", "-addr", srv.URL}, args...)...)
+	_, err = r.InstantiateWithConfig(ctx, wasm, conf)
+	t.Log(out.String())
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		t.Fatalf("conformance test failed: %v", err)
+	}
+}
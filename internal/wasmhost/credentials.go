@@ -0,0 +1,118 @@
+package wasmhost
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Credentials are the credentials of a registry returned to the modules by credentials_*.
+type Credentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// IdentityToken is used for fetching the bearer tokens instead of the username and the password.
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// credentialsEntry is the result of the lookup started by credentials_get.
+type credentialsEntry struct {
+	data  []byte // JSON of Credentials
+	found bool
+}
+
+func (h *Host) lookupCredentials(host string) (*credentialsEntry, error) {
+	if h.credentials == nil {
+		return &credentialsEntry{}, nil
+	}
+	c, err := h.credentials(host)
+	if err != nil {
+		return nil, err
+	} else if c == nil {
+		return &credentialsEntry{}, nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return &credentialsEntry{data: data, found: true}, nil
+}
+
+func (h *Host) getCredentials(id uint32) *credentialsEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.credentialsEntries[id]
+}
+
+func (h *Host) credentialsGet(ctx context.Context, m api.Module, hostP uint32, hostlen uint32, idP uint32) uint32 {
+	hostB, ok := m.Memory().Read(hostP, hostlen)
+	if !ok {
+		log.Println("failed to get registry host")
+		return errnoInval
+	}
+	e, err := h.lookupCredentials(string(hostB))
+	if err != nil {
+		log.Println("failed to get credentials:", err)
+		return errnoInval
+	}
+	id := h.newID()
+	h.mu.Lock()
+	h.credentialsEntries[id] = e
+	h.mu.Unlock()
+	if !writeUint32(m, idP, id, "id") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) credentialsIsReadable(ctx context.Context, m api.Module, id uint32, isOKP uint32, foundP uint32, sizeP uint32) uint32 {
+	e := h.getCredentials(id)
+	if e == nil {
+		log.Println("credentials not found:", id)
+		return errnoInval
+	}
+	if e.found && !writeUint32(m, sizeP, uint32(len(e.data)), "credentials size") {
+		return errnoInval
+	}
+	if !writeUint32(m, foundP, boolToUint32(e.found), "found") {
+		return errnoInval
+	}
+	if !writeUint32(m, isOKP, 1, "status") { // lookups complete synchronously
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) credentialsRead(ctx context.Context, m api.Module, id uint32, respP uint32, bufsize uint32, respsizeP uint32) uint32 {
+	e := h.getCredentials(id)
+	if e == nil || !e.found {
+		log.Println("credentials not available:", id)
+		return errnoInval
+	}
+	if uint32(len(e.data)) > bufsize {
+		log.Printf("buffer is too small for credentials (%d < %d)\n", bufsize, len(e.data))
+		return errnoInval
+	}
+	if !m.Memory().Write(respP, e.data) {
+		log.Println("failed to write credentials")
+		return errnoInval
+	}
+	if !writeUint32(m, respsizeP, uint32(len(e.data)), "credentials size") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) credentialsRelease(ctx context.Context, m api.Module, id uint32) uint32 {
+	h.mu.Lock()
+	e := h.credentialsEntries[id]
+	delete(h.credentialsEntries, id)
+	h.mu.Unlock()
+	if e == nil {
+		log.Println("credentials not found:", id)
+		return errnoInval
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+package wasmhost
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// decompressor decompresses the gzip stream written to the pipe in background.
+type decompressor struct {
+	*io.PipeWriter
+
+	mu  sync.Mutex
+	buf []byte // decompressed data not read yet
+	eof bool
+	err error
+}
+
+func newDecompressor() *decompressor {
+	pr, pw := io.Pipe()
+	d := &decompressor{PipeWriter: pw}
+	go func() {
+		zr, err := gzip.NewReader(pr) // blocks until first completion of reading pr
+		if err != nil {
+			pr.CloseWithError(err)
+			d.finish(err)
+			return
+		}
+		buf := make([]byte, 4096)
+		for {
+			n, err := zr.Read(buf)
+			d.mu.Lock()
+			d.buf = append(d.buf, buf[:n]...)
+			d.mu.Unlock()
+			if err != nil {
+				pr.CloseWithError(err) // fails the following writes
+				d.finish(err)
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *decompressor) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == io.EOF {
+		d.eof = true
+	} else {
+		log.Printf("failed to decompress: %v\n", err)
+		d.err = err
+	}
+}
+
+// read reads the decompressed data. isEOF is true if all data has been read.
+func (d *decompressor) read(p []byte) (n int, isEOF bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return 0, false, d.err
+	}
+	n = copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, d.eof && len(d.buf) == 0, nil
+}
+
+func (h *Host) getDecompressor(id uint32) *decompressor {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.decompressors[id]
+}
+
+func (h *Host) decompressInit(ctx context.Context, m api.Module, idP uint32) uint32 {
+	id := h.newID()
+	h.mu.Lock()
+	h.decompressors[id] = newDecompressor()
+	h.mu.Unlock()
+	if !writeUint32(m, idP, id, "id") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) decompressWrite(ctx context.Context, m api.Module, id uint32, bufP uint32, buflen uint32, isEOF uint32) uint32 {
+	d := h.getDecompressor(id)
+	if d == nil {
+		log.Println("decompressor not found:", id)
+		return errnoInval
+	}
+	bufB, ok := m.Memory().Read(bufP, buflen)
+	if !ok {
+		log.Println("failed to get buf")
+		return errnoInval
+	}
+	// the decompressor reads the data in background so this doesn't block for long.
+	if _, err := d.Write(bufB); err != nil {
+		d.CloseWithError(err)
+		log.Println("failed to write compressed data:", err)
+		return errnoInval
+	}
+	if isEOF == 1 {
+		d.Close()
+	}
+	return 0
+}
+
+func (h *Host) decompressRead(ctx context.Context, m api.Module, id uint32, bufP uint32, buflen uint32, recvLenP uint32, isEOFP uint32) uint32 {
+	d := h.getDecompressor(id)
+	if d == nil {
+		log.Println("decompressor not found:", id)
+		return errnoInval
+	}
+	buf := make([]byte, buflen)
+	n, isEOF, err := d.read(buf)
+	if err != nil {
+		return errnoInval
+	}
+	if isEOF {
+		h.mu.Lock()
+		delete(h.decompressors, id)
+		h.mu.Unlock()
+	}
+	if !m.Memory().Write(bufP, buf[:n]) {
+		log.Println("failed to write decompressed data")
+		return errnoInval
+	}
+	if !writeUint32(m, recvLenP, uint32(n), "decompressed data size") || !writeUint32(m, isEOFP, boolToUint32(isEOF), "EOF status") {
+		return errnoInval
+	}
+	return 0
+}
@@ -0,0 +1,10 @@
+module github.com/ktock/container2wasm/internal/wasmhost
+
+go 1.24.0
+
+require (
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/tetratelabs/wazero v1.11.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
@@ -0,0 +1,144 @@
+package wasmhost
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Host keeps the state of the host functions (HTTP requests, layers, decompressors, caches and credentials)
+// shared by the modules that import them.
+type Host struct {
+	client      *http.Client
+	layerDir    string
+	cacheDir    string
+	credentials func(host string) (*Credentials, error)
+
+	mu            sync.Mutex
+	nextID        uint32
+	requests      map[uint32]*request
+	layers        map[uint32]*layer
+	decompressors map[uint32]*decompressor
+	cacheReaders  map[uint32]*cacheReader
+	cacheWriters  map[uint32]*cacheWriter
+	cache         map[string][]byte       // used if cacheDir is empty
+	tlsClients    map[string]*http.Client // keyed by the TLS configuration of the requests
+
+	credentialsEntries map[uint32]*credentialsEntry
+}
+
+// Option is an option of Host.
+type Option func(*Host)
+
+// WithHTTPClient sends the requests using client instead of http.DefaultClient.
+// The transport of client needs to be *http.Transport (or nil) for the requests that configure TLS.
+func WithHTTPClient(client *http.Client) Option {
+	return func(h *Host) {
+		h.client = client
+	}
+}
+
+// WithLayerDir stores the fetched layers as sparse files in dir instead of memory.
+func WithLayerDir(dir string) Option {
+	return func(h *Host) {
+		h.layerDir = dir
+	}
+}
+
+// WithCacheDir stores the entries of the cache provided to the modules in dir instead of memory.
+// The entries in dir are available to the later instances.
+func WithCacheDir(dir string) Option {
+	return func(h *Host) {
+		h.cacheDir = dir
+	}
+}
+
+// WithCredentials answers the lookups of the registry credentials by the modules using f.
+// f returns nil if it doesn't have the credentials of the host. No credentials are returned by default.
+func WithCredentials(f func(host string) (*Credentials, error)) Option {
+	return func(h *Host) {
+		h.credentials = f
+	}
+}
+
+// NewHost returns the host functions.
+func NewHost(opts ...Option) *Host {
+	h := &Host{
+		client:        http.DefaultClient,
+		requests:      make(map[uint32]*request),
+		layers:        make(map[uint32]*layer),
+		decompressors: make(map[uint32]*decompressor),
+		cacheReaders:  make(map[uint32]*cacheReader),
+		cacheWriters:  make(map[uint32]*cacheWriter),
+		cache:         make(map[string][]byte),
+		tlsClients:    make(map[string]*http.Client),
+
+		credentialsEntries: make(map[uint32]*credentialsEntry),
+	}
+	for _, o := range opts {
+		o(h)
+	}
+	return h
+}
+
+// Instantiate instantiates the host functions as ModuleName on r.
+func (h *Host) Instantiate(ctx context.Context, r wazero.Runtime) (api.Module, error) {
+	return r.NewHostModuleBuilder(ModuleName).
+		NewFunctionBuilder().WithFunc(h.abiVersion).Export("abi_version").
+		NewFunctionBuilder().WithFunc(h.httpSend).Export("http_send").
+		NewFunctionBuilder().WithFunc(h.httpWriteBody).Export("http_writebody").
+		NewFunctionBuilder().WithFunc(h.httpIsReadable).Export("http_isreadable").
+		NewFunctionBuilder().WithFunc(h.httpRecv).Export("http_recv").
+		NewFunctionBuilder().WithFunc(h.httpReadBody).Export("http_readbody").
+		NewFunctionBuilder().WithFunc(h.layerRequest).Export("layer_request").
+		NewFunctionBuilder().WithFunc(h.layerIsReadable).Export("layer_isreadable").
+		NewFunctionBuilder().WithFunc(h.layerReadAt).Export("layer_readat").
+		NewFunctionBuilder().WithFunc(h.layerIsReadable64).Export("layer_isreadable64").
+		NewFunctionBuilder().WithFunc(h.layerReadAt64).Export("layer_readat64").
+		NewFunctionBuilder().WithFunc(h.decompressInit).Export("decompress_init").
+		NewFunctionBuilder().WithFunc(h.decompressWrite).Export("decompress_write").
+		NewFunctionBuilder().WithFunc(h.decompressRead).Export("decompress_read").
+		NewFunctionBuilder().WithFunc(h.cacheGet).Export("cache_get").
+		NewFunctionBuilder().WithFunc(h.cacheIsReadable).Export("cache_isreadable").
+		NewFunctionBuilder().WithFunc(h.cacheReadAt).Export("cache_readat").
+		NewFunctionBuilder().WithFunc(h.cacheRelease).Export("cache_release").
+		NewFunctionBuilder().WithFunc(h.cacheAdd).Export("cache_add").
+		NewFunctionBuilder().WithFunc(h.cacheWrite).Export("cache_write").
+		NewFunctionBuilder().WithFunc(h.cacheCommit).Export("cache_commit").
+		NewFunctionBuilder().WithFunc(h.credentialsGet).Export("credentials_get").
+		NewFunctionBuilder().WithFunc(h.credentialsIsReadable).Export("credentials_isreadable").
+		NewFunctionBuilder().WithFunc(h.credentialsRead).Export("credentials_read").
+		NewFunctionBuilder().WithFunc(h.credentialsRelease).Export("credentials_release").
+		Instantiate(ctx)
+}
+
+func (h *Host) abiVersion(ctx context.Context) uint32 {
+	return ABIVersion
+}
+
+func (h *Host) newID() uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := h.nextID
+	h.nextID++
+	return id
+}
+
+func writeUint32(m api.Module, p uint32, v uint32, name string) bool {
+	if !m.Memory().WriteUint32Le(p, v) {
+		log.Printf("failed to write %s\n", name)
+		return false
+	}
+	return true
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,295 @@
+package wasmhost
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// fetchParameters is the request passed to http_send.
+type fetchParameters struct {
+	Method     string            `json:"method,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	HeaderList [][2]string       `json:"headerList,omitempty"`
+	TLS        *fetchTLSConfig   `json:"tls,omitempty"`
+}
+
+// fetchTLSConfig is the TLS configuration of the request passed to http_send.
+type fetchTLSConfig struct {
+	CACerts            []string `json:"caCerts,omitempty"`
+	InsecureSkipVerify bool     `json:"insecureSkipVerify,omitempty"`
+}
+
+// fetchResponse is the response read by http_recv.
+type fetchResponse struct {
+	Headers    map[string]string `json:"headers,omitempty"`
+	HeaderList [][2]string       `json:"headerList,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	StatusText string            `json:"statusText,omitempty"`
+}
+
+type request struct {
+	body *io.PipeWriter
+	done chan struct{}
+
+	// available after done is closed
+	resp *http.Response
+	err  error
+
+	meta io.Reader // response passed by http_recv
+}
+
+func (h *Host) getRequest(id uint32) *request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests[id]
+}
+
+func (h *Host) httpSend(ctx context.Context, m api.Module, addressP uint32, addresslen uint32, reqP, reqlen uint32, idP uint32) uint32 {
+	mem := m.Memory()
+	addressB, ok := mem.Read(addressP, addresslen)
+	if !ok {
+		log.Println("failed to get address")
+		return errnoInval
+	}
+	reqB, ok := mem.Read(reqP, reqlen)
+	if !ok {
+		log.Println("failed to get req")
+		return errnoInval
+	}
+	var fetchReq fetchParameters
+	if err := json.Unmarshal(reqB, &fetchReq); err != nil {
+		log.Println("failed to unmarshal req:", err)
+		return errnoInval
+	}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(fetchReq.Method, string(addressB), pr)
+	if err != nil {
+		log.Println("failed to create req:", err)
+		return errnoInval
+	}
+	if fetchReq.HeaderList != nil {
+		for _, f := range fetchReq.HeaderList {
+			req.Header.Add(f[0], f[1])
+		}
+	} else {
+		for k, v := range fetchReq.Headers {
+			req.Header.Add(k, v)
+		}
+	}
+
+	client, err := h.clientWithTLS(fetchReq.TLS)
+	if err != nil {
+		log.Println("failed to configure TLS:", err)
+		return errnoInval
+	}
+
+	id := h.newID()
+	r := &request{body: pw, done: make(chan struct{})}
+	h.mu.Lock()
+	h.requests[id] = r
+	h.mu.Unlock()
+	go func() {
+		r.resp, r.err = client.Do(req)
+		if r.err != nil {
+			pr.CloseWithError(r.err)
+		}
+		close(r.done)
+	}()
+	if !writeUint32(m, idP, id, "id") {
+		return errnoInval
+	}
+	return 0
+}
+
+// clientWithTLS returns the client that performs the requests with the TLS configuration.
+// The clients are cached per configuration so that the connections are reused.
+func (h *Host) clientWithTLS(c *fetchTLSConfig) (*http.Client, error) {
+	if c == nil || (len(c.CACerts) == 0 && !c.InsecureSkipVerify) {
+		return h.client, nil
+	}
+	key, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if client, ok := h.tlsClients[string(key)]; ok {
+		return client, nil
+	}
+	var tr *http.Transport
+	switch t := h.client.Transport.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = t.Clone()
+	default:
+		return nil, fmt.Errorf("TLS of transport %T can't be configured", t)
+	}
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.InsecureSkipVerify = c.InsecureSkipVerify
+	if len(c.CACerts) > 0 {
+		pool := tr.TLSClientConfig.RootCAs
+		if pool == nil {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		} else {
+			pool = pool.Clone()
+		}
+		for _, cert := range c.CACerts {
+			if !pool.AppendCertsFromPEM([]byte(cert)) {
+				return nil, fmt.Errorf("invalid CA certificate")
+			}
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	client := *h.client
+	client.Transport = tr
+	h.tlsClients[string(key)] = &client
+	return &client, nil
+}
+
+func (h *Host) httpWriteBody(ctx context.Context, m api.Module, id uint32, chunkP, len uint32, nwrittenP uint32, isEOF uint32) uint32 {
+	r := h.getRequest(id)
+	if r == nil {
+		log.Println("request not found:", id)
+		return errnoInval
+	}
+	chunkB, ok := m.Memory().Read(chunkP, len)
+	if !ok {
+		log.Println("failed to get chunk")
+		return errnoInval
+	}
+	if _, err := r.body.Write(chunkB); err != nil {
+		r.body.CloseWithError(err)
+		log.Println("failed to write req:", err)
+		return errnoInval
+	}
+	if isEOF == 1 {
+		r.body.Close()
+	}
+	if !writeUint32(m, nwrittenP, len, "written number") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) httpIsReadable(ctx context.Context, m api.Module, id uint32, isOKP uint32) uint32 {
+	r := h.getRequest(id)
+	if r == nil {
+		log.Println("request not found:", id)
+		return errnoInval
+	}
+	var readable bool
+	select {
+	case <-r.done:
+		if r.err != nil {
+			log.Println("failed to do request:", r.err)
+			return errnoInval
+		}
+		readable = true
+	default:
+	}
+	if !writeUint32(m, isOKP, boolToUint32(readable), "status") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) httpRecv(ctx context.Context, m api.Module, id uint32, respP uint32, bufsize uint32, respsizeP uint32, isEOFP uint32) uint32 {
+	r := h.getRequest(id)
+	if r == nil {
+		log.Println("request not found:", id)
+		return errnoInval
+	}
+	select {
+	case <-r.done:
+	default:
+		log.Println("response is not available:", id)
+		return errnoInval
+	}
+	if r.err != nil {
+		log.Println("failed to do request:", r.err)
+		return errnoInval
+	}
+	if r.meta == nil {
+		fetchResp := fetchResponse{
+			Headers:    make(map[string]string),
+			Status:     r.resp.StatusCode,
+			StatusText: r.resp.Status,
+		}
+		for k, v := range r.resp.Header {
+			fetchResp.Headers[k] = strings.Join(v, ", ")
+			for _, e := range v {
+				fetchResp.HeaderList = append(fetchResp.HeaderList, [2]string{k, e})
+			}
+		}
+		respD, err := json.Marshal(fetchResp)
+		if err != nil {
+			log.Println("failed to marshal resp:", err)
+			return errnoInval
+		}
+		r.meta = bytes.NewReader(respD)
+	}
+	res, _ := readTo(m, r.meta, respP, bufsize, respsizeP, isEOFP)
+	return res
+}
+
+func (h *Host) httpReadBody(ctx context.Context, m api.Module, id uint32, bodyP uint32, bufsize uint32, bodysizeP uint32, isEOFP uint32) uint32 {
+	r := h.getRequest(id)
+	if r == nil {
+		log.Println("request not found:", id)
+		return errnoInval
+	}
+	select {
+	case <-r.done:
+	default:
+		log.Println("response is not available:", id)
+		return errnoInval
+	}
+	if r.err != nil {
+		log.Println("failed to do request:", r.err)
+		return errnoInval
+	}
+	res, isEOF := readTo(m, r.resp.Body, bodyP, bufsize, bodysizeP, isEOFP)
+	if res != 0 || isEOF {
+		// the response is done
+		r.resp.Body.Close()
+		h.mu.Lock()
+		delete(h.requests, id)
+		h.mu.Unlock()
+	}
+	return res
+}
+
+// readTo reads from r at most bufsize bytes to bufP. The read size is written to sizeP and
+// 1 is written to isEOFP if r reached to EOF.
+func readTo(m api.Module, r io.Reader, bufP uint32, bufsize uint32, sizeP uint32, isEOFP uint32) (errno uint32, isEOF bool) {
+	buf := make([]byte, bufsize)
+	n, err := r.Read(buf)
+	if err != nil && err != io.EOF {
+		log.Println("failed to read:", err)
+		return errnoInval, false
+	}
+	isEOF = err == io.EOF
+	if !m.Memory().Write(bufP, buf[:n]) {
+		log.Println("failed to write data")
+		return errnoInval, isEOF
+	}
+	if !writeUint32(m, sizeP, uint32(n), "data size") || !writeUint32(m, isEOFP, boolToUint32(isEOF), "EOF status") {
+		return errnoInval, isEOF
+	}
+	return 0, isEOF
+}
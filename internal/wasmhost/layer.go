@@ -0,0 +1,267 @@
+package wasmhost
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tetratelabs/wazero/api"
+)
+
+type layer struct {
+	done chan struct{}
+
+	// available after done is closed
+	r    io.ReaderAt
+	size int64
+	err  error
+}
+
+func (h *Host) getLayer(id uint32) *layer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.layers[id]
+}
+
+func (h *Host) layerRequest(ctx context.Context, m api.Module, addressP uint32, addresslen uint32, digestP uint32, digestlen uint32, withDecompression uint32, idP uint32) uint32 {
+	mem := m.Memory()
+	addressB, ok := mem.Read(addressP, addresslen)
+	if !ok {
+		log.Println("failed to get layer address")
+		return errnoInval
+	}
+	digestB, ok := mem.Read(digestP, digestlen)
+	if !ok {
+		log.Println("failed to get layer digest")
+		return errnoInval
+	}
+	dgst := digest.NewDigestFromEncoded(digest.SHA256, string(digestB))
+	if err := dgst.Validate(); err != nil {
+		log.Println("invalid layer digest:", err)
+		return errnoInval
+	}
+	req, err := http.NewRequest("GET", string(addressB), nil)
+	if err != nil {
+		log.Println("failed to create layer req:", err)
+		return errnoInval
+	}
+
+	id := h.newID()
+	l := &layer{done: make(chan struct{})}
+	h.mu.Lock()
+	h.layers[id] = l
+	h.mu.Unlock()
+	go func() {
+		l.r, l.size, l.err = h.fetchLayer(req, dgst, withDecompression == 1)
+		if l.err != nil {
+			log.Printf("failed to fetch layer %q: %v\n", dgst, l.err)
+		}
+		close(l.done)
+	}()
+	if !writeUint32(m, idP, id, "id") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) fetchLayer(req *http.Request, dgst digest.Digest, withDecompression bool) (io.ReaderAt, int64, error) {
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	v := dgst.Verifier()
+	r := io.TeeReader(resp.Body, v)
+	if withDecompression {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to prepare layer decompressor: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var ra io.ReaderAt
+	var size int64
+	if h.layerDir == "" {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		ra, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		f, err := os.CreateTemp(h.layerDir, "layer-")
+		if err != nil {
+			return nil, 0, err
+		}
+		// the data is kept until f is closed
+		os.Remove(f.Name())
+		if size, err = copySparse(f, r); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		ra = f
+	}
+	// consume the trailing data not read by the decompressor
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, 0, err
+	}
+	if !v.Verified() {
+		if c, ok := ra.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, 0, fmt.Errorf("digest mismatch")
+	}
+	return ra, size, nil
+}
+
+// sparseBlockSize is the unit of the holes created by copySparse.
+const sparseBlockSize = 4096
+
+var zeroBlock [sparseBlockSize]byte
+
+// copySparse copies r to f. Blocks filled with zeros are skipped so that they become holes of f.
+func copySparse(f *os.File, r io.Reader) (size int64, _ error) {
+	buf := make([]byte, 256*sparseBlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := writeSparse(f, buf[:n], size); err != nil {
+				return 0, err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	// extend the file for the trailing hole
+	return size, f.Truncate(size)
+}
+
+func writeSparse(f *os.File, p []byte, off int64) error {
+	for len(p) > 0 {
+		// skip the zero blocks and write the following non-zero blocks at once.
+		start := 0
+		for start < len(p) && isZero(p[start:min(start+sparseBlockSize, len(p))]) {
+			start += sparseBlockSize
+		}
+		start = min(start, len(p))
+		end := start
+		for end < len(p) && !isZero(p[end:min(end+sparseBlockSize, len(p))]) {
+			end += sparseBlockSize
+		}
+		end = min(end, len(p))
+		if end > start {
+			if _, err := f.WriteAt(p[start:end], off+int64(start)); err != nil {
+				return err
+			}
+		}
+		p = p[end:]
+		off += int64(end)
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	return bytes.Equal(b, zeroBlock[:len(b)])
+}
+
+// waitLayer returns the layer if it's available.
+func (h *Host) waitLayer(id uint32) (l *layer, ready bool, errno uint32) {
+	l = h.getLayer(id)
+	if l == nil {
+		log.Println("layer not found:", id)
+		return nil, false, errnoInval
+	}
+	select {
+	case <-l.done:
+		if l.err != nil {
+			return nil, false, errnoInval
+		}
+		return l, true, 0
+	default:
+		return nil, false, 0
+	}
+}
+
+func (h *Host) layerIsReadable(ctx context.Context, m api.Module, id uint32, isOKP uint32, sizeP uint32) uint32 {
+	l, ready, errno := h.waitLayer(id)
+	if errno != 0 {
+		return errno
+	}
+	if ready {
+		if l.size > math.MaxUint32 {
+			log.Printf("layer %d is too large (%d bytes); layer_isreadable64 is required\n", id, l.size)
+			return errnoInval
+		}
+		if !writeUint32(m, sizeP, uint32(l.size), "layer size") {
+			return errnoInval
+		}
+	}
+	if !writeUint32(m, isOKP, boolToUint32(ready), "status") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) layerIsReadable64(ctx context.Context, m api.Module, id uint32, isOKP uint32, sizeP uint32) uint32 {
+	l, ready, errno := h.waitLayer(id)
+	if errno != 0 {
+		return errno
+	}
+	if ready && !m.Memory().WriteUint64Le(sizeP, uint64(l.size)) {
+		log.Println("failed to write layer size")
+		return errnoInval
+	}
+	if !writeUint32(m, isOKP, boolToUint32(ready), "status") {
+		return errnoInval
+	}
+	return 0
+}
+
+func (h *Host) layerReadAt(ctx context.Context, m api.Module, id uint32, respP uint32, offset uint32, wantlen uint32, respsizeP uint32) uint32 {
+	return h.readLayer(m, id, respP, uint64(offset), wantlen, respsizeP)
+}
+
+func (h *Host) layerReadAt64(ctx context.Context, m api.Module, id uint32, respP uint32, offset uint64, wantlen uint32, respsizeP uint32) uint32 {
+	return h.readLayer(m, id, respP, offset, wantlen, respsizeP)
+}
+
+func (h *Host) readLayer(m api.Module, id uint32, respP uint32, offset uint64, wantlen uint32, respsizeP uint32) uint32 {
+	l, ready, errno := h.waitLayer(id)
+	if errno != 0 {
+		return errno
+	}
+	if !ready {
+		log.Println("layer is not available:", id)
+		return errnoInval
+	}
+	var data []byte
+	if offset < uint64(l.size) {
+		data = make([]byte, min(int64(wantlen), l.size-int64(offset)))
+		if _, err := l.r.ReadAt(data, int64(offset)); err != nil && err != io.EOF {
+			log.Println("failed to read layer:", err)
+			return errnoInval
+		}
+	}
+	if !m.Memory().Write(respP, data) {
+		log.Println("failed to write layer")
+		return errnoInval
+	}
+	if !writeUint32(m, respsizeP, uint32(len(data)), "layer data size") {
+		return errnoInval
+	}
+	return 0
+}
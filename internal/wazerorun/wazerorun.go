@@ -0,0 +1,154 @@
+// Package wazerorun runs the WASM images converted by container2wasm on the wazero runtime.
+package wazerorun
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental/sock"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// DefaultListenFD is the fd of the listening socket in the guest when no directory is mounted.
+// wazero passes listening sockets after preopened directories.
+const DefaultListenFD = 3
+
+// maxListenAttempts is the max number of free ports tried for the listening socket.
+const maxListenAttempts = 5
+
+// Mount is a directory of the host mounted to the guest.
+type Mount struct {
+	Host  string
+	Guest string
+}
+
+// ParseMapDir parses a directory mapping formatted as "GUEST::HOST".
+func ParseMapDir(m string) (Mount, error) {
+	guest, host, ok := strings.Cut(m, "::")
+	if !ok || guest == "" || host == "" {
+		return Mount{}, fmt.Errorf("invalid directory mapping %q: must be GUEST::HOST", m)
+	}
+	return Mount{Host: host, Guest: guest}, nil
+}
+
+// Config is the configuration of the WASM image.
+type Config struct {
+	// Args are the arguments passed to the image (without arg0).
+	Args []string
+	// Envs are the environment variables (KEY=VALUE).
+	Envs   []string
+	Mounts []Mount
+	// ListenAddr is the address (IP:PORT) of the listening socket passed to the guest.
+	// A free port is used if PORT is 0. No socket is passed if empty.
+	ListenAddr string
+	// Listening is called with the address of the listening socket after wazero creates it and
+	// before the guest starts. The network stack must connect to the address after that so that it
+	// never connects to a socket of another process listening on the same address.
+	Listening func(addr string)
+
+	// Stdin, Stdout and Stderr of the guest. Stdin is empty and outputs are discarded if nil.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ListenFD returns the fd of the listening socket in the guest.
+func (c Config) ListenFD() int {
+	return DefaultListenFD + len(c.Mounts)
+}
+
+// Run runs the WASM image until it exits or ctx is canceled.
+// The exit of the guest is returned as *sys.ExitError.
+func Run(ctx context.Context, wasmFile string, c Config) error {
+	fsConfig := wazero.NewFSConfig()
+	for _, m := range c.Mounts {
+		fsConfig = fsConfig.WithDirMount(m.Host, m.Guest)
+	}
+	// The guest is started after the listening socket is created (see Config.Listening).
+	conf := wazero.NewModuleConfig().WithSysWalltime().WithSysNanotime().WithSysNanosleep().WithRandSource(crand.Reader).WithFSConfig(fsConfig).WithArgs(append([]string{"arg0"}, c.Args...)...).WithStartFunctions()
+	if c.Stdin != nil {
+		conf = conf.WithStdin(c.Stdin)
+	}
+	if c.Stdout != nil {
+		conf = conf.WithStdout(c.Stdout)
+	}
+	if c.Stderr != nil {
+		conf = conf.WithStderr(c.Stderr)
+	}
+	for _, e := range c.Envs {
+		k, v, ok := strings.Cut(e, "=")
+		if !ok {
+			return fmt.Errorf("env must be a key value pair: %q", e)
+		}
+		conf = conf.WithEnv(k, v)
+	}
+	wasm, err := os.ReadFile(wasmFile)
+	if err != nil {
+		return err
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	compiled, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		return fmt.Errorf("failed to compile %q: %w", wasmFile, err)
+	}
+	var mod api.Module
+	var addr string
+	for i := 0; ; i++ {
+		mctx := ctx
+		if c.ListenAddr != "" {
+			var tcpAddr *net.TCPAddr
+			if addr, tcpAddr, err = listenAddr(c.ListenAddr); err != nil {
+				return err
+			}
+			mctx = sock.WithConfig(ctx, sock.NewConfig().WithTCPListener(tcpAddr.IP.String(), tcpAddr.Port))
+		}
+		mod, err = r.InstantiateModule(mctx, compiled, conf)
+		if err == nil {
+			ctx = mctx
+			break
+		}
+		// The free port can be taken by another process before wazero listens on it.
+		if !errors.Is(err, syscall.EADDRINUSE) || addr == c.ListenAddr || i+1 >= maxListenAttempts {
+			return err
+		}
+	}
+	defer mod.Close(ctx)
+	if c.ListenAddr != "" && c.Listening != nil {
+		c.Listening(addr)
+	}
+	start := mod.ExportedFunction("_start")
+	if start == nil {
+		return fmt.Errorf("%q doesn't export _start", wasmFile)
+	}
+	_, err = start.Call(ctx)
+	return err
+}
+
+// listenAddr resolves the address of the listening socket. A free port is chosen if the port is 0.
+func listenAddr(addr string) (string, *net.TCPAddr, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid listening address %q: %w", addr, err)
+	}
+	if tcpAddr.Port != 0 {
+		return addr, tcpAddr, nil
+	}
+	l, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return "", nil, err
+	}
+	defer l.Close()
+	tcpAddr = l.Addr().(*net.TCPAddr)
+	return tcpAddr.String(), tcpAddr, nil
+}
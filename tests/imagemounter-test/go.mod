@@ -1,10 +1,16 @@
-module imagemounter-test
+module github.com/ktock/container2wasm/tests/imagemounter-test
 
 go 1.24.0
 
 require (
-	github.com/opencontainers/go-digest v1.0.0
+	github.com/ktock/container2wasm/internal/wasmhost v0.0.0-00010101000000-000000000000
 	github.com/tetratelabs/wazero v1.11.0
 )
 
-require golang.org/x/sys v0.38.0 // indirect
+require (
+	github.com/opencontainers/go-digest v1.0.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
+
+// Shares the implementation of the host functions with the other components of this repo.
+replace github.com/ktock/container2wasm/internal/wasmhost => ../../internal/wasmhost
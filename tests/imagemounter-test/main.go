@@ -1,28 +1,23 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	crand "crypto/rand"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
-	digest "github.com/opencontainers/go-digest"
 	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental/sock"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"github.com/ktock/container2wasm/internal/wasmhost"
 )
 
 func main() {
@@ -32,9 +27,18 @@ func main() {
 		vmPort    = flag.Int("vm-port", 1234, "listen port of vm")
 		debug     = flag.Bool("debug", false, "enable debug log")
 		imageAddr = flag.String("image", "", "address of image to run")
+		layerDir  = flag.String("layer-dir", "", "directory to store the fetched layers as sparse files (kept in memory if empty)")
+		cacheDir  = flag.String("cache-dir", "", "directory mounted to imagemounter for caching the layers")
+		hostCache = flag.String("host-cache-dir", "", "directory to store the cache provided by the host to imagemounter")
+		hostsDir  = flag.String("registry-hosts-dir", "", "directory containing hosts.toml of the registries mounted to imagemounter")
+		policy    = flag.String("image-policy", "", "image policy file passed to imagemounter (its directory is mounted for the keys referred by the file)")
 	)
 	var envs envFlags
 	flag.Var(&envs, "env", "environment variables")
+	var registryAuth envFlags
+	flag.Var(&registryAuth, "registry-auth", "credentials of the registry (HOST=USERNAME:PASSWORD) passed to imagemounter with --registry-auth flag")
+	var hostRegistryAuth envFlags
+	flag.Var(&hostRegistryAuth, "host-registry-auth", "credentials of the registry (HOST=USERNAME:PASSWORD) provided by the host to imagemounter")
 	flag.Parse()
 	if *debug {
 		log.SetOutput(os.Stdout)
@@ -72,19 +76,23 @@ func main() {
 			r.Close(ctx)
 		}()
 		wasi_snapshot_preview1.MustInstantiate(ctx, r)
-		b := r.NewHostModuleBuilder("env").
-			NewFunctionBuilder().WithFunc(http_send).Export("http_send").
-			NewFunctionBuilder().WithFunc(http_writebody).Export("http_writebody").
-			NewFunctionBuilder().WithFunc(http_isreadable).Export("http_isreadable").
-			NewFunctionBuilder().WithFunc(http_recv).Export("http_recv").
-			NewFunctionBuilder().WithFunc(http_readbody).Export("http_readbody").
-			NewFunctionBuilder().WithFunc(layer_request).Export("layer_request").
-			NewFunctionBuilder().WithFunc(layer_isreadable).Export("layer_isreadable").
-			NewFunctionBuilder().WithFunc(layer_readat).Export("layer_readat").
-			NewFunctionBuilder().WithFunc(decompress_init).Export("decompress_init").
-			NewFunctionBuilder().WithFunc(decompress_write).Export("decompress_write").
-			NewFunctionBuilder().WithFunc(decompress_read).Export("decompress_read")
-		if _, err := b.Instantiate(ctx); err != nil {
+		var hostOpts []wasmhost.Option
+		if *layerDir != "" {
+			hostOpts = append(hostOpts, wasmhost.WithLayerDir(*layerDir))
+		}
+		if *hostCache != "" {
+			hostOpts = append(hostOpts, wasmhost.WithCacheDir(*hostCache))
+		}
+		if len(hostRegistryAuth) > 0 {
+			creds, err := parseCredentials(hostRegistryAuth)
+			if err != nil {
+				panic(err)
+			}
+			hostOpts = append(hostOpts, wasmhost.WithCredentials(func(host string) (*wasmhost.Credentials, error) {
+				return creds[host], nil
+			}))
+		}
+		if _, err := wasmhost.NewHost(hostOpts...).Instantiate(ctx, r); err != nil {
 			panic(err)
 		}
 		compiled, err := r.CompileModule(ctx, c)
@@ -97,7 +105,31 @@ func main() {
 		if *debug {
 			flagargs = append(flagargs, "--debug")
 		}
+		if *cacheDir != "" {
+			stackFSConfig = stackFSConfig.WithDirMount(*cacheDir, "/cache")
+			flagargs = append(flagargs, "--cache-dir=/cache")
+		}
+		if *hostCache != "" {
+			flagargs = append(flagargs, "--cache-host")
+		}
+		if *hostsDir != "" {
+			stackFSConfig = stackFSConfig.WithDirMount(*hostsDir, "/hosts.d")
+			flagargs = append(flagargs, "--registry-hosts-dir=/hosts.d")
+		}
+		if *policy != "" {
+			stackFSConfig = stackFSConfig.WithDirMount(filepath.Dir(*policy), "/policy")
+			flagargs = append(flagargs, "--image-policy=/policy/"+filepath.Base(*policy))
+		}
+		for _, a := range registryAuth {
+			flagargs = append(flagargs, "--registry-auth="+a)
+		}
+		if len(hostRegistryAuth) > 0 {
+			flagargs = append(flagargs, "--registry-auth-host")
+		}
 		conf := wazero.NewModuleConfig().WithSysWalltime().WithSysNanotime().WithSysNanosleep().WithRandSource(crand.Reader).WithStdout(os.Stdout).WithStderr(os.Stderr).WithFSConfig(stackFSConfig).WithArgs(append([]string{"arg0"}, flagargs...)...)
+		if c := os.Getenv("DOCKER_AUTH_CONFIG"); c != "" {
+			conf = conf.WithEnv("DOCKER_AUTH_CONFIG", c)
+		}
 		_, err = r.InstantiateModule(ctx, compiled, conf)
 		if err != nil {
 			panic(err)
@@ -190,332 +222,6 @@ func main() {
 	}
 }
 
-var respMap = make(map[uint32]*http.Response)
-var respMapMu sync.Mutex
-
-var respRMap = make(map[uint32]io.Reader)
-var respRMapMu sync.Mutex
-
-var layerMap = make(map[uint32][]byte)
-var layerMapMu sync.Mutex
-
-type fetchParameters struct {
-	Method  string            `json:"method,omitempty"`
-	Headers map[string]string `json:"headers,omitempty"`
-}
-
-var reqMap = make(map[uint32]*io.PipeWriter)
-var reqMapMu sync.Mutex
-var reqMapId uint32
-
-const ERRNO_INVAL = 28
-
-func layer_request(ctx context.Context, m api.Module, addressP uint32, addresslen uint32, digestP uint32, digestlen uint32, withDecompression uint32, idP uint32) uint32 {
-	mem := m.Memory()
-
-	addressB, ok := mem.Read(addressP, uint32(addresslen))
-	if !ok {
-		log.Println("failed to get layer address")
-		return ERRNO_INVAL
-	}
-	address := string(addressB)
-
-	digestB, ok := mem.Read(digestP, uint32(digestlen))
-	if !ok {
-		log.Println("failed to get layer address")
-		return ERRNO_INVAL
-	}
-
-	req, err := http.NewRequest("GET", address, nil)
-	if err != nil {
-		log.Println("failed to create layer req:", err)
-		return ERRNO_INVAL
-	}
-
-	reqMapMu.Lock()
-	id := reqMapId
-	reqMapId++
-	reqMapMu.Unlock()
-	go func() {
-		c := &http.Client{}
-		resp, err := c.Do(req)
-		if err != nil {
-			log.Println("failed to do layer request:", err)
-			return
-		}
-		defer resp.Body.Close()
-		respMapMu.Lock()
-		respMap[id] = resp
-		respMapMu.Unlock()
-
-		v := digest.Digest("sha256:" + string(digestB)).Verifier()
-		r := io.TeeReader(resp.Body, v)
-		if withDecompression == 1 {
-			raw := r
-			zr, err := gzip.NewReader(raw)
-			if err != nil {
-				log.Println("failed to prepare layer decompressor:", err)
-				return
-			}
-			defer zr.Close()
-			r = zr
-		}
-		data, err := io.ReadAll(r)
-		if err != nil {
-			log.Println("failed to read layer:", err)
-			return
-		}
-		if !v.Verified() {
-			log.Println("failed to veriy layer (%q)", string(digestB))
-			return
-		}
-		layerMapMu.Lock()
-		layerMap[id] = data
-		layerMapMu.Unlock()
-	}()
-	if !mem.WriteUint32Le(idP, id) {
-		log.Println("failed to pass id")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-func layer_isreadable(ctx context.Context, m api.Module, id uint32, isOKP uint32, sizeP uint32) uint32 {
-	mem := m.Memory()
-	layerMapMu.Lock()
-	buf, ok := layerMap[id]
-	layerMapMu.Unlock()
-	v := uint32(0)
-	if ok {
-		v = 1
-		if !mem.WriteUint32Le(sizeP, uint32(len(buf))) {
-			log.Println("failed to pass status")
-			return ERRNO_INVAL
-		}
-	}
-	if !mem.WriteUint32Le(isOKP, v) {
-		log.Println("failed to pass status")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-func layer_readat(ctx context.Context, m api.Module, id uint32, respP uint32, offset uint32, wantlen uint32, respsizeP uint32) uint32 {
-	mem := m.Memory()
-	layerMapMu.Lock()
-	buf, ok := layerMap[id]
-	layerMapMu.Unlock()
-	if !ok {
-		log.Printf("no layer found for id %d\n", id)
-		return ERRNO_INVAL
-	}
-
-	if uint32(len(buf)) < offset+wantlen {
-		wantlen = uint32(len(buf)) - offset
-	}
-	if !mem.Write(respP, buf[offset:offset+wantlen]) {
-		log.Println("failed to write layer")
-		return ERRNO_INVAL
-	}
-	if !mem.WriteUint32Le(respsizeP, uint32(wantlen)) {
-		log.Println("failed to write resp body size")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-func http_send(ctx context.Context, m api.Module, addressP uint32, addresslen uint32, reqP, reqlen uint32, idP uint32) uint32 {
-	mem := m.Memory()
-
-	addressB, ok := mem.Read(addressP, uint32(addresslen))
-	if !ok {
-		log.Println("failed to get address")
-		return ERRNO_INVAL
-	}
-	address := string(addressB)
-
-	reqB, ok := mem.Read(reqP, uint32(reqlen))
-	if !ok {
-		log.Println("failed to get req")
-		return ERRNO_INVAL
-	}
-	var fetchReq fetchParameters
-	if err := json.Unmarshal(reqB, &fetchReq); err != nil {
-		log.Println("failed to marshal req:", err)
-		return ERRNO_INVAL
-	}
-
-	pr, pw := io.Pipe()
-	req, err := http.NewRequest(fetchReq.Method, address, pr)
-	if err != nil {
-		log.Println("failed to create req:", err)
-		return ERRNO_INVAL
-	}
-	if req.Header == nil {
-		req.Header = make(map[string][]string)
-	}
-	for k, v := range fetchReq.Headers {
-		req.Header.Add(k, v)
-	}
-
-	reqMapMu.Lock()
-	id := reqMapId
-	reqMapId++
-	reqMapMu.Unlock()
-	reqMap[id] = pw
-	go func() {
-		c := &http.Client{}
-		resp, err := c.Do(req)
-		if err != nil {
-			log.Println("failed to do request:", err)
-			return
-		}
-		respMapMu.Lock()
-		respMap[id] = resp
-		respMapMu.Unlock()
-	}()
-	if !mem.WriteUint32Le(idP, id) {
-		log.Println("failed to pass id")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-func http_writebody(ctx context.Context, m api.Module, id uint32, chunkP, len uint32, nwrittenP uint32, isEOF uint32) uint32 {
-	mem := m.Memory()
-
-	chunkB, ok := mem.Read(chunkP, uint32(len))
-	if !ok {
-		log.Println("failed to get chunk")
-		return ERRNO_INVAL
-	}
-	reqMapMu.Lock()
-	w := reqMap[id]
-	reqMapMu.Unlock()
-	if _, err := w.Write(chunkB); err != nil {
-		w.CloseWithError(err)
-		log.Println("failed to write req:", err)
-		return ERRNO_INVAL
-	}
-	if isEOF == 1 {
-		w.Close()
-	}
-	if !mem.WriteUint32Le(nwrittenP, len) {
-		log.Println("failed to pass written number")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-func http_isreadable(ctx context.Context, m api.Module, id uint32, isOKP uint32) uint32 {
-	mem := m.Memory()
-	respMapMu.Lock()
-	_, ok := respMap[id]
-	respMapMu.Unlock()
-	v := uint32(0)
-	if ok {
-		v = 1
-	}
-	if !mem.WriteUint32Le(isOKP, v) {
-		log.Println("failed to pass status")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-func http_recv(ctx context.Context, m api.Module, id uint32, respP uint32, bufsize uint32, respsizeP uint32, isEOFP uint32) uint32 {
-	mem := m.Memory()
-	respRMapMu.Lock()
-	respR, ok := respRMap[id]
-	respRMapMu.Unlock()
-	if !ok {
-		respMapMu.Lock()
-		resp, ok := respMap[id]
-		respMapMu.Unlock()
-		if !ok {
-			log.Println("failed to get resp")
-			return ERRNO_INVAL
-		}
-		var fetchResp struct {
-			Headers    map[string]string `json:"headers,omitempty"`
-			Status     int               `json:"status,omitempty"`
-			StatusText string            `json:"statusText,omitempty"`
-		}
-		fetchResp.Headers = make(map[string]string)
-		for k, v := range resp.Header {
-			fetchResp.Headers[k] = strings.Join(v, ", ")
-		}
-		fetchResp.Status = resp.StatusCode
-		fetchResp.StatusText = resp.Status
-		respD, err := json.Marshal(fetchResp)
-		if err != nil {
-			log.Println("failed to marshal resp:", err)
-			return ERRNO_INVAL
-		}
-		respR = bytes.NewReader(respD)
-		respRMapMu.Lock()
-		respRMap[id] = respR
-		respRMapMu.Unlock()
-	}
-
-	isEOF := uint32(0)
-	buf := make([]byte, bufsize)
-	n, err := respR.Read(buf)
-	if err != nil && err != io.EOF {
-		log.Println("failed to read resp:", err)
-		return ERRNO_INVAL
-	} else if err == io.EOF {
-		isEOF = 1
-	}
-	if !mem.Write(respP, buf[:n]) {
-		log.Println("failed to write resp")
-		return ERRNO_INVAL
-	}
-	if !mem.WriteUint32Le(respsizeP, uint32(n)) {
-		log.Println("failed to write resp size")
-		return ERRNO_INVAL
-	}
-	if !mem.WriteUint32Le(isEOFP, isEOF) {
-		log.Println("failed to write EOF status")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-func http_readbody(ctx context.Context, m api.Module, id uint32, bodyP uint32, bufsize uint32, bodysizeP uint32, isEOFP uint32) uint32 {
-	mem := m.Memory()
-	respMapMu.Lock()
-	resp, ok := respMap[id]
-	respMapMu.Unlock()
-	if !ok {
-		log.Println("failed to get resp")
-		return ERRNO_INVAL
-	}
-
-	isEOF := uint32(0)
-	buf := make([]byte, bufsize)
-	n, err := resp.Body.Read(buf)
-	if err != nil && err != io.EOF {
-		log.Println("failed to read resp body:", err)
-		return ERRNO_INVAL
-	} else if err == io.EOF {
-		isEOF = 1
-	}
-	if !mem.Write(bodyP, buf[:n]) {
-		log.Println("failed to write resp body")
-		return ERRNO_INVAL
-	}
-	if !mem.WriteUint32Le(bodysizeP, uint32(n)) {
-		log.Println("failed to write resp body size")
-		return ERRNO_INVAL
-	}
-	if !mem.WriteUint32Le(isEOFP, isEOF) {
-		log.Println("failed to write resp body EOF status")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
 type envFlags []string
 
 func (i *envFlags) String() string {
@@ -526,136 +232,19 @@ func (i *envFlags) Set(value string) error {
 	return nil
 }
 
-var decompressorMap = make(map[uint32]*decompressor)
-var decompressorMapMu sync.Mutex
-var decompressorMapId uint32
-var decompressorMapIdMu sync.Mutex
-
-func decompress_init(ctx context.Context, m api.Module, idP uint32) uint32 {
-	mem := m.Memory()
-	decompressorMapIdMu.Lock()
-	id := decompressorMapId
-	decompressorMapId++
-	decompressorMapIdMu.Unlock()
-
-	pr, pw := io.Pipe()
-
-	decompressorMapMu.Lock()
-	decompressorMap[id] = newDecompressor(pr, pw)
-	decompressorMapMu.Unlock()
-
-	if !mem.WriteUint32Le(idP, id) {
-		log.Println("failed to pass id")
-		return ERRNO_INVAL
-	}
-
-	return 0
-}
-
-func decompress_write(ctx context.Context, m api.Module, id uint32, bufP uint32, buflen uint32, isEOF uint32) uint32 {
-	mem := m.Memory()
-	decompressorMapMu.Lock()
-	w := decompressorMap[id]
-	decompressorMapMu.Unlock()
-	if w == nil {
-		log.Println("decompressor not found:", id)
-		return ERRNO_INVAL
-	}
-
-	bufB, ok := mem.Read(bufP, buflen)
-	if !ok {
-		log.Println("failed to get buf")
-		return ERRNO_INVAL
-	}
-	if _, err := w.Write(bufB); err != nil {
-		w.CloseWithError(err)
-		log.Println("failed to write req:", err)
-		return ERRNO_INVAL
-	}
-
-	if isEOF == 1 {
-		w.Close()
-	}
-	return 0
-}
-
-func decompress_read(ctx context.Context, m api.Module, id uint32, bufP uint32, buflen uint32, recvLenP uint32, isEOFP uint32) uint32 {
-	mem := m.Memory()
-	decompressorMapMu.Lock()
-	r := decompressorMap[id]
-	r.mu.Lock()
-	isEOF := uint32(0)
-	if r.eof {
-		isEOF = 1
-	}
-	n := buflen
-	if uint32(n) > uint32(len(r.buf)) {
-		n = uint32(len(r.buf))
-	}
-	buf := r.buf[:n]
-	r.buf = r.buf[n:]
-	r.mu.Unlock()
-	decompressorMapMu.Unlock()
-
-	if !mem.Write(bufP, buf[:n]) {
-		log.Println("failed to write blob")
-		return ERRNO_INVAL
-	}
-	if !mem.WriteUint32Le(recvLenP, uint32(n)) {
-		log.Println("failed to write blob size")
-		return ERRNO_INVAL
-	}
-	if !mem.WriteUint32Le(isEOFP, isEOF) {
-		log.Println("failed to write EOF status for blob")
-		return ERRNO_INVAL
-	}
-	return 0
-}
-
-type decompressor struct {
-	*io.PipeWriter
-	buf []byte
-	eof bool
-	r   io.ReadCloser
-	mu  sync.Mutex
-}
-
-func newDecompressor(pr *io.PipeReader, pw *io.PipeWriter) *decompressor {
-	d := &decompressor{
-		buf:        make([]byte, 0),
-		PipeWriter: pw,
-	}
-	initCh := make(chan struct{})
-	go func() {
-		r, err := gzip.NewReader(pr) // blocks until first completion of reading pr
-		if err != nil {
-			return
+// parseCredentials parses the credentials specified as HOST=USERNAME:PASSWORD.
+func parseCredentials(values []string) (map[string]*wasmhost.Credentials, error) {
+	creds := make(map[string]*wasmhost.Credentials)
+	for _, v := range values {
+		host, userpass, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("credentials must be HOST=USERNAME:PASSWORD: %q", v)
 		}
-		d.mu.Lock()
-		d.r = r
-		d.mu.Unlock()
-		close(initCh)
-
-	}()
-	go func() {
-		<-initCh
-		buf := make([]byte, 4096)
-		for {
-			n, err := d.r.Read(buf)
-			if err != nil && err != io.EOF {
-				log.Printf("error on preread: %d, %v\n", n, err)
-				return
-			}
-			d.mu.Lock()
-			d.buf = append(d.buf, buf[:n]...)
-			if err == io.EOF {
-				d.eof = true
-			}
-			d.mu.Unlock()
-			if err == io.EOF {
-				break
-			}
+		username, password, ok := strings.Cut(userpass, ":")
+		if !ok {
+			return nil, fmt.Errorf("credentials of %q must be USERNAME:PASSWORD", host)
 		}
-	}()
-	return d
+		creds[host] = &wasmhost.Credentials{Username: username, Password: password}
+	}
+	return creds, nil
 }
@@ -84,6 +84,100 @@ RUN apt-get update && apt-get install -y wget
 			},
 			Want: utils.WantString("hello"),
 		},
+		{
+			Name:    "imagemounter-registry-auth",
+			Runtime: "imagemounter-test",
+			Inputs: []utils.Input{
+				{Image: "alpine:3.17", Architecture: utils.X8664, ConvertOpts: []string{"--external-bundle"}, External: true},
+			},
+			Prepare: func(t *testing.T, env utils.Env) {
+				utils.PushToAuthRegistry(t, env.Input.Image)
+				assert.NilError(t, os.WriteFile(filepath.Join(env.Workdir, "imagemountertest-vm-port"), []byte(fmt.Sprintf("%d", utils.GetPort(t))), 0755))
+				assert.NilError(t, os.WriteFile(filepath.Join(env.Workdir, "imagemountertest-stack-port"), []byte(fmt.Sprintf("%d", utils.GetPort(t))), 0755))
+			},
+			Finalize: func(t *testing.T, env utils.Env) {
+				utils.DonePort(utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-vm-port")))
+				utils.DonePort(utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-stack-port")))
+			},
+			RuntimeOpts: func(t *testing.T, env utils.Env) []string {
+				return []string{
+					"--image", utils.AuthRegistry + "/" + env.Input.Image,
+					"--registry-auth", utils.AuthRegistry + "=" + utils.AuthRegistryUser + ":" + utils.AuthRegistryPassword,
+					"--stack", utils.ImageMounterBin,
+					fmt.Sprintf("--stack-port=%d", utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-stack-port"))),
+					fmt.Sprintf("--vm-port=%d", utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-vm-port"))),
+				}
+			},
+			Args: func(t *testing.T, env utils.Env) []string {
+				return []string{"--net=socket=listenfd=4", "--external-bundle=9p=192.168.127.252", "echo", "-n", "hello"}
+			},
+			Want: utils.WantString("hello"),
+		},
+		{
+			Name:    "imagemounter-registry-auth-host",
+			Runtime: "imagemounter-test",
+			Inputs: []utils.Input{
+				{Image: "alpine:3.17", Architecture: utils.X8664, ConvertOpts: []string{"--external-bundle"}, External: true},
+			},
+			Prepare: func(t *testing.T, env utils.Env) {
+				utils.PushToAuthRegistry(t, env.Input.Image)
+				assert.NilError(t, os.WriteFile(filepath.Join(env.Workdir, "imagemountertest-vm-port"), []byte(fmt.Sprintf("%d", utils.GetPort(t))), 0755))
+				assert.NilError(t, os.WriteFile(filepath.Join(env.Workdir, "imagemountertest-stack-port"), []byte(fmt.Sprintf("%d", utils.GetPort(t))), 0755))
+			},
+			Finalize: func(t *testing.T, env utils.Env) {
+				utils.DonePort(utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-vm-port")))
+				utils.DonePort(utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-stack-port")))
+			},
+			RuntimeOpts: func(t *testing.T, env utils.Env) []string {
+				return []string{
+					"--image", utils.AuthRegistry + "/" + env.Input.Image,
+					"--host-registry-auth", utils.AuthRegistry + "=" + utils.AuthRegistryUser + ":" + utils.AuthRegistryPassword,
+					"--stack", utils.ImageMounterBin,
+					fmt.Sprintf("--stack-port=%d", utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-stack-port"))),
+					fmt.Sprintf("--vm-port=%d", utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-vm-port"))),
+				}
+			},
+			Args: func(t *testing.T, env utils.Env) []string {
+				return []string{"--net=socket=listenfd=4", "--external-bundle=9p=192.168.127.252", "echo", "-n", "hello"}
+			},
+			Want: utils.WantString("hello"),
+		},
+		{
+			Name:    "imagemounter-registry-mirror",
+			Runtime: "imagemounter-test",
+			Inputs: []utils.Input{
+				{Image: "alpine:3.17", Mirror: true, Architecture: utils.X8664, ConvertOpts: []string{"--external-bundle"}, External: true},
+			},
+			Prepare: func(t *testing.T, env utils.Env) {
+				// registry.invalid is only available via the mirror (the plain HTTP registry launched by tests/test.sh)
+				hostDir := filepath.Join(env.Workdir, "hosts.d", "registry.invalid")
+				assert.NilError(t, os.MkdirAll(hostDir, 0755))
+				assert.NilError(t, os.WriteFile(filepath.Join(hostDir, "hosts.toml"), []byte(`
+[host."http://localhost:5000/v2"]
+  capabilities = ["pull", "resolve"]
+  override_path = true
+`), 0644))
+				assert.NilError(t, os.WriteFile(filepath.Join(env.Workdir, "imagemountertest-vm-port"), []byte(fmt.Sprintf("%d", utils.GetPort(t))), 0755))
+				assert.NilError(t, os.WriteFile(filepath.Join(env.Workdir, "imagemountertest-stack-port"), []byte(fmt.Sprintf("%d", utils.GetPort(t))), 0755))
+			},
+			Finalize: func(t *testing.T, env utils.Env) {
+				utils.DonePort(utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-vm-port")))
+				utils.DonePort(utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-stack-port")))
+			},
+			RuntimeOpts: func(t *testing.T, env utils.Env) []string {
+				return []string{
+					"--image", "registry.invalid/" + env.Input.Image,
+					"--registry-hosts-dir", filepath.Join(env.Workdir, "hosts.d"),
+					"--stack", utils.ImageMounterBin,
+					fmt.Sprintf("--stack-port=%d", utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-stack-port"))),
+					fmt.Sprintf("--vm-port=%d", utils.ReadInt(t, filepath.Join(env.Workdir, "imagemountertest-vm-port"))),
+				}
+			},
+			Args: func(t *testing.T, env utils.Env) []string {
+				return []string{"--net=socket=listenfd=4", "--external-bundle=9p=192.168.127.252", "echo", "-n", "hello"}
+			},
+			Want: utils.WantString("hello"),
+		},
 		{
 			Name:    "imagemounter-store",
 			Runtime: "imagemounter-test",
@@ -24,6 +24,13 @@ const C2wBin = "c2w"
 const C2wNetProxyBin = "/opt/c2w-net-proxy.wasm"
 const ImageMounterBin = "/opt/imagemounter.wasm"
 
+// Registry requiring basic auth (htpasswd). Launched by tests/test.sh.
+const (
+	AuthRegistry         = "localhost:5001"
+	AuthRegistryUser     = "testuser"
+	AuthRegistryPassword = "testpassword"
+)
+
 type Architecture int
 
 const (
@@ -437,3 +444,19 @@ func StartDirServer(t *testing.T, dir string) (pid int, port int) {
 	}
 	return cmd.Process.Pid, port
 }
+
+// PushToAuthRegistry pushes the image to AuthRegistry.
+func PushToAuthRegistry(t *testing.T, image string) {
+	if err := exec.Command("docker", "image", "inspect", image).Run(); err != nil {
+		assert.NilError(t, exec.Command("docker", "pull", image).Run())
+	}
+	login := exec.Command("docker", "login", "--username", AuthRegistryUser, "--password-stdin", AuthRegistry)
+	login.Stdin = strings.NewReader(AuthRegistryPassword)
+	out, err := login.CombinedOutput()
+	assert.NilError(t, err, string(out))
+	assert.NilError(t, exec.Command("docker", "tag", image, AuthRegistry+"/"+image).Run())
+	dcmd := exec.Command("docker", "push", AuthRegistry+"/"+image)
+	dcmd.Stdout = os.Stdout
+	dcmd.Stderr = os.Stderr
+	assert.NilError(t, dcmd.Run())
+}
@@ -13,6 +13,10 @@ do
     sleep 3
 done
 docker exec -w /test $CONTAINER docker run --rm -d --name testregistry -p 127.0.0.1:5000:5000 registry:2
+docker exec -w /test $CONTAINER sh -c 'mkdir -p /tmp/testregistry-auth && docker run --rm --entrypoint htpasswd httpd:2 -Bbn testuser testpassword > /tmp/testregistry-auth/htpasswd'
+docker exec -w /test $CONTAINER docker run --rm -d --name testregistry-auth -p 127.0.0.1:5001:5000 \
+       -v /tmp/testregistry-auth:/auth -e REGISTRY_AUTH=htpasswd -e REGISTRY_AUTH_HTPASSWD_REALM=testregistry \
+       -e REGISTRY_AUTH_HTPASSWD_PATH=/auth/htpasswd registry:2
 docker exec -w /test $CONTAINER docker buildx create --name container --driver=docker-container
 docker exec -w /test $CONTAINER go test ${GO_TEST_FLAGS:-} -timeout $TIMEOUT -v ./tests/integration
 docker compose down
@@ -15,27 +15,20 @@ import (
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 
-	gvntypes "github.com/containers/gvisor-tap-vsock/pkg/types"
-	gvnvirtualnetwork "github.com/containers/gvisor-tap-vsock/pkg/virtualnetwork"
+	"github.com/ktock/container2wasm/internal/netstack"
 	"github.com/tetratelabs/wazero/experimental/sock"
 )
 
-const (
-	gatewayIP = "192.168.127.1"
-	vmIP      = "192.168.127.3"
-	vmMAC     = "02:00:00:00:00:01"
-)
-
 func main() {
 	var (
 		mapDir    = flag.String("mapdir", "", "directory mapping to the image")
 		debug     = flag.Bool("debug", false, "debug log")
-		mac       = flag.String("mac", vmMAC, "mac address assigned to the container")
+		mac       = flag.String("mac", netstack.VMMAC, "mac address assigned to the container")
 		wasiAddr  = flag.String("wasi-addr", "127.0.0.1:1234", "IP address used to communicate between wasi and network stack") // TODO: automatically use empty random port or unix socket
 		enableNet = flag.Bool("net", false, "enable network")
 	)
 	var portFlags sliceFlags
-	flag.Var(&portFlags, "p", "map port between host and guest (host:guest). -mac must be set correctly.")
+	flag.Var(&portFlags, "p", "map port between host and guest ([ip:]host:guest[/proto]; IPv6 address must be enclosed by brackets). -mac must be set correctly.")
 	var envs sliceFlags
 	flag.Var(&envs, "env", "environment variables")
 
@@ -54,33 +47,20 @@ func main() {
 	if *enableNet {
 		forwards := make(map[string]string)
 		for _, p := range portFlags {
-			parts := strings.Split(p, ":")
-			switch len(parts) {
-			case 3:
-				// IP:PORT1:PORT2
-				forwards[strings.Join(parts[0:2], ":")] = strings.Join([]string{vmIP, parts[2]}, ":")
-			case 2:
-				// PORT1:PORT2
-				forwards["0.0.0.0:"+parts[0]] = vmIP + ":" + parts[1]
+			f, err := netstack.ParsePortForward(p)
+			if err != nil {
+				panic(err)
 			}
+			forwards[f.Local()] = net.JoinHostPort(netstack.VMIP, f.GuestPort)
 		}
-		config := &gvntypes.Configuration{
-			Debug:             *debug,
-			MTU:               1500,
-			Subnet:            "192.168.127.0/24",
-			GatewayIP:         gatewayIP,
-			GatewayMacAddress: "5a:94:ef:e4:0c:dd",
-			DHCPStaticLeases: map[string]string{
-				vmIP: *mac,
-			},
-			Forwards: forwards,
-			NAT: map[string]string{
-				"192.168.127.254": "127.0.0.1",
-			},
-			GatewayVirtualIPs: []string{"192.168.127.254"},
-			Protocol:          gvntypes.QemuProtocol,
-		}
-		vn, err := gvnvirtualnetwork.New(config)
+		vn, err := netstack.New(
+			netstack.WithDebug(*debug),
+			netstack.WithDHCPStaticLeases(map[string]string{
+				netstack.VMIP: *mac,
+			}),
+			netstack.WithForwards(forwards),
+			netstack.WithHostAccess(),
+		)
 		if err != nil {
 			panic(err)
 		}